@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dilcetto/wasa/service/blobstore"
+)
+
+// newBlobStore creates the blob store selected in the configuration.
+func newBlobStore(cfg WebAPIConfiguration) (blobstore.BlobStore, error) {
+	switch cfg.Blobs.Store {
+	case "filesystem":
+		return blobstore.NewFilesystem(cfg.Blobs.Dir)
+	case "s3":
+		return blobstore.NewS3(blobstore.S3Config{
+			Endpoint:  cfg.Blobs.Bucket.Endpoint,
+			Region:    cfg.Blobs.Bucket.Region,
+			Bucket:    cfg.Blobs.Bucket.Name,
+			AccessKey: cfg.Blobs.Bucket.AccessKey,
+			SecretKey: cfg.Blobs.Bucket.SecretKey,
+			PathStyle: cfg.Blobs.Bucket.PathStyle,
+			Prefix:    cfg.Blobs.Bucket.Prefix,
+		})
+	default:
+		return nil, fmt.Errorf("unknown blob store %q", cfg.Blobs.Store)
+	}
+}
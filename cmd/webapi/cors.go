@@ -17,8 +17,20 @@ func applyCORSHandler(h http.Handler) http.Handler {
 			"Access-Control-Allow-Headers",
 			"X-Requested-With",
 			"Authorization",
+			"Upload-Offset",
+		}),
+		handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "OPTIONS", "DELETE", "PUT", "PATCH"}),
+		// resumable uploads return their progress in these headers, and rate limited routes their limits
+		handlers.ExposedHeaders([]string{
+			"Location",
+			"Upload-Offset",
+			"Upload-Length",
+			"Retry-After",
+			"RateLimit-Policy",
+			"RateLimit-Limit",
+			"RateLimit-Remaining",
+			"RateLimit-Reset",
 		}),
-		handlers.AllowedMethods([]string{"GET", "POST", "OPTIONS", "DELETE", "PUT"}),
 		// Do not modify the CORS origin and max age, they are used in the evaluation.
 		handlers.AllowedOrigins([]string{"*"}),
 		handlers.MaxAge(1),
@@ -18,15 +18,108 @@ type WebAPIConfiguration struct {
 	}
 	Web struct {
 		APIHost         string        `conf:"default:0.0.0.0:3000"`
-		DebugHost       string        `conf:"default:0.0.0.0:4000"`
+		DebugHost       string        `conf:"default:127.0.0.1:4000"`
 		ReadTimeout     time.Duration `conf:"default:5s"`
 		WriteTimeout    time.Duration `conf:"default:5s"`
 		ShutdownTimeout time.Duration `conf:"default:5s"`
 	}
 	Debug bool
-	DB    struct {
+	Auth  struct {
+		// Keys are the secrets that sign access tokens, by key ID, e.g. "2024-01:<secret>;2024-06:<secret>"
+		Keys map[string]string `conf:"noprint"`
+
+		// KeysFile is a YAML file with more keys (`keys`), and optionally the active (`active`) and retired
+		// (`retired`) ones. It is read again on SIGHUP, to rotate the keys without a restart.
+		KeysFile string
+
+		// ActiveKey is the ID of the key that signs new tokens, the only key when empty
+		ActiveKey string
+
+		// RetiredKeys are the IDs of the keys that no longer verify tokens, separated by ";"
+		RetiredKeys []string
+
+		// TokenLifetime is how long access tokens are valid
+		TokenLifetime time.Duration `conf:"default:15m"`
+
+		// RefreshTokenLifetime is how long a session lasts without refreshing its tokens
+		RefreshTokenLifetime time.Duration `conf:"default:720h"`
+
+		// Issuer and Audience are the `iss` and `aud` claims of the tokens, checked when set
+		Issuer   string
+		Audience string
+
+		// LoginMode is "open", where a username is enough to log in and unknown usernames are registered, as for
+		// demos, or "credentials", where users register with a password and log in with it or with a passkey
+		LoginMode string `conf:"default:open"`
+
+		// AllowLegacyLogin lets the users without credentials log in with their username in the "credentials" mode,
+		// until they add a password or a passkey
+		AllowLegacyLogin bool
+
+		// Passkeys is the site passkeys are bound to: its domain (empty to disable passkeys), its name, and the
+		// origins of the web UI, separated by ";"
+		Passkeys struct {
+			RPID    string   `conf:"default:localhost"`
+			RPName  string   `conf:"default:WASAText"`
+			Origins []string `conf:"default:http://localhost:5173;http://localhost:3000"`
+		}
+	}
+	// RateLimits are how many requests each client (the user, or the IP address when not logged in) sends to a route,
+	// as "<requests>/<period>", e.g. "10/1m", or "off"
+	RateLimits struct {
+		// Default limits every route without a limit of its own
+		Default string `conf:"default:600/1m"`
+
+		// Login limits logins and registrations, by IP address
+		Login string `conf:"default:10/1m"`
+
+		// LoginFailures limits the failed logins of each username from each IP address
+		LoginFailures string `conf:"default:5/15m"`
+
+		// UsernameFailures limits the failed logins of each username from any address, which then back off
+		UsernameFailures string `conf:"default:20/15m"`
+
+		// Search limits the searches of users, conversations and messages
+		Search string `conf:"default:30/1m"`
+
+		// SendMessage limits sending, forwarding and scheduling messages
+		SendMessage string `conf:"default:60/1m"`
+
+		// Routes are the limits of other routes, as "<METHOD> <path>=<limit>" with the path as in the API
+		// documentation (e.g. "PUT /user/password=5/1m"), separated by ";"
+		Routes []string
+	}
+	DB struct {
 		Filename string `conf:"default:/tmp/decaf.db"`
 	}
+	Blobs struct {
+		// Store is where attachments and photos are saved: "filesystem" (in Dir) or "s3" (in Bucket)
+		Store  string `conf:"default:filesystem"`
+		Dir    string `conf:"default:/tmp/decaf-blobs"`
+		Bucket struct {
+			Endpoint  string
+			Region    string `conf:"default:us-east-1"`
+			Name      string
+			AccessKey string
+			SecretKey string `conf:"noprint"`
+			PathStyle bool   `conf:"default:true"`
+			Prefix    string
+		}
+	}
+
+	Messages struct {
+		// EditWindow is how long after sending a message its sender can edit it
+		EditWindow time.Duration `conf:"default:15m"`
+
+		// ExpiryInterval is how often disappearing messages, uploads and sessions that expired, and unused blobs, are deleted
+		ExpiryInterval time.Duration `conf:"default:1m"`
+
+		// SchedulerInterval is how often scheduled messages that are due are sent
+		SchedulerInterval time.Duration `conf:"default:5s"`
+	}
+
+	// Args holds the positional arguments, used to select a command (e.g., `migrate status`)
+	Args conf.Args `yaml:"-"`
 }
 
 // loadConfiguration creates a WebAPIConfiguration starting from flags, environment variables and configuration file.
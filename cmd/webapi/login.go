@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dilcetto/wasa/service/api"
+	"github.com/dilcetto/wasa/service/webauthn"
+)
+
+// loginConfig returns how users log in, from the login mode of the configuration, and the site passkeys are bound to.
+func loginConfig(cfg WebAPIConfiguration) (api.LoginConfig, webauthn.RelyingParty, error) {
+	var login api.LoginConfig
+	switch cfg.Auth.LoginMode {
+	case "open":
+	case "credentials":
+		login.RequireCredentials = true
+		login.AllowLegacyLogin = cfg.Auth.AllowLegacyLogin
+	default:
+		return api.LoginConfig{}, webauthn.RelyingParty{}, fmt.Errorf("unknown login mode %q: use \"open\" or \"credentials\"", cfg.Auth.LoginMode)
+	}
+
+	rp := webauthn.RelyingParty{
+		ID:      cfg.Auth.Passkeys.RPID,
+		Name:    cfg.Auth.Passkeys.RPName,
+		Origins: cfg.Auth.Passkeys.Origins,
+	}
+	if rp.ID != "" && len(rp.Origins) == 0 {
+		return api.LoginConfig{}, webauthn.RelyingParty{}, fmt.Errorf("passkeys need the origins of the web UI")
+	}
+	return login, rp, nil
+}
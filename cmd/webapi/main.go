@@ -1,12 +1,24 @@
 /*
 Webapi is the executable for the main web server.
 It builds a web server around APIs from `service/api`.
-Webapi connects to external resources needed (database) and starts two web servers: the API web server, and the debug.
-Everything is served via the API web server, except debug variables (/debug/vars) and profiler infos (pprof).
+Webapi connects to external resources needed (database, blob store) and starts two web servers: the API web server, and the debug.
+Everything is served via the API web server, except debug variables (/debug/vars), profiler infos (pprof) and the
+metrics in the Prometheus format (/metrics), which are served by the debug web server on CFG_WEB_DEBUG_HOST. Set it
+to an empty string to disable the debug web server.
 
 Usage:
 
 	webapi [flags]
+	webapi [flags] migrate status|up|down-to <version>
+	webapi [flags] set-password <username> < password-file
+
+The `migrate` command inspects or changes the schema version of the database, and exits without starting the servers:
+`status` lists the migrations and when they were applied, `up` applies the pending ones, and `down-to` reverts the
+migrations newer than the given version.
+
+The `set-password` command sets the password of a user to the first line of the standard input, closes the sessions of
+the user and exits. Accounts without a password or a passkey can only add their first one from the device that created
+them, so the older ones get it from an operator this way.
 
 Flags and configurations are handled automatically by the code in `load-configuration.go`.
 
@@ -18,13 +30,16 @@ Return values (exit codes):
 	> 0
 		The program ended due to an error
 
+The keys that sign the access tokens are read again on SIGHUP, so that they can be rotated without a restart.
+
 Note that this program will update the schema of the database to the latest version available (embedded in the
-executable during the build).
+executable during the build), and that it refuses to start on a database migrated by a newer executable.
 */
 package main
 
 import (
 	"context"
+	crand "crypto/rand"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -38,7 +53,6 @@ import (
 	"github.com/dilcetto/wasa/service/api"
 	"github.com/dilcetto/wasa/service/database"
 	"github.com/dilcetto/wasa/service/globaltime"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 )
 
@@ -57,8 +71,9 @@ func main() {
 // * connects to any external resources (like databases, authenticators, etc.)
 // * creates an instance of the service/api package
 // * starts the principal web server (using the service/api.Router.Handler() for HTTP handlers)
+// * starts the debug web server
 // * waits for any termination event: SIGTERM signal (UNIX), non-recoverable server error, etc.
-// * closes the principal web server
+// * closes the principal and the debug web servers
 func run() error {
 	rand.Seed(globaltime.Now().UnixNano())
 	// Load Configuration and defaults
@@ -83,7 +98,7 @@ func run() error {
 
 	// Start Database
 	logger.Println("initializing database support")
-	dbconn, err := sql.Open("sqlite3", cfg.DB.Filename)
+	dbconn, err := sql.Open(database.DriverName, cfg.DB.Filename)
 	if err != nil {
 		logger.WithError(err).Error("error opening SQLite DB")
 		return fmt.Errorf("opening SQLite: %w", err)
@@ -92,12 +107,36 @@ func run() error {
 		logger.Debug("database stopping")
 		_ = dbconn.Close()
 	}()
+
+	if cfg.Args.Num(0) == "migrate" {
+		return runMigrate(dbconn, cfg.Args[1:])
+	}
+
 	db, err := database.New(dbconn)
 	if err != nil {
 		logger.WithError(err).Error("error creating AppDatabase")
 		return fmt.Errorf("creating AppDatabase: %w", err)
 	}
 
+	if cfg.Args.Num(0) == "set-password" {
+		return runSetPassword(db, cfg.Args[1:], os.Stdin)
+	}
+
+	// Start blob store
+	logger.Infof("initializing %s blob store", cfg.Blobs.Store)
+	blobs, err := newBlobStore(cfg)
+	if err != nil {
+		logger.WithError(err).Error("error creating the blob store")
+		return fmt.Errorf("creating the blob store: %w", err)
+	}
+	moved, err := db.MoveInlineBlobs(context.Background(), blobs)
+	if err != nil {
+		logger.WithError(err).Error("error moving inline blobs to the blob store")
+		return fmt.Errorf("moving inline blobs: %w", err)
+	} else if moved > 0 {
+		logger.Infof("moved %d inline blobs to the blob store", moved)
+	}
+
 	// Start (main) API server
 	logger.Info("initializing API server")
 
@@ -106,14 +145,52 @@ func run() error {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
-	// Make a channel to listen for errors coming from the listener. Use a
-	// buffered channel so the goroutine can exit if we don't collect this error.
-	serverErrors := make(chan error, 1)
+	// Make a channel to listen for errors coming from the listeners. Use a
+	// buffered channel so the goroutines can exit if we don't collect these errors.
+	serverErrors := make(chan error, 2)
+
+	// Load the keys of the access tokens. The fallback key is kept across reloads, so that reloading a configuration
+	// that still has no keys does not invalidate every token.
+	fallbackKey := make([]byte, 32)
+	if _, err := crand.Read(fallbackKey); err != nil {
+		return fmt.Errorf("generating the fallback token key: %w", err)
+	}
+	tokens, err := tokenConfig(cfg, fallbackKey)
+	if err != nil {
+		logger.WithError(err).Error("error loading the token keys")
+		return fmt.Errorf("loading the token keys: %w", err)
+	}
+	if tokens.ActiveKey == fallbackKeyID {
+		logger.Warning("no token signing key configured: tokens are signed with a random key, and will not be valid after a restart")
+	}
+
+	login, passkeys, err := loginConfig(cfg)
+	if err != nil {
+		logger.WithError(err).Error("error loading the login configuration")
+		return fmt.Errorf("loading the login configuration: %w", err)
+	}
+	if login.RequireCredentials && login.AllowLegacyLogin {
+		logger.Warning("users without credentials can log in with their username only, until legacy logins are turned off")
+	}
+
+	rateLimits, err := rateLimitConfig(cfg)
+	if err != nil {
+		logger.WithError(err).Error("error loading the rate limits")
+		return fmt.Errorf("loading the rate limits: %w", err)
+	}
 
 	// Create the API router
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: db,
+		Logger:            logger,
+		Database:          db,
+		BlobStore:         blobs,
+		MessageEditWindow: cfg.Messages.EditWindow,
+		ExpiryInterval:    cfg.Messages.ExpiryInterval,
+		SchedulerInterval: cfg.Messages.SchedulerInterval,
+		Tokens:            tokens,
+		Login:             login,
+		Passkeys:          passkeys,
+		RateLimits:        rateLimits,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -146,6 +223,40 @@ func run() error {
 		logger.Infof("stopping API server")
 	}()
 
+	// Start the debug server, which is not exposed to the clients of the API
+	debugserver := http.Server{
+		Addr:              cfg.Web.DebugHost,
+		Handler:           debugHandler(),
+		ReadHeaderTimeout: cfg.Web.ReadTimeout,
+	}
+	if debugserver.Addr != "" {
+		go func() {
+			logger.Infof("debug listening on %s", debugserver.Addr)
+			serverErrors <- debugserver.ListenAndServe()
+			logger.Infof("stopping debug server")
+		}()
+	}
+
+	// Reload the token keys on SIGHUP, to rotate them without restarting
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			cfg, err := loadConfiguration()
+			if err == nil {
+				var tokens api.TokenConfig
+				if tokens, err = tokenConfig(cfg, fallbackKey); err == nil {
+					err = apirouter.SetTokenConfig(tokens)
+				}
+			}
+			if err != nil {
+				logger.WithError(err).Error("error reloading the token keys, the current ones are kept")
+				continue
+			}
+			logger.Info("token keys reloaded")
+		}
+	}()
+
 	// Waiting for shutdown signal or POSIX signals
 	select {
 	case err := <-serverErrors:
@@ -165,6 +276,9 @@ func run() error {
 		ctx, cancel := context.WithTimeout(context.Background(), cfg.Web.ShutdownTimeout)
 		defer cancel()
 
+		// The debug server has no requests worth waiting for.
+		_ = debugserver.Close()
+
 		// Asking listener to shut down and load shed.
 		err = apiserver.Shutdown(ctx)
 		if err != nil {
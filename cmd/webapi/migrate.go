@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/dilcetto/wasa/service/database"
+)
+
+// runMigrate executes the `migrate` command with the given arguments (e.g., `status`, `up`, `down-to 2`), printing the
+// result on the standard output.
+func runMigrate(dbconn *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: webapi migrate status|up|down-to <version>")
+	}
+
+	switch args[0] {
+	case "status":
+		status, err := database.GetMigrationStatus(dbconn)
+		if err != nil {
+			return err
+		}
+		current, err := database.SchemaVersion(dbconn)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "VERSION\tDESCRIPTION\tAPPLIED AT")
+		for _, m := range status {
+			appliedAt := m.AppliedAt
+			if appliedAt == "" {
+				appliedAt = "pending"
+			}
+			_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\n", m.Version, m.Description, appliedAt)
+		}
+		_ = tw.Flush()
+		fmt.Printf("database at version %d, latest is %d\n", current, database.LatestSchemaVersion()) //nolint:forbidigo
+		return nil
+
+	case "up":
+		applied, err := database.MigrateUp(dbconn)
+		for _, v := range applied {
+			fmt.Printf("applied migration %d\n", v) //nolint:forbidigo
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("database is up to date") //nolint:forbidigo
+		}
+		return err
+
+	case "down-to":
+		if len(args) != 2 {
+			return errors.New("usage: webapi migrate down-to <version>")
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version %q: %w", args[1], err)
+		}
+		reverted, err := database.MigrateDownTo(dbconn, version)
+		for _, v := range reverted {
+			fmt.Printf("reverted migration %d\n", v) //nolint:forbidigo
+		}
+		return err
+
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dilcetto/wasa/service/api"
+	"github.com/dilcetto/wasa/service/database"
+)
+
+// runSetPassword executes the `set-password <username>` command: it sets the password of a user to the first line of
+// the standard input, and closes every session of the user. It is how the accounts without credentials that cannot
+// prove they own them, as they were created before sessions were verified, get their first password.
+func runSetPassword(db database.AppDatabase, args []string, stdin io.Reader) error {
+	if len(args) != 1 {
+		return errors.New("usage: webapi set-password <username> < password-file")
+	}
+	ctx := context.Background()
+	user, err := db.GetUserByName(ctx, args[0])
+	if err != nil {
+		return fmt.Errorf("finding user %q: %w", args[0], err)
+	}
+
+	password, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("reading the password: %w", err)
+	}
+	hash, err := api.HashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		return err
+	}
+	if err := db.SetPasswordHash(ctx, user.ID, hash); err != nil {
+		return err
+	}
+	closed, err := db.DeleteUserSessions(ctx, user.ID, "")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("password of %s set, %d sessions closed\n", user.Username, closed) //nolint:forbidigo
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api"
+)
+
+// rateLimitRoutes are the routes limited by each named limit of the configuration
+var rateLimitRoutes = map[string][]string{
+	"login": {
+		"POST /login",
+		"POST /register",
+		"POST /login/passkey/options",
+		"POST /login/passkey",
+	},
+	"search": {
+		"GET /searchby",
+		"GET /search/messages",
+	},
+	"sendmessage": {
+		"POST /conversations/:conversationId/messages",
+		"POST /conversations/:conversationId/messages/:messageId/forward",
+		"POST /conversations/:conversationId/scheduled-messages",
+	},
+}
+
+// pathParam matches the parameters of the paths as written in the API documentation, e.g. {conversationId}, which the
+// router writes :conversationId
+var pathParam = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+
+// rateLimitConfig builds the rate limits of the API from the configuration. The limits of single routes (Routes) win
+// over the named ones.
+func rateLimitConfig(cfg WebAPIConfiguration) (api.RateLimitConfig, error) {
+	var limits api.RateLimitConfig
+	var err error
+	if limits.Default, err = parseRateLimit(cfg.RateLimits.Default); err != nil {
+		return limits, fmt.Errorf("default rate limit: %w", err)
+	}
+	if limits.LoginFailures, err = parseRateLimit(cfg.RateLimits.LoginFailures); err != nil {
+		return limits, fmt.Errorf("login failures rate limit: %w", err)
+	}
+	if limits.UsernameFailures, err = parseRateLimit(cfg.RateLimits.UsernameFailures); err != nil {
+		return limits, fmt.Errorf("username failures rate limit: %w", err)
+	}
+
+	limits.Routes = make(map[string]api.RateLimit)
+	for name, value := range map[string]string{
+		"login":       cfg.RateLimits.Login,
+		"search":      cfg.RateLimits.Search,
+		"sendmessage": cfg.RateLimits.SendMessage,
+	} {
+		limit, err := parseRateLimit(value)
+		if err != nil {
+			return limits, fmt.Errorf("%s rate limit: %w", name, err)
+		}
+		for _, route := range rateLimitRoutes[name] {
+			limits.Routes[route] = limit
+		}
+	}
+
+	for _, entry := range cfg.RateLimits.Routes {
+		route, value, ok := cut(entry, "=")
+		method, path, _ := cut(route, " ")
+		if !ok || method == "" || !strings.HasPrefix(path, "/") {
+			return limits, fmt.Errorf("invalid route rate limit %q: use \"<METHOD> <path>=<limit>\"", entry)
+		}
+		limit, err := parseRateLimit(value)
+		if err != nil {
+			return limits, fmt.Errorf("rate limit of %s: %w", route, err)
+		}
+		limits.Routes[strings.ToUpper(method)+" "+pathParam.ReplaceAllString(path, ":$1")] = limit
+	}
+	return limits, nil
+}
+
+// parseRateLimit parses a limit written as "<requests>/<period>", e.g. "10/1m" for 10 requests per minute. "off" (or
+// an empty string) lifts the limit.
+func parseRateLimit(s string) (api.RateLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "off" {
+		return api.RateLimit{}, nil
+	}
+	requests, period, ok := cut(s, "/")
+	n, err := strconv.Atoi(requests)
+	if !ok || err != nil || n <= 0 {
+		return api.RateLimit{}, fmt.Errorf("invalid limit %q: use \"<requests>/<period>\", e.g. \"10/1m\", or \"off\"", s)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return api.RateLimit{}, fmt.Errorf("invalid period in %q: use a duration such as \"30s\" or \"1m\"", s)
+	}
+	return api.RateLimit{Requests: n, Period: d}, nil
+}
+
+// cut splits s around the first sep, like strings.Cut of newer Go versions.
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
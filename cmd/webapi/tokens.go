@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dilcetto/wasa/service/api"
+	"gopkg.in/yaml.v2"
+)
+
+// fallbackKeyID is the ID of the random key that signs tokens when no key is configured
+const fallbackKeyID = "fallback"
+
+// tokenKeysFile is the content of the token keys file. Its active key, when set, replaces the one of the
+// configuration, and its retired keys are added to those of the configuration.
+type tokenKeysFile struct {
+	Active  string            `yaml:"active"`
+	Retired []string          `yaml:"retired"`
+	Keys    map[string]string `yaml:"keys"`
+}
+
+// tokenConfig builds the configuration of the access tokens. The signing keys are those of the configuration and of
+// the keys file, minus the retired ones. When no key is configured at all, tokens are signed with fallbackKey, so that
+// they do not survive a restart.
+func tokenConfig(cfg WebAPIConfiguration, fallbackKey []byte) (api.TokenConfig, error) {
+	activeKey := cfg.Auth.ActiveKey
+	retired := cfg.Auth.RetiredKeys
+	keys := make(map[string][]byte)
+	for id, secret := range cfg.Auth.Keys {
+		keys[id] = []byte(secret)
+	}
+	if cfg.Auth.KeysFile != "" {
+		data, err := os.ReadFile(cfg.Auth.KeysFile)
+		if err != nil {
+			return api.TokenConfig{}, fmt.Errorf("reading the token keys file: %w", err)
+		}
+		var file tokenKeysFile
+		if err := yaml.UnmarshalStrict(data, &file); err != nil {
+			return api.TokenConfig{}, fmt.Errorf("parsing the token keys file: %w", err)
+		}
+		for id, secret := range file.Keys {
+			if other, ok := keys[id]; ok && string(other) != secret {
+				return api.TokenConfig{}, fmt.Errorf("token key %q is configured twice with different secrets", id)
+			}
+			keys[id] = []byte(secret)
+		}
+		if file.Active != "" {
+			activeKey = file.Active
+		}
+		retired = append(retired, file.Retired...)
+	}
+
+	for _, id := range retired {
+		if id == activeKey {
+			return api.TokenConfig{}, fmt.Errorf("active token key %q is retired", id)
+		}
+		delete(keys, id)
+	}
+
+	switch {
+	case len(keys) == 0 && activeKey == "":
+		keys[fallbackKeyID] = fallbackKey
+		activeKey = fallbackKeyID
+	case activeKey == "" && len(keys) == 1:
+		for id := range keys {
+			activeKey = id
+		}
+	case activeKey == "":
+		return api.TokenConfig{}, fmt.Errorf("%d token keys are configured: the active one is required", len(keys))
+	}
+
+	return api.TokenConfig{
+		Keys:            keys,
+		ActiveKey:       activeKey,
+		Lifetime:        cfg.Auth.TokenLifetime,
+		RefreshLifetime: cfg.Auth.RefreshTokenLifetime,
+		Issuer:          cfg.Auth.Issuer,
+		Audience:        cfg.Auth.Audience,
+	}, nil
+}
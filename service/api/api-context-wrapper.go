@@ -1,9 +1,11 @@
 package api
 
 import (
+	"net"
 	"net/http"
 
 	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/felixge/httpsnoop"
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
@@ -13,8 +15,9 @@ import (
 // required by the httprouter package.
 type httpRouterHandler func(http.ResponseWriter, *http.Request, httprouter.Params, reqcontext.RequestContext)
 
-// wrap parses the request and adds a reqcontext.RequestContext instance related to the request.
-func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+// wrap parses the request and adds a reqcontext.RequestContext instance related to the request. The request is counted in
+// the metrics of route, the path pattern it matched.
+func (rt *_router) wrap(route string, fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		reqUUID, err := uuid.NewV4()
 		if err != nil {
@@ -24,7 +27,9 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 		}
 		var ctx = reqcontext.RequestContext{
 			ReqUUID: reqUUID,
+			Client:  requestClient(r),
 		}
+		r = r.WithContext(reqcontext.WithClient(r.Context(), ctx.Client))
 
 		// Create a request-specific logger
 		ctx.Logger = rt.baseLogger.WithFields(logrus.Fields{
@@ -33,6 +38,26 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 		})
 
 		// Call the next handler in chain (usually, the handler function for the path)
-		fn(w, r, ps, ctx)
+		m := httpsnoop.CaptureMetricsFn(w, func(w http.ResponseWriter) {
+			fn(w, r, ps, ctx)
+		})
+		observeRequest(r.Method, route, m.Code, m.Duration)
+	}
+}
+
+// wrapUnrouted adapts a handler to the http.Handler the router calls for requests that match no route.
+func (rt *_router) wrapUnrouted(fn httpRouterHandler) http.Handler {
+	handler := rt.wrap(unmatchedRoute, fn)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, nil)
+	})
+}
+
+// requestClient returns the device that sent the request: its address, without the port, and its user agent.
+func requestClient(r *http.Request) reqcontext.Client {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
 	}
+	return reqcontext.Client{IP: ip, UserAgent: r.UserAgent()}
 }
@@ -7,31 +7,84 @@ import (
 // Handler returns an instance of httprouter.Router that handle APIs registered here
 func (rt *_router) Handler() http.Handler {
 	// auth
-	rt.router.POST("/login", rt.wrap(rt.doLogin))
+	rt.handle(http.MethodPost, "/login", rt.doLogin)
+	rt.handle(http.MethodPost, "/register", rt.register)
+	rt.handle(http.MethodPost, "/login/passkey/options", rt.getPasskeyLoginOptions)
+	rt.handle(http.MethodPost, "/login/passkey", rt.loginWithPasskey)
+	rt.handle(http.MethodPost, "/token/refresh", rt.refreshTokens)
+	rt.handle(http.MethodPost, "/logout", rt.logout)
+	rt.handle(http.MethodPost, "/logout-all", rt.logoutAll)
 	// profile routes
-	rt.router.GET("/searchby", rt.wrap(rt.search_by))
-	rt.router.PUT("/user/username", rt.wrap(rt.setMyUserName))
-	rt.router.PUT("/user/photo", rt.wrap(rt.setMyPhoto))
+	rt.handle(http.MethodGet, "/searchby", rt.search_by)
+	rt.handle(http.MethodGet, "/search/messages", rt.searchMessages)
+	rt.handle(http.MethodPut, "/user/username", rt.setMyUserName)
+	rt.handle(http.MethodPut, "/user/photo", rt.setMyPhoto)
+	rt.handle(http.MethodGet, "/user/sessions", rt.getMySessions)
+	rt.handle(http.MethodDelete, "/user/sessions/:sessionId", rt.deleteMySession)
+	rt.handle(http.MethodPut, "/user/password", rt.setMyPassword)
+	rt.handle(http.MethodGet, "/user/passkeys", rt.getMyPasskeys)
+	rt.handle(http.MethodPost, "/user/passkeys/options", rt.getPasskeyCreationOptions)
+	rt.handle(http.MethodPost, "/user/passkeys", rt.addPasskey)
+	rt.handle(http.MethodDelete, "/user/passkeys/:passkeyId", rt.deletePasskey)
 	// conversation and messages routes
-	rt.router.GET("/conversations", rt.wrap(rt.getMyConversations))
-	rt.router.GET("/conversations/:conversationId", rt.wrap(rt.getConversation))
-	rt.router.GET("/conversations/:conversationId/members", rt.wrap(rt.getConversationMembers))
-	rt.router.POST("/conversations/:conversationId/messages", rt.wrap(rt.sendMessage))
-	rt.router.POST("/conversations/:conversationId/messages/:messageId/forward", rt.wrap(rt.forwardMessage))
-	rt.router.DELETE("/conversations/:conversationId/messages/:messageId", rt.wrap(rt.deleteMessage))
-	rt.router.POST("/conversations/:conversationId/messages/:messageId/status", rt.wrap(rt.setMessageStatus))
-	rt.router.POST("/conversations/:conversationId/messages/:messageId/comment", rt.wrap(rt.commentMessage))
-	rt.router.DELETE("/conversations/:conversationId/messages/:messageId/comment", rt.wrap(rt.uncommentMessage))
+	rt.handle(http.MethodGet, "/conversations", rt.getMyConversations)
+	rt.handle(http.MethodGet, "/conversations/:conversationId", rt.getConversation)
+	rt.handle(http.MethodGet, "/conversations/:conversationId/members", rt.getConversationMembers)
+	rt.handle(http.MethodGet, "/conversations/:conversationId/messages", rt.getConversationMessages)
+	rt.handle(http.MethodPost, "/conversations/:conversationId/read", rt.markConversationRead)
+	rt.handle(http.MethodPut, "/conversations/:conversationId/settings", rt.setConversationSettings)
+	rt.handle(http.MethodPost, "/conversations/:conversationId/scheduled-messages", rt.scheduleMessage)
+	rt.handle(http.MethodGet, "/conversations/:conversationId/scheduled-messages", rt.getScheduledMessages)
+	rt.handle(http.MethodPut, "/conversations/:conversationId/scheduled-messages/:scheduledId", rt.updateScheduledMessage)
+	rt.handle(http.MethodDelete, "/conversations/:conversationId/scheduled-messages/:scheduledId", rt.cancelScheduledMessage)
+	rt.handle(http.MethodPost, "/conversations/:conversationId/messages", rt.sendMessage)
+	rt.handle(http.MethodPost, "/conversations/:conversationId/messages/:messageId/forward", rt.forwardMessage)
+	rt.handle(http.MethodPut, "/conversations/:conversationId/messages/:messageId", rt.editMessage)
+	rt.handle(http.MethodDelete, "/conversations/:conversationId/messages/:messageId", rt.deleteMessage)
+	rt.handle(http.MethodGet, "/conversations/:conversationId/messages/:messageId/history", rt.getMessageHistory)
+	rt.handle(http.MethodGet, "/conversations/:conversationId/messages/:messageId/replies", rt.getMessageReplies)
+	rt.handle(http.MethodPost, "/conversations/:conversationId/messages/:messageId/status", rt.setMessageStatus)
+	rt.handle(http.MethodGet, "/conversations/:conversationId/messages/:messageId/receipts", rt.getMessageReceipts)
+	rt.handle(http.MethodPost, "/conversations/:conversationId/messages/:messageId/comment", rt.commentMessage)
+	rt.handle(http.MethodDelete, "/conversations/:conversationId/messages/:messageId/comment", rt.uncommentMessage)
 	// move direct conversation outside to avoid wildcard conflict under /conversations
-	rt.router.POST("/direct-conversations", rt.wrap(rt.createDirectConversation))
+	rt.handle(http.MethodPost, "/direct-conversations", rt.createDirectConversation)
 	// group routes
-	rt.router.POST("/groups", rt.wrap(rt.createGroup))
-	rt.router.POST("/groups/:groupId", rt.wrap(rt.addToGroup))
-	rt.router.DELETE("/groups/:groupId", rt.wrap(rt.leaveGroup))
-	rt.router.PUT("/groups/:groupId/name", rt.wrap(rt.setGroupName))
-	rt.router.PUT("/groups/:groupId/photo", rt.wrap(rt.setGroupPhoto))
+	rt.handle(http.MethodPost, "/groups", rt.createGroup)
+	rt.handle(http.MethodPost, "/groups/:groupId", rt.addToGroup)
+	rt.handle(http.MethodDelete, "/groups/:groupId", rt.leaveGroup)
+	rt.handle(http.MethodPut, "/groups/:groupId/name", rt.setGroupName)
+	rt.handle(http.MethodPut, "/groups/:groupId/photo", rt.setGroupPhoto)
+	rt.handle(http.MethodPut, "/groups/:groupId/slow-mode", rt.setGroupSlowMode)
+	rt.handle(http.MethodDelete, "/groups/:groupId/members/:userId", rt.kickFromGroup)
+	rt.handle(http.MethodPost, "/groups/:groupId/members/:userId/promote", rt.promoteGroupMember)
+	rt.handle(http.MethodPost, "/groups/:groupId/members/:userId/demote", rt.demoteGroupMember)
+	rt.handle(http.MethodPost, "/groups/:groupId/members/:userId/ownership", rt.transferGroupOwnership)
+
+	// real-time events
+	rt.handle(http.MethodGet, "/events", rt.streamEvents)
+
+	// Media
+	rt.handle(http.MethodGet, "/media/:blobId", rt.getMedia)
+	rt.handle(http.MethodPost, "/uploads", rt.createUpload)
+	rt.handle(http.MethodGet, "/uploads/:uploadId", rt.getUpload)
+	rt.handle(http.MethodHead, "/uploads/:uploadId", rt.getUpload)
+	rt.handle(http.MethodPatch, "/uploads/:uploadId", rt.appendUploadChunk)
+	rt.handle(http.MethodPost, "/uploads/:uploadId/finalize", rt.finalizeUpload)
+	rt.handle(http.MethodDelete, "/uploads/:uploadId", rt.cancelUpload)
 
 	rt.router.GET("/liveness", rt.liveness)
 
+	// errors of the router itself use the JSON error model too
+	rt.router.NotFound = rt.wrapUnrouted(notFound)
+	rt.router.MethodNotAllowed = rt.wrapUnrouted(methodNotAllowed)
+
 	return rt.router
 }
+
+// handle registers the handler of a route. Requests are wrapped with wrap, counted under the path of the route, and
+// limited by the rate limit of the route.
+func (rt *_router) handle(method, path string, fn httpRouterHandler) {
+	rt.router.Handle(method, path, rt.wrap(path, rt.limitRate(method, path, fn)))
+	rt.routes = append(rt.routes, method+" "+path)
+}
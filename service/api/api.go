@@ -9,8 +9,9 @@ Example:
 
 	// Create the API router
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: appdb,
+		Logger:    logger,
+		Database:  appdb,
+		BlobStore: blobs,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -37,10 +38,18 @@ See the `main.go` file inside the `cmd/webapi` for a full usage example.
 package api
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/dilcetto/wasa/service/blobstore"
 	"github.com/dilcetto/wasa/service/database"
+	"github.com/dilcetto/wasa/service/events"
+	"github.com/dilcetto/wasa/service/globaltime"
+	"github.com/dilcetto/wasa/service/webauthn"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 )
@@ -52,6 +61,31 @@ type Config struct {
 
 	// Database is the instance of database.AppDatabase where data are saved
 	Database database.AppDatabase
+
+	// BlobStore is where attachments and photos are saved
+	BlobStore blobstore.BlobStore
+
+	// MessageEditWindow is how long after sending a message its sender can edit it. Zero means 15 minutes.
+	MessageEditWindow time.Duration
+
+	// ExpiryInterval is how often expired messages, uploads, sessions and passkey challenges and unused blobs are
+	// deleted, and the rate limits of idle clients forgotten. Zero means every minute.
+	ExpiryInterval time.Duration
+
+	// SchedulerInterval is how often scheduled messages that are due are sent. Zero means every 5 seconds.
+	SchedulerInterval time.Duration
+
+	// Tokens configures the access tokens: the keys that sign them, their lifetime and their claims
+	Tokens TokenConfig
+
+	// Login chooses between open username login and credential-required login
+	Login LoginConfig
+
+	// Passkeys is the site passkeys are bound to. Passkeys are disabled when its ID is empty.
+	Passkeys webauthn.RelyingParty
+
+	// RateLimits limits how often clients can call each route, and how often a username can fail to log in
+	RateLimits RateLimitConfig
 }
 
 // Router is the package API interface representing an API handler builder
@@ -59,6 +93,10 @@ type Router interface {
 	// Handler returns an HTTP handler for APIs provided in this package
 	Handler() http.Handler
 
+	// SetTokenConfig replaces the configuration of the access tokens, to rotate the signing keys without restarting.
+	// Tokens signed by the keys that are still configured stay valid.
+	SetTokenConfig(cfg TokenConfig) error
+
 	// Close terminates any resource used in the package
 	Close() error
 }
@@ -72,18 +110,58 @@ func New(cfg Config) (Router, error) {
 	if cfg.Database == nil {
 		return nil, errors.New("database is required")
 	}
+	if cfg.BlobStore == nil {
+		return nil, errors.New("blob store is required")
+	}
 
 	// Create a new router where we will register HTTP endpoints. The server will pass requests to this router to be
 	// handled.
+	editWindow := cfg.MessageEditWindow
+	if editWindow <= 0 {
+		editWindow = defaultMessageEditWindow
+	}
+
+	expiryInterval := cfg.ExpiryInterval
+	if expiryInterval <= 0 {
+		expiryInterval = defaultExpiryInterval
+	}
+	schedulerInterval := cfg.SchedulerInterval
+	if schedulerInterval <= 0 {
+		schedulerInterval = defaultSchedulerInterval
+	}
+
+	tokens, err := newTokenSigner(cfg.Tokens)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token configuration: %w", err)
+	}
+
 	router := httprouter.New()
 	router.RedirectTrailingSlash = false
 	router.RedirectFixedPath = false
 
-	return &_router{
+	rt := &_router{
 		router:     router,
 		baseLogger: cfg.Logger,
 		db:         cfg.Database,
-	}, nil
+		blobs:      cfg.BlobStore,
+		authz:      authorizer{db: cfg.Database},
+		tokens:     tokens,
+		login:      cfg.Login,
+		passkeys:   cfg.Passkeys,
+		limits:     cfg.RateLimits,
+		limiter:    newRateLimiter(),
+		editWindow: editWindow,
+		hub:        events.NewHub(),
+		stop:       make(chan struct{}),
+	}
+	rt.startBackground(expiryInterval, rt.reapExpiredMessages)
+	rt.startBackground(expiryInterval, rt.reapExpiredUploads)
+	rt.startBackground(expiryInterval, rt.sweepUnusedBlobs)
+	rt.startBackground(expiryInterval, rt.reapExpiredSessions)
+	rt.startBackground(expiryInterval, rt.reapExpiredChallenges)
+	rt.startBackground(expiryInterval, rt.pruneRateLimits)
+	rt.startBackground(schedulerInterval, rt.sendDueMessages)
+	return rt, nil
 }
 
 type _router struct {
@@ -94,4 +172,60 @@ type _router struct {
 	baseLogger logrus.FieldLogger
 
 	db database.AppDatabase
+
+	// blobs stores the content of attachments and photos, which the database references by blob ID. blobLock keeps
+	// blobs from being stored while the sweep takes unused ones, and guards deleting, the blobs the sweep is deleting
+	// from the store, and deleted, which is closed once they are deleted.
+	blobs    blobstore.BlobStore
+	blobLock sync.RWMutex
+	deleting map[string]bool
+	deleted  chan struct{}
+
+	// authz checks the caller's rights on conversations, groups and messages
+	authz authorizer
+
+	// tokens creates and verifies the access tokens
+	tokens *tokenSigner
+
+	// login chooses how users log in, and passkeys is the site their passkeys are bound to
+	login    LoginConfig
+	passkeys webauthn.RelyingParty
+
+	// limits are the rate limits of the routes, and limiter counts the requests of the clients against them and the
+	// messages sent to the conversations in slow mode
+	limits  RateLimitConfig
+	limiter *rateLimiter
+
+	// editWindow is how long after sending a message its sender can edit it
+	editWindow time.Duration
+
+	// hub delivers real-time events to the clients connected to /events
+	hub *events.Hub
+
+	// routes are the routes registered by handle, by method and path, e.g. "GET /conversations"
+	routes []string
+
+	// stop is closed to stop the background tasks, and background waits for them to return
+	stop       chan struct{}
+	background sync.WaitGroup
+}
+
+// startBackground runs task every `interval` in a goroutine, until the router is closed. Tasks get the current time
+// from globaltime, so that tests can move it.
+func (rt *_router) startBackground(interval time.Duration, task func(ctx context.Context, now time.Time)) {
+	rt.background.Add(1)
+	go func() {
+		defer rt.background.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rt.stop:
+				return
+			case <-ticker.C:
+				task(context.Background(), globaltime.Now())
+			}
+		}
+	}()
 }
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/imaging"
+)
+
+const (
+	// maxAttachments is the largest number of attachments of a message
+	maxAttachments = 10
+
+	// maxAttachmentSize is the size of the largest attachment accepted, in bytes
+	maxAttachmentSize = 10 << 20
+
+	// maxFilenameLength and maxCaptionLength are the longest filename and caption of an attachment, in characters
+	maxFilenameLength = 255
+	maxCaptionLength  = 1000
+)
+
+// errInvalidAttachment is returned by storeAttachments, wrapped with the reason, when an attachment is rejected.
+var errInvalidAttachment = errors.New("invalid attachment")
+
+// checkedAttachment is a new attachment that passed the checks, ready to be stored.
+type checkedAttachment struct {
+	attachment schema.Attachment
+	data       []byte
+
+	// image is the processed image for images, nil for the other kinds
+	image *imaging.Image
+}
+
+// storeAttachments checks the attachments of a message sent by userID and stores them in the blob store. Their content
+// is received inline, in a multipart request, or in a finalized upload of the user, which is already stored. Images
+// are processed first, see imaging.Process, and stored with their thumbnail. It returns the attachments with their
+// blob ID and the metadata detected from their content. Nothing is stored unless every attachment is valid.
+func (rt *_router) storeAttachments(ctx context.Context, userID string, attachments []schema.Attachment) ([]schema.Attachment, error) {
+	if len(attachments) == 0 {
+		return nil, nil
+	}
+	if len(attachments) > maxAttachments {
+		return nil, fmt.Errorf("%w: a message has at most %d attachments", errInvalidAttachment, maxAttachments)
+	}
+
+	checked := make([]checkedAttachment, len(attachments))
+	for i, a := range attachments {
+		var err error
+		if a.UploadID != "" {
+			checked[i].attachment, err = rt.uploadedAttachment(ctx, userID, a)
+		} else {
+			checked[i], err = checkAttachment(a, maxAttachmentSize)
+		}
+		var invalid attachmentError
+		if errors.As(err, &invalid) {
+			return nil, fmt.Errorf("%w %d: %s", errInvalidAttachment, i+1, err)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	stored := make([]schema.Attachment, len(checked))
+	for i, c := range checked {
+		if c.attachment.BlobID != "" {
+			stored[i] = c.attachment
+			continue
+		}
+		var err error
+		if stored[i], err = rt.putAttachment(ctx, c); err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
+
+// attachmentError is an attachment that fails validation, which the client is told about, as opposed to the errors of
+// the database, the blob store or the image encoder.
+type attachmentError string
+
+func (e attachmentError) Error() string {
+	return string(e)
+}
+
+// putAttachment stores a checked attachment in the blob store, and returns it with its blob ID.
+func (rt *_router) putAttachment(ctx context.Context, c checkedAttachment) (schema.Attachment, error) {
+	a := c.attachment
+	if c.image == nil {
+		blobID, err := rt.putBlob(ctx, c.data)
+		if err != nil {
+			return a, err
+		}
+		a.BlobID = blobID
+		return a, nil
+	}
+
+	blobID, err := rt.storeImage(ctx, c.image)
+	if err != nil {
+		return a, err
+	}
+	a.BlobID = blobID
+	a.MimeType = c.image.MimeType
+	a.Size = int64(len(c.image.Data))
+	a.Width, a.Height = c.image.Width, c.image.Height
+	return a, nil
+}
+
+// uploadedAttachment returns the attachment of a finalized upload of userID, with the caption of the request.
+func (rt *_router) uploadedAttachment(ctx context.Context, userID string, a schema.Attachment) (schema.Attachment, error) {
+	upload, err := rt.db.GetUpload(ctx, a.UploadID)
+	if errors.Is(err, schema.ErrUploadNotFound) || (err == nil && upload.UserID != userID) {
+		return a, attachmentError("upload not found")
+	} else if err != nil {
+		return a, err
+	}
+	if upload.Attachment == nil {
+		return a, attachmentError("upload not finalized")
+	}
+
+	caption := strings.TrimSpace(a.Caption)
+	if len([]rune(caption)) > maxCaptionLength {
+		return a, attachmentError(fmt.Sprintf("caption longer than %d characters", maxCaptionLength))
+	}
+	attachment := *upload.Attachment
+	attachment.Caption = caption
+	return attachment, nil
+}
+
+// checkAttachment validates a new attachment of at most maxSize bytes, and returns it with its content and the
+// metadata detected from it, processing images. The MIME type is always sniffed from the content: the kind requested
+// by the client can only send any content as a generic file, kept as it is, or a recording in a video container (WebM
+// or MP4, as recorded by browsers) as audio. Validation errors are attachmentErrors.
+func checkAttachment(a schema.Attachment, maxSize int) (checkedAttachment, error) {
+	data := a.Content
+	if data == nil {
+		if a.Data == "" {
+			return checkedAttachment{}, attachmentError("missing content")
+		}
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(a.Data); err != nil {
+			return checkedAttachment{}, attachmentError("content is not base64-encoded")
+		}
+	}
+	if len(data) == 0 {
+		return checkedAttachment{}, attachmentError("missing content")
+	}
+	if len(data) > maxSize {
+		return checkedAttachment{}, attachmentError(fmt.Sprintf("larger than %d MiB", maxSize>>20))
+	}
+
+	mimeType := http.DetectContentType(data)
+	kind := attachmentKind(mimeType)
+	switch {
+	case a.Kind == "" || a.Kind == kind || a.Kind == schema.AttachmentFile:
+	case a.Kind == schema.AttachmentAudio && (mimeType == "video/webm" || mimeType == "video/mp4"):
+	default:
+		return checkedAttachment{}, attachmentError(fmt.Sprintf("content is not a valid %s", a.Kind))
+	}
+	if a.Kind != "" {
+		kind = a.Kind
+	}
+
+	caption := strings.TrimSpace(a.Caption)
+	if len([]rune(caption)) > maxCaptionLength {
+		return checkedAttachment{}, attachmentError(fmt.Sprintf("caption longer than %d characters", maxCaptionLength))
+	}
+	checked := checkedAttachment{
+		attachment: schema.Attachment{
+			Kind:     kind,
+			MimeType: mimeType,
+			Filename: sanitizeFilename(a.Filename),
+			Size:     int64(len(data)),
+			Caption:  caption,
+		},
+		data: data,
+	}
+	if kind == schema.AttachmentImage {
+		img, err := imaging.Process(data, imaging.MessageImage)
+		if errors.Is(err, imaging.ErrUnsupportedImage) || errors.Is(err, imaging.ErrImageTooLarge) {
+			return checkedAttachment{}, attachmentError(err.Error())
+		} else if err != nil {
+			return checkedAttachment{}, err
+		}
+		checked.image = img
+	}
+	return checked, nil
+}
+
+// attachmentKind returns the kind of an attachment from its MIME type. Only the images that can be processed are
+// images: the others, such as BMP and icons, are generic files.
+func attachmentKind(mimeType string) string {
+	switch {
+	case mimeType == "image/jpeg", mimeType == "image/png", mimeType == "image/gif", mimeType == "image/webp":
+		return schema.AttachmentImage
+	case strings.HasPrefix(mimeType, "video/"):
+		return schema.AttachmentVideo
+	case strings.HasPrefix(mimeType, "audio/"), mimeType == "application/ogg":
+		return schema.AttachmentAudio
+	}
+	return schema.AttachmentFile
+}
+
+// sanitizeFilename keeps the last element of a path sent as filename, without control characters, so that it is safe
+// to show and to offer as the name of a download.
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name))
+	if name == "." || name == ".." {
+		return ""
+	}
+	if runes := []rune(name); len(runes) > maxFilenameLength {
+		name = string(runes[:maxFilenameLength])
+	}
+	return name
+}
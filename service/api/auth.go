@@ -5,55 +5,282 @@ import (
 	"github.com/dilcetto/wasa/service/components/requests"
 	"github.com/dilcetto/wasa/service/components/schema"
 	"github.com/dilcetto/wasa/service/database"
+	"github.com/dilcetto/wasa/service/globaltime"
 
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+var (
+	// errInvalidCredentials is returned when the username, the password or the passkey of a login is wrong. It does
+	// not say which, so that logins cannot tell which usernames exist.
+	errInvalidCredentials = errors.New("invalid credentials")
+
+	// errCredentialsRequired is returned when a user logs in with the username only, while the deployment or the
+	// account requires a password or a passkey
+	errCredentialsRequired = errors.New("credentials required")
+
+	// errUnverifiedSession is returned when a session opened with the username only adds the first credential of an
+	// account: anyone can open one in the open login mode, and would take the account over
+	errUnverifiedSession = errors.New("session not verified")
+)
+
+// LoginConfig configures how users log in.
+type LoginConfig struct {
+	// RequireCredentials refuses logins with a bare username: users register with a password, and log in with it or
+	// with a passkey. When false, for demos, logging in with an unknown username registers it, and the users without
+	// credentials log in with their username.
+	RequireCredentials bool
+
+	// AllowLegacyLogin lets the users without credentials still log in with their username when credentials are
+	// required, so that the accounts created before can add a password or a passkey.
+	AllowLegacyLogin bool
+}
+
 func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	w.Header().Set("Content-Type", "application/json")
 
 	var req requests.LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 	if len(req.Username) < 3 || len(req.Username) > 16 {
-		http.Error(w, "Invalid username length", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid username length")
+		return
+	}
+	if len(req.DeviceLabel) > maxDeviceLabelLength {
+		writeError(w, ctx, http.StatusBadRequest, "Device label too long")
 		return
 	}
 
-	user, err := rt.db.GetUserByName(req.Username)
-	if errors.Is(err, database.ErrUserDoesNotExist) {
-		newID, err := generateNewID()
+	if err := rt.checkLoginFailures(w, req.Username, ctx.Client); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	user, err := rt.db.GetUserByName(r.Context(), req.Username)
+	var needsCredentials, verified bool
+	switch {
+	case errors.Is(err, database.ErrUserDoesNotExist) && !rt.login.RequireCredentials:
+		// open login registers unknown usernames, with the password if one is given
+		var passwordHash string
+		if req.Password != "" {
+			if passwordHash, err = hashPassword(req.Password); err != nil {
+				writeMappedError(w, ctx, err)
+				return
+			}
+		}
+		if user, err = rt.createUser(r.Context(), req.Username, passwordHash, ""); err != nil {
+			writeMappedError(w, ctx, err)
+			return
+		}
+		verified = true
+	case errors.Is(err, database.ErrUserDoesNotExist):
+		// as slow as a wrong password, so that logins do not tell which usernames exist
+		checkPassword("", req.Password)
+		rt.recordLogin(ctx, req.Username, errInvalidCredentials)
+		writeMappedError(w, ctx, errInvalidCredentials)
+		return
+	case err != nil:
+		writeMappedError(w, ctx, err)
+		return
+	default:
+		needsCredentials, err = rt.checkLogin(r.Context(), user.ID, req.Password)
+		rt.recordLogin(ctx, req.Username, err)
 		if err != nil {
-			http.Error(w, "Failed to generate user ID", http.StatusInternalServerError)
+			writeMappedError(w, ctx, err)
 			return
 		}
-		newUser := schema.User{
-			ID:       newID,
-			Username: req.Username,
+		// a password given is always checked, against the hash of the user
+		verified = req.Password != ""
+	}
+
+	tokens, err := rt.openSession(r.Context(), user.ID, strings.TrimSpace(req.DeviceLabel), verified)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	response := schema.LoginResponse{User: *user, TokenResponse: *tokens, NeedsCredentials: needsCredentials}
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// checkLogin checks the password of a login with a username. Users without a password log in with their username
+// only, unless they have passkeys or the deployment requires credentials; when legacy logins are allowed, it reports
+// that the user needs to add credentials.
+func (rt *_router) checkLogin(ctx context.Context, userID, password string) (bool, error) {
+	hash, err := rt.db.GetPasswordHash(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if hash != "" || password != "" {
+		if !checkPassword(hash, password) {
+			return false, errInvalidCredentials
+		}
+		return false, nil
+	}
+
+	passkeys, err := rt.db.GetUserPasskeys(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case len(passkeys) > 0:
+		return false, errCredentialsRequired
+	case rt.login.RequireCredentials && !rt.login.AllowLegacyLogin:
+		return false, errCredentialsRequired
+	}
+	return rt.login.RequireCredentials, nil
+}
+
+// createUser registers a user, with a password hash and a profile photo when not empty.
+func (rt *_router) createUser(ctx context.Context, username, passwordHash, photoID string) (*schema.User, error) {
+	userID, err := generateNewID()
+	if err != nil {
+		return nil, err
+	}
+	user := schema.User{ID: userID, Username: username, PhotoID: photoID}
+	err = rt.db.WithTx(ctx, func(tx database.AppDatabase) error {
+		if err := tx.CreateUser(ctx, &user); err != nil {
+			return err
 		}
-		if err := rt.db.CreateUser(&newUser); err != nil {
-			http.Error(w, "Could not create user", http.StatusInternalServerError)
-			return
+		if passwordHash != "" {
+			return tx.SetPasswordHash(ctx, userID, passwordHash)
 		}
-		user = &newUser
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if photoID != "" {
+		// with the thumbnail of the photo
+		return rt.db.GetUserById(ctx, userID)
+	}
+	return &user, nil
+}
+
+// refreshTokens exchanges the refresh token of a session for a new access token and a new refresh token. Refresh
+// tokens rotate: each one is accepted once, and presenting one again closes the session and its event streams.
+func (rt *_router) refreshTokens(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req requests.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	refreshToken, refreshHash, err := newRefreshToken()
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	now := globaltime.Now().UTC()
+	expiresAt := now.Add(rt.tokens.refreshLifetime()).Format(time.RFC3339)
+	session, err := rt.db.RefreshSession(r.Context(), hashRefreshToken(req.RefreshToken), refreshHash, now, expiresAt)
+	if errors.Is(err, schema.ErrSessionNotFound) {
+		writeError(w, ctx, http.StatusUnauthorized, "Invalid or expired refresh token")
+		return
+	} else if errors.Is(err, schema.ErrRefreshTokenReused) {
+		ctx.Logger.Warning("Refresh token reused, its session has been closed")
+		rt.hub.Disconnect(session.UserID, session.ID)
+		writeMappedError(w, ctx, err)
+		return
 	} else if err != nil {
-		ctx.Logger.WithError(err).Error("failed to get user by name")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
-	tokenString, err := createToken(user.ID)
+
+	tokens, err := rt.sessionTokens(session.UserID, session.ID, refreshToken)
 	if err != nil {
-		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(tokens)
+}
 
-	response := schema.LoginResponse{User: *user, Token: tokenString}
-	w.WriteHeader(http.StatusCreated)
-	_ = json.NewEncoder(w).Encode(response)
+// logout closes the session of the caller: its access and refresh tokens stop working.
+func (rt *_router) logout(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	session, err := rt.getAuthenticatedSession(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if err := rt.db.DeleteSession(r.Context(), session.UserID, session.ID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	rt.hub.Disconnect(session.UserID, session.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// logoutAll closes every session of the caller, on every device, the current one included.
+func (rt *_router) logoutAll(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if _, err := rt.db.DeleteUserSessions(r.Context(), userID, ""); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	rt.hub.DisconnectAll(userID, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// openSession opens a new session for the user on the client of ctx, and returns its first tokens. Without a label,
+// the device is named after its user agent. verified tells whether the session was opened by creating the account or
+// with a credential, see schema.Session.Verified.
+func (rt *_router) openSession(ctx context.Context, userID, label string, verified bool) (*schema.TokenResponse, error) {
+	sessionID, err := generateNewID()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, refreshHash, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	client := reqcontext.ClientFrom(ctx)
+	if label == "" {
+		label = deviceLabel(client.UserAgent)
+	}
+	now := globaltime.Now().UTC()
+	session := schema.Session{
+		ID:          sessionID,
+		UserID:      userID,
+		DeviceLabel: label,
+		UserAgent:   client.UserAgent,
+		IP:          client.IP,
+		CreatedAt:   now.Format(time.RFC3339),
+		ExpiresAt:   now.Add(rt.tokens.refreshLifetime()).Format(time.RFC3339),
+		Verified:    verified,
+	}
+	if err := rt.db.CreateSession(ctx, &session, refreshHash); err != nil {
+		return nil, err
+	}
+	return rt.sessionTokens(userID, sessionID, refreshToken)
+}
+
+// sessionTokens returns a new access token for a session, with the refresh token that was just issued for it.
+func (rt *_router) sessionTokens(userID, sessionID, refreshToken string) (*schema.TokenResponse, error) {
+	token, expiresAt, err := rt.tokens.create(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &schema.TokenResponse{
+		Token:        token,
+		ExpiresAt:    expiresAt.UTC().Format(time.RFC3339),
+		RefreshToken: refreshToken,
+		SessionID:    sessionID,
+	}, nil
 }
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// TestRefreshTokenReuse checks that presenting a used refresh token closes its session: every refresh token of the
+// session and its access tokens stop working, and its event streams are disconnected, while the other sessions of the
+// user are kept.
+func TestRefreshTokenReuse(t *testing.T) {
+	f := newAuthzFixture(t)
+	var other schema.TokenResponse
+	f.mustDo(http.MethodPost, "/login", "", `{"username": "target"}`, &other)
+	otherStream := f.rt.hub.Subscribe(f.users["target"], other.SessionID)
+
+	refresh := func(token string) (int, schema.TokenResponse) {
+		var tokens schema.TokenResponse
+		w := f.do(http.MethodPost, "/token/refresh", "", fmt.Sprintf(`{"refreshToken": %q}`, token), nil)
+		if w.Code == http.StatusOK {
+			_ = json.Unmarshal(w.Body.Bytes(), &tokens)
+		} else {
+			var body struct {
+				Error struct {
+					Code string `json:"code"`
+				} `json:"error"`
+			}
+			_ = json.Unmarshal(w.Body.Bytes(), &body)
+			tokens.Token = body.Error.Code
+		}
+		return w.Code, tokens
+	}
+
+	first := f.refresh["target"]
+	code, second := refresh(first)
+	if code != http.StatusOK || second.SessionID == other.SessionID {
+		t.Fatalf("refreshing: got %d for session %q", code, second.SessionID)
+	}
+	stream := f.rt.hub.Subscribe(f.users["target"], second.SessionID)
+	code, third := refresh(second.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refreshing again: got %d", code)
+	}
+
+	if code, reply := refresh(first); code != http.StatusUnauthorized || reply.Token != "refresh_token_reused" {
+		t.Fatalf("reusing the first refresh token: got %d %q, want %d refresh_token_reused", code, reply.Token, http.StatusUnauthorized)
+	}
+	for name, token := range map[string]string{"second": second.RefreshToken, "latest": third.RefreshToken} {
+		if code, _ := refresh(token); code != http.StatusUnauthorized {
+			t.Errorf("refreshing with the %s refresh token of the closed session: got %d, want %d", name, code, http.StatusUnauthorized)
+		}
+	}
+	for name, token := range map[string]string{"first": f.tokens["target"], "latest": third.Token} {
+		if w := f.do(http.MethodGet, "/user/sessions", token, "", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("the %s access token of the closed session: got %d, want %d", name, w.Code, http.StatusUnauthorized)
+		}
+	}
+	select {
+	case _, open := <-stream.Events():
+		if open || !stream.SignedOut() {
+			t.Errorf("the event stream of the closed session was not signed out")
+		}
+	default:
+		t.Errorf("the event stream of the closed session is still open")
+	}
+
+	// the other session of the user is not part of the family
+	if w := f.do(http.MethodGet, "/user/sessions", other.Token, "", nil); w.Code != http.StatusOK {
+		t.Errorf("the access token of the other session: got %d, want %d", w.Code, http.StatusOK)
+	}
+	if code, _ := refresh(other.RefreshToken); code != http.StatusOK {
+		t.Errorf("refreshing the other session: got %d, want %d", code, http.StatusOK)
+	}
+	select {
+	case _, open := <-otherStream.Events():
+		if !open {
+			t.Errorf("the event stream of the other session was closed")
+		}
+	default:
+	}
+}
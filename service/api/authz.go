@@ -0,0 +1,155 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dilcetto/wasa/service/blobstore"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/database"
+)
+
+var ErrForbidden = errors.New("forbidden")
+
+// errReplyNotFound is returned by authorizer.NewMessage when the replied message is not in the conversation.
+var errReplyNotFound = errors.New("replied message not found in the conversation")
+
+// authorizer checks the rights of an authenticated user on conversations, groups and messages. Every handler that
+// works on an existing conversation asks the authorizer first, so membership rules live in a single place.
+//
+// All methods return nil when the access is allowed, one of the schema.Err*DoesNotExist errors when the resource does
+// not exist, or ErrForbidden when the resource exists but the user has no rights on it.
+type authorizer struct {
+	db database.AppDatabase
+}
+
+// Conversation checks that userID is a member of the conversation.
+func (a authorizer) Conversation(ctx context.Context, userID, conversationID string) error {
+	if _, err := a.db.GetConversationType(ctx, conversationID); err != nil {
+		return err
+	}
+	isMember, err := a.db.IsConversationMember(ctx, conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// NewMessage checks that userID can send a message to the conversation in reply to replyTo, if not empty. Replies can
+// only answer a message of the same conversation; errReplyNotFound is returned otherwise.
+func (a authorizer) NewMessage(ctx context.Context, userID, conversationID, replyTo string) error {
+	if err := a.Conversation(ctx, userID, conversationID); err != nil {
+		return err
+	}
+	if replyTo == "" {
+		return nil
+	}
+	if err := a.Message(ctx, userID, conversationID, replyTo); errors.Is(err, schema.ErrMessageDoesNotExist) {
+		return errReplyNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Group checks that groupID is a group conversation and that userID is one of its members.
+func (a authorizer) Group(ctx context.Context, userID, groupID string) error {
+	convType, err := a.db.GetConversationType(ctx, groupID)
+	if errors.Is(err, schema.ErrConversationDoesNotExist) || (err == nil && convType != "group") {
+		return schema.ErrGroupDoesNotExist
+	} else if err != nil {
+		return err
+	}
+	isMember, err := a.db.IsConversationMember(ctx, groupID, userID)
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// GroupRole checks that userID is a member of the group with at least minRole, and returns the user's actual role.
+func (a authorizer) GroupRole(ctx context.Context, userID, groupID, minRole string) (string, error) {
+	if err := a.Group(ctx, userID, groupID); err != nil {
+		return "", err
+	}
+	role, err := a.db.GetMemberRole(ctx, groupID, userID)
+	if err != nil {
+		return "", err
+	}
+	if roleRank(role) < roleRank(minRole) {
+		return role, ErrForbidden
+	}
+	return role, nil
+}
+
+// Blob checks that userID can see something that references the blob, see database.AppDatabase.CanSeeBlob. Blobs
+// the user cannot see are reported as missing, so that their content cannot be probed by hash.
+func (a authorizer) Blob(ctx context.Context, userID, blobID string) error {
+	visible, err := a.db.CanSeeBlob(ctx, userID, blobID)
+	if err != nil {
+		return err
+	}
+	if !visible {
+		return blobstore.ErrBlobNotFound
+	}
+	return nil
+}
+
+// roleRank orders group roles by power, so that roles can be compared.
+func roleRank(role string) int {
+	switch role {
+	case schema.RoleOwner:
+		return 3
+	case schema.RoleAdmin:
+		return 2
+	case schema.RoleMember:
+		return 1
+	}
+	return 0
+}
+
+// Message checks that userID is a member of the conversation and that the message belongs to it. A message that
+// lives in another conversation is reported as missing, so message IDs do not leak across conversations.
+func (a authorizer) Message(ctx context.Context, userID, conversationID, messageID string) error {
+	if err := a.Conversation(ctx, userID, conversationID); err != nil {
+		return err
+	}
+	msgConversationID, err := a.db.GetMessageConversationID(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if msgConversationID != conversationID {
+		return schema.ErrMessageDoesNotExist
+	}
+	return nil
+}
+
+// DeleteMessage checks that userID can delete a message for everyone: its sender can, and so can the admins and the
+// owner of a group.
+func (a authorizer) DeleteMessage(ctx context.Context, userID, conversationID, messageID string) error {
+	if err := a.Message(ctx, userID, conversationID, messageID); err != nil {
+		return err
+	}
+	message, err := a.db.GetMessageByID(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if message.SenderID == userID {
+		return nil
+	}
+	convType, err := a.db.GetConversationType(ctx, conversationID)
+	if err != nil {
+		return err
+	}
+	if convType != "group" {
+		return ErrForbidden
+	}
+	_, err = a.GroupRole(ctx, userID, conversationID, schema.RoleAdmin)
+	return err
+}
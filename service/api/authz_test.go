@@ -0,0 +1,342 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dilcetto/wasa/service/blobstore"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/database"
+	"github.com/dilcetto/wasa/service/webauthn"
+	"github.com/sirupsen/logrus"
+)
+
+// The roles of the callers in the group of an authzFixture.
+const (
+	roleMember    = "member"
+	roleNonMember = "non-member"
+	roleKicked    = "kicked member"
+	roleAdmin     = "admin"
+)
+
+var authzRoles = []string{roleMember, roleNonMember, roleKicked, roleAdmin}
+
+// authzFixture is a server with a group and its content. The admin owns the group, the member sent its message and
+// owns the scheduled message, the upload, the session and the passkey of the fixture, and both reacted to the message.
+// The kicked member was removed from the group by the admin, and the non-member never was in it. The target is another
+// member of the group.
+type authzFixture struct {
+	t       *testing.T
+	rt      *_router
+	handler http.Handler
+	db      database.AppDatabase
+
+	// tokens and refresh are the tokens of the session of each role, users their user IDs
+	tokens  map[string]string
+	refresh map[string]string
+	users   map[string]string
+
+	// params are the values of the path parameters of the routes, and of the {placeholders} of the request bodies
+	params map[string]string
+}
+
+// newTestRouter returns a router on a new database and blob store, closed at the end of the test.
+func newTestRouter(t *testing.T) (*_router, database.AppDatabase) {
+	t.Helper()
+	conn, err := sql.Open(database.DriverName, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	db, err := database.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := blobstore.NewFilesystem(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	router, err := New(Config{
+		Logger:    logger,
+		Database:  db,
+		BlobStore: blobs,
+		Tokens:    TokenConfig{Keys: map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")}, ActiveKey: "k1"},
+		Passkeys:  webauthn.RelyingParty{ID: "localhost", Name: "WASAText", Origins: []string{"http://localhost"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = router.Close() })
+	return router.(*_router), db
+}
+
+func newAuthzFixture(t *testing.T) *authzFixture {
+	t.Helper()
+	rt, db := newTestRouter(t)
+	f := &authzFixture{
+		t:       t,
+		rt:      rt,
+		handler: rt.Handler(),
+		db:      db,
+		tokens:  make(map[string]string),
+		refresh: make(map[string]string),
+		users:   make(map[string]string),
+		params:  make(map[string]string),
+	}
+	for _, role := range append(authzRoles, "target") {
+		var login schema.LoginResponse
+		f.mustDo(http.MethodPost, "/login", "", fmt.Sprintf(`{"username": %q}`, strings.ReplaceAll(role, " ", "")), &login)
+		f.tokens[role], f.refresh[role], f.users[role] = login.Token, login.RefreshToken, login.ID
+		if role == roleMember {
+			f.params["sessionId"] = login.SessionID
+		}
+	}
+	f.params["userId"] = f.users["target"]
+
+	var group schema.Conversation
+	f.mustDo(http.MethodPost, "/groups", f.tokens[roleAdmin], fmt.Sprintf(`{"groupName": "group", "members": [%q, %q, %q]}`,
+		f.users[roleMember], f.users[roleKicked], f.users["target"]), &group)
+	f.params["conversationId"], f.params["groupId"] = group.ConversationID, group.ConversationID
+	f.mustDo(http.MethodDelete, "/groups/"+group.ConversationID+"/members/"+f.users[roleKicked], f.tokens[roleAdmin], "", nil)
+
+	var message schema.Message
+	f.mustDo(http.MethodPost, "/conversations/"+group.ConversationID+"/messages", f.tokens[roleMember], fmt.Sprintf(
+		`{"content": {"type": "text", "value": %q}, "attachments": [{"kind": "file", "mimeType": "text/plain", "filename": "a.txt", "data": %q}]}`,
+		base64.StdEncoding.EncodeToString([]byte("hello")), base64.StdEncoding.EncodeToString([]byte("attachment"))), &message)
+	f.params["messageId"], f.params["blobId"] = message.ID, message.Attachments[0].BlobID
+	for _, role := range []string{roleMember, roleAdmin} {
+		f.mustDo(http.MethodPost, "/conversations/"+group.ConversationID+"/messages/"+message.ID+"/comment", f.tokens[role],
+			fmt.Sprintf(`{"conversation_id": %q, "message_id": %q, "emoji": "🎉"}`, group.ConversationID, message.ID), nil)
+	}
+
+	var scheduled schema.ScheduledMessage
+	f.mustDo(http.MethodPost, "/conversations/"+group.ConversationID+"/scheduled-messages", f.tokens[roleMember], fmt.Sprintf(
+		`{"content": {"type": "text", "value": %q}, "sendAt": %q}`,
+		base64.StdEncoding.EncodeToString([]byte("later")), time.Now().Add(time.Hour).UTC().Format(time.RFC3339)), &scheduled)
+	f.params["scheduledId"] = scheduled.ID
+
+	var upload schema.Upload
+	f.mustDo(http.MethodPost, "/uploads", f.tokens[roleMember], `{"length": 4, "filename": "a.txt", "kind": "file"}`, &upload)
+	f.params["uploadId"] = upload.ID
+
+	f.params["passkeyId"] = "passkey"
+	if err := db.CreatePasskey(context.Background(), &schema.Passkey{ID: "passkey", UserID: f.users[roleMember], Name: "key", PublicKey: []byte{0xa0}, CreatedAt: time.Now().UTC().Format(time.RFC3339)}); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// do sends a request with the access token, when not empty, and returns the response.
+func (f *authzFixture) do(method, path, token, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	f.handler.ServeHTTP(w, r)
+	return w
+}
+
+// mustDo sends a request that must succeed, and decodes its response into out when not nil.
+func (f *authzFixture) mustDo(method, path, token, body string, out interface{}) []byte {
+	f.t.Helper()
+	w := f.do(method, path, token, body, nil)
+	if w.Code >= 300 {
+		f.t.Fatalf("%s %s: %d %s", method, path, w.Code, w.Body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			f.t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return w.Body.Bytes()
+}
+
+var (
+	routeParam  = regexp.MustCompile(`:([A-Za-z]+)`)
+	placeholder = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+)
+
+// expand replaces the parameters of a route, and the placeholders of a body, with the values of the fixture.
+func (f *authzFixture) expand(re *regexp.Regexp, s string) string {
+	return re.ReplaceAllStringFunc(s, func(m string) string {
+		return f.params[re.FindStringSubmatch(m)[1]]
+	})
+}
+
+// authzStatus is the status expected from a route for each role.
+type authzStatus struct {
+	member, nonMember, kicked, admin int
+}
+
+func (s authzStatus) of(role string) int {
+	switch role {
+	case roleMember:
+		return s.member
+	case roleNonMember:
+		return s.nonMember
+	case roleKicked:
+		return s.kicked
+	}
+	return s.admin
+}
+
+// anyone is the status of a route that does not depend on the group.
+func anyone(status int) authzStatus {
+	return authzStatus{status, status, status, status}
+}
+
+// membersOnly is the status of a route for the members of the group: the others are forbidden.
+func membersOnly(status int) authzStatus {
+	return authzStatus{status, http.StatusForbidden, http.StatusForbidden, status}
+}
+
+// authzRoutes are the routes of Handler, with a valid request for the member or the admin, and the status each role
+// gets with it.
+var authzRoutes = []struct {
+	method, route string
+	body          string
+	headers       map[string]string
+	want          authzStatus
+}{
+	// auth
+	{http.MethodPost, "/login", `{"username": "someone"}`, nil, anyone(http.StatusCreated)},
+	{http.MethodPost, "/register", `{"username": "newuser", "password": "correct horse battery"}`, nil, anyone(http.StatusCreated)},
+	{http.MethodPost, "/login/passkey/options", `{}`, nil, anyone(http.StatusOK)},
+	{http.MethodPost, "/login/passkey", `{}`, nil, anyone(http.StatusUnprocessableEntity)},
+	{http.MethodPost, "/token/refresh", `{"refreshToken": "{refreshToken}"}`, nil, anyone(http.StatusOK)},
+	{http.MethodPost, "/logout", ``, nil, anyone(http.StatusNoContent)},
+	{http.MethodPost, "/logout-all", ``, nil, anyone(http.StatusNoContent)},
+
+	// profile: the sessions, passkeys and uploads of the fixture are the member's
+	{http.MethodGet, "/searchby?user=target", ``, nil, anyone(http.StatusOK)},
+	{http.MethodGet, "/search/messages?q=hello", ``, nil, anyone(http.StatusOK)},
+	{http.MethodPut, "/user/username", `{"username": "renamed"}`, nil, anyone(http.StatusNoContent)},
+	{http.MethodPut, "/user/photo", `{"photo": ""}`, nil, anyone(http.StatusBadRequest)},
+	{http.MethodGet, "/user/sessions", ``, nil, anyone(http.StatusOK)},
+	{http.MethodDelete, "/user/sessions/:sessionId", ``, nil, authzStatus{http.StatusNoContent, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound}},
+	{http.MethodPut, "/user/password", `{"password": "correct horse battery"}`, nil, anyone(http.StatusNoContent)},
+	{http.MethodGet, "/user/passkeys", ``, nil, anyone(http.StatusOK)},
+	{http.MethodPost, "/user/passkeys/options", `{}`, nil, anyone(http.StatusOK)},
+	{http.MethodPost, "/user/passkeys", `{}`, nil, anyone(http.StatusUnprocessableEntity)},
+	{http.MethodDelete, "/user/passkeys/:passkeyId", ``, nil, authzStatus{http.StatusNoContent, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound}},
+
+	// conversations and messages
+	{http.MethodGet, "/conversations", ``, nil, anyone(http.StatusOK)},
+	{http.MethodGet, "/conversations/:conversationId", ``, nil, membersOnly(http.StatusOK)},
+	{http.MethodGet, "/conversations/:conversationId/members", ``, nil, membersOnly(http.StatusOK)},
+	{http.MethodGet, "/conversations/:conversationId/messages", ``, nil, membersOnly(http.StatusOK)},
+	{http.MethodPost, "/conversations/:conversationId/read", `{"messageId": "{messageId}"}`, nil, membersOnly(http.StatusNoContent)},
+	{http.MethodPut, "/conversations/:conversationId/settings", `{"messageTtl": 3600}`, nil, membersOnly(http.StatusOK)},
+	{http.MethodPost, "/conversations/:conversationId/scheduled-messages", `{"content": {"type": "text", "value": "aGk="}, "sendAt": "{sendAt}"}`, nil, membersOnly(http.StatusCreated)},
+	{http.MethodGet, "/conversations/:conversationId/scheduled-messages", ``, nil, membersOnly(http.StatusOK)},
+	{http.MethodPut, "/conversations/:conversationId/scheduled-messages/:scheduledId", `{"content": {"type": "text", "value": "aGk="}, "sendAt": "{sendAt}"}`, nil, authzStatus{http.StatusOK, http.StatusForbidden, http.StatusForbidden, http.StatusNotFound}},
+	{http.MethodDelete, "/conversations/:conversationId/scheduled-messages/:scheduledId", ``, nil, authzStatus{http.StatusNoContent, http.StatusForbidden, http.StatusForbidden, http.StatusNotFound}},
+	{http.MethodPost, "/conversations/:conversationId/messages", `{"content": {"type": "text", "value": "aGk="}}`, nil, membersOnly(http.StatusCreated)},
+	{http.MethodPost, "/conversations/:conversationId/messages/:messageId/forward", `{"targetConversationId": "{conversationId}"}`, nil, membersOnly(http.StatusCreated)},
+	{http.MethodPut, "/conversations/:conversationId/messages/:messageId", `{"content": {"type": "text", "value": "aGk="}}`, nil, authzStatus{http.StatusOK, http.StatusForbidden, http.StatusForbidden, http.StatusForbidden}},
+	{http.MethodDelete, "/conversations/:conversationId/messages/:messageId", ``, nil, membersOnly(http.StatusNoContent)},
+	{http.MethodGet, "/conversations/:conversationId/messages/:messageId/history", ``, nil, membersOnly(http.StatusOK)},
+	{http.MethodGet, "/conversations/:conversationId/messages/:messageId/replies", ``, nil, membersOnly(http.StatusOK)},
+	{http.MethodPost, "/conversations/:conversationId/messages/:messageId/status", `{"status": "read"}`, nil, membersOnly(http.StatusNoContent)},
+	{http.MethodGet, "/conversations/:conversationId/messages/:messageId/receipts", ``, nil, authzStatus{http.StatusOK, http.StatusForbidden, http.StatusForbidden, http.StatusForbidden}},
+	{http.MethodPost, "/conversations/:conversationId/messages/:messageId/comment", `{"conversation_id": "{conversationId}", "message_id": "{messageId}", "emoji": "👍"}`, nil, membersOnly(http.StatusNoContent)},
+	{http.MethodDelete, "/conversations/:conversationId/messages/:messageId/comment", `{"conversation_id": "{conversationId}", "message_id": "{messageId}"}`, nil, membersOnly(http.StatusNoContent)},
+	{http.MethodPost, "/direct-conversations", `{"peerUserId": "{userId}"}`, nil, anyone(http.StatusCreated)},
+
+	// groups: the target of the member routes is another member
+	{http.MethodPost, "/groups", `{"groupName": "other group", "members": ["{userId}"]}`, nil, anyone(http.StatusCreated)},
+	{http.MethodPost, "/groups/:groupId", `{"username": "non-member"}`, nil, authzStatus{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusNoContent}},
+	{http.MethodDelete, "/groups/:groupId", ``, nil, membersOnly(http.StatusOK)},
+	{http.MethodPut, "/groups/:groupId/name", `{"newName": "renamed"}`, nil, authzStatus{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusOK}},
+	{http.MethodPut, "/groups/:groupId/photo", `{"groupPhoto": ""}`, nil, authzStatus{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusBadRequest}},
+	{http.MethodPut, "/groups/:groupId/slow-mode", `{"slowMode": 60}`, nil, authzStatus{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusOK}},
+	{http.MethodDelete, "/groups/:groupId/members/:userId", ``, nil, authzStatus{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusNoContent}},
+	{http.MethodPost, "/groups/:groupId/members/:userId/promote", ``, nil, authzStatus{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusOK}},
+	{http.MethodPost, "/groups/:groupId/members/:userId/demote", ``, nil, authzStatus{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusOK}},
+	{http.MethodPost, "/groups/:groupId/members/:userId/ownership", ``, nil, authzStatus{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusOK}},
+
+	// real-time events need a WebSocket, which the recorder cannot upgrade to
+	{http.MethodGet, "/events", ``, nil, anyone(http.StatusBadRequest)},
+
+	// media: the blob is an attachment of the message, the upload is the member's
+	{http.MethodGet, "/media/:blobId", ``, nil, authzStatus{http.StatusOK, http.StatusNotFound, http.StatusNotFound, http.StatusOK}},
+	{http.MethodPost, "/uploads", `{"length": 4, "filename": "b.txt", "kind": "file"}`, nil, anyone(http.StatusCreated)},
+	{http.MethodGet, "/uploads/:uploadId", ``, nil, authzStatus{http.StatusOK, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound}},
+	{http.MethodHead, "/uploads/:uploadId", ``, nil, authzStatus{http.StatusOK, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound}},
+	{http.MethodPatch, "/uploads/:uploadId", `data`, map[string]string{"Content-Type": chunkContentType, "Upload-Offset": "0"}, authzStatus{http.StatusNoContent, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound}},
+	{http.MethodPost, "/uploads/:uploadId/finalize", ``, nil, authzStatus{http.StatusConflict, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound}},
+	{http.MethodDelete, "/uploads/:uploadId", ``, nil, authzStatus{http.StatusNoContent, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound}},
+}
+
+// TestAuthz sends a request to every route as each role, on a new fixture each time, and checks the status.
+func TestAuthz(t *testing.T) {
+	for _, route := range authzRoutes {
+		route := route
+		t.Run(route.method+" "+route.route, func(t *testing.T) {
+			t.Parallel()
+			for _, role := range authzRoles {
+				f := newAuthzFixture(t)
+				f.params["refreshToken"] = f.refresh[role]
+				f.params["sendAt"] = time.Now().Add(2 * time.Hour).UTC().Format(time.RFC3339)
+				w := f.do(route.method, f.expand(routeParam, route.route), f.tokens[role], f.expand(placeholder, route.body), route.headers)
+				if want := route.want.of(role); w.Code != want {
+					t.Errorf("%s: got %d, want %d: %s", role, w.Code, want, bytes.TrimSpace(w.Body.Bytes()))
+				}
+			}
+		})
+	}
+}
+
+// TestAuthzCoversEveryRoute checks that every route registered by Handler is in authzRoutes.
+func TestAuthzCoversEveryRoute(t *testing.T) {
+	rt, _ := newTestRouter(t)
+	rt.Handler()
+	tested := make(map[string]bool)
+	for _, route := range authzRoutes {
+		tested[route.method+" "+strings.SplitN(route.route, "?", 2)[0]] = true
+	}
+	if len(rt.routes) == 0 {
+		t.Fatal("no route registered")
+	}
+	for _, route := range rt.routes {
+		if !tested[route] {
+			t.Errorf("route %s is not tested", route)
+		}
+	}
+}
+
+// TestSearchConversations checks that searches need a login, and only find the conversations of the caller.
+func TestSearchConversations(t *testing.T) {
+	f := newAuthzFixture(t)
+	if w := f.do(http.MethodGet, "/searchby?conversation=gro", "", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous search: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	for role, want := range map[string]int{roleMember: 1, roleAdmin: 1, roleNonMember: 0, roleKicked: 0} {
+		var found struct {
+			Conversations []schema.Conversation `json:"conversations"`
+		}
+		f.mustDo(http.MethodGet, "/searchby?conversation=gro", f.tokens[role], "", &found)
+		if len(found.Conversations) != want {
+			t.Errorf("%s found %d conversations, want %d", role, len(found.Conversations), want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/events"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// minMessageTTL is the shortest lifetime of disappearing messages
+	minMessageTTL = time.Minute
+
+	// maxMessageTTL is the longest lifetime of disappearing messages
+	maxMessageTTL = 365 * 24 * time.Hour
+)
+
+// conversationSettings are the settings of a conversation that any member can change.
+type conversationSettings struct {
+	// MessageTTL is the lifetime of the new messages in seconds, 0 if they never expire
+	MessageTTL int `json:"messageTtl"`
+}
+
+// setConversationSettings changes the settings of a conversation. Disappearing messages only apply to the messages sent
+// after they are enabled, and messages that already disappear keep their expiry time when the lifetime changes.
+func (rt *_router) setConversationSettings(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationID := ps.ByName("conversationId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var settings conversationSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	ttl := time.Duration(settings.MessageTTL) * time.Second
+	if settings.MessageTTL != 0 && (ttl < minMessageTTL || ttl > maxMessageTTL) {
+		writeError(w, ctx, http.StatusBadRequest, "Message lifetime must be 0, or between 1 minute and 365 days")
+		return
+	}
+
+	if err := rt.authz.Conversation(r.Context(), userID, conversationID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if err := rt.db.SetConversationMessageTTL(r.Context(), conversationID, ttl); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	rt.publish(ctx, conversationID, events.ConversationUpdated, events.SettingsData{
+		UserID:     userID,
+		MessageTTL: settings.MessageTTL,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(settings)
+}
@@ -1,28 +1,38 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
-	"time"
+	"strconv"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/dilcetto/wasa/service/api/reqcontext"
 	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/database"
+	"github.com/dilcetto/wasa/service/events"
 	"github.com/julienschmidt/httprouter"
 )
 
+const (
+	// defaultMessagePageSize is the number of messages returned when the client does not ask for a limit
+	defaultMessagePageSize = 50
+
+	// maxMessagePageSize is the largest page of messages a client can ask for
+	maxMessagePageSize = 100
+)
+
 func (rt *_router) getMyConversations(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
 	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	conversations, err := rt.db.GetMyConversations(userID)
+	conversations, err := rt.db.GetMyConversations(r.Context(), userID)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to get conversations")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -35,35 +45,42 @@ func (rt *_router) getMyConversations(w http.ResponseWriter, r *http.Request, _
 func (rt *_router) getConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	conversationID := ps.ByName("conversationId")
 	if conversationID == "" {
-		http.Error(w, "Missing conversation ID", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Missing conversation ID")
 		return
 	}
 
 	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := rt.authz.Conversation(r.Context(), userID, conversationID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
 
-	conversation, err := rt.db.GetConversationByID(userID, conversationID)
+	conversation, err := rt.db.GetConversationByID(r.Context(), userID, conversationID)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to get conversation")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
 
-	messages, err := rt.db.GetMessagesByConversationID(conversationID)
+	// only the newest page is embedded: older messages are loaded with getConversationMessages
+	page, err := rt.db.GetMessagesPage(r.Context(), conversationID, userID, "", "", defaultMessagePageSize)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to get messages")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
 
-	conversation.Messages = messages
-	for _, msg := range messages {
-		if err := rt.db.MarkMessageStatus(msg.ID, userID, "delivered"); err != nil {
-			ctx.Logger.WithError(err).WithField("message_id", msg.ID).Error("Failed to mark message as delivered")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	conversation.Messages = page.Messages
+	conversation.MessagesCursor = page.OlderCursor
+	for _, msg := range page.Messages {
+		if msg.SenderID == userID {
+			continue
+		}
+		if err := rt.db.MarkMessageStatus(r.Context(), msg.ID, userID, "delivered"); err != nil {
+			writeMappedError(w, ctx, err)
 			return
 		}
 	}
@@ -75,25 +92,72 @@ func (rt *_router) getConversation(w http.ResponseWriter, r *http.Request, ps ht
 	}
 }
 
+// getConversationMessages returns a page of the conversation timeline. Without cursors the newest messages are
+// returned; `before` and `after` take the cursors of a previous page to move to older or newer messages.
+func (rt *_router) getConversationMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationID := ps.ByName("conversationId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := rt.authz.Conversation(r.Context(), userID, conversationID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	query := r.URL.Query()
+	before, after := query.Get("before"), query.Get("after")
+	if before != "" && after != "" {
+		writeError(w, ctx, http.StatusBadRequest, "Only one of before and after can be set")
+		return
+	}
+	limit := defaultMessagePageSize
+	if l := query.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxMessagePageSize {
+			writeError(w, ctx, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	page, err := rt.db.GetMessagesPage(r.Context(), conversationID, userID, before, after, limit)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(page)
+}
+
 // createDirectConversation ensures a direct conversation exists between the authenticated user and the specified peer
 // and returns the conversation.
 func (rt *_router) createDirectConversation(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
 	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 	var body struct {
 		PeerUserID string `json:"peerUserId"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.PeerUserID == "" {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if body.PeerUserID == userID {
+		writeError(w, ctx, http.StatusUnprocessableEntity, "Cannot start a direct conversation with yourself")
+		return
+	}
+	if _, err := rt.db.GetUserById(r.Context(), body.PeerUserID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
-	conv, err := rt.db.EnsureDirectConversation(userID, body.PeerUserID)
+	conv, err := rt.db.EnsureDirectConversation(r.Context(), userID, body.PeerUserID)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to ensure direct conversation")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -104,25 +168,24 @@ func (rt *_router) createDirectConversation(w http.ResponseWriter, r *http.Reque
 func (rt *_router) getConversationMembers(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	conversationID := ps.ByName("conversationId")
 	if conversationID == "" {
-		http.Error(w, "Missing conversation ID", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Missing conversation ID")
 		return
 	}
 
 	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	if _, err := rt.db.GetConversationByID(userID, conversationID); err != nil {
-		http.Error(w, "Conversation not found", http.StatusNotFound)
+	if err := rt.authz.Conversation(r.Context(), userID, conversationID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
 
-	members, err := rt.db.GetConversationMembers(conversationID)
+	members, err := rt.db.GetConversationMembers(r.Context(), conversationID)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to get conversation members")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
 
@@ -133,55 +196,78 @@ func (rt *_router) getConversationMembers(w http.ResponseWriter, r *http.Request
 func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	conversationID := ps.ByName("conversationId")
 	if conversationID == "" {
-		http.Error(w, "Missing conversation ID", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Missing conversation ID")
 		return
 	}
 
 	var message schema.Message
-	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+	if isMultipart(r) {
+		if !decodeMultipartMessage(w, r, ctx, &message) {
+			return
+		}
+		defer func() { _ = r.MultipartForm.RemoveAll() }()
+	} else if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
 		ctx.Logger.WithError(err).Error("Failed to decode message")
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	if len(message.Content.Value) == 0 && len(message.Attachments) == 0 {
+		writeError(w, ctx, http.StatusBadRequest, "Missing message content")
 		return
 	}
 
 	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	message.Quote = nil
+	if err := rt.authz.NewMessage(r.Context(), userID, conversationID, message.ReplyTo); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	turn, err := rt.takeSlowModeTurn(w, r, userID, conversationID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
+	defer turn.release()
 
 	messageID, err := generateNewID()
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to generate message ID")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
+		return
+	}
+	message.Attachments, err = rt.storeAttachments(r.Context(), userID, message.Attachments)
+	if err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
+	message.AttachmentIDs = nil
+
 	message.ID = messageID
 	message.SenderID = userID
 	message.ConversationID = conversationID
-	message.Timestamp = time.Now().Format(time.RFC3339)
-	message.MessageStatus = "sent"
-
-	if err := rt.db.SendMessage(&message); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to send message")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	stored, err := postMessage(r.Context(), rt.db, &message)
+	if err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
+	turn.use()
 	// Return 201
-	stored, gerr := rt.db.GetMessageByID(messageID)
-	if gerr != nil {
-		w.WriteHeader(http.StatusCreated)
-		return
-	}
+	messagesSent.With(messageSourceSent).Inc()
+	rt.publish(ctx, conversationID, events.MessageCreated, stored)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	_ = json.NewEncoder(w).Encode(stored)
 }
 
 func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationID := ps.ByName("conversationId")
 	messageID := ps.ByName("messageId")
-	if messageID == "" {
-		http.Error(w, "Missing message ID", http.StatusBadRequest)
+	if conversationID == "" || messageID == "" {
+		writeError(w, ctx, http.StatusBadRequest, "Missing conversation or message ID")
 		return
 	}
 
@@ -190,111 +276,194 @@ func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps htt
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		ctx.Logger.WithError(err).Error("Failed to decode forward message request")
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
 	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	targetConv := body.TargetConversationId
+	if targetConv == "" {
+		writeError(w, ctx, http.StatusBadRequest, "Missing target conversation id")
 		return
 	}
 
-	// Fetch the original message
-	originalMessage, err := rt.db.GetMessageByID(messageID)
+	// the caller must be able to read the original message and to write into the target conversation
+	if err := rt.authz.Message(r.Context(), userID, conversationID, messageID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if err := rt.authz.Conversation(r.Context(), userID, targetConv); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	turn, err := rt.takeSlowModeTurn(w, r, userID, targetConv)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to fetch original message")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
+	defer turn.release()
 
 	// Generate new message ID
 	newMessageID, err := generateNewID()
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to generate new message ID")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
 
-	// Create the forwarded message
-	targetConv := body.TargetConversationId
-	if targetConv == "" {
-		http.Error(w, "Missing target conversation id", http.StatusBadRequest)
+	// Copy the original message and load the copy back atomically, so the original cannot be deleted half-way
+	var stored *schema.Message
+	err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		originalMessage, err := tx.GetMessageByID(r.Context(), messageID)
+		if err != nil {
+			return err
+		}
+		if originalMessage.DeletedAt != "" {
+			return schema.ErrMessageDeleted
+		}
+
+		// Create the forwarded message
+		forwardedMessage := schema.Message{
+			ID:             newMessageID,
+			SenderID:       userID,
+			Sender:         originalMessage.Sender,
+			ConversationID: targetConv,
+			MessageType:    originalMessage.MessageType,
+			Content:        originalMessage.Content,
+			Timestamp:      generateCurrentTimestamp(),
+			MessageStatus:  "sent",
+			Reaction:       []schema.Reaction{},
+			Attachments:    originalMessage.Attachments,
+			ForwardedFrom:  originalMessage.ID,
+		}
+		if err := tx.ForwardMessage(r.Context(), &forwardedMessage, userID); err != nil {
+			return err
+		}
+		stored, err = tx.GetMessageByID(r.Context(), newMessageID)
+		return err
+	})
+	if err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
+	turn.use()
+
+	// Return 201 with the new message
+	messagesSent.With(messageSourceForwarded).Inc()
+	rt.publish(ctx, targetConv, events.MessageCreated, stored)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(stored)
+}
 
-	forwardedMessage := schema.Message{
-		ID:             newMessageID,
-		SenderID:       userID,
-		Sender:         originalMessage.Sender,
-		ConversationID: targetConv,
-		MessageType:    originalMessage.MessageType,
-		Content:        originalMessage.Content,
-		Timestamp:      time.Now().Format(time.RFC3339),
-		MessageStatus:  "sent",
-		Reaction:       []schema.Reaction{},
-		Attachments:    originalMessage.Attachments,
-		ForwardedFrom:  originalMessage.ID,
+// getMessageReplies lists the messages that reply to a message, in chronological order.
+func (rt *_router) getMessageReplies(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
 	}
 
-	// Persist forwarded message
-	if err := rt.db.ForwardMessage(&forwardedMessage, userID); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to send forwarded message")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	if err := rt.authz.Message(r.Context(), userID, conversationID, messageID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
 
-	// Return 201 with the new message
-	stored, gerr := rt.db.GetMessageByID(newMessageID)
-	if gerr != nil {
-		w.WriteHeader(http.StatusCreated)
+	replies, err := rt.db.GetMessageReplies(r.Context(), messageID, userID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	_ = json.NewEncoder(w).Encode(stored)
+	_ = json.NewEncoder(w).Encode(replies)
 }
 
+// deleteMessage deletes a message. With `for=me`, any member hides the message from their own timeline only. With
+// `for=everyone`, the default, the sender or a group admin replaces the message with a tombstone that every member
+// sees as deleted, and that keeps its place in the timeline and in the replies to it.
 func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	conversationID := ps.ByName("conversationId")
 	messageID := ps.ByName("messageId")
 	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	err = rt.db.DeleteMessage(conversationID, messageID, userID)
-	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to delete message")
-		ctx.Logger.WithFields(logrus.Fields{
-			"conversation_id": conversationID,
-			"message_id":      messageID,
-			"user_id":         userID,
-		}).Error("Failed to delete message")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	scope := r.URL.Query().Get("for")
+	if scope == "" {
+		scope = "everyone"
+	}
+	if scope != "me" && scope != "everyone" {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid deletion scope: use me or everyone")
 		return
 	}
-
-	w.WriteHeader(http.StatusNoContent)
-	ctx.Logger.WithFields(logrus.Fields{
+	logger := ctx.Logger.WithFields(logrus.Fields{
 		"conversation_id": conversationID,
 		"message_id":      messageID,
 		"user_id":         userID,
-	}).Info("Message deleted successfully")
+		"scope":           scope,
+	})
+
+	if scope == "me" {
+		if err := rt.authz.Message(r.Context(), userID, conversationID, messageID); err != nil {
+			writeMappedError(w, ctx, err)
+			return
+		}
+		if err := rt.db.HideMessage(r.Context(), messageID, userID, generateCurrentTimestamp()); err != nil {
+			writeMappedError(w, ctx, err)
+			return
+		}
+
+		// only the other sessions of the caller need to drop the message
+		rt.hub.Publish([]string{userID}, events.Event{
+			Type:           events.MessageHidden,
+			ConversationID: conversationID,
+			Timestamp:      generateCurrentTimestamp(),
+			Data:           events.MessageData{MessageID: messageID},
+		})
+		w.WriteHeader(http.StatusNoContent)
+		logger.Info("Message deleted successfully")
+		return
+	}
+
+	if err := rt.authz.DeleteMessage(r.Context(), userID, conversationID, messageID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if err := rt.db.DeleteMessage(r.Context(), messageID, generateCurrentTimestamp()); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	rt.publish(ctx, conversationID, events.MessageDeleted, events.MessageData{MessageID: messageID, Tombstone: true})
+	w.WriteHeader(http.StatusNoContent)
+	logger.Info("Message deleted successfully")
 }
 
 func (rt *_router) setMessageStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	conversationID := ps.ByName("conversationId")
 	messageID := ps.ByName("messageId")
 	if conversationID == "" || messageID == "" {
-		http.Error(w, "Missing conversation or message ID", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Missing conversation or message ID")
 		return
 	}
 
 	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := rt.authz.Message(r.Context(), userID, conversationID, messageID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
 
@@ -304,15 +473,111 @@ func (rt *_router) setMessageStatus(w http.ResponseWriter, r *http.Request, ps h
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		ctx.Logger.WithError(err).Error("Failed to decode message status request")
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Status != "delivered" && req.Status != "read" {
+		writeError(w, ctx, http.StatusBadRequest, "Status must be delivered or read")
+		return
+	}
+
+	message, err := rt.db.GetMessageByID(r.Context(), messageID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if err := rt.db.MarkMessageStatus(r.Context(), messageID, userID, req.Status); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	// Receipts only concern the sender, and the other devices of the caller
+	rt.publishTo(conversationID, events.ReceiptUpdated, events.ReceiptData{
+		MessageID: messageID,
+		UserID:    userID,
+		Status:    req.Status,
+	}, message.SenderID, userID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getMessageReceipts lists when the message was delivered to and read by each of its recipients. Only the sender can
+// see the receipts of a message; other members only get the aggregated status of the message.
+func (rt *_router) getMessageReceipts(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := rt.authz.Message(r.Context(), userID, conversationID, messageID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	message, err := rt.db.GetMessageByID(r.Context(), messageID)
+	if err == nil && message.SenderID != userID {
+		err = ErrForbidden
+	}
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	receipts, err := rt.db.GetMessageReceipts(r.Context(), messageID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(receipts)
+}
+
+// markConversationRead marks as read every message of the conversation up to the given one, and moves the read
+// watermark of the caller, which unread counters start from.
+func (rt *_router) markConversationRead(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationID := ps.ByName("conversationId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		MessageID string `json:"messageId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID == "" {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := rt.authz.Message(r.Context(), userID, conversationID, req.MessageID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
 
-	if err := rt.db.MarkMessageStatus(messageID, userID, req.Status); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to update message status")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	senders, err := rt.db.MarkConversationRead(r.Context(), conversationID, userID, req.MessageID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
+	// Only the senders of the messages that were just read, and the other devices of the caller, are notified
+	rt.publishTo(conversationID, events.ConversationRead, events.ReadData{
+		UserID:    userID,
+		MessageID: req.MessageID,
+	}, append(senders, userID)...)
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// postMessage stores a new message, sent now, and returns it as stored. Messages sent by users and scheduled messages
+// are all stored here.
+func postMessage(ctx context.Context, db database.AppDatabase, message *schema.Message) (*schema.Message, error) {
+	message.Timestamp = generateCurrentTimestamp()
+	message.MessageStatus = "sent"
+	if err := db.SendMessage(ctx, message); err != nil {
+		return nil, err
+	}
+	return db.GetMessageByID(ctx, message.ID)
+}
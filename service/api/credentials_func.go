@@ -0,0 +1,444 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/components/requests"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/globaltime"
+	"github.com/dilcetto/wasa/service/webauthn"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// challengeRegister and challengeLogin are the kinds of passkey challenges
+	challengeRegister = "register"
+	challengeLogin    = "login"
+
+	// maxPasskeyNameLength is the length of the longest passkey name accepted, in bytes
+	maxPasskeyNameLength = 64
+)
+
+// register creates an account with a password, and logs it in.
+func (rt *_router) register(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req requests.RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if !req.IsValid() {
+		writeError(w, ctx, http.StatusBadRequest, "Username must be between 3 and 16 letters, digits or underscores")
+		return
+	}
+	if len(req.DeviceLabel) > maxDeviceLabelLength {
+		writeError(w, ctx, http.StatusBadRequest, "Device label too long")
+		return
+	}
+
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	var photoID string
+	if len(req.Photo) > 0 {
+		if photoID, err = rt.storePhoto(r.Context(), req.Photo); err != nil {
+			writeMappedError(w, ctx, err)
+			return
+		}
+	}
+	user, err := rt.createUser(r.Context(), req.Username, passwordHash, photoID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	tokens, err := rt.openSession(r.Context(), user.ID, strings.TrimSpace(req.DeviceLabel), true)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(schema.LoginResponse{User: *user, TokenResponse: *tokens})
+}
+
+// setMyPassword sets the password of the caller, or changes it given the current one. The first credential of an
+// account is only set from a verified session, see checkFirstCredential. The other sessions of the user are closed.
+func (rt *_router) setMyPassword(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	session, err := rt.getAuthenticatedSession(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req requests.PasswordUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	current, err := rt.db.GetPasswordHash(r.Context(), session.UserID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if current != "" && !checkPassword(current, req.CurrentPassword) {
+		writeError(w, ctx, http.StatusForbidden, "Current password is incorrect")
+		return
+	} else if current == "" {
+		if _, err := rt.checkFirstCredential(r.Context(), session); err != nil {
+			writeMappedError(w, ctx, err)
+			return
+		}
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if err := rt.db.SetPasswordHash(r.Context(), session.UserID, hash); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if _, err := rt.db.DeleteUserSessions(r.Context(), session.UserID, session.ID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	rt.hub.DisconnectAll(session.UserID, session.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkFirstCredential reports whether the user of the session has no password and no passkey yet. It returns
+// errUnverifiedSession if so and the session was opened with the username only: anyone can open such a session in the
+// open login mode, or while legacy logins are allowed, so the first credential of an account comes from the session
+// that created it. The accounts created before sessions were verified get theirs from an operator, with
+// `webapi set-password`.
+func (rt *_router) checkFirstCredential(ctx context.Context, session *schema.Session) (bool, error) {
+	hash, err := rt.db.GetPasswordHash(ctx, session.UserID)
+	if err != nil {
+		return false, err
+	}
+	passkeys, err := rt.db.GetUserPasskeys(ctx, session.UserID)
+	if err != nil {
+		return false, err
+	}
+	first := hash == "" && len(passkeys) == 0
+	if first && !session.Verified {
+		return true, errUnverifiedSession
+	}
+	return first, nil
+}
+
+// passkeysEnabled replies with 404 when passkeys are not configured.
+func (rt *_router) passkeysEnabled(w http.ResponseWriter, ctx reqcontext.RequestContext) bool {
+	if rt.passkeys.ID == "" {
+		writeError(w, ctx, http.StatusNotFound, "Passkeys are not enabled")
+		return false
+	}
+	return true
+}
+
+// newChallenge creates and keeps a passkey challenge of the kind, for the user when not empty.
+func (rt *_router) newChallenge(r *http.Request, kind, userID string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	expiresAt := globaltime.Now().Add(webauthn.Timeout)
+	if err := rt.db.CreateChallenge(r.Context(), challenge, kind, userID, expiresAt); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// consumeChallenge uses the challenge that the client data was signed for, and returns it with its user.
+func (rt *_router) consumeChallenge(r *http.Request, clientDataJSON []byte, kind string) (string, string, error) {
+	challenge, err := webauthn.ChallengeOf(clientDataJSON)
+	if err != nil {
+		return "", "", err
+	}
+	userID, err := rt.db.ConsumeChallenge(r.Context(), challenge, kind, globaltime.Now())
+	if err != nil {
+		return "", "", err
+	}
+	return challenge, userID, nil
+}
+
+// credentialIDs returns the credential IDs of passkeys.
+func credentialIDs(passkeys []schema.Passkey) [][]byte {
+	ids := make([][]byte, 0, len(passkeys))
+	for _, p := range passkeys {
+		if id, err := decodeBase64URL(p.ID); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// decodeBase64URL decodes the base64url values of WebAuthn, padded or not.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// getPasskeyCreationOptions starts adding a passkey: it returns the options of navigator.credentials.create().
+func (rt *_router) getPasskeyCreationOptions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !rt.passkeysEnabled(w, ctx) {
+		return
+	}
+	session, err := rt.getAuthenticatedSession(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	userID := session.UserID
+	if _, err := rt.checkFirstCredential(r.Context(), session); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	user, err := rt.db.GetUserById(r.Context(), userID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	passkeys, err := rt.db.GetUserPasskeys(r.Context(), userID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	challenge, err := rt.newChallenge(r, challengeRegister, userID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rt.passkeys.CreationOptions(challenge, []byte(userID), user.Username, credentialIDs(passkeys)))
+}
+
+// addPasskey verifies and stores the passkey created from the options of getPasskeyCreationOptions. As passwords, the
+// first passkey of an account is only added from a verified session, see checkFirstCredential, and closes the other
+// sessions of the user.
+func (rt *_router) addPasskey(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !rt.passkeysEnabled(w, ctx) {
+		return
+	}
+	session, err := rt.getAuthenticatedSession(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	userID := session.UserID
+	first, err := rt.checkFirstCredential(r.Context(), session)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	var req requests.PasskeyRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if len(name) > maxPasskeyNameLength {
+		writeError(w, ctx, http.StatusBadRequest, "Passkey name too long")
+		return
+	}
+	clientDataJSON, err1 := decodeBase64URL(req.Credential.Response.ClientDataJSON)
+	attestationObject, err2 := decodeBase64URL(req.Credential.Response.AttestationObject)
+	if err1 != nil || err2 != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid credential encoding")
+		return
+	}
+
+	challenge, challengeUserID, err := rt.consumeChallenge(r, clientDataJSON, challengeRegister)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if challengeUserID != userID {
+		writeMappedError(w, ctx, schema.ErrChallengeNotFound)
+		return
+	}
+	cred, err := rt.passkeys.VerifyRegistration(clientDataJSON, attestationObject, challenge)
+	if err != nil {
+		ctx.Logger.WithError(err).Info("Passkey registration refused")
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	if name == "" {
+		name = deviceLabel(ctx.Client.UserAgent)
+	}
+	passkey := schema.Passkey{
+		ID:        base64.RawURLEncoding.EncodeToString(cred.ID),
+		UserID:    userID,
+		Name:      name,
+		PublicKey: cred.PublicKey,
+		SignCount: cred.SignCount,
+		CreatedAt: globaltime.Now().UTC().Format(time.RFC3339),
+	}
+	if err := rt.db.CreatePasskey(r.Context(), &passkey); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if first {
+		if _, err := rt.db.DeleteUserSessions(r.Context(), userID, session.ID); err != nil {
+			writeMappedError(w, ctx, err)
+			return
+		}
+		rt.hub.DisconnectAll(userID, session.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(passkey)
+}
+
+// getMyPasskeys lists the passkeys of the caller.
+func (rt *_router) getMyPasskeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	passkeys, err := rt.db.GetUserPasskeys(r.Context(), userID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(passkeys)
+}
+
+// deletePasskey removes a passkey of the caller. The sessions it opened stay open.
+func (rt *_router) deletePasskey(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if err := rt.db.DeletePasskey(r.Context(), userID, ps.ByName("passkeyId")); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getPasskeyLoginOptions starts logging in with a passkey: it returns the options of navigator.credentials.get(), for
+// the passkeys of the user when a username is given, or for any passkey of the site.
+func (rt *_router) getPasskeyLoginOptions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !rt.passkeysEnabled(w, ctx) {
+		return
+	}
+	var req requests.PasskeyLoginOptionsRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	// an unknown username gets options for any passkey, so that the response does not tell whether it exists
+	var allowed [][]byte
+	if req.Username != "" {
+		user, err := rt.db.GetUserByName(r.Context(), req.Username)
+		if err != nil && !errors.Is(err, schema.ErrUserDoesNotExist) {
+			writeMappedError(w, ctx, err)
+			return
+		} else if err == nil {
+			passkeys, err := rt.db.GetUserPasskeys(r.Context(), user.ID)
+			if err != nil {
+				writeMappedError(w, ctx, err)
+				return
+			}
+			allowed = credentialIDs(passkeys)
+		}
+	}
+	challenge, err := rt.newChallenge(r, challengeLogin, "")
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rt.passkeys.RequestOptions(challenge, allowed))
+}
+
+// loginWithPasskey logs in with a passkey that signed the challenge of getPasskeyLoginOptions.
+func (rt *_router) loginWithPasskey(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if !rt.passkeysEnabled(w, ctx) {
+		return
+	}
+	var req requests.PasskeyLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(req.DeviceLabel) > maxDeviceLabelLength {
+		writeError(w, ctx, http.StatusBadRequest, "Device label too long")
+		return
+	}
+	resp := req.Credential.Response
+	clientDataJSON, err1 := decodeBase64URL(resp.ClientDataJSON)
+	authData, err2 := decodeBase64URL(resp.AuthenticatorData)
+	signature, err3 := decodeBase64URL(resp.Signature)
+	userHandle, err4 := decodeBase64URL(resp.UserHandle)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid credential encoding")
+		return
+	}
+
+	challenge, _, err := rt.consumeChallenge(r, clientDataJSON, challengeLogin)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	passkey, err := rt.db.GetPasskey(r.Context(), strings.TrimRight(req.Credential.ID, "="))
+	if errors.Is(err, schema.ErrPasskeyNotFound) {
+		writeMappedError(w, ctx, errInvalidCredentials)
+		return
+	} else if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if len(userHandle) > 0 && string(userHandle) != passkey.UserID {
+		writeMappedError(w, ctx, errInvalidCredentials)
+		return
+	}
+	signCount, err := rt.passkeys.VerifyAssertion(clientDataJSON, authData, signature, challenge, webauthn.Credential{
+		PublicKey: passkey.PublicKey,
+		SignCount: passkey.SignCount,
+	})
+	if err != nil {
+		ctx.Logger.WithError(err).WithField("passkey_id", passkey.ID).Info("Passkey login refused")
+		writeMappedError(w, ctx, errInvalidCredentials)
+		return
+	}
+	if err := rt.db.UpdatePasskeyUse(r.Context(), passkey.ID, signCount, globaltime.Now()); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	user, err := rt.db.GetUserById(r.Context(), passkey.UserID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	tokens, err := rt.openSession(r.Context(), user.ID, strings.TrimSpace(req.DeviceLabel), true)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(schema.LoginResponse{User: *user, TokenResponse: *tokens})
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/blobstore"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/database"
+	"github.com/dilcetto/wasa/service/imaging"
+	"github.com/dilcetto/wasa/service/webauthn"
+	"github.com/julienschmidt/httprouter"
+)
+
+// statusCodes are the error codes of the responses written with writeError, by HTTP status.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "unprocessable_entity",
+	http.StatusTooManyRequests:       "too_many_requests",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// errorMapping is the HTTP status and the error code of an error returned by the database, the authorizer or the
+// helpers of the handlers. The response says Message, or the text of the error when empty, which then must not leak
+// internal details.
+type errorMapping struct {
+	err     error
+	status  int
+	code    string
+	message string
+}
+
+// errorMappings is the single place where errors become HTTP responses, see writeMappedError. Wrapped errors match
+// too, so the first mapping that matches wins.
+var errorMappings = []errorMapping{
+	{ErrForbidden, http.StatusForbidden, "forbidden", "Forbidden"},
+	{errInvalidCredentials, http.StatusUnauthorized, "invalid_credentials", "Invalid username or password"},
+	{errCredentialsRequired, http.StatusUnauthorized, "credentials_required", "This account logs in with a password or a passkey"},
+	{errUnverifiedSession, http.StatusForbidden, "unverified_session", "Only the device that created this account can add its first password or passkey"},
+	{schema.ErrRefreshTokenReused, http.StatusUnauthorized, "refresh_token_reused", "Refresh token already used, the session has been closed"},
+
+	{schema.ErrUserDoesNotExist, http.StatusNotFound, "user_not_found", "User not found"},
+	{schema.ErrConversationDoesNotExist, http.StatusNotFound, "conversation_not_found", "Conversation not found"},
+	{schema.ErrGroupDoesNotExist, http.StatusNotFound, "group_not_found", "Group not found"},
+	{schema.ErrMessageDoesNotExist, http.StatusNotFound, "message_not_found", "Message not found"},
+	{schema.ErrReactionDoesNotExist, http.StatusNotFound, "reaction_not_found", "Reaction not found"},
+	{schema.ErrScheduledMessageNotFound, http.StatusNotFound, "scheduled_message_not_found", "Scheduled message not found"},
+	{schema.ErrNotGroupMember, http.StatusNotFound, "member_not_found", "Member not found"},
+	{schema.ErrUploadNotFound, http.StatusNotFound, "upload_not_found", "Upload not found"},
+	{schema.ErrSessionNotFound, http.StatusNotFound, "session_not_found", "Session not found"},
+	{schema.ErrPasskeyNotFound, http.StatusNotFound, "passkey_not_found", "Passkey not found"},
+	{blobstore.ErrBlobNotFound, http.StatusNotFound, "media_not_found", "Media not found"},
+	{blobstore.ErrInvalidBlobID, http.StatusNotFound, "media_not_found", "Media not found"},
+
+	{schema.ErrUsernameTaken, http.StatusConflict, "username_taken", "Username already exists"},
+	{schema.ErrAlreadyGroupMember, http.StatusConflict, "already_member", "User is already a member of the group"},
+	{errMemberIsOwner, http.StatusConflict, "member_is_owner", "The role of the group owner only changes by transferring the ownership"},
+	{schema.ErrMessageNotEditable, http.StatusConflict, "message_not_editable", "Message can no longer be edited"},
+	{schema.ErrMessageDeleted, http.StatusConflict, "message_deleted", "Message has been deleted"},
+	{schema.ErrUploadOffsetMismatch, http.StatusConflict, "upload_offset_mismatch", ""},
+	{schema.ErrUploadIncomplete, http.StatusConflict, "upload_incomplete", ""},
+	{schema.ErrUploadFinalized, http.StatusConflict, "upload_finalized", ""},
+	{schema.ErrPasskeyExists, http.StatusConflict, "passkey_exists", "Passkey already registered"},
+
+	{schema.ErrInvalidGroupName, http.StatusUnprocessableEntity, "invalid_group_name", "Group name must be between 1 and 50 characters"},
+	{errReplyNotFound, http.StatusUnprocessableEntity, "reply_not_found", "Replied message not found in this conversation"},
+	{errInvalidAttachment, http.StatusUnprocessableEntity, "invalid_attachment", ""},
+	{errWeakPassword, http.StatusUnprocessableEntity, "weak_password", "Password must be between 8 and 72 characters"},
+	{schema.ErrChallengeNotFound, http.StatusUnprocessableEntity, "challenge_expired", "Passkey challenge expired, try again"},
+	{webauthn.ErrInvalidCredential, http.StatusUnprocessableEntity, "invalid_passkey", "Invalid passkey"},
+	{database.ErrInvalidCursor, http.StatusBadRequest, "invalid_cursor", "Invalid cursor"},
+	{errInvalidMultipart, http.StatusBadRequest, "invalid_multipart", "Invalid multipart body"},
+
+	{schema.ErrUploadTooLarge, http.StatusRequestEntityTooLarge, "upload_too_large", ""},
+	{errPhotoTooLarge, http.StatusRequestEntityTooLarge, "photo_too_large", "Photo too large. Maximum allowed size is 10 MB."},
+	{imaging.ErrImageTooLarge, http.StatusRequestEntityTooLarge, "image_too_large", "Image dimensions too large."},
+	{errRequestTooLarge, http.StatusRequestEntityTooLarge, "payload_too_large", "Request too large"},
+	{imaging.ErrUnsupportedImage, http.StatusUnsupportedMediaType, "unsupported_image", "Invalid file type. Only JPEG, PNG, GIF and WebP are supported."},
+
+	{errTooManyLogins, http.StatusTooManyRequests, "too_many_login_attempts", "Too many failed logins, try again later"},
+	{errSlowMode, http.StatusTooManyRequests, "slow_mode", "Slow mode is on, wait before sending another message"},
+}
+
+// writeError writes an error response with the given status and message, and the generic error code of the status.
+func writeError(w http.ResponseWriter, ctx reqcontext.RequestContext, status int, message string) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = "error"
+	}
+	writeErrorResponse(w, ctx, status, code, message)
+}
+
+// writeMappedError writes the response for an error returned by the database, the authorizer or the helpers of the
+// handlers, as listed in errorMappings. Any other error is logged and reported as an internal error, without details.
+func writeMappedError(w http.ResponseWriter, ctx reqcontext.RequestContext, err error) {
+	for _, m := range errorMappings {
+		if errors.Is(err, m.err) {
+			message := m.message
+			if message == "" {
+				message = err.Error()
+			}
+			writeErrorResponse(w, ctx, m.status, m.code, message)
+			return
+		}
+	}
+	ctx.Logger.WithError(err).Error("Failed to process the request")
+	writeErrorResponse(w, ctx, http.StatusInternalServerError, statusCodes[http.StatusInternalServerError], "Internal Server Error")
+}
+
+// notFound is the handler of the requests whose path matches no route.
+func notFound(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	writeError(w, ctx, http.StatusNotFound, "Not found")
+}
+
+// methodNotAllowed is the handler of the requests whose path matches a route for other methods only. The router has
+// already set the Allow header.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	writeError(w, ctx, http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+// writeErrorResponse writes the JSON error envelope, with the ID of the request so that it can be found in the logs.
+func writeErrorResponse(w http.ResponseWriter, ctx reqcontext.RequestContext, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(schema.ErrorResponse{Error: schema.ErrorDetail{
+		Code:      code,
+		Message:   message,
+		RequestID: ctx.ReqUUID.String(),
+	}})
+}
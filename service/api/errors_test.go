@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// TestClientErrors checks that invalid requests are reported as client errors, with the error envelope.
+func TestClientErrors(t *testing.T) {
+	f := newAuthzFixture(t)
+	message := "/conversations/" + f.params["conversationId"] + "/messages"
+	for _, tc := range []struct {
+		name, method, path, body string
+		status                   int
+	}{
+		{"unknown status", http.MethodPost, message + "/" + f.params["messageId"] + "/status", `{"status": "bogus"}`, http.StatusBadRequest},
+		{"empty emoji", http.MethodPost, message + "/" + f.params["messageId"] + "/comment", `{"emoji": ""}`, http.StatusBadRequest},
+		{"empty message", http.MethodPost, message, `{}`, http.StatusBadRequest},
+		{"direct conversation with oneself", http.MethodPost, "/direct-conversations", `{"peerUserId": "` + f.users[roleMember] + `"}`, http.StatusUnprocessableEntity},
+		{"unknown peer", http.MethodPost, "/direct-conversations", `{"peerUserId": "nobody"}`, http.StatusNotFound},
+	} {
+		w := f.do(tc.method, tc.path, f.tokens[roleMember], tc.body, nil)
+		var response schema.ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Error.Code == "" {
+			t.Errorf("%s: got %q, want an error envelope", tc.name, w.Body.String())
+		}
+		if w.Code != tc.status {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, tc.status)
+		}
+	}
+
+	var messages struct {
+		Messages []schema.Message `json:"messages"`
+	}
+	f.mustDo(http.MethodGet, message, f.tokens[roleMember], "", &messages)
+	if len(messages.Messages) != 1 {
+		t.Errorf("the conversation holds %d messages, want 1", len(messages.Messages))
+	}
+}
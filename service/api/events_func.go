@@ -0,0 +1,156 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/events"
+	"github.com/dilcetto/wasa/service/globaltime"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// eventsWriteWait is the time allowed to write an event to the client
+	eventsWriteWait = 10 * time.Second
+
+	// eventsPongWait is the time allowed to read the next pong from the client
+	eventsPongWait = 60 * time.Second
+
+	// eventsPingPeriod is the interval between pings, it must be shorter than eventsPongWait
+	eventsPingPeriod = eventsPongWait * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// The API accepts requests from any origin (see the CORS policy in cmd/webapi), and the stream is authenticated
+	// by the bearer token anyway.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// streamEvents upgrades the connection to a WebSocket and streams the events of every conversation of the user, as
+// JSON-encoded events.Event objects. Browsers cannot set the Authorization header on WebSockets, so the token can also
+// be passed in the `token` query parameter. The stream is closed as soon as its session is signed out, and soon after it
+// expires.
+func (rt *_router) streamEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	authSession, err := rt.getAuthenticatedSessionAllowQuery(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	userID := authSession.UserID
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied to the client
+		ctx.Logger.WithError(err).Debug("Failed to upgrade the event stream")
+		return
+	}
+
+	session := rt.hub.Subscribe(userID, authSession.ID)
+	eventSessions.Inc()
+	ctx.Logger.WithField("user_id", userID).Debug("Event stream opened")
+
+	// Read loop: clients are not expected to send anything, but reading is needed to process pongs and to notice
+	// when the client goes away.
+	go func() {
+		defer func() {
+			rt.hub.Unsubscribe(session)
+			eventSessions.Dec()
+		}()
+		conn.SetReadLimit(512)
+		_ = conn.SetReadDeadline(time.Now().Add(eventsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(eventsPongWait))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(eventsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = conn.Close()
+		ctx.Logger.WithField("user_id", userID).Debug("Event stream closed")
+	}()
+	for {
+		select {
+		case ev, ok := <-session.Events():
+			_ = conn.SetWriteDeadline(time.Now().Add(eventsWriteWait))
+			if !ok && session.SignedOut() {
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session closed"))
+				return
+			} else if !ok {
+				// unsubscribed, too slow, or server shutting down
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+			rt.markDelivered(r, ctx, userID, ev)
+		case <-ticker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(eventsWriteWait))
+			if _, err := rt.db.GetSession(r.Context(), authSession.ID, globaltime.Now()); errors.Is(err, schema.ErrSessionNotFound) {
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session closed"))
+				return
+			}
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// markDelivered marks a new message as delivered once it has been pushed to one of the recipient's sessions, so that
+// clients do not need to poll the conversation for receipts to advance.
+func (rt *_router) markDelivered(r *http.Request, ctx reqcontext.RequestContext, userID string, ev events.Event) {
+	if ev.Type != events.MessageCreated {
+		return
+	}
+	msg, ok := ev.Data.(*schema.Message)
+	if !ok || msg.SenderID == userID {
+		return
+	}
+	if err := rt.db.MarkMessageStatus(r.Context(), msg.ID, userID, "delivered"); err != nil {
+		ctx.Logger.WithError(err).WithField("message_id", msg.ID).Error("Failed to mark message as delivered")
+		return
+	}
+	// Only the sender follows the receipts of a message: publishing them to every member would send each member an
+	// event per recipient of every group message.
+	rt.publishTo(msg.ConversationID, events.ReceiptUpdated, events.ReceiptData{
+		MessageID: msg.ID,
+		UserID:    userID,
+		Status:    "delivered",
+	}, msg.SenderID)
+}
+
+// publish sends an event to every member of the conversation, plus the users in `also` (e.g., a member that just
+// left). Failures are logged and never fail the request that caused the event. The change has already been stored, so
+// recipients are loaded even if the client that caused it went away in the meantime.
+func (rt *_router) publish(ctx reqcontext.RequestContext, conversationID, eventType string, data interface{}, also ...string) {
+	members, err := rt.db.GetConversationMemberIDs(context.Background(), conversationID)
+	if err != nil {
+		ctx.Logger.WithError(err).WithField("conversation_id", conversationID).Error("Failed to load event recipients")
+		return
+	}
+	rt.publishTo(conversationID, eventType, data, append(members, also...)...)
+}
+
+// publishTo sends an event about the conversation to the given users only, e.g. a receipt to the sender of the message.
+func (rt *_router) publishTo(conversationID, eventType string, data interface{}, userIDs ...string) {
+	rt.hub.Publish(userIDs, events.Event{
+		Type:           eventType,
+		ConversationID: conversationID,
+		Timestamp:      generateCurrentTimestamp(),
+		Data:           data,
+	})
+}
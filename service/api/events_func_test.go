@@ -0,0 +1,81 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/events"
+	"github.com/sirupsen/logrus"
+)
+
+// receivedEvents returns the types of the events waiting in the session.
+func receivedEvents(s *events.Session) []string {
+	var types []string
+	for {
+		select {
+		case ev := <-s.Events():
+			types = append(types, ev.Type)
+		default:
+			return types
+		}
+	}
+}
+
+func TestDeliveryReceiptRecipients(t *testing.T) {
+	f := newAuthzFixture(t)
+	sessions := make(map[string]*events.Session)
+	for _, role := range []string{roleMember, roleAdmin, "target"} {
+		sessions[role] = f.rt.hub.Subscribe(f.users[role], role)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctx := reqcontext.RequestContext{Logger: logger}
+	r := httptest.NewRequest(http.MethodGet, "/events", nil)
+	message := &schema.Message{ID: f.params["messageId"], ConversationID: f.params["conversationId"], SenderID: f.users[roleMember]}
+	f.rt.markDelivered(r, ctx, f.users[roleAdmin], events.Event{Type: events.MessageCreated, Data: message})
+
+	if got := receivedEvents(sessions[roleMember]); len(got) != 1 || got[0] != events.ReceiptUpdated {
+		t.Errorf("the sender received %v, want a receipt", got)
+	}
+	for _, role := range []string{roleAdmin, "target"} {
+		if got := receivedEvents(sessions[role]); len(got) != 0 {
+			t.Errorf("%s received %v, want nothing", role, got)
+		}
+	}
+}
+
+func TestReadReceiptRecipients(t *testing.T) {
+	f := newAuthzFixture(t)
+	sessions := make(map[string]*events.Session)
+	for _, role := range []string{roleMember, roleAdmin, "target"} {
+		sessions[role] = f.rt.hub.Subscribe(f.users[role], role)
+	}
+	expect := func(action string, want map[string]string) {
+		t.Helper()
+		for role, s := range sessions {
+			got := receivedEvents(s)
+			if want[role] == "" && len(got) != 0 {
+				t.Errorf("%s: %s received %v, want nothing", action, role, got)
+			} else if want[role] != "" && (len(got) != 1 || got[0] != want[role]) {
+				t.Errorf("%s: %s received %v, want %s", action, role, got, want[role])
+			}
+		}
+	}
+	conversation := "/conversations/" + f.params["conversationId"]
+
+	f.mustDo(http.MethodPost, conversation+"/messages/"+f.params["messageId"]+"/status", f.tokens[roleAdmin], `{"status": "read"}`, nil)
+	expect("status", map[string]string{roleMember: events.ReceiptUpdated, roleAdmin: events.ReceiptUpdated})
+
+	body := `{"messageId": "` + f.params["messageId"] + `"}`
+	f.mustDo(http.MethodPost, conversation+"/read", f.tokens["target"], body, nil)
+	expect("read", map[string]string{roleMember: events.ConversationRead, "target": events.ConversationRead})
+
+	// The message of the member was already read by the admin
+	f.mustDo(http.MethodPost, conversation+"/read", f.tokens[roleAdmin], body, nil)
+	expect("read again", map[string]string{roleAdmin: events.ConversationRead})
+}
@@ -4,6 +4,7 @@ package api
 import (
 	"time"
 
+	"github.com/dilcetto/wasa/service/globaltime"
 	"github.com/gofrs/uuid"
 )
 
@@ -16,5 +17,5 @@ func generateNewID() (string, error) {
 }
 
 func generateCurrentTimestamp() string {
-	return time.Now().UTC().Format(time.RFC3339)
+	return globaltime.Now().UTC().Format(time.RFC3339)
 }
@@ -2,12 +2,14 @@ package api
 
 import (
 	"encoding/json"
-	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/dilcetto/wasa/service/api/reqcontext"
 	"github.com/dilcetto/wasa/service/components/requests"
 	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/database"
+	"github.com/dilcetto/wasa/service/events"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -15,7 +17,7 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 	// require authentication and include creator among members
 	userID, authErr := rt.getAuthenticatedUserID(r)
 	if authErr != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
@@ -25,7 +27,7 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 		GroupPhoto []byte   `json:"groupPhoto"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid JSON body")
 		return
 	}
 	groupName := body.GroupName
@@ -34,7 +36,7 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 
 	// validate basic input
 	if groupName == "" || len(members) == 0 {
-		http.Error(w, "Group name and members are required", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Group name and members are required")
 		return
 	}
 
@@ -52,34 +54,44 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 
 	groupID, err := generateNewID()
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to generate group ID")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
 
+	var photoID string
+	if len(photo) > 0 {
+		if photoID, err = rt.storePhoto(r.Context(), photo); err != nil {
+			writeMappedError(w, ctx, err)
+			return
+		}
+	}
+
 	createdAt := generateCurrentTimestamp()
 
 	group := &schema.Group{
-		ID:         groupID,
-		GroupName:  groupName,
-		GroupPhoto: photo,
-		Members:    members,
-		CreatedAt:  createdAt,
+		ID:        groupID,
+		GroupName: groupName,
+		PhotoID:   photoID,
+		Members:   members,
+		OwnerID:   userID,
+		CreatedAt: createdAt,
 	}
 
-	if err := rt.db.CreateGroup(group); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to create group in database")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	// return the created conversation as response
-	conv, err := rt.db.GetConversationByID(userID, groupID)
+	// create the group and load it back atomically, so that a failure never leaves a group nobody was told about
+	var conv *schema.Conversation
+	err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		if err := tx.CreateGroup(r.Context(), group); err != nil {
+			return err
+		}
+		var err error
+		conv, err = tx.GetConversationByID(r.Context(), userID, groupID)
+		return err
+	})
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Group created but failed to load conversation")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
+	rt.publish(ctx, groupID, events.ConversationCreated, conv)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(conv); err != nil {
@@ -89,65 +101,81 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 
 func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	groupID := ps.ByName("groupId")
-	_, err := rt.getAuthenticatedUserID(r)
+	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, err := rt.authz.GroupRole(r.Context(), userID, groupID, schema.RoleAdmin); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
 
 	var req requests.AddMemberRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
 		return
 	}
-	// map username to user ID
-	u, err := rt.db.GetUserByName(req.Username)
+	// map username to user ID, and add the user in the same transaction so a concurrent rename cannot slip in between
+	var u *schema.User
+	err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		var err error
+		if u, err = tx.GetUserByName(r.Context(), req.Username); err != nil {
+			return err
+		}
+		return tx.AddUserToGroup(r.Context(), groupID, u.ID)
+	})
 	if err != nil {
-		ctx.Logger.WithError(err).Error("User not found for addToGroup")
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	}
-
-	if err := rt.db.AddUserToGroup(groupID, u.ID); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to add user to group")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
+	rt.publish(ctx, groupID, events.MemberJoined, events.MemberData{
+		UserID:   u.ID,
+		Username: u.Username,
+		Role:     schema.RoleMember,
+	})
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (rt *_router) leaveGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	groupID := ps.ByName("groupId")
-	if _, err := rt.getAuthenticatedUserID(r); err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	var req requests.LeaveGroupRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := rt.authz.Group(r.Context(), userID, groupID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
 
-	if err := rt.db.LeaveGroup(groupID, req.UserID); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to remove user from group")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	// the caller can only remove itself: other members are removed with kickFromGroup
+	if err := rt.db.LeaveGroup(r.Context(), groupID, userID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
+	rt.publish(ctx, groupID, events.MemberLeft, events.MemberData{UserID: userID}, userID)
 
 	w.WriteHeader(http.StatusOK)
 }
 
 func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	if r.Method != http.MethodPut {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeError(w, ctx, http.StatusMethodNotAllowed, "Method Not Allowed")
 		return
 	}
 	groupID := ps.ByName("groupId")
 	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, err := rt.authz.GroupRole(r.Context(), userID, groupID, schema.RoleAdmin); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
 
@@ -155,25 +183,20 @@ func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httpr
 		NewName string `json:"newName"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	if err := rt.db.UpdateGroupName(groupID, req.NewName); err != nil {
-		if errors.Is(err, schema.ErrGroupNotFound) {
-			http.Error(w, "Group not found", http.StatusNotFound)
-			return
-		} else if errors.Is(err, schema.ErrInvalidGroupName) {
-			http.Error(w, "Invalid group name", http.StatusBadRequest)
-			return
-		}
-		ctx.Logger.WithError(err).Error("Failed to update group name")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	req.NewName = strings.TrimSpace(req.NewName)
+	if err := rt.db.UpdateGroupName(r.Context(), groupID, req.NewName); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
 
+	rt.publish(ctx, groupID, events.GroupUpdated, events.GroupData{GroupName: req.NewName})
+
 	// return updated conversation
-	conv, err := rt.db.GetConversationByID(userID, groupID)
+	conv, err := rt.db.GetConversationByID(r.Context(), userID, groupID)
 	if err != nil {
 		ctx.Logger.WithError(err).Error("Group name updated but failed to load conversation")
 		w.WriteHeader(http.StatusOK)
@@ -187,50 +210,65 @@ func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httpr
 func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	groupID := ps.ByName("groupId")
 	if r.Method != http.MethodPut {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeError(w, ctx, http.StatusMethodNotAllowed, "Method Not Allowed")
 		return
 	}
-	_, err := rt.getAuthenticatedUserID(r)
+	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
+	if _, err := rt.authz.GroupRole(r.Context(), userID, groupID, schema.RoleAdmin); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	// the photo is sent either in the `groupPhoto` file of a multipart form, or base64-encoded in JSON
 	var body struct {
 		GroupPhoto []byte `json:"groupPhoto"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+	if isMultipart(r) {
+		if err := parseMultipart(w, r, maxPhotoSize+multipartOverhead); err != nil {
+			writeMappedError(w, ctx, err)
+			return
+		}
+		defer func() { _ = r.MultipartForm.RemoveAll() }()
+		files, err := formFiles(r, "groupPhoto")
+		if err != nil {
+			writeMappedError(w, ctx, err)
+			return
+		}
+		if len(files) > 0 {
+			body.GroupPhoto = files[0].Content
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid JSON body")
 		return
 	}
 	photo := body.GroupPhoto
 	if len(photo) == 0 {
-		http.Error(w, "Missing group photo", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Missing group photo")
 		return
 	}
 
-	if len(photo) > 10*1024*1024 {
-		http.Error(w, "Photo too large. Maximum allowed size is 10 MB.", http.StatusRequestEntityTooLarge)
-		return
-	}
-
-	fileType := http.DetectContentType(photo)
-	if fileType != "image/jpeg" && fileType != "image/png" {
-		http.Error(w, "Invalid file type. Only JPEG and PNG are supported.", http.StatusUnsupportedMediaType)
+	photoID, err := rt.storePhoto(r.Context(), photo)
+	if err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
-	if err := rt.db.UpdateGroupPhoto(groupID, photo); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to update group photo")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	if err := rt.db.UpdateGroupPhoto(r.Context(), groupID, photoID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
+	rt.publish(ctx, groupID, events.GroupUpdated, events.GroupData{PhotoID: photoID})
 
 	response := struct {
-		Message    string `json:"message"`
-		GroupPhoto []byte `json:"groupPhoto"`
+		Message string `json:"message"`
+		PhotoID string `json:"photoId"`
 	}{
-		Message:    "Photo updated successfully",
-		GroupPhoto: photo,
+		Message: "Photo updated successfully",
+		PhotoID: photoID,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/database"
+	"github.com/dilcetto/wasa/service/events"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// errMemberIsOwner is returned when trying to change the role of the group owner, which only changes by transferring
+// the ownership.
+var errMemberIsOwner = errors.New("the member is the group owner")
+
+// kickFromGroup removes another member from the group. Admins can remove members, the owner can remove anyone. A user
+// removing itself is the same as leaving the group.
+func (rt *_router) kickFromGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	groupID := ps.ByName("groupId")
+	targetID := ps.ByName("userId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	minRole := schema.RoleAdmin
+	if targetID == userID {
+		minRole = schema.RoleMember
+	}
+
+	// roles are checked in the same transaction as the removal, so a concurrent promotion cannot be bypassed
+	err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		role, err := authorizer{db: tx}.GroupRole(r.Context(), userID, groupID, minRole)
+		if err != nil {
+			return err
+		}
+		if targetID != userID {
+			targetRole, err := tx.GetMemberRole(r.Context(), groupID, targetID)
+			if err != nil {
+				return err
+			}
+			if roleRank(targetRole) >= roleRank(role) {
+				return ErrForbidden
+			}
+		}
+		return tx.LeaveGroup(r.Context(), groupID, targetID)
+	})
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	rt.publish(ctx, groupID, events.MemberLeft, events.MemberData{UserID: targetID}, targetID)
+
+	ctx.Logger.WithFields(logrus.Fields{
+		"group_id":  groupID,
+		"user_id":   userID,
+		"target_id": targetID,
+	}).Info("Member removed from group")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// promoteGroupMember makes a member an admin of the group. Only the owner can promote members.
+func (rt *_router) promoteGroupMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	rt.changeMemberRole(w, r, ps, ctx, schema.RoleMember, schema.RoleAdmin)
+}
+
+// demoteGroupMember makes an admin a plain member of the group. Only the owner can demote admins.
+func (rt *_router) demoteGroupMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	rt.changeMemberRole(w, r, ps, ctx, schema.RoleAdmin, schema.RoleMember)
+}
+
+// changeMemberRole moves the target member from role `from` to role `to` on behalf of the group owner, and replies
+// with the updated list of members.
+func (rt *_router) changeMemberRole(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext, from, to string) {
+	groupID := ps.ByName("groupId")
+	targetID := ps.ByName("userId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var changed bool
+	err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		if _, err := (authorizer{db: tx}).GroupRole(r.Context(), userID, groupID, schema.RoleOwner); err != nil {
+			return err
+		}
+		targetRole, err := tx.GetMemberRole(r.Context(), groupID, targetID)
+		if err != nil {
+			return err
+		}
+		if targetRole != from && targetRole != to {
+			return errMemberIsOwner
+		}
+		if targetRole == to {
+			return nil
+		}
+		changed = true
+		return tx.SetMemberRole(r.Context(), groupID, targetID, to)
+	})
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if changed {
+		rt.publish(ctx, groupID, events.MemberUpdated, events.MemberData{UserID: targetID, Role: to})
+	}
+
+	rt.writeGroupMembers(w, r, ctx, groupID)
+}
+
+// transferGroupOwnership hands the group over to another member. The previous owner stays in the group as an admin.
+func (rt *_router) transferGroupOwnership(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	groupID := ps.ByName("groupId")
+	targetID := ps.ByName("userId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if targetID == userID {
+		writeError(w, ctx, http.StatusBadRequest, "You already own the group")
+		return
+	}
+
+	err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		if _, err := (authorizer{db: tx}).GroupRole(r.Context(), userID, groupID, schema.RoleOwner); err != nil {
+			return err
+		}
+		return tx.TransferGroupOwnership(r.Context(), groupID, userID, targetID)
+	})
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	rt.publish(ctx, groupID, events.MemberUpdated, events.MemberData{UserID: targetID, Role: schema.RoleOwner})
+	rt.publish(ctx, groupID, events.MemberUpdated, events.MemberData{UserID: userID, Role: schema.RoleAdmin})
+
+	rt.writeGroupMembers(w, r, ctx, groupID)
+}
+
+// writeGroupMembers replies with the current list of members of the group.
+func (rt *_router) writeGroupMembers(w http.ResponseWriter, r *http.Request, ctx reqcontext.RequestContext, groupID string) {
+	members, err := rt.db.GetConversationMembers(r.Context(), groupID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(members)
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+func TestGroupRoles(t *testing.T) {
+	f := newAuthzFixture(t)
+	group := "/groups/" + f.params["groupId"] + "/members/"
+	roles := func() map[string]string {
+		var members []schema.Member
+		f.mustDo(http.MethodGet, "/conversations/"+f.params["conversationId"]+"/members", f.tokens[roleMember], "", &members)
+		byRole := make(map[string]string)
+		for _, m := range members {
+			for role, id := range f.users {
+				if m.ID == id {
+					byRole[role] = m.Role
+				}
+			}
+		}
+		return byRole
+	}
+	for _, tc := range []struct {
+		name, caller, action, target string
+		status                       int
+		roles                        map[string]string
+	}{
+		{"promote", roleAdmin, "promote", "target", http.StatusOK,
+			map[string]string{roleAdmin: schema.RoleOwner, roleMember: schema.RoleMember, "target": schema.RoleAdmin}},
+		{"promote again", roleAdmin, "promote", "target", http.StatusOK, nil},
+		{"promote as an admin", "target", "promote", roleMember, http.StatusForbidden, nil},
+		{"promote the owner", roleAdmin, "promote", roleAdmin, http.StatusConflict, nil},
+		{"demote the owner", roleAdmin, "demote", roleAdmin, http.StatusConflict, nil},
+		{"demote a member", roleAdmin, "demote", roleMember, http.StatusOK,
+			map[string]string{roleAdmin: schema.RoleOwner, roleMember: schema.RoleMember, "target": schema.RoleAdmin}},
+		{"demote as a member", roleMember, "demote", "target", http.StatusForbidden, nil},
+		{"demote", roleAdmin, "demote", "target", http.StatusOK,
+			map[string]string{roleAdmin: schema.RoleOwner, roleMember: schema.RoleMember, "target": schema.RoleMember}},
+		{"promote a non-member", roleAdmin, "promote", roleNonMember, http.StatusNotFound, nil},
+		{"transfer", roleAdmin, "ownership", roleMember, http.StatusOK,
+			map[string]string{roleAdmin: schema.RoleAdmin, roleMember: schema.RoleOwner, "target": schema.RoleMember}},
+		{"promote as the previous owner", roleAdmin, "promote", "target", http.StatusForbidden, nil},
+		{"demote the previous owner", roleMember, "demote", roleAdmin, http.StatusOK,
+			map[string]string{roleAdmin: schema.RoleMember, roleMember: schema.RoleOwner, "target": schema.RoleMember}},
+	} {
+		w := f.do(http.MethodPost, group+f.users[tc.target]+"/"+tc.action, f.tokens[tc.caller], "", nil)
+		if w.Code != tc.status {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.status, w.Body.String())
+			continue
+		}
+		if tc.roles == nil {
+			continue
+		}
+		got := roles()
+		for role, want := range tc.roles {
+			if got[role] != want {
+				t.Errorf("%s: %s is %q, want %q", tc.name, role, got[role], want)
+			}
+		}
+	}
+}
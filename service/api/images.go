@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dilcetto/wasa/service/imaging"
+)
+
+// maxPhotoSize is the size of the largest profile or group photo accepted, in bytes
+const maxPhotoSize = 10 << 20
+
+// errPhotoTooLarge is returned by storePhoto when the photo is larger than maxPhotoSize.
+var errPhotoTooLarge = errors.New("photo too large")
+
+// storePhoto processes a profile or group photo and stores it with its thumbnail, returning its blob ID. Invalid photos
+// are reported with errPhotoTooLarge, imaging.ErrUnsupportedImage or imaging.ErrImageTooLarge.
+func (rt *_router) storePhoto(ctx context.Context, data []byte) (string, error) {
+	if len(data) > maxPhotoSize {
+		return "", errPhotoTooLarge
+	}
+	img, err := imaging.Process(data, imaging.Avatar)
+	if err != nil {
+		return "", err
+	}
+	return rt.storeImage(ctx, img)
+}
+
+// storeImage stores a processed image and its thumbnail in the blob store, and records them in the database. It
+// returns the blob ID of the image.
+func (rt *_router) storeImage(ctx context.Context, img *imaging.Image) (string, error) {
+	blobID, err := rt.putBlob(ctx, img.Data)
+	if err != nil {
+		return "", err
+	}
+	thumbnailID, err := rt.putBlob(ctx, img.Thumbnail)
+	if err != nil {
+		return "", err
+	}
+	if err := rt.db.SaveImage(ctx, blobID, img.Width, img.Height, thumbnailID); err != nil {
+		return "", err
+	}
+	return blobID, nil
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/julienschmidt/httprouter"
+)
+
+// getMedia serves the content of a blob (an attachment, or a profile or group photo) that the user can see, see
+// authorizer.Blob. Blob IDs are the SHA-256 of the content, so the content never changes and clients can cache it
+// forever. As for the event stream, the token can be passed in the `token` query parameter, so that browsers can load
+// media directly in <img> tags.
+func (rt *_router) getMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userID, err := rt.getAuthenticatedUserIDAllowQuery(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	blobID := ps.ByName("blobId")
+	if err := rt.authz.Blob(r.Context(), userID, blobID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	data, err := rt.blobs.Get(r.Context(), blobID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	contentType := http.DetectContentType(data)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if attachmentKind(contentType) == schema.AttachmentFile {
+		// generic files (HTML and text included) are downloaded rather than rendered in the origin of the app
+		w.Header().Set("Content-Disposition", "attachment")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	}
+	w.Header().Set("ETag", `"`+blobID+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	// ServeContent handles conditional (If-None-Match) and range requests
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/database"
+	"github.com/dilcetto/wasa/service/events"
+	"github.com/dilcetto/wasa/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultMessageEditWindow is how long messages can be edited when Config.MessageEditWindow is not set.
+const defaultMessageEditWindow = 15 * time.Minute
+
+// editMessage replaces the text of a message. Only the sender can edit a message, and only within the edit window
+// since it was sent; the replaced text is kept in the message history. Forwarded messages cannot be edited, as their
+// text belongs to the original sender, and neither can messages deleted for everyone.
+func (rt *_router) editMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var body struct {
+		Content schema.MessageContent `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(body.Content.Value) == 0 {
+		writeError(w, ctx, http.StatusBadRequest, "Missing message content")
+		return
+	}
+
+	if err := rt.authz.Message(r.Context(), userID, conversationID, messageID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	// the checks run in the same transaction as the edit, so that two concurrent edits are recorded one after the other
+	var stored *schema.Message
+	err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		original, err := tx.GetMessageByID(r.Context(), messageID)
+		if err != nil {
+			return err
+		}
+		if original.SenderID != userID {
+			return ErrForbidden
+		}
+		if original.ForwardedFrom != "" || original.DeletedAt != "" {
+			return schema.ErrMessageNotEditable
+		}
+		sentAt, err := time.Parse(time.RFC3339, original.Timestamp)
+		if err != nil || globaltime.Since(sentAt) > rt.editWindow {
+			return schema.ErrMessageNotEditable
+		}
+
+		if err := tx.EditMessage(r.Context(), messageID, body.Content.Value, generateCurrentTimestamp()); err != nil {
+			return err
+		}
+		stored, err = tx.GetMessageByID(r.Context(), messageID)
+		return err
+	})
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	rt.publish(ctx, conversationID, events.MessageEdited, stored)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(stored)
+}
+
+// getMessageHistory lists the previous versions of the text of a message, oldest first, to any member of the
+// conversation.
+func (rt *_router) getMessageHistory(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := rt.authz.Message(r.Context(), userID, conversationID, messageID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	revisions, err := rt.db.GetMessageRevisions(r.Context(), messageID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(revisions)
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// TestEditMessage checks that only the sender edits their message, within the edit window, and that every replaced
+// text is kept in the history with the time it was written.
+func TestEditMessage(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second)
+	fixTime(t, start)
+	f := newAuthzFixture(t)
+	// shorter than the lifetime of the access tokens of the fixture
+	f.rt.editWindow = 5 * time.Minute
+	conv := "/conversations/" + f.params["conversationId"] + "/messages/"
+	message := conv + f.params["messageId"]
+	edit := func(path, role, text string) int {
+		body := fmt.Sprintf(`{"content": {"type": "text", "value": %q}}`, base64.StdEncoding.EncodeToString([]byte(text)))
+		return f.do(http.MethodPut, path, f.tokens[role], body, nil).Code
+	}
+
+	fixTime(t, start.Add(time.Minute))
+	if code := edit(message, roleMember, "first edit"); code != http.StatusOK {
+		t.Fatalf("editing: got %d, want %d", code, http.StatusOK)
+	}
+	fixTime(t, start.Add(2*time.Minute))
+	if code := edit(message, roleMember, "second edit"); code != http.StatusOK {
+		t.Fatalf("editing again: got %d, want %d", code, http.StatusOK)
+	}
+	if code := edit(message, roleAdmin, "not mine"); code != http.StatusForbidden {
+		t.Errorf("editing the message of someone else: got %d, want %d", code, http.StatusForbidden)
+	}
+	fixTime(t, start.Add(f.rt.editWindow+time.Second))
+	if code := edit(message, roleMember, "too late"); code != http.StatusConflict {
+		t.Errorf("editing after the edit window: got %d, want %d", code, http.StatusConflict)
+	}
+
+	var history []schema.MessageRevision
+	f.mustDo(http.MethodGet, message+"/history", f.tokens[roleAdmin], "", &history)
+	want := []schema.MessageRevision{
+		{Revision: 0, Timestamp: start.Format(time.RFC3339), Content: schema.MessageContent{Value: []byte("hello")}},
+		{Revision: 1, Timestamp: start.Add(time.Minute).Format(time.RFC3339), Content: schema.MessageContent{Value: []byte("first edit")}},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("got %d revisions, want %d", len(history), len(want))
+	}
+	for i, rev := range history {
+		if rev.Revision != want[i].Revision || rev.Timestamp != want[i].Timestamp || string(rev.Content.Value) != string(want[i].Content.Value) {
+			t.Errorf("revision %d is %d %q written at %s, want %d %q written at %s", i, rev.Revision, rev.Content.Value,
+				rev.Timestamp, want[i].Revision, want[i].Content.Value, want[i].Timestamp)
+		}
+	}
+
+	// forwarded messages and messages deleted for everyone are not editable, even by their sender
+	fixTime(t, start.Add(f.rt.editWindow+time.Minute))
+	var forwarded schema.Message
+	f.mustDo(http.MethodPost, message+"/forward", f.tokens[roleMember],
+		fmt.Sprintf(`{"targetConversationId": %q}`, f.params["conversationId"]), &forwarded)
+	if code := edit(conv+forwarded.ID, roleMember, "forwarded"); code != http.StatusConflict {
+		t.Errorf("editing a forwarded message: got %d, want %d", code, http.StatusConflict)
+	}
+	var sent schema.Message
+	f.mustDo(http.MethodPost, strings.TrimSuffix(conv, "/"), f.tokens[roleMember], `{"content": {"type": "text", "value": "ZGVsZXRlZA=="}}`, &sent)
+	f.mustDo(http.MethodDelete, conv+sent.ID, f.tokens[roleMember], "", nil)
+	if code := edit(conv+sent.ID, roleMember, "deleted"); code != http.StatusConflict {
+		t.Errorf("editing a deleted message: got %d, want %d", code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/dilcetto/wasa/service/metrics"
+)
+
+// unmatchedRoute is the route of the requests that match no route in the metrics, so that unknown paths do not create
+// new series
+const unmatchedRoute = "unmatched"
+
+var (
+	requestsTotal = metrics.NewCounterVec("wasa_http_requests_total",
+		"HTTP requests served, by method, route and status code.", "method", "route", "status")
+	requestDuration = metrics.NewHistogramVec("wasa_http_request_duration_seconds",
+		"Duration of the HTTP requests, by method and route. Event streams last as long as the connection.",
+		metrics.DefaultBuckets, "method", "route")
+	eventSessions = metrics.NewGaugeVec("wasa_event_sessions",
+		"Event streams (WebSockets) currently open.").With()
+	messagesSent = metrics.NewCounterVec("wasa_messages_sent_total",
+		"Messages delivered to conversations, by source: sent, forwarded or scheduled.", "source")
+	rateLimitBuckets = metrics.NewGaugeVec("wasa_rate_limit_buckets",
+		"Token buckets of the rate limits and slow modes that are not full, as of the last pruning.").With()
+)
+
+// sources of messagesSent
+const (
+	messageSourceSent      = "sent"
+	messageSourceForwarded = "forwarded"
+	messageSourceScheduled = "scheduled"
+)
+
+// observeRequest records a request served by wrap.
+func observeRequest(method, route string, status int, duration time.Duration) {
+	requestsTotal.With(method, route, strconv.Itoa(status)).Inc()
+	requestDuration.With(method, route).Observe(duration.Seconds())
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+const (
+	// multipartMemory is how much of a multipart body is kept in memory while parsing it, the rest of the files are
+	// buffered in temporary files
+	multipartMemory = 8 << 20
+
+	// multipartOverhead is the room left for the boundaries, the headers and the other fields of multipart bodies
+	multipartOverhead = 1 << 20
+)
+
+var (
+	// errRequestTooLarge is returned by parseMultipart when the body is larger than allowed
+	errRequestTooLarge = errors.New("request too large")
+
+	// errInvalidMultipart is returned by parseMultipart, wrapped with the reason, when the body cannot be parsed
+	errInvalidMultipart = errors.New("invalid multipart body")
+)
+
+// formFile is a file received in a multipart/form-data request.
+type formFile struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// isMultipart reports whether the body of a request is multipart/form-data, rather than JSON. Sending files as
+// multipart avoids inflating them by a third with base64.
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// parseMultipart parses a multipart/form-data body of at most maxSize bytes. Callers must remove the temporary files
+// of the form with r.MultipartForm.RemoveAll once done.
+func parseMultipart(w http.ResponseWriter, r *http.Request, maxSize int64) error {
+	if r.ContentLength > maxSize {
+		return errRequestTooLarge
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		return fmt.Errorf("%w: %s", errInvalidMultipart, err)
+	}
+	return nil
+}
+
+// formFiles returns the files of a field of a parsed multipart form, in the order they were sent.
+func formFiles(r *http.Request, field string) ([]formFile, error) {
+	if r.MultipartForm == nil {
+		return nil, nil
+	}
+	headers := r.MultipartForm.File[field]
+	files := make([]formFile, 0, len(headers))
+	for _, h := range headers {
+		f, err := h.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, formFile{Filename: h.Filename, ContentType: h.Header.Get("Content-Type"), Content: content})
+	}
+	return files, nil
+}
+
+// decodeMultipartMessage decodes a message sent as multipart/form-data: the `message` field holds the message as JSON,
+// and each file of the `attachments` field is appended to its attachments. Files are sniffed like the other
+// attachments; the content type of a file only tells voice recordings apart from videos. It writes the error response
+// and returns false when the body is invalid; otherwise the caller must remove the temporary files of the form.
+func decodeMultipartMessage(w http.ResponseWriter, r *http.Request, ctx reqcontext.RequestContext, message *schema.Message) bool {
+	if err := parseMultipart(w, r, maxAttachments*maxAttachmentSize+multipartOverhead); err != nil {
+		writeMappedError(w, ctx, err)
+		return false
+	}
+	if err := json.Unmarshal([]byte(r.FormValue("message")), message); err != nil {
+		_ = r.MultipartForm.RemoveAll()
+		writeError(w, ctx, http.StatusBadRequest, "Invalid message field")
+		return false
+	}
+	files, err := formFiles(r, "attachments")
+	if err != nil {
+		_ = r.MultipartForm.RemoveAll()
+		writeMappedError(w, ctx, err)
+		return false
+	}
+	for _, f := range files {
+		a := schema.Attachment{Filename: f.Filename, Content: f.Content}
+		if mediaType, _, err := mime.ParseMediaType(f.ContentType); err == nil && attachmentKind(mediaType) == schema.AttachmentAudio {
+			a.Kind = schema.AttachmentAudio
+		}
+		message.Attachments = append(message.Attachments, a)
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// minPasswordLength is the length of the shortest password accepted, in bytes
+	minPasswordLength = 8
+
+	// maxPasswordLength is the length of the longest password accepted, in bytes: bcrypt ignores what follows
+	maxPasswordLength = 72
+)
+
+// errWeakPassword is returned for passwords too short or too long
+var errWeakPassword = errors.New("password must be between 8 and 72 bytes")
+
+// hashPassword returns the bcrypt hash of a password, or errWeakPassword.
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return "", errWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// HashPassword is hashPassword for the `set-password` command of webapi, which sets passwords without the API.
+func HashPassword(password string) (string, error) {
+	return hashPassword(password)
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// checkPassword reports whether the password matches the hash. An empty hash never matches, but takes as long to
+// check as a real one, so that the response time does not tell whether a user has a password.
+func checkPassword(hash, password string) bool {
+	if hash == "" {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+		})
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
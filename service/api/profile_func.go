@@ -1,42 +1,96 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/dilcetto/wasa/service/api/reqcontext"
 	"github.com/dilcetto/wasa/service/components/requests"
 	"github.com/dilcetto/wasa/service/components/schema"
-	"github.com/dilcetto/wasa/service/database"
+	"github.com/dilcetto/wasa/service/globaltime"
 	"github.com/julienschmidt/httprouter"
 )
 
 var ErrUnauthorized = errors.New("unauthorized")
 
 func (rt *_router) getAuthenticatedUserID(r *http.Request) (string, error) {
+	session, err := rt.getAuthenticatedSession(r)
+	if err != nil {
+		return "", err
+	}
+	return session.UserID, nil
+}
+
+// getAuthenticatedSession returns the session of the bearer token of the request.
+func (rt *_router) getAuthenticatedSession(r *http.Request) (*schema.Session, error) {
 	authHeader := r.Header.Get("Authorization")
 	if len(authHeader) < 7 || !strings.HasPrefix(authHeader, "Bearer ") {
-		return "", ErrUnauthorized
+		return nil, ErrUnauthorized
 	}
-	tokenString := authHeader[7:]
+	return rt.authenticateToken(r.Context(), authHeader[7:])
+}
 
-	userID, err := ParseToken(tokenString)
+// getAuthenticatedUserIDAllowQuery is getAuthenticatedUserID for the endpoints that browsers reach without setting
+// headers (WebSockets, images): the token can also be passed in the `token` query parameter.
+func (rt *_router) getAuthenticatedUserIDAllowQuery(r *http.Request) (string, error) {
+	session, err := rt.getAuthenticatedSessionAllowQuery(r)
 	if err != nil {
-		return "", ErrUnauthorized
+		return "", err
 	}
-	if _, err := rt.db.GetUserById(userID); err != nil {
-		if errors.Is(err, database.ErrUserDoesNotExist) {
-			return "", ErrUnauthorized
+	return session.UserID, nil
+}
+
+// getAuthenticatedSessionAllowQuery is getAuthenticatedSession, with the token also accepted in the query string.
+func (rt *_router) getAuthenticatedSessionAllowQuery(r *http.Request) (*schema.Session, error) {
+	session, err := rt.getAuthenticatedSession(r)
+	if err != nil && r.URL.Query().Get("token") != "" {
+		return rt.authenticateToken(r.Context(), r.URL.Query().Get("token"))
+	}
+	return session, err
+}
+
+// sessionSeenInterval is how often the last-seen time of a session is recorded, when its device does not change
+const sessionSeenInterval = time.Minute
+
+// authenticateToken validates an access token and returns the session it was issued for. Tokens of closed sessions,
+// including the sessions of deleted users, are refused. The session is marked as seen from the client of ctx.
+func (rt *_router) authenticateToken(ctx context.Context, tokenString string) (*schema.Session, error) {
+	userID, sessionID, err := rt.tokens.parse(tokenString)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	session, err := rt.db.GetSession(ctx, sessionID, globaltime.Now())
+	if errors.Is(err, schema.ErrSessionNotFound) || (err == nil && session.UserID != userID) {
+		return nil, ErrUnauthorized
+	} else if err != nil {
+		return nil, err
+	}
+
+	client := reqcontext.ClientFrom(ctx)
+	now := globaltime.Now()
+	lastSeen, _ := time.Parse(time.RFC3339, session.LastSeenAt)
+	if now.Sub(lastSeen) >= sessionSeenInterval || client.IP != session.IP || client.UserAgent != session.UserAgent {
+		if err := rt.db.TouchSession(ctx, session.ID, client.IP, client.UserAgent, now); err != nil {
+			return nil, err
 		}
+		session.LastSeenAt = now.UTC().Format(time.RFC3339)
+		session.IP, session.UserAgent = client.IP, client.UserAgent
 	}
-	return userID, nil
+	return session, nil
 }
 
 func (rt *_router) search_by(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeError(w, ctx, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 	req := requests.SearchRequest{
@@ -45,34 +99,31 @@ func (rt *_router) search_by(w http.ResponseWriter, r *http.Request, ps httprout
 	}
 
 	if req.User == "" && req.Conversation == "" {
-		http.Error(w, "Missing query parameters", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Missing query parameters")
 		return
 	}
 	if !req.IsValid() {
-		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid query parameters")
 		return
 	}
 
 	var (
 		users         []schema.User
 		conversations []schema.Conversation
-		err           error
 	)
 
 	if req.User != "" {
-		users, err = rt.db.SearchUserByUsername(req.User)
+		users, err = rt.db.SearchUserByUsername(r.Context(), req.User)
 		if err != nil {
-			ctx.Logger.WithError(err).Error("Failed to search users by username")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			writeMappedError(w, ctx, err)
 			return
 		}
 	}
 
 	if req.Conversation != "" {
-		conversations, err = rt.db.SearchConversationByName(req.Conversation)
+		conversations, err = rt.db.SearchConversationByName(r.Context(), userID, req.Conversation)
 		if err != nil {
-			ctx.Logger.WithError(err).Error("Failed to search conversations by name")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			writeMappedError(w, ctx, err)
 			return
 		}
 	}
@@ -90,20 +141,18 @@ func (rt *_router) search_by(w http.ResponseWriter, r *http.Request, ps httprout
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		ctx.Logger.WithError(err).Error("Failed to encode response")
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
-		return
 	}
 }
 
 func (rt *_router) setMyUserName(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	if r.Method != http.MethodPut {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeError(w, ctx, http.StatusMethodNotAllowed, "Method Not Allowed")
 		return
 	}
-	userID, err := rt.getAuthenticatedUserID(r)
+	session, err := rt.getAuthenticatedSession(r)
 	if err != nil {
 		ctx.Logger.WithError(err).Error("Unauthorized access")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
@@ -111,68 +160,76 @@ func (rt *_router) setMyUserName(w http.ResponseWriter, r *http.Request, ps http
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		ctx.Logger.WithError(err).Error("Failed to decode request body")
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
 	if !req.IsValid() {
-		http.Error(w, "Username must be between 3 and 16 characters", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Username must be between 3 and 16 characters")
 		return
 	}
 
-	dbErr := rt.db.UpdateUsername(userID, req.Username)
-	if errors.Is(dbErr, database.ErrUserDoesNotExist) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+	if err := rt.db.UpdateUsername(r.Context(), session.UserID, req.Username); err != nil {
+		writeMappedError(w, ctx, err)
 		return
-	} else if errors.Is(dbErr, database.ErrUsernameTaken) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusConflict)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Username already exists"})
-		return
-	} else if dbErr != nil {
-		ctx.Logger.WithError(dbErr).Error("failed to update username")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update username"})
+	}
+	// the username is what logs in, so the sessions opened on other devices are closed
+	if _, err := rt.db.DeleteUserSessions(r.Context(), session.UserID, session.ID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
+	rt.hub.DisconnectAll(session.UserID, session.ID)
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (rt *_router) setMyPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	if r.Method != http.MethodPut {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeError(w, ctx, http.StatusMethodNotAllowed, "Method Not Allowed")
 		return
 	}
 	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
 		ctx.Logger.WithError(err).Error("Unauthorized access")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
 	var req requests.ProfilePhotoUpdateRequest
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	// the photo is sent either in the `photo` file of a multipart form, or base64-encoded in JSON
+	if isMultipart(r) {
+		if err := parseMultipart(w, r, maxPhotoSize+multipartOverhead); err != nil {
+			writeMappedError(w, ctx, err)
+			return
+		}
+		defer func() { _ = r.MultipartForm.RemoveAll() }()
+		files, err := formFiles(r, "photo")
+		if err != nil {
+			writeMappedError(w, ctx, err)
+			return
+		}
+		if len(files) > 0 {
+			req.Photo = files[0].Content
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		ctx.Logger.WithError(err).Error("Failed to decode request body")
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
 	if !req.IsValid() {
-		http.Error(w, "Invalid photo", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid photo")
 		return
 	}
 
-	dbErr := rt.db.UpdateUserPhoto(userID, req.Photo)
-	if errors.Is(dbErr, database.ErrUserDoesNotExist) {
-		http.Error(w, "User not found", http.StatusNotFound)
+	photoID, err := rt.storePhoto(r.Context(), req.Photo)
+	if err != nil {
+		writeMappedError(w, ctx, err)
 		return
-	} else if dbErr != nil {
-		ctx.Logger.WithError(dbErr).Error("failed to update user photo")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+
+	if err := rt.db.UpdateUserPhoto(r.Context(), userID, photoID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
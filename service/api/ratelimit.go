@@ -0,0 +1,385 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// errTooManyLogins is returned when a username failed to log in too many times from an address, or during the backoff
+// of a username that failed too many times from any address, until some attempts are allowed again
+var errTooManyLogins = errors.New("too many failed logins")
+
+// minLoginBackoff and maxLoginBackoff bound how long a username that failed more than UsernameFailures waits between
+// logins, doubling with each failure over the limit.
+const (
+	minLoginBackoff = time.Second
+	maxLoginBackoff = 30 * time.Second
+)
+
+// RateLimit allows Requests requests per Period, in bursts of up to Requests: it is a token bucket that holds Requests
+// tokens and refills at Requests per Period. The zero RateLimit allows every request.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Requests > 0 && l.Period > 0
+}
+
+// perSecond is how many tokens the bucket earns each second.
+func (l RateLimit) perSecond() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// RateLimitConfig configures the rate limits of the API. Requests are counted per route, and per user for the requests
+// with a valid access token, or per IP address for the others.
+type RateLimitConfig struct {
+	// Default limits the routes that have no limit in Routes
+	Default RateLimit
+
+	// Routes are the limits of specific routes, by method and path as registered, e.g. "POST /login". A zero limit
+	// lifts the default one.
+	Routes map[string]RateLimit
+
+	// LoginFailures limits the failed logins of each username from each IP address, against password guessing. Once
+	// exhausted, the username cannot log in from the address until the bucket refills.
+	LoginFailures RateLimit
+
+	// UsernameFailures limits the failed logins of each username, whatever the address they come from, against
+	// guessing from many addresses. Once exhausted, the username gets one login per backoff period rather than none,
+	// so that nobody can lock a user out of their account.
+	UsernameFailures RateLimit
+}
+
+// limit returns the limit of a route.
+func (c RateLimitConfig) limit(route string) RateLimit {
+	if limit, ok := c.Routes[route]; ok {
+		return limit
+	}
+	return c.Default
+}
+
+// tokenBucket counts the requests of a client, see RateLimit.
+type tokenBucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated time.Time
+
+	// next is the time before which the bucket refuses requests while it owes tokens, see reserve
+	next time.Time
+}
+
+// refill adds the tokens earned since the last update.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Requests), b.tokens+elapsed.Seconds()*b.limit.perSecond())
+		b.updated = now
+	}
+}
+
+// until returns how long until the bucket holds n tokens.
+func (b *tokenBucket) until(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.limit.perSecond() * float64(time.Second))
+}
+
+// rateStatus is the state of a bucket after a request, as reported in the RateLimit headers.
+type rateStatus struct {
+	limit   RateLimit
+	allowed bool
+
+	// remaining is the number of requests allowed right now
+	remaining int
+
+	// retryAfter is how long until the next request is allowed, and reset how long until the bucket is full again
+	retryAfter time.Duration
+	reset      time.Duration
+}
+
+// rateLimiter keeps the token buckets of the clients, by key. Buckets live in memory: every instance of the server
+// counts the requests it serves, and restarting it resets the counts.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// bucket returns the bucket of key, refilled at now. Missing buckets, and the buckets of another limit, start full.
+// The caller must hold mu.
+func (l *rateLimiter) bucket(key string, limit RateLimit, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		b = &tokenBucket{limit: limit, tokens: float64(limit.Requests), updated: now}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	return b
+}
+
+// status describes the bucket after a request, allowed or not.
+func (b *tokenBucket) status(allowed bool) rateStatus {
+	return rateStatus{
+		limit:      b.limit,
+		allowed:    allowed,
+		remaining:  int(b.tokens),
+		retryAfter: b.until(1),
+		reset:      b.until(float64(b.limit.Requests)),
+	}
+}
+
+// take takes a token from the bucket of key, when it has one: the request is allowed.
+func (l *rateLimiter) take(key string, limit RateLimit, now time.Time) rateStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(key, limit, now)
+	if b.tokens < 1 {
+		return b.status(false)
+	}
+	b.tokens--
+	return b.status(true)
+}
+
+// check tells whether the bucket of key has a token, without taking it.
+func (l *rateLimiter) check(key string, limit RateLimit, now time.Time) rateStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(key, limit, now)
+	return b.status(b.tokens >= 1)
+}
+
+// refund gives back a token taken from the bucket of key, for a request that did not go through after all.
+func (l *rateLimiter) refund(key string, limit RateLimit, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(key, limit, now)
+	b.tokens = math.Min(float64(limit.Requests), b.tokens+1)
+}
+
+// charge takes a token from the bucket of key even when it has none, down to owing limit.Requests tokens, and
+// returns how many tokens it owes: the requests over the limit that are not paid back yet.
+func (l *rateLimiter) charge(key string, limit RateLimit, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(key, limit, now)
+	b.tokens = math.Max(b.tokens-1, -float64(limit.Requests))
+	return b.owed()
+}
+
+// owed returns how many tokens the bucket of key owes, see charge.
+func (l *rateLimiter) owed(key string, limit RateLimit, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bucket(key, limit, now).owed()
+}
+
+// delay makes the bucket of key refuse the requests of the next `wait`, as long as it owes tokens.
+func (l *rateLimiter) delay(key string, limit RateLimit, now time.Time, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bucket(key, limit, now).next = now.Add(wait)
+}
+
+// reserve returns how long until the bucket of key, when it owes tokens, lets a request through. When it lets the
+// request through, it delays the next ones by backoff(owed) so that concurrent requests are taken one at a time.
+func (l *rateLimiter) reserve(key string, limit RateLimit, now time.Time, backoff func(owed int) time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(key, limit, now)
+	owed := b.owed()
+	if owed == 0 {
+		return 0
+	}
+	if wait := b.next.Sub(now); wait > 0 {
+		return wait
+	}
+	b.next = now.Add(backoff(owed))
+	return 0
+}
+
+func (b *tokenBucket) owed() int {
+	if b.tokens >= 0 {
+		return 0
+	}
+	return int(math.Ceil(-b.tokens))
+}
+
+// forget fills the bucket of key again.
+func (l *rateLimiter) forget(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, key)
+}
+
+// prune deletes the buckets that are full at now, as they are no different from new ones, and returns how many are
+// left.
+func (l *rateLimiter) prune(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Requests) {
+			delete(l.buckets, key)
+		}
+	}
+	return len(l.buckets)
+}
+
+// pruneRateLimits deletes the buckets of the clients that have not sent requests for a while.
+func (rt *_router) pruneRateLimits(ctx context.Context, now time.Time) {
+	left := rt.limiter.prune(now)
+	rateLimitBuckets.Set(float64(left))
+}
+
+// limitRate applies the rate limit of a route, by method and path, to its handler. Requests over the limit are
+// refused with 429 Too Many Requests, and every response of a limited route carries the RateLimit headers.
+func (rt *_router) limitRate(method, path string, fn httpRouterHandler) httpRouterHandler {
+	route := method + " " + path
+	limit := rt.limits.limit(route)
+	if !limit.enabled() {
+		return fn
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+		status := rt.limiter.take(route+" "+rt.rateLimitClient(r, ctx), limit, globaltime.Now())
+		setRateLimitHeaders(w, status)
+		if !status.allowed {
+			writeError(w, ctx, http.StatusTooManyRequests, "Too many requests, try again later")
+			return
+		}
+		fn(w, r, ps, ctx)
+	}
+}
+
+// rateLimitClient returns who the requests are counted for: the user of a valid access token, or the IP address. The
+// session of the token is not checked, which would cost a database query for every request.
+func (rt *_router) rateLimitClient(r *http.Request, ctx reqcontext.RequestContext) string {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = auth[7:]
+	}
+	if token != "" {
+		if userID, _, err := rt.tokens.parse(token); err == nil {
+			return "user:" + userID
+		}
+	}
+	return "ip:" + ctx.Client.IP
+}
+
+// setRateLimitHeaders describes the rate limit of the route in the response: the policy (requests per window, in
+// seconds), the requests left, the seconds until they are all available again, and when refused, the seconds until
+// the next request is allowed.
+func setRateLimitHeaders(w http.ResponseWriter, status rateStatus) {
+	h := w.Header()
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", status.limit.Requests, ceilSeconds(status.limit.Period)))
+	h.Set("RateLimit-Limit", strconv.Itoa(status.limit.Requests))
+	h.Set("RateLimit-Remaining", strconv.Itoa(status.remaining))
+	h.Set("RateLimit-Reset", ceilSeconds(status.reset))
+	if !status.allowed {
+		setRetryAfter(w, status.retryAfter)
+	}
+}
+
+// setRetryAfter tells a refused client how long to wait, in whole seconds.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	if wait < time.Second {
+		wait = time.Second
+	}
+	w.Header().Set("Retry-After", ceilSeconds(wait))
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// loginFailuresKey is the bucket of the failed logins of a username from an IP address. Usernames are compared
+// without case, like logins from several addresses would try them.
+func loginFailuresKey(username, ip string) string {
+	return "login-failures " + strings.ToLower(username) + " " + ip
+}
+
+// usernameFailuresKey is the bucket of the failed logins of a username from any address.
+func usernameFailuresKey(username string) string {
+	return "username-failures " + strings.ToLower(username)
+}
+
+// checkLoginFailures returns errTooManyLogins, and sets the Retry-After header, when the username failed to log in
+// too many times recently from the address of the client, or when it failed too many times from any address and its
+// backoff is not over. Logins are refused rather than held, which would tie a goroutine to each guess and outlast
+// the write timeout of the server; a login let through after a backoff starts the next one.
+func (rt *_router) checkLoginFailures(w http.ResponseWriter, username string, client reqcontext.Client) error {
+	now := globaltime.Now()
+	if rt.limits.LoginFailures.enabled() {
+		status := rt.limiter.check(loginFailuresKey(username, client.IP), rt.limits.LoginFailures, now)
+		if !status.allowed {
+			setRetryAfter(w, status.retryAfter)
+			return errTooManyLogins
+		}
+	}
+	if !rt.limits.UsernameFailures.enabled() {
+		return nil
+	}
+	if wait := rt.limiter.reserve(usernameFailuresKey(username), rt.limits.UsernameFailures, now, loginBackoff); wait > 0 {
+		setRetryAfter(w, wait)
+		return errTooManyLogins
+	}
+	return nil
+}
+
+// loginBackoff is how long a username waits between logins when it failed owed times more than UsernameFailures
+// allows.
+func loginBackoff(owed int) time.Duration {
+	if owed == 0 {
+		return 0
+	}
+	wait := minLoginBackoff
+	for i := 1; i < owed && wait < maxLoginBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxLoginBackoff {
+		wait = maxLoginBackoff
+	}
+	return wait
+}
+
+// recordLogin counts a failed login of the username, when err says that the credentials were wrong, and forgets the
+// failures of a successful login.
+func (rt *_router) recordLogin(ctx reqcontext.RequestContext, username string, err error) {
+	now := globaltime.Now()
+	switch {
+	case err == nil:
+		rt.limiter.forget(loginFailuresKey(username, ctx.Client.IP))
+		rt.limiter.forget(usernameFailuresKey(username))
+	case errors.Is(err, errInvalidCredentials):
+		logger := ctx.Logger.WithField("username", username)
+		if rt.limits.LoginFailures.enabled() {
+			status := rt.limiter.take(loginFailuresKey(username, ctx.Client.IP), rt.limits.LoginFailures, now)
+			if status.remaining == 0 {
+				logger.Warning("Too many failed logins, the username is locked for a while from the address")
+			}
+		}
+		if rt.limits.UsernameFailures.enabled() {
+			key := usernameFailuresKey(username)
+			owed := rt.limiter.charge(key, rt.limits.UsernameFailures, now)
+			rt.limiter.delay(key, rt.limits.UsernameFailures, now, loginBackoff(owed))
+			if owed == 1 {
+				logger.Warning("Too many failed logins, the logins of the username are slowed down for a while")
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/globaltime"
+	"github.com/sirupsen/logrus"
+)
+
+// TestLoginFailures checks that failed logins lock a username out of an address only, and only let its logins from
+// the other addresses through once per backoff period.
+func TestLoginFailures(t *testing.T) {
+	globaltime.FixedTime = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+	rt := &_router{
+		limits: RateLimitConfig{
+			LoginFailures:    RateLimit{Requests: 2, Period: time.Hour},
+			UsernameFailures: RateLimit{Requests: 3, Period: time.Hour},
+		},
+		limiter: newRateLimiter(),
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	from := func(ip string) reqcontext.RequestContext {
+		return reqcontext.RequestContext{Logger: logger, Client: reqcontext.Client{IP: ip}}
+	}
+	attacker, user := from("192.0.2.1"), from("192.0.2.2")
+	check := func(ctx reqcontext.RequestContext, retryAfter string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		err := rt.checkLoginFailures(w, "alice", ctx.Client)
+		if retryAfter == "" && err != nil {
+			t.Errorf("login from %s: %v", ctx.Client.IP, err)
+		} else if retryAfter != "" && (err != errTooManyLogins || w.Header().Get("Retry-After") != retryAfter) {
+			t.Errorf("login from %s: got %v and Retry-After %q, want %v and %q", ctx.Client.IP, err,
+				w.Header().Get("Retry-After"), errTooManyLogins, retryAfter)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		rt.recordLogin(attacker, "Alice", errInvalidCredentials)
+	}
+	check(attacker, "1800")
+	check(user, "")
+
+	// the failures from other addresses space the logins of the username out once over the limit
+	owed := func() int {
+		return rt.limiter.owed(usernameFailuresKey("alice"), rt.limits.UsernameFailures, globaltime.Now())
+	}
+	rt.recordLogin(from("192.0.2.3"), "alice", errInvalidCredentials)
+	if owed() != 0 {
+		t.Fatalf("the username owes %d failures at the limit, want 0", owed())
+	}
+	check(user, "")
+	rt.recordLogin(from("192.0.2.3"), "alice", errInvalidCredentials)
+	if owed() != 1 {
+		t.Fatalf("the username owes %d failures, want 1", owed())
+	}
+	check(user, "1")
+
+	// once the backoff is over, a single login goes through until it fails
+	globaltime.FixedTime = globaltime.FixedTime.Add(minLoginBackoff)
+	check(from("192.0.2.4"), "")
+	check(user, "1")
+	rt.recordLogin(from("192.0.2.4"), "alice", errInvalidCredentials)
+	check(user, "2")
+
+	globaltime.FixedTime = globaltime.FixedTime.Add(2 * minLoginBackoff)
+	check(user, "")
+	rt.recordLogin(user, "alice", nil)
+	if owed() != 0 {
+		t.Errorf("a successful login left %d failures of the username", owed())
+	}
+	check(user, "")
+}
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		owed int
+		want time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{5, 16 * time.Second},
+		{6, maxLoginBackoff},
+		{1000, maxLoginBackoff},
+	}
+	for _, tt := range tests {
+		if got := loginBackoff(tt.owed); got != tt.want {
+			t.Errorf("loginBackoff(%d) = %v, want %v", tt.owed, got, tt.want)
+		}
+	}
+}
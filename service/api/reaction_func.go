@@ -7,31 +7,42 @@ import (
 	"github.com/dilcetto/wasa/service/api/reqcontext"
 	"github.com/dilcetto/wasa/service/components/requests"
 	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/events"
 	"github.com/julienschmidt/httprouter"
 )
 
 func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, ctx, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
 	var req requests.AddReactionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		ctx.Logger.WithError(err).Error("Failed to decode comment request")
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Emoji == "" {
+		writeError(w, ctx, http.StatusBadRequest, "Missing emoji")
 		return
 	}
 
+	conversationID := ps.ByName("conversationId")
 	messageID := ps.ByName("messageId")
-	if messageID == "" {
-		http.Error(w, "Missing message ID", http.StatusBadRequest)
+	if conversationID == "" || messageID == "" {
+		writeError(w, ctx, http.StatusBadRequest, "Missing conversation or message ID")
+		return
+	}
+
+	if err := rt.authz.Message(r.Context(), userID, conversationID, messageID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
 
@@ -41,47 +52,60 @@ func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps htt
 		Emoji:     req.Emoji,
 	}
 
-	err = rt.db.AddReactionToMessage(reaction)
+	err = rt.db.AddReactionToMessage(r.Context(), reaction)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to insert comment")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
+	rt.publish(ctx, conversationID, events.ReactionChanged, events.ReactionData{
+		MessageID: messageID,
+		UserID:    userID,
+		Emoji:     req.Emoji,
+	})
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (rt *_router) uncommentMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	if r.Method != http.MethodDelete {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, ctx, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	userID, err := rt.getAuthenticatedUserID(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
 	var req requests.RemoveReactionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		ctx.Logger.WithError(err).Error("Failed to decode un-comment request")
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
+	conversationID := ps.ByName("conversationId")
 	messageID := ps.ByName("messageId")
-	if messageID == "" {
-		http.Error(w, "Missing message ID", http.StatusBadRequest)
+	if conversationID == "" || messageID == "" {
+		writeError(w, ctx, http.StatusBadRequest, "Missing conversation or message ID")
+		return
+	}
+
+	if err := rt.authz.Message(r.Context(), userID, conversationID, messageID); err != nil {
+		writeMappedError(w, ctx, err)
 		return
 	}
 
-	err = rt.db.DeleteReactionFromMessage(messageID, userID)
+	err = rt.db.DeleteReactionFromMessage(r.Context(), messageID, userID)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to remove comment")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeMappedError(w, ctx, err)
 		return
 	}
+	rt.publish(ctx, conversationID, events.ReactionChanged, events.ReactionData{
+		MessageID: messageID,
+		UserID:    userID,
+	})
 
 	w.WriteHeader(http.StatusNoContent)
 }
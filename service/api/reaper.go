@@ -0,0 +1,171 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/blobstore"
+	"github.com/dilcetto/wasa/service/events"
+)
+
+const (
+	// defaultExpiryInterval is how often expired messages, uploads, sessions and passkey challenges are deleted when
+	// Config.ExpiryInterval is not set
+	defaultExpiryInterval = time.Minute
+
+	// expiryBatchSize is the largest number of expired messages, uploads, sessions or challenges deleted in a single
+	// transaction
+	expiryBatchSize = 500
+
+	// blobDeletionGrace is how long blobs stay marked for deletion before they are deleted, if nothing references them
+	// anymore. It lets the requests that stored the same content before it was marked reference it.
+	blobDeletionGrace = time.Hour
+)
+
+// reapExpiredMessages deletes the messages that expired at `now`; their attachments are swept by sweepUnusedBlobs.
+// Members of the conversations are notified as if the messages had been deleted by their senders.
+func (rt *_router) reapExpiredMessages(ctx context.Context, now time.Time) {
+	logger := rt.baseLogger.WithField("task", "reaper")
+	for {
+		expired, err := rt.db.DeleteExpiredMessages(ctx, now, expiryBatchSize)
+		if err != nil {
+			logger.WithError(err).Error("Failed to delete expired messages")
+			return
+		}
+		for _, m := range expired {
+			rt.publish(reqcontext.RequestContext{Logger: logger}, m.ConversationID, events.MessageDeleted, events.MessageData{MessageID: m.ID})
+		}
+		if len(expired) > 0 {
+			logger.Debugf("deleted %d expired messages", len(expired))
+		}
+
+		if len(expired) < expiryBatchSize {
+			return
+		}
+	}
+}
+
+// reapExpiredUploads deletes the resumable uploads that expired at `now`, complete or not. Their content is swept by
+// sweepUnusedBlobs, unless a message was sent with it.
+func (rt *_router) reapExpiredUploads(ctx context.Context, now time.Time) {
+	logger := rt.baseLogger.WithField("task", "reaper")
+	for {
+		deleted, err := rt.db.DeleteExpiredUploads(ctx, now, expiryBatchSize)
+		if err != nil {
+			logger.WithError(err).Error("Failed to delete expired uploads")
+			return
+		}
+		if deleted > 0 {
+			logger.Debugf("deleted %d expired uploads", deleted)
+		}
+
+		if deleted < expiryBatchSize {
+			return
+		}
+	}
+}
+
+// sweepUnusedBlobs deletes from the blob store the blobs marked for deletion for longer than blobDeletionGrace that
+// nothing references anymore. Stores of new blobs only wait while the sweep takes the unused blobs from the database,
+// and stores of the blobs being deleted wait for their deletion, see putBlob.
+func (rt *_router) sweepUnusedBlobs(ctx context.Context, now time.Time) {
+	logger := rt.baseLogger.WithField("task", "reaper")
+	for {
+		rt.blobLock.Lock()
+		unused, err := rt.db.SweepUnusedBlobs(ctx, now.Add(-blobDeletionGrace), expiryBatchSize)
+		if err != nil {
+			rt.blobLock.Unlock()
+			logger.WithError(err).Error("Failed to sweep unused blobs")
+			return
+		}
+		deleted := make(chan struct{})
+		rt.deleting, rt.deleted = make(map[string]bool, len(unused)), deleted
+		for _, blobID := range unused {
+			rt.deleting[blobID] = true
+		}
+		rt.blobLock.Unlock()
+
+		// a blob that fails to be deleted is only wasted space, so it does not stop the reaper
+		for _, blobID := range unused {
+			if err := rt.blobs.Delete(ctx, blobID); err != nil {
+				logger.WithError(err).WithField("blob_id", blobID).Warning("Failed to delete an unused blob")
+			}
+		}
+		// stores waiting for the deletion hold blobLock, so they are let through before it is taken again
+		close(deleted)
+		rt.blobLock.Lock()
+		rt.deleting = nil
+		rt.blobLock.Unlock()
+		if len(unused) > 0 {
+			logger.Debugf("deleted %d unused blobs", len(unused))
+		}
+
+		if len(unused) < expiryBatchSize {
+			return
+		}
+	}
+}
+
+// putBlob stores content in the blob store, and keeps it from being swept if it was marked for deletion: blobs are
+// shared by everything with the same content, and the caller is about to reference it. Blobs are stored concurrently,
+// but never while the sweep takes unused blobs, so a blob cannot be taken between being stored and being kept, and a
+// blob the sweep is deleting is stored again once deleted.
+func (rt *_router) putBlob(ctx context.Context, data []byte) (string, error) {
+	rt.blobLock.RLock()
+	defer rt.blobLock.RUnlock()
+	if rt.deleting[blobstore.ID(data)] {
+		select {
+		case <-rt.deleted:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	blobID, err := rt.blobs.Put(ctx, data)
+	if err != nil {
+		return "", err
+	}
+	if err := rt.db.KeepBlob(ctx, blobID); err != nil {
+		return "", err
+	}
+	return blobID, nil
+}
+
+// reapExpiredSessions deletes the sessions that expired at `now`, and the refresh tokens that expired.
+func (rt *_router) reapExpiredSessions(ctx context.Context, now time.Time) {
+	logger := rt.baseLogger.WithField("task", "reaper")
+	for {
+		deleted, err := rt.db.DeleteExpiredSessions(ctx, now, expiryBatchSize)
+		if err != nil {
+			logger.WithError(err).Error("Failed to delete expired sessions")
+			return
+		}
+		if deleted > 0 {
+			logger.Debugf("deleted %d expired sessions", deleted)
+		}
+
+		if deleted < expiryBatchSize {
+			return
+		}
+	}
+}
+
+// reapExpiredChallenges deletes the passkey challenges that expired at `now`, as ceremonies that were never completed
+// leave theirs behind.
+func (rt *_router) reapExpiredChallenges(ctx context.Context, now time.Time) {
+	logger := rt.baseLogger.WithField("task", "reaper")
+	for {
+		deleted, err := rt.db.DeleteExpiredChallenges(ctx, now, expiryBatchSize)
+		if err != nil {
+			logger.WithError(err).Error("Failed to delete expired passkey challenges")
+			return
+		}
+		if deleted > 0 {
+			logger.Debugf("deleted %d expired passkey challenges", deleted)
+		}
+
+		if deleted < expiryBatchSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dilcetto/wasa/service/blobstore"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/events"
+)
+
+// blockingDeletes is a blob store whose deletions wait to be released, announcing each blob on started first.
+type blockingDeletes struct {
+	blobstore.BlobStore
+	started chan string
+	release chan struct{}
+}
+
+func (s *blockingDeletes) Delete(ctx context.Context, id string) error {
+	s.started <- id
+	<-s.release
+	return s.BlobStore.Delete(ctx, id)
+}
+
+func TestReapExpiredMessages(t *testing.T) {
+	f := newAuthzFixture(t)
+	ctx := context.Background()
+	conversation := "/conversations/" + f.params["conversationId"]
+	f.mustDo(http.MethodPut, conversation+"/settings", f.tokens[roleMember], `{"messageTtl": 60}`, nil)
+	content := []byte("expiring")
+	var message schema.Message
+	f.mustDo(http.MethodPost, conversation+"/messages", f.tokens[roleMember], fmt.Sprintf(
+		`{"content": {"type": "text", "value": "aGk="}, "attachments": [{"kind": "file", "data": %q}]}`,
+		base64.StdEncoding.EncodeToString(content)), &message)
+	session := f.rt.hub.Subscribe(f.users["target"], "target")
+	now := time.Now()
+
+	f.rt.reapExpiredMessages(ctx, now)
+	if _, err := f.db.GetMessageByID(ctx, message.ID); err != nil {
+		t.Fatalf("a message was reaped before it expired: %v", err)
+	}
+	f.rt.reapExpiredMessages(ctx, now.Add(2*time.Minute))
+	if _, err := f.db.GetMessageByID(ctx, message.ID); !errors.Is(err, schema.ErrMessageDoesNotExist) {
+		t.Errorf("the expired message was not reaped: %v", err)
+	}
+	if got := receivedEvents(session); len(got) != 1 || got[0] != events.MessageDeleted {
+		t.Errorf("a member received %v, want a deletion", got)
+	}
+	if _, err := f.db.GetMessageByID(ctx, f.params["messageId"]); err != nil {
+		t.Errorf("a message sent before the lifetime was set was reaped: %v", err)
+	}
+
+	// the attachment is swept after the grace period only
+	blobID := blobstore.ID(content)
+	f.rt.sweepUnusedBlobs(ctx, now.Add(blobDeletionGrace/2))
+	if _, err := f.rt.blobs.Get(ctx, blobID); err != nil {
+		t.Fatalf("the attachment was swept during the grace period: %v", err)
+	}
+	f.rt.sweepUnusedBlobs(ctx, now.Add(2*blobDeletionGrace))
+	if _, err := f.rt.blobs.Get(ctx, blobID); !errors.Is(err, blobstore.ErrBlobNotFound) {
+		t.Errorf("the attachment of the expired message was not swept: %v", err)
+	}
+	if _, err := f.rt.blobs.Get(ctx, f.params["blobId"]); err != nil {
+		t.Errorf("an attachment in use was swept: %v", err)
+	}
+}
+
+// TestSweepUnusedBlobs checks that blobs are stored while the sweep deletes others, and that storing a blob being
+// deleted waits for its deletion, so that it is not lost.
+func TestSweepUnusedBlobs(t *testing.T) {
+	f := newAuthzFixture(t)
+	ctx := context.Background()
+	content := []byte("swept")
+	blobID := blobstore.ID(content)
+	// the blob is the attachment of a message deleted for everyone, which marks it
+	var message schema.Message
+	conversation := "/conversations/" + f.params["conversationId"]
+	f.mustDo(http.MethodPost, conversation+"/messages", f.tokens[roleMember], fmt.Sprintf(
+		`{"attachments": [{"kind": "file", "data": %q}]}`, base64.StdEncoding.EncodeToString(content)), &message)
+	f.mustDo(http.MethodDelete, conversation+"/messages/"+message.ID, f.tokens[roleMember], "", nil)
+
+	store := &blockingDeletes{BlobStore: f.rt.blobs, started: make(chan string), release: make(chan struct{})}
+	f.rt.blobs = store
+	swept := make(chan struct{})
+	go func() {
+		f.rt.sweepUnusedBlobs(ctx, time.Now().Add(2*blobDeletionGrace))
+		close(swept)
+	}()
+	if id := <-store.started; id != blobID {
+		t.Fatalf("the sweep deletes %s, want %s", id, blobID)
+	}
+
+	// other blobs are stored during the deletion
+	other := make(chan error)
+	go func() {
+		_, err := f.rt.putBlob(ctx, []byte("other"))
+		other <- err
+	}()
+	select {
+	case err := <-other:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("storing another blob waits for the sweep")
+	}
+
+	// the blob being deleted is stored again after its deletion
+	stored := make(chan error)
+	go func() {
+		_, err := f.rt.putBlob(ctx, content)
+		stored <- err
+	}()
+	select {
+	case err := <-stored:
+		t.Fatalf("the blob being deleted was stored during its deletion: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(store.release)
+	if err := <-stored; err != nil {
+		t.Fatal(err)
+	}
+	<-swept
+	if _, err := store.Get(ctx, blobID); err != nil {
+		t.Errorf("the blob stored during its deletion is lost: %v", err)
+	}
+}
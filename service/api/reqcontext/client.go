@@ -0,0 +1,25 @@
+package reqcontext
+
+import "context"
+
+// Client describes the device that sent a request, as seen by the server.
+type Client struct {
+	// IP is the address of the client, without the port
+	IP string
+
+	// UserAgent is the User-Agent header of the request
+	UserAgent string
+}
+
+type clientKey struct{}
+
+// WithClient returns a copy of ctx that carries the client of the request.
+func WithClient(ctx context.Context, client Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFrom returns the client carried by ctx, or an empty Client.
+func ClientFrom(ctx context.Context) Client {
+	client, _ := ctx.Value(clientKey{}).(Client)
+	return client
+}
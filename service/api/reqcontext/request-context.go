@@ -18,4 +18,8 @@ type RequestContext struct {
 
 	// Logger is a custom field logger for the request
 	Logger logrus.FieldLogger
+
+	// Client is the device that sent the request. It is also carried by the context of the request, for the code that
+	// only sees the http.Request.
+	Client Client
 }
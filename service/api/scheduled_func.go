@@ -0,0 +1,228 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxScheduleAhead is how far in the future messages can be scheduled.
+const maxScheduleAhead = 365 * 24 * time.Hour
+
+// scheduleMessage queues a message to be sent to the conversation at `sendAt`. Scheduled messages are only visible to
+// their sender until they are sent.
+func (rt *_router) scheduleMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationID := ps.ByName("conversationId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var message schema.ScheduledMessage
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if message.SendAt, err = parseSendAt(message.SendAt); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(message.Content.Value) == 0 && len(message.Attachments) == 0 {
+		writeError(w, ctx, http.StatusBadRequest, "Missing message content")
+		return
+	}
+
+	if err := rt.authz.NewMessage(r.Context(), userID, conversationID, message.ReplyTo); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	message.ID, err = generateNewID()
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	message.Attachments, err = rt.storeAttachments(r.Context(), userID, message.Attachments)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	message.AttachmentIDs = nil
+	message.ConversationID = conversationID
+	message.SenderID = userID
+	message.CreatedAt = generateCurrentTimestamp()
+
+	if err := rt.db.CreateScheduledMessage(r.Context(), &message); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	stored, err := rt.db.GetScheduledMessage(r.Context(), message.ID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(stored)
+}
+
+// getScheduledMessages lists the messages the caller scheduled in the conversation, in the order they will be sent.
+func (rt *_router) getScheduledMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationID := ps.ByName("conversationId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := rt.authz.Conversation(r.Context(), userID, conversationID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	messages, err := rt.db.GetScheduledMessages(r.Context(), conversationID, userID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(messages)
+}
+
+// updateScheduledMessage replaces the content and the send time of a scheduled message that has not been sent yet. A
+// failed message is retried at its new send time. The attachments whose blob IDs the request lists in `attachmentIds`
+// are kept, in that order, followed by the new `attachments` of the request; the others are removed.
+func (rt *_router) updateScheduledMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationID := ps.ByName("conversationId")
+	scheduledID := ps.ByName("scheduledId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var update schema.ScheduledMessage
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if update.SendAt, err = parseSendAt(update.SendAt); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	message, err := rt.ownScheduledMessage(r, userID, conversationID, scheduledID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if err := rt.authz.NewMessage(r.Context(), userID, conversationID, update.ReplyTo); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	var attachments []schema.Attachment
+	for _, blobID := range update.AttachmentIDs {
+		for _, a := range message.Attachments {
+			if a.BlobID == blobID {
+				attachments = append(attachments, a)
+				break
+			}
+		}
+	}
+	if len(attachments)+len(update.Attachments) > maxAttachments {
+		writeMappedError(w, ctx, fmt.Errorf("%w: a message has at most %d attachments", errInvalidAttachment, maxAttachments))
+		return
+	}
+	added, err := rt.storeAttachments(r.Context(), userID, update.Attachments)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	message.Attachments = append(attachments, added...)
+	if len(update.Content.Value) == 0 && len(message.Attachments) == 0 {
+		writeError(w, ctx, http.StatusBadRequest, "Missing message content")
+		return
+	}
+	message.Content = update.Content
+	message.ReplyTo = update.ReplyTo
+	message.SendAt = update.SendAt
+
+	// the message may have been sent in the meantime
+	if err := rt.db.UpdateScheduledMessage(r.Context(), message); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	stored, err := rt.db.GetScheduledMessage(r.Context(), scheduledID)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stored)
+}
+
+// cancelScheduledMessage deletes a scheduled message that has not been sent yet.
+func (rt *_router) cancelScheduledMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationID := ps.ByName("conversationId")
+	scheduledID := ps.ByName("scheduledId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if _, err := rt.ownScheduledMessage(r, userID, conversationID, scheduledID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if err := rt.db.DeleteScheduledMessage(r.Context(), scheduledID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownScheduledMessage loads a scheduled message of userID in the conversation. The scheduled messages of other users
+// are reported as missing, as they are not visible to the caller.
+func (rt *_router) ownScheduledMessage(r *http.Request, userID, conversationID, scheduledID string) (*schema.ScheduledMessage, error) {
+	if err := rt.authz.Conversation(r.Context(), userID, conversationID); err != nil {
+		return nil, err
+	}
+	message, err := rt.db.GetScheduledMessage(r.Context(), scheduledID)
+	if err != nil {
+		return nil, err
+	}
+	if message.ConversationID != conversationID || message.SenderID != userID {
+		return nil, schema.ErrScheduledMessageNotFound
+	}
+	return message, nil
+}
+
+// parseSendAt checks the send time of a scheduled message, which must be in the future and in RFC 3339 format, and
+// returns it in UTC.
+func parseSendAt(value string) (string, error) {
+	sendAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", errors.New("Invalid send time: use RFC 3339, e.g. 2030-01-02T15:04:05Z")
+	}
+	now := globaltime.Now()
+	if !sendAt.After(now) {
+		return "", errors.New("Send time must be in the future")
+	}
+	if sendAt.Sub(now) > maxScheduleAhead {
+		return "", errors.New("Send time must be within a year")
+	}
+	return sendAt.UTC().Format(time.RFC3339), nil
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/database"
+	"github.com/dilcetto/wasa/service/events"
+)
+
+const (
+	// defaultSchedulerInterval is how often due scheduled messages are sent when Config.SchedulerInterval is not set
+	defaultSchedulerInterval = 5 * time.Second
+
+	// schedulerBatchSize is the largest number of scheduled messages sent in a single run
+	schedulerBatchSize = 100
+)
+
+// sendDueMessages sends the scheduled messages that are due at `now`. Messages that cannot be sent stay in the queue
+// and are retried at the next run, like the messages whose sender must wait for their slow mode turn, unless they will
+// never be sendable, e.g. because the sender left the conversation: these are marked as failed.
+func (rt *_router) sendDueMessages(ctx context.Context, now time.Time) {
+	logger := rt.baseLogger.WithField("task", "scheduler")
+	due, err := rt.db.GetDueScheduledMessages(ctx, now, schedulerBatchSize)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get due scheduled messages")
+		return
+	}
+
+	for _, m := range due {
+		stored, err := rt.sendScheduledMessage(ctx, m.ID)
+		if err != nil {
+			logger.WithError(err).WithField("scheduled_id", m.ID).Error("Failed to send scheduled message")
+			continue
+		}
+		if stored != nil {
+			messagesSent.With(messageSourceScheduled).Inc()
+			rt.publish(reqcontext.RequestContext{Logger: logger}, stored.ConversationID, events.MessageCreated, stored)
+		}
+	}
+}
+
+// sendScheduledMessage sends a scheduled message and removes it from the queue in the same transaction, so that it is
+// sent exactly once even if the process stops half-way; the message also keeps the ID of the scheduled message. It
+// returns the message sent, or nil if the scheduled message was cancelled, updated or marked as failed meanwhile, or
+// if its sender has to wait for their slow mode turn.
+func (rt *_router) sendScheduledMessage(ctx context.Context, id string) (*schema.Message, error) {
+	var stored *schema.Message
+	var turn *slowModeTurn
+	defer func() { turn.release() }()
+	err := rt.db.WithTx(ctx, func(tx database.AppDatabase) error {
+		scheduled, err := tx.GetScheduledMessage(ctx, id)
+		if errors.Is(err, schema.ErrScheduledMessageNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if scheduled.Status != "pending" {
+			return nil
+		}
+
+		// like any reply, a reply to a message deleted meanwhile quotes it as deleted
+		err = authorizer{db: tx}.NewMessage(ctx, scheduled.SenderID, scheduled.ConversationID, scheduled.ReplyTo)
+		switch {
+		case errors.Is(err, ErrForbidden):
+			return tx.FailScheduledMessage(ctx, id, "The sender is no longer a member of the conversation")
+		case errors.Is(err, schema.ErrConversationDoesNotExist):
+			return tx.FailScheduledMessage(ctx, id, "The conversation no longer exists")
+		case err != nil && !errors.Is(err, errReplyNotFound):
+			return err
+		}
+		// the slow mode turn is taken when the message is sent: a message due before the turn of its sender waits for it
+		turn, _, err = rt.takeTurn(ctx, tx, scheduled.SenderID, scheduled.ConversationID)
+		if errors.Is(err, errSlowMode) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		stored, err = postMessage(ctx, tx, &schema.Message{
+			ID:             scheduled.ID,
+			ConversationID: scheduled.ConversationID,
+			SenderID:       scheduled.SenderID,
+			Content:        scheduled.Content,
+			Attachments:    scheduled.Attachments,
+			ReplyTo:        scheduled.ReplyTo,
+		})
+		if err != nil {
+			return err
+		}
+		return tx.DeleteScheduledMessage(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	turn.use()
+	return stored, nil
+}
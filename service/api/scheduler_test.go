@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/globaltime"
+)
+
+// scheduleAt schedules a text message of the role in the group of the fixture, and returns its ID.
+func (f *authzFixture) scheduleAt(role string, sendAt time.Time) string {
+	var scheduled schema.ScheduledMessage
+	f.mustDo(http.MethodPost, "/conversations/"+f.params["conversationId"]+"/scheduled-messages", f.tokens[role],
+		fmt.Sprintf(`{"content": {"type": "text", "value": "bGF0ZXI="}, "sendAt": %q}`, sendAt.UTC().Format(time.RFC3339)), &scheduled)
+	return scheduled.ID
+}
+
+// fixTime sets the clock of the server to now until the end of the test.
+func fixTime(t *testing.T, now time.Time) {
+	globaltime.FixedTime = now
+	t.Cleanup(func() { globaltime.FixedTime = time.Time{} })
+}
+
+func TestScheduler(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second)
+	fixTime(t, start)
+	f := newAuthzFixture(t)
+	ctx := context.Background()
+	later := f.scheduleAt(roleMember, start.Add(time.Minute))
+	leaving := f.scheduleAt("target", start.Add(time.Minute))
+	f.mustDo(http.MethodDelete, "/groups/"+f.params["groupId"]+"/members/"+f.users["target"], f.tokens[roleAdmin], "", nil)
+
+	f.rt.sendDueMessages(ctx, start.Add(59*time.Second))
+	if _, err := f.db.GetMessageByID(ctx, later); !errors.Is(err, schema.ErrMessageDoesNotExist) {
+		t.Errorf("a message was sent before its time: %v", err)
+	}
+
+	fixTime(t, start.Add(time.Minute))
+	f.rt.sendDueMessages(ctx, globaltime.Now())
+	if message, err := f.db.GetMessageByID(ctx, later); err != nil || string(message.Content.Value) != "later" {
+		t.Errorf("the due message was not sent: %v", err)
+	}
+	if _, err := f.db.GetScheduledMessage(ctx, later); !errors.Is(err, schema.ErrScheduledMessageNotFound) {
+		t.Errorf("the sent message is still queued: %v", err)
+	}
+	if scheduled, err := f.db.GetScheduledMessage(ctx, leaving); err != nil || scheduled.Status != "failed" {
+		t.Errorf("the message of a member who left is not failed: %+v, %v", scheduled, err)
+	}
+
+	// nothing is sent twice
+	f.rt.sendDueMessages(ctx, globaltime.Now())
+	var messages struct {
+		Messages []schema.Message `json:"messages"`
+	}
+	f.mustDo(http.MethodGet, "/conversations/"+f.params["conversationId"]+"/messages", f.tokens[roleMember], "", &messages)
+	if len(messages.Messages) != 2 {
+		t.Errorf("the conversation holds %d messages, want 2", len(messages.Messages))
+	}
+}
+
+// TestSchedulerSlowMode checks that scheduled messages take the slow mode turn of their sender when they are sent,
+// not when they are scheduled.
+func TestSchedulerSlowMode(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second)
+	fixTime(t, start)
+	f := newAuthzFixture(t)
+	ctx := context.Background()
+	conversation := "/conversations/" + f.params["conversationId"]
+	f.mustDo(http.MethodPut, "/groups/"+f.params["groupId"]+"/slow-mode", f.tokens[roleAdmin], `{"slowMode": 60}`, nil)
+
+	f.mustDo(http.MethodPost, conversation+"/messages", f.tokens[roleMember], `{"content": {"type": "text", "value": "bm93"}}`, nil)
+	id := f.scheduleAt(roleMember, start.Add(10*time.Second))
+
+	fixTime(t, start.Add(10*time.Second))
+	f.rt.sendDueMessages(ctx, globaltime.Now())
+	if scheduled, err := f.db.GetScheduledMessage(ctx, id); err != nil || scheduled.Status != "pending" {
+		t.Fatalf("the message was not kept for the turn of its sender: %+v, %v", scheduled, err)
+	}
+
+	fixTime(t, start.Add(time.Minute))
+	f.rt.sendDueMessages(ctx, globaltime.Now())
+	if _, err := f.db.GetMessageByID(ctx, id); err != nil {
+		t.Fatalf("the message was not sent on the turn of its sender: %v", err)
+	}
+	if w := f.do(http.MethodPost, conversation+"/messages", f.tokens[roleMember], `{"content": {"type": "text", "value": "bm93"}}`, nil); w.Code != http.StatusTooManyRequests {
+		t.Errorf("a message right after the scheduled one: got %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+
+	// the owner is not slowed down
+	fixTime(t, start.Add(2*time.Minute))
+	f.mustDo(http.MethodPost, conversation+"/messages", f.tokens[roleAdmin], `{"content": {"type": "text", "value": "bm93"}}`, nil)
+	id = f.scheduleAt(roleAdmin, start.Add(2*time.Minute+time.Second))
+	f.rt.sendDueMessages(ctx, start.Add(2*time.Minute+time.Second))
+	if _, err := f.db.GetMessageByID(ctx, id); err != nil {
+		t.Errorf("the message of the owner was not sent: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// defaultSearchResults is the number of search results returned when the client does not ask for a limit
+	defaultSearchResults = 20
+
+	// maxSearchResults is the largest number of search results a client can ask for
+	maxSearchResults = 100
+
+	// maxSearchQueryLength is the longest search query accepted, in bytes
+	maxSearchQueryLength = 500
+)
+
+// searchMessages finds the messages matching the `q` query parameter in the conversations of the caller. See
+// parseMessageSearch for the query syntax.
+func (rt *_router) searchMessages(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	query := r.URL.Query()
+	search, err := parseMessageSearch(query.Get("q"))
+	if err != nil {
+		writeError(w, ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	search.UserID = userID
+	search.Limit = defaultSearchResults
+	if l := query.Get("limit"); l != "" {
+		search.Limit, err = strconv.Atoi(l)
+		if err != nil || search.Limit < 1 || search.Limit > maxSearchResults {
+			writeError(w, ctx, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	results, err := rt.db.SearchMessages(r.Context(), search)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Results []schema.MessageSearchResult `json:"results"`
+	}{results})
+}
+
+// parseMessageSearch parses a message search query. Words are matched anywhere in the text, "quoted phrases" are
+// matched as a whole and words ending with `*` match as prefixes. The filters are `from:<username>`,
+// `in:<conversation>` (conversation ID, group name or username of the other member of a direct conversation),
+// `has:photo`, `before:<date>` and `after:<date>`, with dates in YYYY-MM-DD or RFC 3339 format. Filter values can be
+// quoted too, e.g. `in:"study group"`.
+func parseMessageSearch(q string) (database.MessageSearch, error) {
+	var search database.MessageSearch
+	if len(q) > maxSearchQueryLength {
+		return search, errors.New("Search query too long")
+	}
+
+	tokens, err := splitSearchQuery(q)
+	if err != nil {
+		return search, err
+	}
+	hasFilter := false
+	for _, tok := range tokens {
+		if tok.quoted {
+			if tok.text != "" {
+				search.Terms = append(search.Terms, database.SearchTerm{Text: tok.text})
+			}
+			continue
+		}
+		if key, value, ok := cutSearchFilter(tok.text); ok {
+			hasFilter = true
+			switch key {
+			case "from":
+				search.From = strings.TrimPrefix(value, "@")
+			case "in":
+				search.In = value
+			case "has":
+				if value != "photo" {
+					return search, fmt.Errorf("Unknown filter has:%s", value)
+				}
+				search.HasPhoto = true
+			case "before":
+				if search.Before, err = parseSearchDate(value); err != nil {
+					return search, err
+				}
+			case "after":
+				if search.After, err = parseSearchDate(value); err != nil {
+					return search, err
+				}
+			}
+			continue
+		}
+		term := database.SearchTerm{Text: tok.text}
+		if strings.HasSuffix(term.Text, "*") {
+			term.Text = strings.TrimRight(term.Text, "*")
+			term.Prefix = true
+		}
+		if term.Text != "" {
+			search.Terms = append(search.Terms, term)
+		}
+	}
+
+	if len(search.Terms) == 0 && !hasFilter {
+		return search, errors.New("Missing search query")
+	}
+	return search, nil
+}
+
+// searchToken is a piece of a search query: a word, a filter, or a quoted phrase.
+type searchToken struct {
+	text   string
+	quoted bool
+}
+
+// splitSearchQuery splits a search query on spaces, keeping quoted phrases and quoted filter values together.
+func splitSearchQuery(q string) ([]searchToken, error) {
+	var tokens []searchToken
+	var current strings.Builder
+	inQuotes, quotedToken := false, false
+	flush := func() {
+		if current.Len() > 0 || quotedToken {
+			// a quoted filter value (in:"a b") is a filter, not a phrase
+			_, _, isFilter := cutSearchFilter(current.String())
+			tokens = append(tokens, searchToken{text: current.String(), quoted: quotedToken && !isFilter})
+		}
+		current.Reset()
+		quotedToken = false
+	}
+	for _, c := range q {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+			quotedToken = true
+		case unicode.IsSpace(c) && !inQuotes:
+			flush()
+		default:
+			current.WriteRune(c)
+		}
+	}
+	if inQuotes {
+		return nil, errors.New("Unterminated quote in search query")
+	}
+	flush()
+	return tokens, nil
+}
+
+// cutSearchFilter splits a `key:value` filter, returning ok = false if the token is not a known filter.
+func cutSearchFilter(tok string) (key, value string, ok bool) {
+	i := strings.Index(tok, ":")
+	if i <= 0 || i == len(tok)-1 {
+		return "", "", false
+	}
+	key, value = strings.ToLower(tok[:i]), tok[i+1:]
+	switch key {
+	case "from", "in", "has", "before", "after":
+		return key, value, true
+	}
+	return "", "", false
+}
+
+// parseSearchDate parses the date of a before: or after: filter. Dates without a time are midnight UTC.
+func parseSearchDate(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid date %q: use YYYY-MM-DD", value)
+}
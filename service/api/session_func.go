@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxDeviceLabelLength is the length of the longest device label accepted at login, in bytes
+const maxDeviceLabelLength = 64
+
+// getMySessions lists the devices the caller is logged in on, the current one flagged.
+func (rt *_router) getMySessions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	session, err := rt.getAuthenticatedSession(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	sessions, err := rt.db.GetUserSessions(r.Context(), session.UserID, globaltime.Now())
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == session.ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sessions)
+}
+
+// deleteMySession signs one of the devices of the caller out: the tokens of its session stop working, and its event
+// streams are closed, at once.
+func (rt *_router) deleteMySession(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	sessionID := ps.ByName("sessionId")
+	if err := rt.db.DeleteSession(r.Context(), userID, sessionID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	rt.hub.Disconnect(userID, sessionID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deviceLabel names the device of a user agent for the list of sessions, such as "Firefox on Linux".
+func deviceLabel(userAgent string) string {
+	var browser string
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"), strings.Contains(userAgent, "Chromium/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	case userAgent == "":
+		return "Unknown device"
+	default:
+		// command-line clients, such as curl/8.5.0
+		name := strings.SplitN(userAgent, "/", 2)[0]
+		if len(name) > maxDeviceLabelLength {
+			name = name[:maxDeviceLabelLength]
+		}
+		return name
+	}
+
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		return browser + " on Android"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		return browser + " on iOS"
+	case strings.Contains(userAgent, "Windows"):
+		return browser + " on Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		return browser + " on macOS"
+	case strings.Contains(userAgent, "Linux"):
+		return browser + " on Linux"
+	}
+	return browser
+}
@@ -2,5 +2,11 @@ package api
 
 // Close should close everything opened in the lifecycle of the `_router`; for example, background goroutines.
 func (rt *_router) Close() error {
+	// stop the background tasks, waiting for the current runs to finish
+	close(rt.stop)
+	rt.background.Wait()
+
+	// disconnect every event stream
+	rt.hub.Close()
 	return nil
 }
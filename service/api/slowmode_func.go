@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/database"
+	"github.com/dilcetto/wasa/service/events"
+	"github.com/dilcetto/wasa/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// errSlowMode is returned when a member of a group in slow mode sends a message before their turn
+var errSlowMode = errors.New("slow mode")
+
+// maxSlowMode is the longest wait between two messages of a member in slow mode
+const maxSlowMode = time.Hour
+
+// slowModeSettings is the slow mode of a group.
+type slowModeSettings struct {
+	// SlowMode is how long, in seconds, members wait between two messages, 0 if slow mode is off
+	SlowMode int `json:"slowMode"`
+}
+
+// setGroupSlowMode turns the slow mode of a group on or off. Only admins and the owner can change it, and they are not
+// slowed down themselves.
+func (rt *_router) setGroupSlowMode(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	groupID := ps.ByName("groupId")
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var settings slowModeSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	interval := time.Duration(settings.SlowMode) * time.Second
+	if settings.SlowMode < 0 || interval > maxSlowMode {
+		writeError(w, ctx, http.StatusBadRequest, "Slow mode must be 0, or between 1 second and 1 hour")
+		return
+	}
+
+	if _, err := rt.authz.GroupRole(r.Context(), userID, groupID, schema.RoleAdmin); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	if err := rt.db.SetGroupSlowMode(r.Context(), groupID, interval); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	rt.publish(ctx, groupID, events.GroupUpdated, events.GroupData{SlowMode: &settings.SlowMode})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(settings)
+}
+
+// slowModeTurn is the turn a member took to post a message to a conversation in slow mode. A turn that is released
+// before being used is given back, so that a message refused after the turn was taken, e.g. for an invalid attachment,
+// does not make its sender wait. The nil turn, of a member who is not slowed down, does nothing.
+type slowModeTurn struct {
+	limiter *rateLimiter
+	key     string
+	limit   RateLimit
+	used    bool
+}
+
+// use tells that the message has been stored, and keeps the turn taken.
+func (t *slowModeTurn) use() {
+	if t != nil {
+		t.used = true
+	}
+}
+
+// release gives the turn back, unless it was used.
+func (t *slowModeTurn) release() {
+	if t != nil && !t.used {
+		t.limiter.refund(t.key, t.limit, globaltime.Now())
+	}
+}
+
+// takeSlowModeTurn takes the turn of a member to post a message to a conversation in slow mode, with the same token
+// buckets as the rate limits of the routes: each member can post one message per interval. Admins and the owner are
+// not slowed down. errSlowMode is returned, and the Retry-After header set, when the member must wait. The caller
+// uses the turn once the message is stored, and releases it in any case.
+func (rt *_router) takeSlowModeTurn(w http.ResponseWriter, r *http.Request, userID, conversationID string) (*slowModeTurn, error) {
+	turn, wait, err := rt.takeTurn(r.Context(), rt.db, userID, conversationID)
+	if errors.Is(err, errSlowMode) {
+		setRetryAfter(w, wait)
+	}
+	return turn, err
+}
+
+// takeTurn takes the slow mode turn of a member, reading the group from db, and returns errSlowMode and how long until
+// the turn of the member when they must wait.
+func (rt *_router) takeTurn(ctx context.Context, db database.AppDatabase, userID, conversationID string) (*slowModeTurn, time.Duration, error) {
+	interval, err := db.GetConversationSlowMode(ctx, conversationID)
+	if err != nil || interval == 0 {
+		return nil, 0, err
+	}
+	role, err := db.GetMemberRole(ctx, conversationID, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if roleRank(role) >= roleRank(schema.RoleAdmin) {
+		return nil, 0, nil
+	}
+
+	turn := &slowModeTurn{limiter: rt.limiter, key: "slow-mode " + conversationID + " " + userID, limit: RateLimit{Requests: 1, Period: interval}}
+	status := rt.limiter.take(turn.key, turn.limit, globaltime.Now())
+	if !status.allowed {
+		return nil, status.retryAfter, errSlowMode
+	}
+	return turn, 0, nil
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dilcetto/wasa/service/globaltime"
+)
+
+// TestSlowModeTurn checks that a turn released before being used is given back, and that a used turn is kept.
+func TestSlowModeTurn(t *testing.T) {
+	limiter := newRateLimiter()
+	limit := RateLimit{Requests: 1, Period: time.Minute}
+	take := func() *slowModeTurn {
+		if !limiter.take("turn", limit, globaltime.Now()).allowed {
+			return nil
+		}
+		return &slowModeTurn{limiter: limiter, key: "turn", limit: limit}
+	}
+
+	turn := take()
+	if turn == nil {
+		t.Fatal("the first turn was refused")
+	}
+	turn.release()
+	if turn = take(); turn == nil {
+		t.Fatal("a released turn was not given back")
+	}
+	turn.use()
+	turn.release()
+	if take() != nil {
+		t.Error("a used turn was given back")
+	}
+
+	// members who are not slowed down have no turn
+	var none *slowModeTurn
+	none.use()
+	none.release()
+}
@@ -2,67 +2,241 @@ package api
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/dilcetto/wasa/service/globaltime"
 )
 
-var jwtKey = []byte("your-very-secret-key")
+const (
+	// defaultTokenLifetime is how long access tokens are valid when TokenConfig.Lifetime is not set
+	defaultTokenLifetime = 15 * time.Minute
+
+	// defaultRefreshLifetime is how long sessions last without refreshing their tokens when
+	// TokenConfig.RefreshLifetime is not set
+	defaultRefreshLifetime = 30 * 24 * time.Hour
+
+	// minKeySize is the size of the shortest signing key accepted, in bytes, as long as the output of HMAC-SHA256
+	minKeySize = 32
+)
+
+// TokenConfig configures the access tokens (JWTs signed with HMAC-SHA256) issued by the API.
+type TokenConfig struct {
+	// Keys are the secrets that verify tokens, by key ID. Tokens name the key that signed them in the `kid` header,
+	// so keys can be added and removed without invalidating the tokens signed by the other keys.
+	Keys map[string][]byte
+
+	// ActiveKey is the ID of the key that signs new tokens
+	ActiveKey string
+
+	// Lifetime is how long new access tokens are valid. Zero means 15 minutes.
+	Lifetime time.Duration
+
+	// RefreshLifetime is how long a session lasts without refreshing its tokens. Zero means 30 days.
+	RefreshLifetime time.Duration
+
+	// Issuer and Audience are the `iss` and `aud` claims of new tokens. When set, tokens without the same claims are
+	// refused.
+	Issuer   string
+	Audience string
+}
+
+// validate checks that the configuration can sign and verify tokens.
+func (c TokenConfig) validate() error {
+	if c.ActiveKey == "" {
+		return errors.New("active token key is required")
+	}
+	if _, ok := c.Keys[c.ActiveKey]; !ok {
+		return fmt.Errorf("active token key %q is not configured", c.ActiveKey)
+	}
+	for id, secret := range c.Keys {
+		if id == "" {
+			return errors.New("token keys must have an ID")
+		}
+		if len(secret) < minKeySize {
+			return fmt.Errorf("token key %q is too short: at least %d bytes are required", id, minKeySize)
+		}
+	}
+	if c.Lifetime < 0 || c.RefreshLifetime < 0 {
+		return errors.New("token lifetimes cannot be negative")
+	}
+	return nil
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
 
 type tokenClaims struct {
 	Sub string `json:"sub"`
+	Sid string `json:"sid"`
+	Iss string `json:"iss,omitempty"`
+	Aud string `json:"aud,omitempty"`
+	Iat int64  `json:"iat"`
 	Exp int64  `json:"exp"`
 }
 
-func sign(data string) []byte {
-	h := hmac.New(sha256.New, jwtKey)
+// tokenSigner creates and verifies access tokens. Its configuration can be replaced while serving requests, to rotate
+// the keys.
+type tokenSigner struct {
+	mu  sync.RWMutex
+	cfg TokenConfig
+}
+
+func newTokenSigner(cfg TokenConfig) (*tokenSigner, error) {
+	s := &tokenSigner{}
+	if err := s.setConfig(cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// setConfig replaces the configuration, unless it is invalid. Tokens signed by the keys still configured stay valid.
+func (s *tokenSigner) setConfig(cfg TokenConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	keys := make(map[string][]byte, len(cfg.Keys))
+	for id, secret := range cfg.Keys {
+		keys[id] = append([]byte(nil), secret...)
+	}
+	cfg.Keys = keys
+	if cfg.Lifetime == 0 {
+		cfg.Lifetime = defaultTokenLifetime
+	}
+	if cfg.RefreshLifetime == 0 {
+		cfg.RefreshLifetime = defaultRefreshLifetime
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+	return nil
+}
+
+func sign(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
 	h.Write([]byte(data))
 	return h.Sum(nil)
 }
 
-func createToken(userID string) (string, error) {
-	h := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
-	c := tokenClaims{
-		Sub: userID,
-		Exp: time.Now().Add(24 * time.Hour).Unix(),
+// refreshLifetime returns how long sessions last without refreshing their tokens.
+func (s *tokenSigner) refreshLifetime() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg.RefreshLifetime
+}
+
+// create returns a new access token for a session of the user, signed with the active key, and its expiry time.
+func (s *tokenSigner) create(userID, sessionID string) (string, time.Time, error) {
+	s.mu.RLock()
+	cfg := s.cfg
+	s.mu.RUnlock()
+
+	headerBytes, err := json.Marshal(tokenHeader{Alg: "HS256", Typ: "JWT", Kid: cfg.ActiveKey})
+	if err != nil {
+		return "", time.Time{}, err
 	}
-	payloadBytes, err := json.Marshal(c)
+	now := globaltime.Now()
+	expiresAt := now.Add(cfg.Lifetime)
+	payloadBytes, err := json.Marshal(tokenClaims{
+		Sub: userID,
+		Sid: sessionID,
+		Iss: cfg.Issuer,
+		Aud: cfg.Audience,
+		Iat: now.Unix(),
+		Exp: expiresAt.Unix(),
+	})
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
+
 	// Create the token payload
+	header := base64.RawURLEncoding.EncodeToString(headerBytes)
 	payload := base64.RawURLEncoding.EncodeToString(payloadBytes)
-	sig := sign(h + "." + payload)
-	token := h + "." + payload + "." + base64.RawURLEncoding.EncodeToString(sig)
-	return token, nil
+	sig := sign(cfg.Keys[cfg.ActiveKey], header+"."+payload)
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(sig), expiresAt, nil
 }
 
-func ParseToken(tokenString string) (string, error) {
+// parse verifies an access token and returns the ID of the user and of the session it was issued for. Tokens signed by
+// any configured key are accepted; every failure is reported as ErrUnauthorized.
+func (s *tokenSigner) parse(tokenString string) (string, string, error) {
 	parts := strings.Split(tokenString, ".")
 	if len(parts) != 3 {
-		return "", ErrUnauthorized
+		return "", "", ErrUnauthorized
 	}
 	header, payload, sigB64 := parts[0], parts[1], parts[2]
-	sig, err := base64.RawURLEncoding.DecodeString(sigB64)
-	if err != nil {
-		return "", ErrUnauthorized
+
+	var h tokenHeader
+	if err := decodeTokenPart(header, &h); err != nil || h.Alg != "HS256" {
+		return "", "", ErrUnauthorized
 	}
-	expected := sign(header + "." + payload)
-	if !hmac.Equal(sig, expected) {
-		return "", ErrUnauthorized
+	s.mu.RLock()
+	cfg := s.cfg
+	s.mu.RUnlock()
+	key, ok := cfg.Keys[h.Kid]
+	if !ok {
+		return "", "", ErrUnauthorized
 	}
-	payloadBytes, err := base64.RawURLEncoding.DecodeString(payload)
+
+	sig, err := base64.RawURLEncoding.DecodeString(sigB64)
 	if err != nil {
-		return "", ErrUnauthorized
+		return "", "", ErrUnauthorized
 	}
+	if !hmac.Equal(sig, sign(key, header+"."+payload)) {
+		return "", "", ErrUnauthorized
+	}
+
 	var claims tokenClaims
-	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
-		return "", ErrUnauthorized
+	if err := decodeTokenPart(payload, &claims); err != nil {
+		return "", "", ErrUnauthorized
+	}
+	if claims.Exp < globaltime.Now().Unix() || claims.Sub == "" || claims.Sid == "" {
+		return "", "", ErrUnauthorized
+	}
+	if (cfg.Issuer != "" && claims.Iss != cfg.Issuer) || (cfg.Audience != "" && claims.Aud != cfg.Audience) {
+		return "", "", ErrUnauthorized
+	}
+	return claims.Sub, claims.Sid, nil
+}
+
+// newRefreshToken returns a random refresh token, and the hash the database keeps instead of the token.
+func newRefreshToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
 	}
-	if claims.Exp < time.Now().Unix() || claims.Sub == "" {
-		return "", ErrUnauthorized
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRefreshToken(token), nil
+}
+
+// hashRefreshToken returns the hash of a refresh token. Refresh tokens are random, so a fast hash is enough.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// decodeTokenPart decodes the header or the payload of a token.
+func decodeTokenPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
 	}
-	return claims.Sub, nil
+	return json.Unmarshal(data, v)
+}
+
+// SetTokenConfig replaces the configuration of the access tokens. An invalid configuration is refused, and the current
+// one is kept.
+func (rt *_router) SetTokenConfig(cfg TokenConfig) error {
+	return rt.tokens.setConfig(cfg)
 }
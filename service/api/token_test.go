@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	key1 = []byte("0123456789abcdef0123456789abcdef")
+	key2 = []byte("fedcba9876543210fedcba9876543210")
+)
+
+// forge returns a token with the header and the claims, signed with the key.
+func forge(t *testing.T, h tokenHeader, c tokenClaims, key []byte) string {
+	t.Helper()
+	headerBytes, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadBytes, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(payloadBytes)
+	return data + "." + base64.RawURLEncoding.EncodeToString(sign(key, data))
+}
+
+func mustCreate(t *testing.T, s *tokenSigner) string {
+	t.Helper()
+	token, _, err := s.create("user", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func expectValid(t *testing.T, s *tokenSigner, name, token string, valid bool) {
+	t.Helper()
+	userID, sessionID, err := s.parse(token)
+	switch {
+	case valid && (err != nil || userID != "user" || sessionID != "session"):
+		t.Errorf("%s: got %q, %q, %v, want a valid token", name, userID, sessionID, err)
+	case !valid && !errors.Is(err, ErrUnauthorized):
+		t.Errorf("%s: got %v, want %v", name, err, ErrUnauthorized)
+	}
+}
+
+// TestTokenKeyRotation rotates the signing key in two steps: the new key signs new tokens while the old one still
+// verifies the tokens it signed, until it is removed.
+func TestTokenKeyRotation(t *testing.T) {
+	s, err := newTokenSigner(TokenConfig{Keys: map[string][]byte{"k1": key1}, ActiveKey: "k1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := mustCreate(t, s)
+
+	if err := s.setConfig(TokenConfig{Keys: map[string][]byte{"k1": key1, "k2": key2}, ActiveKey: "k2"}); err != nil {
+		t.Fatal(err)
+	}
+	rotated := mustCreate(t, s)
+	var h tokenHeader
+	if err := decodeTokenPart(strings.Split(rotated, ".")[0], &h); err != nil || h.Kid != "k2" {
+		t.Errorf("new tokens are signed by %q, want k2", h.Kid)
+	}
+	expectValid(t, s, "token of the previous key", old, true)
+	expectValid(t, s, "token of the active key", rotated, true)
+
+	if err := s.setConfig(TokenConfig{Keys: map[string][]byte{"k2": key2}, ActiveKey: "k2"}); err != nil {
+		t.Fatal(err)
+	}
+	expectValid(t, s, "token of the rotated out key", old, false)
+	expectValid(t, s, "token of the active key after the rotation", rotated, true)
+
+	// an invalid configuration is refused and the current one is kept
+	for name, cfg := range map[string]TokenConfig{
+		"missing active key": {Keys: map[string][]byte{"k1": key1}, ActiveKey: "k2"},
+		"short key":          {Keys: map[string][]byte{"k3": []byte("short")}, ActiveKey: "k3"},
+		"no active key":      {Keys: map[string][]byte{"k1": key1}},
+	} {
+		if err := s.setConfig(cfg); err == nil {
+			t.Errorf("%s: the configuration was accepted", name)
+		}
+	}
+	expectValid(t, s, "token of the active key after refused configurations", rotated, true)
+}
+
+func TestTokenRejected(t *testing.T) {
+	fixTime(t, time.Unix(1700000000, 0))
+	s, err := newTokenSigner(TokenConfig{Keys: map[string][]byte{"k1": key1, "k2": key2}, ActiveKey: "k1", Issuer: "wasa", Audience: "webui"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := tokenHeader{Alg: "HS256", Typ: "JWT", Kid: "k1"}
+	claims := tokenClaims{Sub: "user", Sid: "session", Iss: "wasa", Aud: "webui", Iat: 1700000000, Exp: 1700000900}
+	valid := forge(t, header, claims, key1)
+	expectValid(t, s, "forged like a valid token", valid, true)
+
+	unknown := header
+	unknown.Kid = "k3"
+	other := header
+	other.Kid = "k2"
+	none := header
+	none.Alg = "none"
+	expired := claims
+	expired.Exp = 1699999999
+	issuer := claims
+	issuer.Iss = "elsewhere"
+	audience := claims
+	audience.Aud = ""
+	anonymous := claims
+	anonymous.Sub = ""
+	admin := claims
+	admin.Sub = "admin"
+	tampered := forge(t, header, admin, key1)
+
+	for name, token := range map[string]string{
+		"unknown key":               forge(t, unknown, claims, key1),
+		"signed by another key":     forge(t, other, claims, key1),
+		"with the none algorithm":   forge(t, none, claims, key1),
+		"expired":                   forge(t, header, expired, key1),
+		"from another issuer":       forge(t, header, issuer, key1),
+		"for another audience":      forge(t, header, audience, key1),
+		"without a user":            forge(t, header, anonymous, key1),
+		"truncated":                 valid[:20],
+		"with a tampered signature": valid[:len(valid)-2] + "AA",
+		"with a tampered claim":     tampered[:strings.LastIndex(tampered, ".")] + valid[strings.LastIndex(valid, "."):],
+	} {
+		expectValid(t, s, name, token, false)
+	}
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dilcetto/wasa/service/api/reqcontext"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// maxUploadSize is the size of the largest resumable upload accepted, in bytes
+	maxUploadSize = 64 << 20
+
+	// maxChunkSize is the size of the largest chunk of a resumable upload accepted in a single request, in bytes
+	maxChunkSize = 4 << 20
+
+	// uploadLifetime is how long a resumable upload can be completed, finalized and then referenced by messages
+	uploadLifetime = 24 * time.Hour
+
+	// chunkContentType is the content type of the chunks of a resumable upload
+	chunkContentType = "application/offset+octet-stream"
+)
+
+// createUpload starts a resumable upload of a large attachment. The content is then sent in chunks with
+// appendUploadChunk, and the upload is turned into an attachment by finalizeUpload. Messages reference the finalized
+// upload by its ID.
+func (rt *_router) createUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var body struct {
+		Length   int64  `json:"length"`
+		Filename string `json:"filename"`
+		Kind     string `json:"kind"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if body.Length <= 0 {
+		writeError(w, ctx, http.StatusBadRequest, "Missing upload length")
+		return
+	}
+	if body.Length > maxUploadSize {
+		writeError(w, ctx, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload too large. Maximum allowed size is %d MB.", maxUploadSize>>20))
+		return
+	}
+	switch body.Kind {
+	case "", schema.AttachmentImage, schema.AttachmentVideo, schema.AttachmentAudio, schema.AttachmentFile:
+	default:
+		writeError(w, ctx, http.StatusBadRequest, "Invalid attachment kind")
+		return
+	}
+
+	uploadID, err := generateNewID()
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	now := globaltime.Now().UTC()
+	upload := schema.Upload{
+		ID:        uploadID,
+		UserID:    userID,
+		Length:    body.Length,
+		Filename:  sanitizeFilename(body.Filename),
+		Kind:      body.Kind,
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: now.Add(uploadLifetime).Format(time.RFC3339),
+	}
+	if err := rt.db.CreateUpload(r.Context(), &upload); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+
+	w.Header().Set("Location", "/uploads/"+uploadID)
+	writeUploadHeaders(w, &upload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(upload)
+}
+
+// getUpload returns the state of an upload of the caller. Clients resuming an interrupted upload read the offset to
+// send the next chunk from; a HEAD request returns it in the Upload-Offset header only.
+func (rt *_router) getUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	upload, ok := rt.ownUpload(w, r, ps, ctx)
+	if !ok {
+		return
+	}
+
+	writeUploadHeaders(w, upload)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_ = json.NewEncoder(w).Encode(upload)
+	}
+}
+
+// appendUploadChunk appends the body of the request to an upload of the caller. The Upload-Offset header must be the
+// offset of the upload, so that a chunk that was already received is not appended twice; the new offset is returned
+// in the same header.
+func (rt *_router) appendUploadChunk(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != chunkContentType {
+		writeError(w, ctx, http.StatusUnsupportedMediaType, "Content-Type must be "+chunkContentType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, ctx, http.StatusBadRequest, "Missing or invalid Upload-Offset header")
+		return
+	}
+	if _, ok := rt.ownUpload(w, r, ps, ctx); !ok {
+		return
+	}
+
+	chunk, err := io.ReadAll(io.LimitReader(r.Body, maxChunkSize+1))
+	if err != nil {
+		writeError(w, ctx, http.StatusBadRequest, "Failed to read chunk")
+		return
+	}
+	if len(chunk) > maxChunkSize {
+		writeError(w, ctx, http.StatusRequestEntityTooLarge, fmt.Sprintf("Chunk too large. Maximum allowed size is %d MB.", maxChunkSize>>20))
+		return
+	}
+
+	newOffset, err := rt.db.AppendUploadChunk(r.Context(), ps.ByName("uploadId"), offset, chunk)
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finalizeUpload turns a complete upload of the caller into an attachment, checked and processed like the
+// attachments sent inline. Finalizing an upload again returns the same attachment.
+func (rt *_router) finalizeUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	upload, ok := rt.ownUpload(w, r, ps, ctx)
+	if !ok {
+		return
+	}
+
+	if upload.Attachment == nil {
+		content, err := rt.db.GetUploadContent(r.Context(), upload.ID)
+		if err != nil && !errors.Is(err, schema.ErrUploadFinalized) {
+			writeMappedError(w, ctx, err)
+			return
+		}
+		if err == nil {
+			checked, err := checkAttachment(schema.Attachment{Kind: upload.Kind, Filename: upload.Filename, Content: content}, maxUploadSize)
+			var invalid attachmentError
+			if errors.As(err, &invalid) {
+				writeMappedError(w, ctx, fmt.Errorf("%w: %s", errInvalidAttachment, err))
+				return
+			} else if err != nil {
+				writeMappedError(w, ctx, err)
+				return
+			}
+			attachment, err := rt.putAttachment(r.Context(), checked)
+			if err != nil {
+				writeMappedError(w, ctx, err)
+				return
+			}
+			// a concurrent request may have finalized the upload meanwhile: both stored the same content-addressed blob
+			if err := rt.db.FinalizeUpload(r.Context(), upload.ID, attachment); err != nil && !errors.Is(err, schema.ErrUploadFinalized) {
+				writeMappedError(w, ctx, err)
+				return
+			}
+		}
+		if upload, err = rt.db.GetUpload(r.Context(), upload.ID); err != nil {
+			writeMappedError(w, ctx, err)
+			return
+		}
+	}
+
+	writeUploadHeaders(w, upload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(upload)
+}
+
+// cancelUpload deletes an upload of the caller. Messages already sent with it keep their attachment.
+func (rt *_router) cancelUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	upload, ok := rt.ownUpload(w, r, ps, ctx)
+	if !ok {
+		return
+	}
+
+	if err := rt.db.DeleteUpload(r.Context(), upload.ID); err != nil {
+		writeMappedError(w, ctx, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownUpload loads the upload of the request, writing the error response unless it exists and belongs to the caller.
+// The uploads of other users are reported as not found.
+func (rt *_router) ownUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) (*schema.Upload, bool) {
+	userID, err := rt.getAuthenticatedUserID(r)
+	if err != nil {
+		writeError(w, ctx, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	upload, err := rt.db.GetUpload(r.Context(), ps.ByName("uploadId"))
+	if err == nil && upload.UserID != userID {
+		err = schema.ErrUploadNotFound
+	}
+	if err != nil {
+		writeMappedError(w, ctx, err)
+		return nil, false
+	}
+	return upload, true
+}
+
+// writeUploadHeaders sets the headers that describe the progress of an upload.
+func writeUploadHeaders(w http.ResponseWriter, upload *schema.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+}
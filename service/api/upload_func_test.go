@@ -0,0 +1,84 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// TestResumableUpload sends an upload in two chunks, with the mistakes of a client resuming it, finalizes it and sends
+// it in a message.
+func TestResumableUpload(t *testing.T) {
+	f := newAuthzFixture(t)
+	token := f.tokens[roleMember]
+	var upload schema.Upload
+	f.mustDo(http.MethodPost, "/uploads", token, `{"length": 11, "filename": "hello.txt", "kind": "file"}`, &upload)
+	path := "/uploads/" + upload.ID
+	chunk := func(offset, contentType, data string) (int, string) {
+		headers := map[string]string{"Content-Type": contentType}
+		if offset != "" {
+			headers["Upload-Offset"] = offset
+		}
+		w := f.do(http.MethodPatch, path, token, data, headers)
+		return w.Code, w.Header().Get("Upload-Offset")
+	}
+
+	for _, tc := range []struct {
+		name, offset, contentType, data string
+		status                          int
+		newOffset                       string
+	}{
+		{"first chunk", "0", chunkContentType, "hello ", http.StatusNoContent, "6"},
+		{"first chunk again", "0", chunkContentType, "hello ", http.StatusConflict, ""},
+		{"ahead of the content", "8", chunkContentType, "rld", http.StatusConflict, ""},
+		{"missing offset", "", chunkContentType, "world", http.StatusBadRequest, ""},
+		{"negative offset", "-1", chunkContentType, "world", http.StatusBadRequest, ""},
+		{"wrong content type", "6", "text/plain", "world", http.StatusUnsupportedMediaType, ""},
+		{"longer than declared", "6", chunkContentType, "world!", http.StatusRequestEntityTooLarge, ""},
+	} {
+		if status, newOffset := chunk(tc.offset, tc.contentType, tc.data); status != tc.status || newOffset != tc.newOffset {
+			t.Errorf("%s: got %d with offset %q, want %d with offset %q", tc.name, status, newOffset, tc.status, tc.newOffset)
+		}
+	}
+
+	if w := f.do(http.MethodPost, path+"/finalize", token, "", nil); w.Code != http.StatusConflict {
+		t.Errorf("finalizing an incomplete upload: got %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	// a client that lost the response reads the offset to resume from
+	w := f.do(http.MethodHead, path, token, "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "6" || w.Header().Get("Upload-Length") != "11" || w.Body.Len() != 0 {
+		t.Errorf("HEAD: got %d with offset %q and length %q", w.Code, w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+	if status, newOffset := chunk("6", chunkContentType+"; charset=binary", "world"); status != http.StatusNoContent || newOffset != "11" {
+		t.Fatalf("last chunk: got %d with offset %q", status, newOffset)
+	}
+	if w := f.do(http.MethodGet, path, f.tokens[roleAdmin], "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("reading the upload of someone else: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	var finalized, again schema.Upload
+	f.mustDo(http.MethodPost, path+"/finalize", token, "", &finalized)
+	if finalized.Attachment == nil || finalized.Attachment.Size != 11 || finalized.Attachment.Filename != "hello.txt" {
+		t.Fatalf("finalized into %+v", finalized.Attachment)
+	}
+	f.mustDo(http.MethodPost, path+"/finalize", token, "", &again)
+	if again.Attachment == nil || again.Attachment.BlobID != finalized.Attachment.BlobID {
+		t.Errorf("finalizing again returned %+v, want %+v", again.Attachment, finalized.Attachment)
+	}
+	if status, _ := chunk("11", chunkContentType, ""); status != http.StatusConflict {
+		t.Errorf("appending to a finalized upload: got %d, want %d", status, http.StatusConflict)
+	}
+
+	var message schema.Message
+	f.mustDo(http.MethodPost, "/conversations/"+f.params["conversationId"]+"/messages", token,
+		`{"attachments": [{"uploadId": "`+upload.ID+`"}]}`, &message)
+	if len(message.Attachments) != 1 || message.Attachments[0].BlobID != finalized.Attachment.BlobID {
+		t.Fatalf("sent %+v, want the attachment of the upload", message.Attachments)
+	}
+	w = f.do(http.MethodGet, "/media/"+finalized.Attachment.BlobID, f.tokens[roleAdmin], "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello world" {
+		t.Errorf("the attachment is %d %q, want %q", w.Code, w.Body.String(), "hello world")
+	}
+}
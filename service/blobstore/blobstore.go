@@ -0,0 +1,68 @@
+/*
+Package blobstore stores binary content (message attachments, profile and group photos) outside the database.
+
+Blobs are content-addressed: the ID of a blob is the hex-encoded SHA-256 of its content, so storing the same content
+twice returns the same ID and stores it once. The database only keeps blob IDs, and the API serves the content from a
+dedicated endpoint.
+
+Two implementations are available: NewFilesystem stores blobs as files in a local directory, and NewS3 stores them as
+objects in a bucket of any S3-compatible service (including local stand-ins such as MinIO).
+
+Example:
+
+	store, err := blobstore.NewFilesystem("/var/lib/wasa/blobs")
+	if err != nil {
+		return err
+	}
+
+	id, err := store.Put(ctx, photo)
+	...
+	photo, err = store.Get(ctx, id)
+*/
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// ErrBlobNotFound is returned when there is no blob with the requested ID.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// ErrInvalidBlobID is returned when the requested ID is not a valid blob ID.
+var ErrInvalidBlobID = errors.New("invalid blob ID")
+
+// BlobStore stores and retrieves blobs by their content-addressed ID.
+type BlobStore interface {
+	// Put stores the content and returns its ID. Storing content that already exists is a no-op.
+	Put(ctx context.Context, data []byte) (string, error)
+
+	// Get returns the content of the blob, ErrBlobNotFound if there is no such blob, or ErrInvalidBlobID.
+	Get(ctx context.Context, id string) ([]byte, error)
+
+	// Delete removes the blob. Deleting a blob that does not exist is a no-op. As blobs are shared by everything with
+	// the same content, callers must make sure that nothing references the blob anymore.
+	Delete(ctx context.Context, id string) error
+}
+
+// ID returns the ID of a blob with the given content.
+func ID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidID reports whether id is well-formed, i.e., a lowercase hex-encoded SHA-256 digest. IDs must be checked before
+// being used in paths or object keys.
+func ValidID(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// filesystem stores each blob in a file named after its ID. Files are spread in sub-directories named after the first
+// two characters of the ID, to keep directories small.
+type filesystem struct {
+	dir string
+}
+
+// NewFilesystem returns a BlobStore keeping blobs in the directory `dir`, which is created if missing.
+func NewFilesystem(dir string) (BlobStore, error) {
+	if dir == "" {
+		return nil, errors.New("blob directory is required")
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("creating blob directory: %w", err)
+	}
+	return &filesystem{dir: dir}, nil
+}
+
+func (fs *filesystem) path(id string) string {
+	return filepath.Join(fs.dir, id[:2], id)
+}
+
+func (fs *filesystem) Put(ctx context.Context, data []byte) (string, error) {
+	id := ID(data)
+	path := fs.path(id)
+	if _, err := os.Stat(path); err == nil {
+		return id, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return "", fmt.Errorf("creating blob directory: %w", err)
+	}
+
+	// Write to a temporary file first, so that a blob is either complete or missing, never truncated
+	tmp, err := os.CreateTemp(filepath.Dir(path), id+".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("creating blob file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return "", fmt.Errorf("writing blob file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("writing blob file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("storing blob file: %w", err)
+	}
+	return id, nil
+}
+
+func (fs *filesystem) Get(ctx context.Context, id string) ([]byte, error) {
+	if !ValidID(id) {
+		return nil, ErrInvalidBlobID
+	}
+	data, err := os.ReadFile(fs.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("reading blob file: %w", err)
+	}
+	return data, nil
+}
+
+func (fs *filesystem) Delete(ctx context.Context, id string) error {
+	if !ValidID(id) {
+		return ErrInvalidBlobID
+	}
+	if err := os.Remove(fs.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("deleting blob file: %w", err)
+	}
+	return nil
+}
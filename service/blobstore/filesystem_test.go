@@ -0,0 +1,70 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilesystem(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "blobs")
+	store, err := NewFilesystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("hello")
+	id, err := store.Put(ctx, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != ID(content) || !ValidID(id) {
+		t.Errorf("got ID %q, want %q", id, ID(content))
+	}
+	if _, err := os.Stat(filepath.Join(dir, id[:2], id)); err != nil {
+		t.Errorf("the blob is not stored under its prefix: %v", err)
+	}
+	if again, err := store.Put(ctx, content); err != nil || again != id {
+		t.Errorf("storing the same content again: got %q, %v", again, err)
+	}
+	if data, err := store.Get(ctx, id); err != nil || string(data) != "hello" {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	// Only the blob remains in its directory, no temporary file
+	if entries, err := os.ReadDir(filepath.Join(dir, id[:2])); err != nil || len(entries) != 1 {
+		t.Errorf("the blob directory holds %d entries, want 1 (%v)", len(entries), err)
+	}
+
+	if err := store.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, id); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("getting a deleted blob: got %v, want %v", err, ErrBlobNotFound)
+	}
+	if err := store.Delete(ctx, id); err != nil {
+		t.Errorf("deleting a missing blob: %v", err)
+	}
+}
+
+func TestFilesystemInvalidID(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFilesystem(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"", "../../etc/passwd", ID(nil)[:63] + "G", "AB" + ID(nil)[2:]} {
+		if _, err := store.Get(ctx, id); !errors.Is(err, ErrInvalidBlobID) {
+			t.Errorf("Get(%q): got %v, want %v", id, err, ErrInvalidBlobID)
+		}
+		if err := store.Delete(ctx, id); !errors.Is(err, ErrInvalidBlobID) {
+			t.Errorf("Delete(%q): got %v, want %v", id, err, ErrInvalidBlobID)
+		}
+	}
+	if _, err := NewFilesystem(""); err == nil {
+		t.Error("a store without a directory was created")
+	}
+}
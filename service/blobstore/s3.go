@@ -0,0 +1,212 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dilcetto/wasa/service/globaltime"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty body, signed for requests without a body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config describes how to reach the bucket of an S3-compatible service.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.eu-west-1.amazonaws.com or http://127.0.0.1:9000
+	Endpoint string
+
+	// Region is the region of the bucket, used to sign the requests
+	Region string
+
+	Bucket    string
+	AccessKey string
+	SecretKey string
+
+	// PathStyle addresses objects as <endpoint>/<bucket>/<key> instead of <bucket>.<endpoint>/<key>. Most local
+	// stand-ins (e.g., MinIO) need it.
+	PathStyle bool
+
+	// Prefix is prepended to the blob IDs to build the object keys, e.g. "blobs/"
+	Prefix string
+}
+
+// s3 stores each blob as an object of the bucket. Requests are signed with AWS Signature Version 4, so that no SDK is
+// needed.
+type s3 struct {
+	cfg    S3Config
+	base   *url.URL
+	client *http.Client
+}
+
+// NewS3 returns a BlobStore keeping blobs in a bucket of an S3-compatible service. The bucket must already exist.
+func NewS3(cfg S3Config) (BlobStore, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" || cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("S3 endpoint, bucket and credentials are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	base, err := url.Parse(cfg.Endpoint)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if !cfg.PathStyle {
+		base.Host = cfg.Bucket + "." + base.Host
+	}
+	return &s3{
+		cfg:    cfg,
+		base:   base,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// objectURL returns the URL of the object holding the blob.
+func (s *s3) objectURL(id string) *url.URL {
+	u := *s.base
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	if s.cfg.PathStyle {
+		u.Path += "/" + s.cfg.Bucket
+	}
+	u.Path += "/" + s.cfg.Prefix + id
+	return &u
+}
+
+func (s *s3) Put(ctx context.Context, data []byte) (string, error) {
+	id := ID(data)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(id).String(), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	// the blob ID is the SHA-256 of the content, i.e. the payload hash
+	s.sign(req, id)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("storing blob: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("storing blob: %w", s3Error(resp))
+	}
+	return id, nil
+}
+
+func (s *s3) Get(ctx context.Context, id string) ([]byte, error) {
+	if !ValidID(id) {
+		return nil, ErrInvalidBlobID
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(id).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, emptyPayloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reading blob: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrBlobNotFound
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("reading blob: %w", s3Error(resp))
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading blob: %w", err)
+	}
+	return data, nil
+}
+
+func (s *s3) Delete(ctx context.Context, id string) error {
+	if !ValidID(id) {
+		return ErrInvalidBlobID
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(id).String(), nil)
+	if err != nil {
+		return err
+	}
+	s.sign(req, emptyPayloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("deleting blob: %w", err)
+	}
+	defer resp.Body.Close()
+	// S3 answers 204 whether the object existed or not, some stand-ins answer 404 for missing objects
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("deleting blob: %w", s3Error(resp))
+	}
+	return nil
+}
+
+// sign adds the AWS Signature Version 4 headers to the request. `payloadHash` is the hex-encoded SHA-256 of the body.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *s3) sign(req *http.Request, payloadHash string) {
+	now := globaltime.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	// Only the headers below are signed; they are listed in lexicographic order
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), day)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// s3Error builds an error from an unsuccessful response, including the beginning of the body (an XML error document).
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
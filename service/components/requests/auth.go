@@ -4,9 +4,12 @@ import (
 	"regexp"
 )
 
-// LoginRequest contains the username submitted during login
+// LoginRequest contains the username submitted during login, the password of the accounts that have one, and
+// optionally a name for the device
 type LoginRequest struct {
-	Username string `json:"username"`
+	Username    string `json:"username"`
+	Password    string `json:"password,omitempty"`
+	DeviceLabel string `json:"deviceLabel,omitempty"`
 }
 
 // IsValid checks if the username meets required format constraints
@@ -16,9 +19,17 @@ func (u *LoginRequest) IsValid() bool {
 	return match
 }
 
+// RefreshRequest contains the refresh token exchanged for new tokens
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// RegisterRequest creates an account with a password, and optionally a profile photo
 type RegisterRequest struct {
-	Username string `json:"username"`
-	Photo    []byte `json:"photo,omitempty"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	Photo       []byte `json:"photo,omitempty"`
+	DeviceLabel string `json:"deviceLabel,omitempty"`
 }
 
 func (u *RegisterRequest) IsValid() bool {
@@ -27,6 +38,47 @@ func (u *RegisterRequest) IsValid() bool {
 	return match
 }
 
+// PasswordUpdateRequest sets the password of the caller. The current password is required to change one.
+type PasswordUpdateRequest struct {
+	CurrentPassword string `json:"currentPassword,omitempty"`
+	Password        string `json:"password"`
+}
+
+// PublicKeyCredential is the result of navigator.credentials.create() or navigator.credentials.get(), with the binary
+// values encoded in base64url.
+type PublicKeyCredential struct {
+	ID       string                `json:"id"`
+	Type     string                `json:"type"`
+	Response AuthenticatorResponse `json:"response"`
+}
+
+// AuthenticatorResponse holds the fields of the response of a registration (AttestationObject) or of a login
+// (AuthenticatorData, Signature and UserHandle).
+type AuthenticatorResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+// PasskeyRegistrationRequest adds a passkey, with a name to tell it apart
+type PasskeyRegistrationRequest struct {
+	Name       string              `json:"name"`
+	Credential PublicKeyCredential `json:"credential"`
+}
+
+// PasskeyLoginOptionsRequest asks to log in with a passkey, of the user when a username is given
+type PasskeyLoginOptionsRequest struct {
+	Username string `json:"username,omitempty"`
+}
+
+// PasskeyLoginRequest logs in with a passkey
+type PasskeyLoginRequest struct {
+	Credential  PublicKeyCredential `json:"credential"`
+	DeviceLabel string              `json:"deviceLabel,omitempty"`
+}
+
 type SearchRequest struct {
 	User         string `json:"user,omitempty"`
 	Conversation string `json:"conversation,omitempty"`
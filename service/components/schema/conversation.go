@@ -3,26 +3,49 @@ package schema
 import "time"
 
 type Conversation struct {
-	ConversationID string       `json:"conversationId"`
-	DisplayName    string       `json:"displayName"`
-	ProfilePhoto   []byte       `json:"profilePhoto,omitempty"`
-	Type           string       `json:"type"`
-	CreatedAt      string       `json:"createdAt"`
-	Members        []string     `json:"membersIds"`
-	Messages       []*Message   `json:"messages,omitempty"`
-	LastMessage    *LastMessage `json:"lastMessage,omitempty"`
+	ConversationID    string       `json:"conversationId"`
+	DisplayName       string       `json:"displayName"`
+	PhotoID           string       `json:"photoId,omitempty"` // blob ID of the group photo, or of the peer's photo
+	PhotoThumbnailURL string       `json:"photoThumbnailUrl,omitempty"`
+	PhotoWidth        int          `json:"photoWidth,omitempty"`
+	PhotoHeight       int          `json:"photoHeight,omitempty"`
+	Type              string       `json:"type"`
+	CreatedAt         string       `json:"createdAt"`
+	Members           []string     `json:"membersIds"`
+	Messages          []*Message   `json:"messages,omitempty"`
+	MessagesCursor    string       `json:"messagesCursor,omitempty"`
+	LastMessage       *LastMessage `json:"lastMessage,omitempty"`
+	UnreadCount       int          `json:"unreadCount"`          // messages of the other members after the read watermark
+	UnreadMentions    int          `json:"unreadMentions"`       // unread messages mentioning the user as @username
+	MessageTTL        int          `json:"messageTtl,omitempty"` // lifetime of new messages in seconds, 0 if they never expire
+	SlowMode          int          `json:"slowMode,omitempty"`   // seconds members wait between two messages, 0 if off
 }
 
 type LastMessage struct {
 	MessageType string    `json:"messageType"`
 	Preview     string    `json:"preview"`
 	Timestamp   time.Time `json:"timestamp"`
+	Deleted     bool      `json:"deleted,omitempty"` // the message was deleted for everyone and has no preview
 }
 
 type Group struct {
-	ID         string   `json:"id"`
-	GroupName  string   `json:"group_name"`
-	GroupPhoto []byte   `json:"group_photo"`
-	Members    []string `json:"members"`
-	CreatedAt  string   `json:"createdAt"`
+	ID        string   `json:"id"`
+	GroupName string   `json:"group_name"`
+	PhotoID   string   `json:"photoId,omitempty"` // blob ID of the group photo
+	Members   []string `json:"members"`
+	OwnerID   string   `json:"ownerId,omitempty"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+// Roles of a user inside a group conversation. Members of direct conversations are always RoleMember.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Member is a user listed as part of a conversation, together with its role.
+type Member struct {
+	User
+	Role string `json:"role"`
 }
@@ -2,13 +2,41 @@ package schema
 
 import "errors"
 
+// ErrorResponse is the body of every error response of the API.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes why a request failed. Code is stable, so that clients can act on it, while Message is meant
+// for humans and may change. RequestID identifies the request in the logs of the server.
+type ErrorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId"`
+}
+
+// Errors returned by the database and the API. Handlers map them to their HTTP status and error code.
 var (
-	ErrUserDoesNotExist            = errors.New("user does not exist")
-	ErrConversationDoesNotExist    = errors.New("conversation does not exist")
-	ErrMessageDoesNotExist         = errors.New("message does not exist")
-	ErrReactionDoesNotExist        = errors.New("reaction does not exist")
-	ErrGroupDoesNotExist           = errors.New("group does not exist")
-	ErrUnauthorizedToDeleteMessage = errors.New("unauthorized to delete message")
-	ErrInvalidGroupName            = errors.New("invalid group name")
-	ErrGroupNotFound               = errors.New("group not found")
+	ErrUserDoesNotExist         = errors.New("user does not exist")
+	ErrUsernameTaken            = errors.New("username already exists")
+	ErrConversationDoesNotExist = errors.New("conversation does not exist")
+	ErrMessageDoesNotExist      = errors.New("message does not exist")
+	ErrReactionDoesNotExist     = errors.New("reaction does not exist")
+	ErrGroupDoesNotExist        = errors.New("group does not exist")
+	ErrInvalidGroupName         = errors.New("invalid group name")
+	ErrNotGroupMember           = errors.New("user is not a member of the group")
+	ErrAlreadyGroupMember       = errors.New("user is already a member of the group")
+	ErrMessageNotEditable       = errors.New("message cannot be edited")
+	ErrScheduledMessageNotFound = errors.New("scheduled message does not exist")
+	ErrMessageDeleted           = errors.New("message has been deleted")
+	ErrUploadNotFound           = errors.New("upload does not exist")
+	ErrUploadOffsetMismatch     = errors.New("upload offset does not match the content received")
+	ErrUploadTooLarge           = errors.New("upload is larger than its declared length")
+	ErrUploadIncomplete         = errors.New("upload has not received all its content")
+	ErrUploadFinalized          = errors.New("upload has already been finalized")
+	ErrSessionNotFound          = errors.New("session does not exist")
+	ErrRefreshTokenReused       = errors.New("refresh token has already been used")
+	ErrPasskeyNotFound          = errors.New("passkey does not exist")
+	ErrPasskeyExists            = errors.New("passkey is already registered")
+	ErrChallengeNotFound        = errors.New("challenge does not exist or has expired")
 )
@@ -1,9 +1,11 @@
 package schema
 
+import "encoding/json"
+
 type Sender struct {
 	ID       string `json:"id"`
 	Username string `json:"username"`
-	Photo    []byte `json:"photo,omitempty"`
+	PhotoID  string `json:"photoId,omitempty"`
 }
 
 type Message struct {
@@ -16,8 +18,110 @@ type Message struct {
 	Timestamp      string         `json:"timestamp"`
 	MessageStatus  string         `json:"message_status"`
 	Reaction       []Reaction     `json:"reaction,omitempty"`
-	Attachments    []string       `json:"attachments,omitempty"`
+	Attachments    []Attachment   `json:"attachments,omitempty"`
+	AttachmentIDs  []string       `json:"attachmentIds,omitempty"` // blob IDs of the attachments, in responses only
 	ForwardedFrom  string         `json:"forwarded_from,omitempty"`
+	EditedAt       string         `json:"editedAt,omitempty"`  // time of the last edit, empty if never edited
+	Revisions      int            `json:"revisions,omitempty"` // number of times the message has been edited
+	ReplyTo        string         `json:"replyTo,omitempty"`   // ID of the message this one replies to
+	Quote          *MessageQuote  `json:"quote,omitempty"`     // summary of the ReplyTo message, in responses only
+	ExpiresAt      string         `json:"expiresAt,omitempty"` // time the message disappears at, empty if it never does
+	DeletedAt      string         `json:"deletedAt,omitempty"` // time the message was deleted for everyone, empty if it was not
+}
+
+// Attachment is a file attached to a message. In requests, new attachments carry their base64-encoded content in Data,
+// or reference a finalized Upload by UploadID, and optionally a Filename and a Caption; the other fields are set by
+// the server, which detects the MIME type from the content. A plain base64 string is accepted as an attachment with no
+// filename nor caption.
+type Attachment struct {
+	BlobID    string `json:"blobId,omitempty"`
+	Kind      string `json:"kind,omitempty"`     // one of the Attachment* kinds
+	MimeType  string `json:"mimeType,omitempty"` // empty for photos sent before it was recorded
+	Filename  string `json:"filename,omitempty"`
+	Size      int64  `json:"size,omitempty"` // in bytes, 0 for photos sent before it was recorded
+	Caption   string `json:"caption,omitempty"`
+	Data      string `json:"data,omitempty"`     // base64-encoded content, in requests only
+	UploadID  string `json:"uploadId,omitempty"` // finalized upload holding the content, in requests only
+	Content   []byte `json:"-"`                  // content received in a multipart request
+	ImageInfo        // set for images only
+}
+
+// UnmarshalJSON reads an attachment object, or a base64 string as sent by older clients.
+func (a *Attachment) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err == nil {
+		*a = Attachment{Data: encoded}
+		return nil
+	}
+	type attachment Attachment
+	return json.Unmarshal(data, (*attachment)(a))
+}
+
+// Kinds of attachments.
+const (
+	AttachmentImage = "image"
+	AttachmentVideo = "video"
+	AttachmentAudio = "audio" // audio files and voice notes
+	AttachmentFile  = "file"
+)
+
+// MessageQuote is the compact version of a message shown above the replies to it. When the message has been deleted,
+// only MessageID and Deleted are set.
+type MessageQuote struct {
+	MessageID   string `json:"messageId"`
+	SenderID    string `json:"senderId,omitempty"`
+	Username    string `json:"username,omitempty"`
+	Preview     string `json:"preview,omitempty"`
+	MessageType string `json:"messageType,omitempty"`
+	Deleted     bool   `json:"deleted,omitempty"`
+}
+
+// MessageRevision is a version of the content of a message that has since been edited. Revisions are numbered from 0,
+// the content the message was sent with, and Timestamp is when that version was written.
+type MessageRevision struct {
+	Revision  int            `json:"revision"`
+	Content   MessageContent `json:"content"`
+	Timestamp string         `json:"timestamp"`
+}
+
+// MessageReceipt is the delivery status of a message for one of its recipients. DeliveredAt and ReadAt are empty
+// while the message has not been delivered to or read by the recipient.
+type MessageReceipt struct {
+	User        User   `json:"user"`
+	DeliveredAt string `json:"deliveredAt,omitempty"`
+	ReadAt      string `json:"readAt,omitempty"`
+}
+
+// ScheduledMessage is a message to be sent to a conversation at SendAt. It is sent with the same ID, and stops being a
+// scheduled message once sent. Status is "pending" until then, or "failed" with the reason in Error when it could not
+// be sent, e.g. because the sender left the conversation.
+type ScheduledMessage struct {
+	ID             string         `json:"id"`
+	ConversationID string         `json:"conversationId"`
+	SenderID       string         `json:"senderId"`
+	Content        MessageContent `json:"content"`
+	Attachments    []Attachment   `json:"attachments,omitempty"`
+	AttachmentIDs  []string       `json:"attachmentIds,omitempty"` // blob IDs of the attachments, or of those to keep in updates
+	ReplyTo        string         `json:"replyTo,omitempty"`
+	SendAt         string         `json:"sendAt"`
+	CreatedAt      string         `json:"createdAt"`
+	Status         string         `json:"status"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// MessagePage is a slice of the timeline of a conversation, in chronological order. OlderCursor is set when older
+// messages exist, and NewerCursor can be used to poll for messages newer than the page.
+type MessagePage struct {
+	Messages    []*Message `json:"messages"`
+	OlderCursor string     `json:"olderCursor,omitempty"`
+	NewerCursor string     `json:"newerCursor,omitempty"`
+}
+
+// MessageSearchResult is a message matching a search. Snippet is the part of its text that matches, with the matching
+// words highlighted.
+type MessageSearchResult struct {
+	Message *Message `json:"message"`
+	Snippet string   `json:"snippet"`
 }
 
 type ContentType string
@@ -26,8 +130,24 @@ const (
 	TextContent ContentType = "text"
 	// Keep constant name for backward compatibility, but align value to OpenAPI ('photo')
 	Image ContentType = "photo"
+	Video ContentType = "video"
+	Audio ContentType = "audio"
+	File  ContentType = "file"
 )
 
+// AttachmentContentType returns the content type of a message whose first attachment is of the given kind.
+func AttachmentContentType(kind string) ContentType {
+	switch kind {
+	case AttachmentImage:
+		return Image
+	case AttachmentVideo:
+		return Video
+	case AttachmentAudio:
+		return Audio
+	}
+	return File
+}
+
 type MessageContent struct {
 	ContentType ContentType `json:"type"`
 	Value       []byte      `json:"value"`
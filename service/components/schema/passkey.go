@@ -0,0 +1,13 @@
+package schema
+
+// Passkey is a WebAuthn credential that a user logs in with instead of a password. The public key verifies the
+// signatures of the authenticator that holds the private key.
+type Passkey struct {
+	ID         string `json:"id"` // credential ID, in base64url
+	UserID     string `json:"-"`
+	Name       string `json:"name"`
+	PublicKey  []byte `json:"-"` // COSE encoding
+	SignCount  uint32 `json:"-"`
+	CreatedAt  string `json:"createdAt"`
+	LastUsedAt string `json:"lastUsedAt,omitempty"`
+}
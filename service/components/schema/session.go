@@ -0,0 +1,30 @@
+package schema
+
+// Session is opened by logging in, and lasts as long as its refresh tokens are used before they expire. Access tokens
+// name the session they were issued for, and stop working once it is closed. A session is a device of the user.
+type Session struct {
+	ID          string `json:"sessionId"`
+	UserID      string `json:"-"`
+	DeviceLabel string `json:"deviceLabel"`
+	UserAgent   string `json:"userAgent"`
+	IP          string `json:"ip"`
+	CreatedAt   string `json:"createdAt"`
+	RefreshedAt string `json:"refreshedAt"`
+	LastSeenAt  string `json:"lastSeenAt"`
+	ExpiresAt   string `json:"expiresAt"`
+
+	// Verified is set on the sessions opened by creating the account or with a password or a passkey, rather than
+	// with a bare username, which anyone can do in the open login mode
+	Verified bool `json:"-"`
+
+	// Current is set, when listing sessions, on the session of the request
+	Current bool `json:"current"`
+}
+
+// TokenResponse is returned by logging in and by refreshing the tokens of a session.
+type TokenResponse struct {
+	Token        string `json:"token"`        // access token, sent as bearer token
+	ExpiresAt    string `json:"expiresAt"`    // when the access token expires
+	RefreshToken string `json:"refreshToken"` // exchanged once for new tokens
+	SessionID    string `json:"sessionId"`
+}
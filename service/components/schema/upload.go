@@ -0,0 +1,16 @@
+package schema
+
+// Upload is a resumable upload of a large attachment. Its content is sent in chunks, appended at Offset until it
+// reaches Length, then the upload is finalized into Attachment, which messages reference by the ID of the upload until
+// the upload expires.
+type Upload struct {
+	ID         string      `json:"uploadId"`
+	UserID     string      `json:"-"`
+	Length     int64       `json:"length"`
+	Offset     int64       `json:"offset"`
+	Filename   string      `json:"filename,omitempty"`
+	Kind       string      `json:"kind,omitempty"` // requested kind, as in Attachment
+	CreatedAt  string      `json:"createdAt"`
+	ExpiresAt  string      `json:"expiresAt"`
+	Attachment *Attachment `json:"attachment,omitempty"` // set once finalized
+}
@@ -1,9 +1,12 @@
 package schema
 
 type User struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
-	Photo    []byte `json:"photo"`
+	ID                string `json:"id"`
+	Username          string `json:"username"`
+	PhotoID           string `json:"photoId,omitempty"`           // blob ID of the profile photo
+	PhotoThumbnailURL string `json:"photoThumbnailUrl,omitempty"` // empty for photos uploaded before thumbnails
+	PhotoWidth        int    `json:"photoWidth,omitempty"`
+	PhotoHeight       int    `json:"photoHeight,omitempty"`
 }
 
 type LoginRequest struct {
@@ -12,11 +15,28 @@ type LoginRequest struct {
 
 type LoginResponse struct {
 	User
-	Token string `json:"token"`
+	TokenResponse
+
+	// NeedsCredentials is set when the user logged in with the username only, while the deployment requires a
+	// password or a passkey: the user should add one before legacy logins are turned off
+	NeedsCredentials bool `json:"needsCredentials,omitempty"`
 }
 
 type UsernameUpdateResponse = User
 
 type ProfilePhotoUpdateResponse struct {
-	Photo []byte `json:"photo"`
+	PhotoID string `json:"photoId"`
+}
+
+// MediaURL returns the path, relative to the API, to download a blob.
+func MediaURL(blobID string) string {
+	return "/media/" + blobID
+}
+
+// ImageInfo describes an image processed on upload: its size in pixels and the URL of its thumbnail. It is empty for
+// images uploaded before images were processed.
+type ImageInfo struct {
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
 }
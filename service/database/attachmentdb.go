@@ -0,0 +1,132 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// Tables holding the attachments of messages and of scheduled messages, which share the same columns.
+const (
+	messageAttachments          = "message_attachments"
+	scheduledMessageAttachments = "scheduled_message_attachments"
+)
+
+// attachmentPreviews is the preview of the last message of a conversation when it has an attachment and no text, by
+// kind of attachment.
+var attachmentPreviews = map[string]string{
+	schema.AttachmentImage: "Photo",
+	schema.AttachmentVideo: "Video",
+	schema.AttachmentAudio: "Audio",
+	schema.AttachmentFile:  "File",
+}
+
+// firstAttachmentKind is the SQL expression of the kind of the first attachment of `m`, the messages table, NULL for
+// messages without attachments.
+const firstAttachmentKind = `(SELECT a.kind FROM message_attachments a WHERE a.message_id = m.id ORDER BY a.position LIMIT 1)`
+
+// insertAttachments stores the attachments of a message in the attachments table, in order, replacing those the
+// message had. Attachments must already be in the blob store.
+func (db *appdbimpl) insertAttachments(ctx context.Context, table, messageID string, attachments []schema.Attachment) error {
+	if _, err := db.c.ExecContext(ctx, `DELETE FROM `+table+` WHERE message_id = ?`, messageID); err != nil {
+		return fmt.Errorf("failed to delete attachments: %w", err)
+	}
+	for i, a := range attachments {
+		if a.BlobID == "" || a.Kind == "" {
+			return fmt.Errorf("attachment %d has no blob ID or kind", i)
+		}
+		_, err := db.c.ExecContext(ctx, `INSERT INTO `+table+` (message_id, position, blob_id, kind, mime_type, filename, size, caption)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, messageID, i, a.BlobID, a.Kind, a.MimeType, a.Filename, a.Size, a.Caption)
+		if err != nil {
+			return fmt.Errorf("failed to store attachment: %w", err)
+		}
+	}
+	return nil
+}
+
+// attachmentsOf returns the attachments of the messages with the given IDs from the attachments table, in order,
+// keyed by message ID, with the thumbnail and the dimensions of images. Messages without attachments are missing from
+// the map.
+func (db *appdbimpl) attachmentsOf(ctx context.Context, table string, messageIDs []string) (map[string][]schema.Attachment, error) {
+	found := make(map[string][]schema.Attachment)
+	if len(messageIDs) == 0 {
+		return found, nil
+	}
+
+	placeholders := make([]string, 0, len(messageIDs))
+	args := make([]interface{}, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		placeholders = append(placeholders, "?")
+		args = append(args, id)
+	}
+	rows, err := db.c.QueryContext(ctx, `SELECT a.message_id, a.blob_id, a.kind, a.mime_type, a.filename, a.size, a.caption,
+		       COALESCE(i.width, 0), COALESCE(i.height, 0), COALESCE(i.thumbnail_blob_id, '')
+		FROM `+table+` a LEFT JOIN images i ON i.blob_id = a.blob_id
+		WHERE a.message_id IN (`+strings.Join(placeholders, ",")+`) ORDER BY a.message_id, a.position`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachments: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID, thumbnailID string
+		var a schema.Attachment
+		if err := rows.Scan(&messageID, &a.BlobID, &a.Kind, &a.MimeType, &a.Filename, &a.Size, &a.Caption,
+			&a.Width, &a.Height, &thumbnailID); err != nil {
+			return nil, fmt.Errorf("failed to scan attachment: %w", err)
+		}
+		if thumbnailID != "" {
+			a.ThumbnailURL = schema.MediaURL(thumbnailID)
+		}
+		found[messageID] = append(found[messageID], a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading attachments: %w", err)
+	}
+	return found, nil
+}
+
+// loadAttachments sets the attachments of the messages, and their content type from the kind of the first one.
+func (db *appdbimpl) loadAttachments(ctx context.Context, messages []*schema.Message) error {
+	ids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	attachments, err := db.attachmentsOf(ctx, messageAttachments, ids)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		m.Attachments = attachments[m.ID]
+		m.AttachmentIDs = nil
+		for _, a := range m.Attachments {
+			m.AttachmentIDs = append(m.AttachmentIDs, a.BlobID)
+		}
+		if len(m.Attachments) > 0 {
+			m.Content.ContentType = schema.AttachmentContentType(m.Attachments[0].Kind)
+			m.MessageType = string(m.Content.ContentType)
+		}
+	}
+	return nil
+}
+
+// attachmentBlobs returns the blob IDs of the attachments of the messages with the given IDs from the attachments
+// table, without duplicates.
+func (db *appdbimpl) attachmentBlobs(ctx context.Context, table string, messageIDs []string) ([]string, error) {
+	attachments, err := db.attachmentsOf(ctx, table, messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var blobs []string
+	for _, id := range messageIDs {
+		for _, a := range attachments[id] {
+			if !seen[a.BlobID] {
+				seen[a.BlobID] = true
+				blobs = append(blobs, a.BlobID)
+			}
+		}
+	}
+	return blobs, nil
+}
@@ -0,0 +1,236 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dilcetto/wasa/service/blobstore"
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// inlineBlobColumns lists the BLOB columns used before the blob store existed, each one with the column holding the
+// blob ID that replaced it. Message attachments, which moved to their own table, are handled by moveInlineAttachments.
+var inlineBlobColumns = []struct {
+	table, blob, ref string
+}{
+	{"users", "photo", "photoBlobId"},
+	{"conversations", "conversationPhoto", "photoBlobId"},
+}
+
+// MoveInlineBlobs moves the content still stored in the legacy BLOB columns to the blob store, replacing it with the
+// blob ID. It returns the number of rows that were updated, and can be interrupted and run again at any time.
+func (db *appdbimpl) MoveInlineBlobs(ctx context.Context, store blobstore.BlobStore) (int, error) {
+	moved := 0
+	for _, col := range inlineBlobColumns {
+		ids, err := db.inlineBlobRows(ctx, col.table, col.blob)
+		if err != nil {
+			return moved, err
+		}
+
+		for _, id := range ids {
+			var data []byte
+			err := db.c.QueryRowContext(ctx, `SELECT `+col.blob+` FROM `+col.table+` WHERE id = ?`, id).Scan(&data)
+			if err != nil {
+				return moved, fmt.Errorf("failed to read %s.%s: %w", col.table, col.blob, err)
+			}
+			var ref interface{}
+			if len(data) > 0 {
+				blobID, err := store.Put(ctx, data)
+				if err != nil {
+					return moved, err
+				}
+				ref = blobID
+			}
+			_, err = db.c.ExecContext(ctx, `UPDATE `+col.table+` SET `+col.ref+` = COALESCE(?, `+col.ref+`), `+col.blob+` = NULL WHERE id = ?`, ref, id)
+			if err != nil {
+				return moved, fmt.Errorf("failed to update %s.%s: %w", col.table, col.ref, err)
+			}
+			moved++
+		}
+	}
+
+	n, err := db.moveInlineAttachments(ctx, store)
+	return moved + n, err
+}
+
+// moveInlineAttachments moves the photos still stored in messages.attachment to the blob store, as the first
+// attachment of their message.
+func (db *appdbimpl) moveInlineAttachments(ctx context.Context, store blobstore.BlobStore) (int, error) {
+	ids, err := db.inlineBlobRows(ctx, "messages", "attachment")
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, id := range ids {
+		var data []byte
+		if err := db.c.QueryRowContext(ctx, `SELECT attachment FROM messages WHERE id = ?`, id).Scan(&data); err != nil {
+			return moved, fmt.Errorf("failed to read messages.attachment: %w", err)
+		}
+		err := db.withTx(ctx, func(tx *appdbimpl) error {
+			if len(data) > 0 {
+				blobID, err := store.Put(ctx, data)
+				if err != nil {
+					return err
+				}
+				_, err = tx.c.ExecContext(ctx, `INSERT INTO message_attachments (message_id, position, blob_id, kind, mime_type, size)
+					VALUES (?, 0, ?, ?, '', ?) ON CONFLICT (message_id, position) DO NOTHING`, id, blobID, schema.AttachmentImage, len(data))
+				if err != nil {
+					return fmt.Errorf("failed to store attachment: %w", err)
+				}
+			}
+			_, err := tx.c.ExecContext(ctx, `UPDATE messages SET attachment = NULL WHERE id = ?`, id)
+			if err != nil {
+				return fmt.Errorf("failed to update messages.attachment: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// inlineBlobRows returns the IDs of the rows of the table with content in the BLOB column.
+func (db *appdbimpl) inlineBlobRows(ctx context.Context, table, blob string) ([]string, error) {
+	rows, err := db.c.QueryContext(ctx, `SELECT id FROM `+table+` WHERE `+blob+` IS NOT NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s.%s: %w", table, blob, err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan %s row: %w", table, err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over %s rows: %w", table, err)
+	}
+	return ids, nil
+}
+
+// markBlobsForDeletion marks the blobs as candidates for deletion, as the rows referencing them were deleted. Blobs are
+// shared by everything with the same content, so SweepUnusedBlobs checks them again before they are deleted: a marked
+// blob can be referenced again in the meantime.
+func (db *appdbimpl) markBlobsForDeletion(ctx context.Context, blobIDs []string) error {
+	for _, blobID := range blobIDs {
+		_, err := db.c.ExecContext(ctx, `INSERT INTO blob_deletions (blob_id, marked_at) VALUES (?, `+receiptNow+`)
+			ON CONFLICT (blob_id) DO UPDATE SET marked_at = excluded.marked_at`, blobID)
+		if err != nil {
+			return fmt.Errorf("failed to mark blob for deletion: %w", err)
+		}
+	}
+	return nil
+}
+
+// KeepBlob drops the mark for deletion of a blob, which is about to be referenced again. It must be called after the
+// blob is stored, and before SweepUnusedBlobs can run.
+func (db *appdbimpl) KeepBlob(ctx context.Context, blobID string) error {
+	if _, err := db.c.ExecContext(ctx, `DELETE FROM blob_deletions WHERE blob_id = ?`, blobID); err != nil {
+		return fmt.Errorf("failed to keep blob: %w", err)
+	}
+	return nil
+}
+
+// CanSeeBlob reports whether userID can see something that references the blob: the photo of any user, the photo of a
+// group they are a member of, an attachment of a message of their conversations that they did not delete for
+// themselves, one of their scheduled messages or uploads. The thumbnail of an image is seen along with the image.
+func (db *appdbimpl) CanSeeBlob(ctx context.Context, userID, blobID string) (bool, error) {
+	var visible bool
+	err := db.c.QueryRowContext(ctx, `WITH refs (id) AS (
+			SELECT ? UNION SELECT blob_id FROM images WHERE thumbnail_blob_id = ?
+		)
+		SELECT EXISTS (SELECT 1 FROM users WHERE photoBlobId IN refs)
+			OR EXISTS (SELECT 1 FROM conversations c
+				JOIN conversation_members cm ON cm.conversationId = c.id AND cm.userId = ?
+				WHERE c.photoBlobId IN refs)
+			OR EXISTS (SELECT 1 FROM `+messageAttachments+` a
+				JOIN messages m ON m.id = a.message_id
+				JOIN conversation_members cm ON cm.conversationId = m.conversationId AND cm.userId = ?
+				WHERE a.blob_id IN refs AND `+notHiddenFor+`)
+			OR EXISTS (SELECT 1 FROM `+scheduledMessageAttachments+` a
+				JOIN scheduled_messages s ON s.id = a.message_id AND s.senderId = ?
+				WHERE a.blob_id IN refs)
+			OR EXISTS (SELECT 1 FROM uploads WHERE user_id = ? AND blob_id IN refs)`,
+		blobID, blobID, userID, userID, userID, userID, userID).Scan(&visible)
+	if err != nil {
+		return false, fmt.Errorf("failed to check access to blob: %w", err)
+	}
+	return visible, nil
+}
+
+// SweepUnusedBlobs takes up to `limit` blobs marked for deletion before markedBefore, and returns those that nothing
+// references, which the caller must remove from the blob store. The images among them are forgotten, and their
+// thumbnails marked for deletion in turn. The grace period between the mark and the sweep lets the requests that stored
+// the same content before it was marked reference it; those that store it later call KeepBlob first.
+func (db *appdbimpl) SweepUnusedBlobs(ctx context.Context, markedBefore time.Time, limit int) ([]string, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+
+	var unused []string
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		// marks are stored in RFC 3339, which sorts chronologically as text
+		rows, err := tx.c.QueryContext(ctx, `DELETE FROM blob_deletions WHERE blob_id IN (
+				SELECT blob_id FROM blob_deletions WHERE marked_at <= ? ORDER BY marked_at LIMIT ?
+			) RETURNING blob_id`, markedBefore.UTC().Format(time.RFC3339), limit)
+		if err != nil {
+			return fmt.Errorf("failed to take blobs marked for deletion: %w", err)
+		}
+		defer rows.Close()
+
+		var marked []string
+		for rows.Next() {
+			var blobID string
+			if err := rows.Scan(&blobID); err != nil {
+				return fmt.Errorf("failed to scan blob marked for deletion: %w", err)
+			}
+			marked = append(marked, blobID)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error reading blobs marked for deletion: %w", err)
+		}
+		if err := rows.Close(); err != nil {
+			return fmt.Errorf("failed to close blobs marked for deletion: %w", err)
+		}
+
+		var thumbnails []string
+		for _, blobID := range marked {
+			used, err := tx.blobInUse(ctx, blobID)
+			if err != nil {
+				return err
+			}
+			if used {
+				continue
+			}
+			unused = append(unused, blobID)
+			thumbnailID, err := tx.forgetImage(ctx, blobID)
+			if err != nil {
+				return err
+			}
+			if thumbnailID != "" {
+				thumbnails = append(thumbnails, thumbnailID)
+			}
+		}
+		return tx.markBlobsForDeletion(ctx, thumbnails)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unused, nil
+}
+
+// nullIfEmpty stores empty blob IDs as NULL.
+func nullIfEmpty(id string) interface{} {
+	if id == "" {
+		return nil
+	}
+	return id
+}
@@ -0,0 +1,169 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// TestSweepUnusedBlobs checks that the blobs of deleted messages are only swept once marked for long enough, and never
+// while referenced or kept.
+func TestSweepUnusedBlobs(t *testing.T) {
+	db, conn := newTestAppDB(t)
+	ctx := context.Background()
+	mustExec(t, conn,
+		`INSERT INTO users (id, username) VALUES ('u1', 'alice');`,
+		`INSERT INTO conversations (id, name, type) VALUES ('c1', 'group', 'group');`,
+		`INSERT INTO conversation_members (conversationId, userId) VALUES ('c1', 'u1');`,
+		`INSERT INTO messages (id, conversationId, senderId, content, timestamp, status, forwardedFrom) VALUES
+			('m1', 'c1', 'u1', 'one', '2024-01-01T00:00:00Z', 'sent', ''),
+			('m2', 'c1', 'u1', 'two', '2024-01-01T00:00:00Z', 'sent', ''),
+			('m3', 'c1', 'u1', 'three', '2024-01-01T00:00:00Z', 'sent', '');`,
+		`INSERT INTO message_attachments (message_id, position, blob_id, kind, mime_type, size) VALUES
+			('m1', 0, 'shared', 'file', 'text/plain', 1),
+			('m2', 0, 'shared', 'file', 'text/plain', 1),
+			('m1', 1, 'own', 'file', 'text/plain', 1),
+			('m3', 0, 'kept', 'file', 'text/plain', 1);`,
+	)
+
+	for _, id := range []string{"m1", "m3"} {
+		if err := db.DeleteMessage(ctx, id, "2024-01-02T00:00:00Z"); err != nil {
+			t.Fatalf("deleting %s: %v", id, err)
+		}
+	}
+	// the content of m3 is sent again before the sweep
+	if err := db.KeepBlob(ctx, "kept"); err != nil {
+		t.Fatalf("keeping blob: %v", err)
+	}
+
+	unused, err := db.SweepUnusedBlobs(ctx, time.Now().Add(-time.Hour), 10)
+	if err != nil {
+		t.Fatalf("sweeping: %v", err)
+	}
+	if len(unused) != 0 {
+		t.Errorf("swept %v before the grace period", unused)
+	}
+
+	unused, err = db.SweepUnusedBlobs(ctx, time.Now().Add(time.Second), 10)
+	if err != nil {
+		t.Fatalf("sweeping: %v", err)
+	}
+	if len(unused) != 1 || unused[0] != "own" {
+		t.Errorf("swept %v, want [own]", unused)
+	}
+
+	var marks int
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM blob_deletions`).Scan(&marks); err != nil {
+		t.Fatal(err)
+	}
+	if marks != 0 {
+		t.Errorf("%d blobs are still marked for deletion after the sweep", marks)
+	}
+}
+
+func TestCanSeeBlob(t *testing.T) {
+	db, conn := newTestAppDB(t)
+	mustExec(t, conn,
+		`INSERT INTO users (id, username, photoBlobId) VALUES ('u1', 'alice', 'avatar'), ('u2', 'bob', NULL), ('u3', 'carol', NULL);`,
+		`INSERT INTO conversations (id, name, type, photoBlobId) VALUES ('c1', 'group', 'group', 'group-photo');`,
+		`INSERT INTO conversation_members (conversationId, userId) VALUES ('c1', 'u1'), ('c1', 'u2');`,
+		`INSERT INTO messages (id, conversationId, senderId, content, timestamp, status, forwardedFrom) VALUES
+			('m1', 'c1', 'u1', '', '2024-01-01T00:00:00Z', 'sent', ''),
+			('m2', 'c1', 'u1', '', '2024-01-01T00:00:00Z', 'sent', '');`,
+		`INSERT INTO message_attachments (message_id, position, blob_id, kind, mime_type, size) VALUES
+			('m1', 0, 'photo', 'image', 'image/png', 1),
+			('m2', 0, 'hidden', 'file', 'text/plain', 1);`,
+		`INSERT INTO images (blob_id, width, height, thumbnail_blob_id) VALUES ('photo', 1000, 1000, 'thumbnail');`,
+		`INSERT INTO hidden_messages (message_id, user_id, hidden_at) VALUES ('m2', 'u2', '2024-01-01T00:00:00Z');`,
+		`INSERT INTO scheduled_messages (id, conversationId, senderId, content, sendAt, createdAt) VALUES
+			('s1', 'c1', 'u1', '', '2030-01-01T00:00:00Z', '2024-01-01T00:00:00Z');`,
+		`INSERT INTO scheduled_message_attachments (message_id, position, blob_id, kind, mime_type, size) VALUES
+			('s1', 0, 'scheduled', 'file', 'text/plain', 1);`,
+		`INSERT INTO uploads (id, user_id, length, created_at, expires_at, blob_id) VALUES
+			('up1', 'u1', 1, '2024-01-01T00:00:00Z', '2030-01-01T00:00:00Z', 'uploaded');`,
+	)
+
+	tests := []struct {
+		userID, blobID string
+		want           bool
+	}{
+		{"u3", "avatar", true},
+		{"u2", "group-photo", true},
+		{"u3", "group-photo", false},
+		{"u2", "photo", true},
+		{"u2", "thumbnail", true},
+		{"u3", "photo", false},
+		{"u3", "thumbnail", false},
+		{"u1", "hidden", true},
+		{"u2", "hidden", false},
+		{"u1", "scheduled", true},
+		{"u2", "scheduled", false},
+		{"u1", "uploaded", true},
+		{"u2", "uploaded", false},
+		{"u1", "missing", false},
+	}
+	for _, tt := range tests {
+		got, err := db.CanSeeBlob(context.Background(), tt.userID, tt.blobID)
+		if err != nil {
+			t.Fatalf("checking %s for %s: %v", tt.blobID, tt.userID, err)
+		}
+		if got != tt.want {
+			t.Errorf("CanSeeBlob(%s, %s) = %v, want %v", tt.userID, tt.blobID, got, tt.want)
+		}
+	}
+}
+
+// TestScheduledMessageBlobs checks that the attachments of scheduled messages are marked for deletion when they are
+// removed, and when the message is cancelled or sent.
+func TestScheduledMessageBlobs(t *testing.T) {
+	db, conn := newTestAppDB(t)
+	ctx := context.Background()
+	mustExec(t, conn,
+		`INSERT INTO users (id, username) VALUES ('u1', 'alice');`,
+		`INSERT INTO conversations (id, name, type) VALUES ('c1', 'group', 'group');`,
+		`INSERT INTO conversation_members (conversationId, userId) VALUES ('c1', 'u1');`,
+		`INSERT INTO scheduled_messages (id, conversationId, senderId, content, sendAt, createdAt, status) VALUES
+			('s1', 'c1', 'u1', 'one', '2030-01-01T00:00:00Z', '2024-01-01T00:00:00Z', 'pending'),
+			('s2', 'c1', 'u1', 'two', '2030-01-01T00:00:00Z', '2024-01-01T00:00:00Z', 'pending');`,
+		`INSERT INTO scheduled_message_attachments (message_id, position, blob_id, kind, mime_type, size) VALUES
+			('s1', 0, 'removed', 'file', 'text/plain', 1),
+			('s1', 1, 'kept', 'file', 'text/plain', 1),
+			('s2', 0, 'cancelled', 'file', 'text/plain', 1);`,
+	)
+	marked := func() map[string]bool {
+		rows, err := conn.Query(`SELECT blob_id FROM blob_deletions`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		blobs := make(map[string]bool)
+		for rows.Next() {
+			var blobID string
+			if err := rows.Scan(&blobID); err != nil {
+				t.Fatal(err)
+			}
+			blobs[blobID] = true
+		}
+		return blobs
+	}
+
+	err := db.UpdateScheduledMessage(ctx, &schema.ScheduledMessage{ID: "s1", SendAt: "2030-01-01T00:00:00Z",
+		Attachments: []schema.Attachment{{BlobID: "kept", Kind: "file", MimeType: "text/plain", Size: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := marked(); len(got) != 1 || !got["removed"] {
+		t.Errorf("after the update, marked %v, want [removed]", got)
+	}
+
+	for _, id := range []string{"s1", "s2"} {
+		if err := db.DeleteScheduledMessage(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := marked(); len(got) != 3 {
+		t.Errorf("after the deletions, marked %v, want every attachment", got)
+	}
+}
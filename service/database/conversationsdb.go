@@ -1,8 +1,8 @@
 package database
 
 import (
+	"context"
 	"database/sql"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"time"
@@ -11,14 +11,14 @@ import (
 	"github.com/gofrs/uuid"
 )
 
-func (db *appdbimpl) GetMyConversations(userID string) ([]*schema.Conversation, error) {
+func (db *appdbimpl) GetMyConversations(ctx context.Context, userID string) ([]*schema.Conversation, error) {
 	query := `
-		SELECT c.id, c.name, c.type, c.created_at, c.conversationPhoto
+		SELECT c.id, c.name, c.type, c.created_at, COALESCE(c.photoBlobId, ''), COALESCE(c.messageTtl, 0), COALESCE(c.slowMode, 0)
 		FROM conversations c
 		JOIN conversation_members cm ON cm.conversationId = c.id
 		WHERE cm.userId = ?`
 
-	rows, err := db.c.Query(query, userID)
+	rows, err := db.c.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query conversations: %w", err)
 	}
@@ -28,29 +28,29 @@ func (db *appdbimpl) GetMyConversations(userID string) ([]*schema.Conversation,
 
 	for rows.Next() {
 		var conv schema.Conversation
-		var convPhoto []byte
-		if err := rows.Scan(&conv.ConversationID, &conv.DisplayName, &conv.Type, &conv.CreatedAt, &convPhoto); err != nil {
+		var convPhoto string
+		if err := rows.Scan(&conv.ConversationID, &conv.DisplayName, &conv.Type, &conv.CreatedAt, &convPhoto, &conv.MessageTTL, &conv.SlowMode); err != nil {
 			return nil, err
 		}
 
 		// Set the profile photo if it exists
 		if conv.Type == "direct" {
 			// Get the other user's info
-			err = db.c.QueryRow(`
-				SELECT u.username, u.photo
+			err = db.c.QueryRowContext(ctx, `
+				SELECT u.username, COALESCE(u.photoBlobId, '')
 				FROM users u
 				JOIN conversation_members cm ON cm.userId = u.id
 				WHERE cm.conversationId = ? AND cm.userId != ?
-			`, conv.ConversationID, userID).Scan(&conv.DisplayName, &conv.ProfilePhoto)
+			`, conv.ConversationID, userID).Scan(&conv.DisplayName, &conv.PhotoID)
 			if err != nil {
 				return nil, fmt.Errorf("failed to get private conversation info: %w", err)
 			}
 		} else {
 			// For group conversations, set the profile photo to the group photo
-			conv.ProfilePhoto = convPhoto
+			conv.PhotoID = convPhoto
 		}
 		// Fetch members
-		memberRows, err := db.c.Query(`SELECT userId FROM conversation_members WHERE conversationId = ?`, conv.ConversationID)
+		memberRows, err := db.c.QueryContext(ctx, `SELECT userId FROM conversation_members WHERE conversationId = ?`, conv.ConversationID)
 		if err != nil {
 			return nil, err
 		}
@@ -69,22 +69,22 @@ func (db *appdbimpl) GetMyConversations(userID string) ([]*schema.Conversation,
 		var last schema.LastMessage
 		var senderID string
 		var ts string
-		var attLen int
-		err = db.c.QueryRow(`
+		var kind string
+		err = db.c.QueryRowContext(ctx, `
 			SELECT content, timestamp, senderId,
-			       CASE WHEN attachment IS NOT NULL AND LENGTH(attachment) > 0 THEN 1 ELSE 0 END as attlen
-			FROM messages
-			WHERE conversationId = ?
+			       COALESCE(`+firstAttachmentKind+`, ''), deletedAt IS NOT NULL
+			FROM messages m
+			WHERE conversationId = ? AND `+notHiddenFor+`
 			ORDER BY timestamp DESC LIMIT 1
-		`, conv.ConversationID).Scan(&last.Preview, &ts, &senderID, &attLen)
+		`, conv.ConversationID, userID).Scan(&last.Preview, &ts, &senderID, &kind, &last.Deleted)
 		if err == nil {
 			if t, perr := time.Parse(time.RFC3339, ts); perr == nil {
 				last.Timestamp = t
 			}
-			if attLen > 0 {
-				last.MessageType = "photo"
+			if kind != "" {
+				last.MessageType = string(schema.AttachmentContentType(kind))
 				if last.Preview == "" {
-					last.Preview = "Photo"
+					last.Preview = attachmentPreviews[kind]
 				}
 			} else {
 				last.MessageType = "text"
@@ -97,45 +97,57 @@ func (db *appdbimpl) GetMyConversations(userID string) ([]*schema.Conversation,
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+
+	unread, err := db.unreadCounts(ctx, userID, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, conv := range conversations {
+		conv.UnreadCount = unread[conv.ConversationID].messages
+		conv.UnreadMentions = unread[conv.ConversationID].mentions
+	}
+	if err := db.loadConversationPhotos(ctx, conversations); err != nil {
+		return nil, err
+	}
 	return conversations, nil
 }
 
-func (db *appdbimpl) GetConversationByID(userID, conversationID string) (*schema.Conversation, error) {
+func (db *appdbimpl) GetConversationByID(ctx context.Context, userID, conversationID string) (*schema.Conversation, error) {
 	query := `
-		SELECT c.id, c.name, c.type, c.created_at, c.conversationPhoto
+		SELECT c.id, c.name, c.type, c.created_at, COALESCE(c.photoBlobId, ''), COALESCE(c.messageTtl, 0), COALESCE(c.slowMode, 0)
 		FROM conversations c
 		JOIN conversation_members cm ON cm.conversationId = c.id
 		WHERE c.id = ? AND cm.userId = ?`
 
 	var conv schema.Conversation
-	var convPhoto []byte
+	var convPhoto string
 
-	err := db.c.QueryRow(query, conversationID, userID).Scan(&conv.ConversationID, &conv.DisplayName, &conv.Type, &conv.CreatedAt, &convPhoto)
+	err := db.c.QueryRowContext(ctx, query, conversationID, userID).Scan(&conv.ConversationID, &conv.DisplayName, &conv.Type, &conv.CreatedAt, &convPhoto, &conv.MessageTTL, &conv.SlowMode)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("conversation not found")
+			return nil, schema.ErrConversationDoesNotExist
 		}
 		return nil, fmt.Errorf("failed to get conversation: %w", err)
 	}
 
 	if conv.Type == "direct" {
 		// Get the other user's info
-		err = db.c.QueryRow(`
-			SELECT u.username, u.photo
+		err = db.c.QueryRowContext(ctx, `
+			SELECT u.username, COALESCE(u.photoBlobId, '')
 			FROM users u
 			JOIN conversation_members cm ON cm.userId = u.id
 			WHERE cm.conversationId = ? AND cm.userId != ?
-		`, conv.ConversationID, userID).Scan(&conv.DisplayName, &conv.ProfilePhoto)
+		`, conv.ConversationID, userID).Scan(&conv.DisplayName, &conv.PhotoID)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get private conversation info: %w", err)
 		}
 	} else {
 		// For group conversations, set the profile photo to the group photo
-		conv.ProfilePhoto = convPhoto
+		conv.PhotoID = convPhoto
 	}
 
 	// Fetch members
-	memberRows, err := db.c.Query(`SELECT userId FROM conversation_members WHERE conversationId = ?`, conv.ConversationID)
+	memberRows, err := db.c.QueryContext(ctx, `SELECT userId FROM conversation_members WHERE conversationId = ?`, conv.ConversationID)
 	if err != nil {
 		return nil, err
 	}
@@ -156,22 +168,22 @@ func (db *appdbimpl) GetConversationByID(userID, conversationID string) (*schema
 	var last schema.LastMessage
 	var senderID string
 	var ts2 string
-	var attLen2 int
-	err = db.c.QueryRow(`
+	var kind2 string
+	err = db.c.QueryRowContext(ctx, `
 		SELECT content, timestamp, senderId,
-		       CASE WHEN attachment IS NOT NULL AND LENGTH(attachment) > 0 THEN 1 ELSE 0 END as attlen
-		FROM messages
-		WHERE conversationId = ?
+		       COALESCE(`+firstAttachmentKind+`, ''), deletedAt IS NOT NULL
+		FROM messages m
+		WHERE conversationId = ? AND `+notHiddenFor+`
 		ORDER BY timestamp DESC LIMIT 1
-	`, conv.ConversationID).Scan(&last.Preview, &ts2, &senderID, &attLen2)
+	`, conv.ConversationID, userID).Scan(&last.Preview, &ts2, &senderID, &kind2, &last.Deleted)
 	if err == nil {
 		if t, perr := time.Parse(time.RFC3339, ts2); perr == nil {
 			last.Timestamp = t
 		}
-		if attLen2 > 0 {
-			last.MessageType = "photo"
+		if kind2 != "" {
+			last.MessageType = string(schema.AttachmentContentType(kind2))
 			if last.Preview == "" {
-				last.Preview = "Photo"
+				last.Preview = attachmentPreviews[kind2]
 			}
 		} else {
 			last.MessageType = "text"
@@ -179,11 +191,26 @@ func (db *appdbimpl) GetConversationByID(userID, conversationID string) (*schema
 		conv.LastMessage = &last
 	}
 
+	unread, err := db.unreadCounts(ctx, userID, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	conv.UnreadCount = unread[conversationID].messages
+	conv.UnreadMentions = unread[conversationID].mentions
+	if err := db.loadConversationPhotos(ctx, []*schema.Conversation{&conv}); err != nil {
+		return nil, err
+	}
+
 	return &conv, nil
 }
 
-func (db *appdbimpl) SearchConversationByName(name string) ([]schema.Conversation, error) {
-	rows, err := db.c.Query("SELECT id, name, type, created_at, conversationPhoto FROM conversations WHERE name LIKE '%' || ? || '%'", name)
+func (db *appdbimpl) SearchConversationByName(ctx context.Context, userID, name string) ([]schema.Conversation, error) {
+	query := `
+		SELECT c.id, c.name, c.type, c.created_at, COALESCE(c.photoBlobId, '')
+		FROM conversations c
+		JOIN conversation_members cm ON cm.conversationId = c.id AND cm.userId = ?
+		WHERE c.name LIKE '%' || ? || '%'`
+	rows, err := db.c.QueryContext(ctx, query, userID, name)
 	if err != nil {
 		return nil, fmt.Errorf("failed to search conversations by name: %w", err)
 	}
@@ -192,7 +219,7 @@ func (db *appdbimpl) SearchConversationByName(name string) ([]schema.Conversatio
 	var conversations []schema.Conversation
 	for rows.Next() {
 		var conv schema.Conversation
-		if err := rows.Scan(&conv.ConversationID, &conv.DisplayName, &conv.Type, &conv.CreatedAt, &conv.ProfilePhoto); err != nil {
+		if err := rows.Scan(&conv.ConversationID, &conv.DisplayName, &conv.Type, &conv.CreatedAt, &conv.PhotoID); err != nil {
 			return nil, fmt.Errorf("failed to scan conversation row: %w", err)
 		}
 		conversations = append(conversations, conv)
@@ -201,32 +228,47 @@ func (db *appdbimpl) SearchConversationByName(name string) ([]schema.Conversatio
 		return nil, fmt.Errorf("error iterating over conversation rows: %w", err)
 	}
 
+	ptrs := make([]*schema.Conversation, len(conversations))
+	for i := range conversations {
+		ptrs[i] = &conversations[i]
+	}
+	if err := db.loadConversationPhotos(ctx, ptrs); err != nil {
+		return nil, err
+	}
 	return conversations, nil
 }
 
-func (db *appdbimpl) CreateConversation(conversation *schema.Conversation) error {
+func (db *appdbimpl) CreateConversation(ctx context.Context, conversation *schema.Conversation) error {
 	query := `
-		INSERT INTO conversations (id, name, type, created_at, conversationPhoto)
+		INSERT INTO conversations (id, name, type, created_at, photoBlobId)
 		VALUES (?, ?, ?, datetime('now'), ?)`
 
-	_, err := db.c.Exec(query, conversation.ConversationID, conversation.DisplayName, conversation.Type, conversation.ProfilePhoto)
-	if err != nil {
-		return fmt.Errorf("failed to create conversation: %w", err)
-	}
-
-	for _, memberID := range conversation.Members {
-		_, err = db.c.Exec(`INSERT INTO conversation_members (conversationId, userId) VALUES (?, ?)`, conversation.ConversationID, memberID)
+	// the conversation and its members are created together, or not at all
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		_, err := tx.c.ExecContext(ctx, query, conversation.ConversationID, conversation.DisplayName, conversation.Type, nullIfEmpty(conversation.PhotoID))
 		if err != nil {
-			return fmt.Errorf("failed to add member to conversation: %w", err)
+			return fmt.Errorf("failed to create conversation: %w", err)
 		}
-	}
 
-	return nil
+		// unknown members are reported as such, rather than as the foreign key they fail
+		for _, memberID := range conversation.Members {
+			res, err := tx.c.ExecContext(ctx, `INSERT INTO conversation_members (conversationId, userId) SELECT ?, id FROM users WHERE id = ?`, conversation.ConversationID, memberID)
+			if err != nil {
+				return fmt.Errorf("failed to add member to conversation: %w", err)
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return fmt.Errorf("failed to add member to conversation: %w", err)
+			} else if n == 0 {
+				return ErrUserDoesNotExist
+			}
+		}
+		return nil
+	})
 }
 
-func (db *appdbimpl) GetLastMessageByConversationID(conversationID string) (*schema.Message, error) {
+func (db *appdbimpl) GetLastMessageByConversationID(ctx context.Context, conversationID string) (*schema.Message, error) {
 	query := `
-		SELECT id, content, timestamp, senderId, attachment
+		SELECT id, content, timestamp, senderId
 		FROM messages
 		WHERE conversationId = ?
 		ORDER BY timestamp DESC LIMIT 1`
@@ -234,39 +276,39 @@ func (db *appdbimpl) GetLastMessageByConversationID(conversationID string) (*sch
 	var msg schema.Message
 	var content string
 	var senderID string
-	var attachment []byte
-	err := db.c.QueryRow(query, conversationID).Scan(&msg.ID, &content, &msg.Timestamp, &senderID, &attachment)
+	err := db.c.QueryRowContext(ctx, query, conversationID).Scan(&msg.ID, &content, &msg.Timestamp, &senderID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("no messages found for conversation %s", conversationID)
+			return nil, schema.ErrMessageDoesNotExist
 		}
 		return nil, fmt.Errorf("failed to get last message: %w", err)
 	}
 	msg.SenderID = senderID
 	msg.Content = schema.MessageContent{ContentType: schema.TextContent, Value: []byte(content)}
-	if len(attachment) > 0 {
-		msg.Attachments = []string{base64.StdEncoding.EncodeToString(attachment)}
+	if err := db.loadAttachments(ctx, []*schema.Message{&msg}); err != nil {
+		return nil, err
 	}
 	return &msg, nil
 }
 
-// return the list of users in the conversation.
-func (db *appdbimpl) GetConversationMembers(conversationID string) ([]schema.User, error) {
-	rows, err := db.c.Query(`
-        SELECT u.id, u.username, u.photo
+// return the list of users in the conversation, with their role.
+func (db *appdbimpl) GetConversationMembers(ctx context.Context, conversationID string) ([]schema.Member, error) {
+	rows, err := db.c.QueryContext(ctx, `
+        SELECT u.id, u.username, COALESCE(u.photoBlobId, ''), cm.role
         FROM users u
         JOIN conversation_members cm ON cm.userId = u.id
         WHERE cm.conversationId = ?
+        ORDER BY cm.rowid
     `, conversationID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query conversation members: %w", err)
 	}
 	defer rows.Close()
 
-	var users []schema.User
+	var users []schema.Member
 	for rows.Next() {
-		var u schema.User
-		if err := rows.Scan(&u.ID, &u.Username, &u.Photo); err != nil {
+		var u schema.Member
+		if err := rows.Scan(&u.ID, &u.Username, &u.PhotoID, &u.Role); err != nil {
 			return nil, fmt.Errorf("failed to scan conversation member: %w", err)
 		}
 		users = append(users, u)
@@ -274,15 +316,23 @@ func (db *appdbimpl) GetConversationMembers(conversationID string) ([]schema.Use
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating over conversation members: %w", err)
 	}
+
+	ptrs := make([]*schema.User, len(users))
+	for i := range users {
+		ptrs[i] = &users[i].User
+	}
+	if err := db.loadUserPhotos(ctx, ptrs); err != nil {
+		return nil, err
+	}
 	return users, nil
 }
 
 // EnsureDirectConversation returns an existing direct conversation between userID and other user,
 // or creates a new one if none exists.
-func (db *appdbimpl) EnsureDirectConversation(userID, peerUserID string) (*schema.Conversation, error) {
+func (db *appdbimpl) EnsureDirectConversation(ctx context.Context, userID, peerUserID string) (*schema.Conversation, error) {
 	// find existing direct conversation between the two users
 	var conversationID string
-	err := db.c.QueryRow(`
+	err := db.c.QueryRowContext(ctx, `
         SELECT c.id
         FROM conversations c
         JOIN conversation_members cm1 ON cm1.conversationId = c.id AND cm1.userId = ?
@@ -292,7 +342,7 @@ func (db *appdbimpl) EnsureDirectConversation(userID, peerUserID string) (*schem
     `, userID, peerUserID).Scan(&conversationID)
 	if err == nil {
 		// return the full conversation
-		return db.GetConversationByID(userID, conversationID)
+		return db.GetConversationByID(ctx, userID, conversationID)
 	}
 
 	// create a new direct conversation via the single write path
@@ -306,8 +356,8 @@ func (db *appdbimpl) EnsureDirectConversation(userID, peerUserID string) (*schem
 		Type:           "direct",
 		Members:        []string{userID, peerUserID},
 	}
-	if cerr = db.CreateConversation(conv); cerr != nil {
+	if cerr = db.CreateConversation(ctx, conv); cerr != nil {
 		return nil, fmt.Errorf("failed to create conversation: %w", cerr)
 	}
-	return db.GetConversationByID(userID, convID.String())
+	return db.GetConversationByID(ctx, userID, convID.String())
 }
@@ -0,0 +1,180 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// GetPasswordHash returns the password hash of a user, empty when the user has no password.
+func (db *appdbimpl) GetPasswordHash(ctx context.Context, userID string) (string, error) {
+	var hash sql.NullString
+	err := db.c.QueryRowContext(ctx, `SELECT passwordHash FROM users WHERE id = ?`, userID).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUserDoesNotExist
+	} else if err != nil {
+		return "", fmt.Errorf("failed to load password: %w", err)
+	}
+	return hash.String, nil
+}
+
+// SetPasswordHash sets the password hash of a user.
+func (db *appdbimpl) SetPasswordHash(ctx context.Context, userID, hash string) error {
+	if hash == "" {
+		return fmt.Errorf("password hash cannot be empty")
+	}
+	res, err := db.c.ExecContext(ctx, `UPDATE users SET passwordHash = ? WHERE id = ?`, hash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set password: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to set password: %w", err)
+	} else if n == 0 {
+		return ErrUserDoesNotExist
+	}
+	return nil
+}
+
+// CreatePasskey registers a passkey of a user, or returns schema.ErrPasskeyExists when its credential ID is taken.
+func (db *appdbimpl) CreatePasskey(ctx context.Context, p *schema.Passkey) error {
+	if p.ID == "" || p.UserID == "" || len(p.PublicKey) == 0 || p.CreatedAt == "" {
+		return fmt.Errorf("passkey ID, user ID, public key and creation time cannot be empty")
+	}
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		var exists bool
+		if err := tx.c.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM passkeys WHERE id = ?)`, p.ID).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to check passkey: %w", err)
+		}
+		if exists {
+			return schema.ErrPasskeyExists
+		}
+		_, err := tx.c.ExecContext(ctx, `INSERT INTO passkeys (id, user_id, name, public_key, sign_count, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)`, p.ID, p.UserID, p.Name, p.PublicKey, p.SignCount, p.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to create passkey: %w", err)
+		}
+		return nil
+	})
+}
+
+const passkeyColumns = `id, user_id, name, public_key, sign_count, created_at, COALESCE(last_used_at, '')`
+
+func scanPasskey(row interface{ Scan(...interface{}) error }) (schema.Passkey, error) {
+	var p schema.Passkey
+	err := row.Scan(&p.ID, &p.UserID, &p.Name, &p.PublicKey, &p.SignCount, &p.CreatedAt, &p.LastUsedAt)
+	return p, err
+}
+
+// GetPasskey returns a passkey by credential ID, or schema.ErrPasskeyNotFound.
+func (db *appdbimpl) GetPasskey(ctx context.Context, id string) (*schema.Passkey, error) {
+	p, err := scanPasskey(db.c.QueryRowContext(ctx, `SELECT `+passkeyColumns+` FROM passkeys WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, schema.ErrPasskeyNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load passkey: %w", err)
+	}
+	return &p, nil
+}
+
+// GetUserPasskeys returns the passkeys of a user, the oldest first.
+func (db *appdbimpl) GetUserPasskeys(ctx context.Context, userID string) ([]schema.Passkey, error) {
+	rows, err := db.c.QueryContext(ctx, `SELECT `+passkeyColumns+` FROM passkeys WHERE user_id = ?
+		ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load passkeys: %w", err)
+	}
+	defer rows.Close()
+
+	passkeys := []schema.Passkey{}
+	for rows.Next() {
+		p, err := scanPasskey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passkey: %w", err)
+		}
+		passkeys = append(passkeys, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load passkeys: %w", err)
+	}
+	return passkeys, nil
+}
+
+// UpdatePasskeyUse records that a passkey logged in at `now`, with its new signature counter.
+func (db *appdbimpl) UpdatePasskeyUse(ctx context.Context, id string, signCount uint32, now time.Time) error {
+	_, err := db.c.ExecContext(ctx, `UPDATE passkeys SET sign_count = ?, last_used_at = ? WHERE id = ?`,
+		signCount, now.UTC().Format(time.RFC3339), id)
+	if err != nil {
+		return fmt.Errorf("failed to update passkey: %w", err)
+	}
+	return nil
+}
+
+// DeletePasskey removes a passkey of a user, or returns schema.ErrPasskeyNotFound.
+func (db *appdbimpl) DeletePasskey(ctx context.Context, userID, id string) error {
+	res, err := db.c.ExecContext(ctx, `DELETE FROM passkeys WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete passkey: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to delete passkey: %w", err)
+	} else if n == 0 {
+		return schema.ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// CreateChallenge keeps a WebAuthn challenge until expiresAt. kind is "register", for the challenges of a user adding
+// a passkey, or "login", where userID can be empty.
+func (db *appdbimpl) CreateChallenge(ctx context.Context, challenge, kind, userID string, expiresAt time.Time) error {
+	_, err := db.c.ExecContext(ctx, `INSERT INTO webauthn_challenges (challenge, kind, user_id, expires_at)
+		VALUES (?, ?, ?, ?)`, challenge, kind, nullIfEmpty(userID), expiresAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to create challenge: %w", err)
+	}
+	return nil
+}
+
+// ConsumeChallenge deletes a challenge of the kind that has not expired at `now`, and returns the user it was created
+// for, possibly empty. Challenges are used once: schema.ErrChallengeNotFound is returned the second time.
+func (db *appdbimpl) ConsumeChallenge(ctx context.Context, challenge, kind string, now time.Time) (string, error) {
+	var userID sql.NullString
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		err := tx.c.QueryRowContext(ctx, `SELECT user_id FROM webauthn_challenges
+			WHERE challenge = ? AND kind = ? AND expires_at > ?`, challenge, kind, now.UTC().Format(time.RFC3339)).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return schema.ErrChallengeNotFound
+		} else if err != nil {
+			return fmt.Errorf("failed to load challenge: %w", err)
+		}
+		if _, err := tx.c.ExecContext(ctx, `DELETE FROM webauthn_challenges WHERE challenge = ?`, challenge); err != nil {
+			return fmt.Errorf("failed to delete challenge: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return userID.String, nil
+}
+
+// DeleteExpiredChallenges deletes up to limit challenges that expired at `now`, and returns their number.
+func (db *appdbimpl) DeleteExpiredChallenges(ctx context.Context, now time.Time, limit int) (int, error) {
+	if limit <= 0 {
+		return 0, fmt.Errorf("limit must be positive")
+	}
+	res, err := db.c.ExecContext(ctx, `DELETE FROM webauthn_challenges WHERE challenge IN (
+			SELECT challenge FROM webauthn_challenges WHERE expires_at <= ? ORDER BY expires_at LIMIT ?
+		)`, now.UTC().Format(time.RFC3339), limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired challenges: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired challenges: %w", err)
+	}
+	return int(n), nil
+}
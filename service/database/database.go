@@ -2,8 +2,18 @@
 Package database is the middleware between the app database and the code. All data (de)serialization (save/load) from a
 persistent database are handled here. Database specific logic should never escape this package.
 
-To use this package you need to apply migrations to the database if needed/wanted, connect to it (using the database
-data source name from config), and then initialize an instance of AppDatabase from the DB connection.
+To use this package you need to connect to the database (using the database data source name from config), and then
+initialize an instance of AppDatabase from the DB connection. New applies the pending migrations (see migrations.go)
+before returning, and refuses to work on a database migrated by a newer executable (ErrSchemaTooNew). Migrations can
+also be inspected and applied or reverted explicitly with MigrateUp, MigrateDownTo and GetMigrationStatus, which the
+`webapi migrate` command exposes.
+
+Message search uses the SQLite FTS5 full-text index when the executable is built with the `sqlite_fts5` tag, and falls
+back to matching the content of messages with LIKE otherwise. A database indexed once cannot be opened without FTS5
+anymore (ErrSearchNotSupported).
+
+Deletions rely on the foreign keys to cascade, which SQLite enables per connection: open the database with DriverName,
+which enables them on every connection of the pool. New refuses a connection without them (ErrForeignKeysDisabled).
 
 For example, this code adds a parameter in `webapi` executable for the database data source name (add it to the
 main.WebAPIConfiguration structure):
@@ -16,7 +26,7 @@ This is an example on how to migrate the DB and connect to it:
 
 	// Start Database
 	logger.Println("initializing database support")
-	db, err := sql.Open("sqlite3", "./foo.db")
+	db, err := sql.Open(database.DriverName, "./foo.db")
 	if err != nil {
 		logger.WithError(err).Error("error opening SQLite DB")
 		return fmt.Errorf("opening SQLite: %w", err)
@@ -31,58 +41,167 @@ Then you can initialize the AppDatabase and pass it to the api package.
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/dilcetto/wasa/service/blobstore"
 	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/mattn/go-sqlite3"
 )
 
+// DriverName is the name of the SQLite driver that enables the foreign keys on each new connection.
+const DriverName = "sqlite3_wasa"
+
+// ErrForeignKeysDisabled is returned by New when the connection does not enforce the foreign keys.
+var ErrForeignKeysDisabled = errors.New("the database connection does not enforce foreign keys: open it with database.DriverName")
+
+func init() {
+	sql.Register(DriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec(`PRAGMA foreign_keys = ON;`, nil)
+			return err
+		},
+	})
+}
+
 // AppDatabase is the high level interface for the DB
 type AppDatabase interface {
-	Ping() error
+	Ping(ctx context.Context) error
+
+	// WithTx runs fn in a transaction: the AppDatabase passed to fn is bound to the transaction, which is committed if
+	// fn returns nil and rolled back otherwise. Calls nested in an existing transaction join it.
+	WithTx(ctx context.Context, fn func(AppDatabase) error) error
 
 	// user related
-	SearchUserByUsername(username string) ([]schema.User, error)
-	GetUserByName(username string) (*schema.User, error)
-	GetUserById(id string) (*schema.User, error)
-	CreateUser(user *schema.User) error
-	UpdateUsername(userID, newUsername string) error
-	UpdateUserPhoto(userID string, photo []byte) error
+	SearchUserByUsername(ctx context.Context, username string) ([]schema.User, error)
+	GetUserByName(ctx context.Context, username string) (*schema.User, error)
+	GetUserById(ctx context.Context, id string) (*schema.User, error)
+	CreateUser(ctx context.Context, user *schema.User) error
+	UpdateUsername(ctx context.Context, userID, newUsername string) error
+	UpdateUserPhoto(ctx context.Context, userID, photoBlobID string) error
 
 	// conversation related
-	GetMyConversations(userID string) ([]*schema.Conversation, error)
-	GetConversationByID(userID, conversationID string) (*schema.Conversation, error)
-	SearchConversationByName(name string) ([]schema.Conversation, error)
-	CreateConversation(conversation *schema.Conversation) error
-	GetLastMessageByConversationID(conversationID string) (*schema.Message, error)
-	EnsureDirectConversation(userID, peerUserID string) (*schema.Conversation, error)
-	GetConversationMembers(conversationID string) ([]schema.User, error)
+	GetMyConversations(ctx context.Context, userID string) ([]*schema.Conversation, error)
+	GetConversationByID(ctx context.Context, userID, conversationID string) (*schema.Conversation, error)
+	// SearchConversationByName returns the conversations of userID whose name contains name.
+	SearchConversationByName(ctx context.Context, userID, name string) ([]schema.Conversation, error)
+	CreateConversation(ctx context.Context, conversation *schema.Conversation) error
+	GetLastMessageByConversationID(ctx context.Context, conversationID string) (*schema.Message, error)
+	EnsureDirectConversation(ctx context.Context, userID, peerUserID string) (*schema.Conversation, error)
+	GetConversationMembers(ctx context.Context, conversationID string) ([]schema.Member, error)
+	SetConversationMessageTTL(ctx context.Context, conversationID string, ttl time.Duration) error
+	GetConversationSlowMode(ctx context.Context, conversationID string) (time.Duration, error)
+
+	// membership related
+	GetConversationType(ctx context.Context, conversationID string) (string, error)
+	IsConversationMember(ctx context.Context, conversationID, userID string) (bool, error)
+	GetConversationMemberIDs(ctx context.Context, conversationID string) ([]string, error)
+	GetMessageConversationID(ctx context.Context, messageID string) (string, error)
 
 	// message related
-	SendMessage(message *schema.Message) error
-	GetMessagesByConversationID(conversationID string) ([]*schema.Message, error)
-	GetMessageByID(messageID string) (*schema.Message, error)
-	ForwardMessage(message *schema.Message, userID string) error
-	DeleteMessage(conversationID, messageID, userID string) error
-	MarkMessageStatus(messageID, userID, status string) error
+	SendMessage(ctx context.Context, message *schema.Message) error
+	GetMessagesByConversationID(ctx context.Context, conversationID string) ([]*schema.Message, error)
+	GetMessagesPage(ctx context.Context, conversationID, userID, before, after string, limit int) (*schema.MessagePage, error)
+	GetMessageByID(ctx context.Context, messageID string) (*schema.Message, error)
+	ForwardMessage(ctx context.Context, message *schema.Message, userID string) error
+	DeleteMessage(ctx context.Context, messageID, deletedAt string) error
+	HideMessage(ctx context.Context, messageID, userID, hiddenAt string) error
+	MarkMessageStatus(ctx context.Context, messageID, userID, status string) error
+	MarkConversationRead(ctx context.Context, conversationID, userID, messageID string) ([]string, error)
+	GetMessageReceipts(ctx context.Context, messageID string) ([]schema.MessageReceipt, error)
+	EditMessage(ctx context.Context, messageID string, content []byte, editedAt string) error
+	GetMessageRevisions(ctx context.Context, messageID string) ([]schema.MessageRevision, error)
+	GetMessageReplies(ctx context.Context, messageID, userID string) ([]*schema.Message, error)
+	SearchMessages(ctx context.Context, search MessageSearch) ([]schema.MessageSearchResult, error)
+	DeleteExpiredMessages(ctx context.Context, now time.Time, limit int) ([]ExpiredMessage, error)
+
+	// scheduled message related
+	CreateScheduledMessage(ctx context.Context, message *schema.ScheduledMessage) error
+	GetScheduledMessage(ctx context.Context, id string) (*schema.ScheduledMessage, error)
+	GetScheduledMessages(ctx context.Context, conversationID, senderID string) ([]*schema.ScheduledMessage, error)
+	GetDueScheduledMessages(ctx context.Context, now time.Time, limit int) ([]*schema.ScheduledMessage, error)
+	UpdateScheduledMessage(ctx context.Context, message *schema.ScheduledMessage) error
+	FailScheduledMessage(ctx context.Context, id, reason string) error
+	DeleteScheduledMessage(ctx context.Context, id string) error
 
 	// group related
-	GetGroupByID(groupID string) (*schema.Group, error)
-	GetMyGroups(userID string) ([]*schema.Group, error)
-	CreateGroup(group *schema.Group) error
-	UpdateGroupName(groupID, newName string) error
-	UpdateGroupPhoto(groupID string, photo []byte) error
-	AddUserToGroup(groupID, userID string) error
-	LeaveGroup(groupID, userID string) error
+	GetGroupByID(ctx context.Context, groupID string) (*schema.Group, error)
+	GetMyGroups(ctx context.Context, userID string) ([]*schema.Group, error)
+	CreateGroup(ctx context.Context, group *schema.Group) error
+	UpdateGroupName(ctx context.Context, groupID, newName string) error
+	UpdateGroupPhoto(ctx context.Context, groupID, photoBlobID string) error
+	SetGroupSlowMode(ctx context.Context, groupID string, interval time.Duration) error
+	AddUserToGroup(ctx context.Context, groupID, userID string) error
+	LeaveGroup(ctx context.Context, groupID, userID string) error
+	GetMemberRole(ctx context.Context, groupID, userID string) (string, error)
+	SetMemberRole(ctx context.Context, groupID, userID, role string) error
+	TransferGroupOwnership(ctx context.Context, groupID, fromUserID, toUserID string) error
 
 	// reaction related
-	AddReactionToMessage(reaction *schema.Reaction) error
-	DeleteReactionFromMessage(messageId, userId string) error
+	AddReactionToMessage(ctx context.Context, reaction *schema.Reaction) error
+	DeleteReactionFromMessage(ctx context.Context, messageId, userId string) error
+
+	// blob related
+	MoveInlineBlobs(ctx context.Context, store blobstore.BlobStore) (int, error)
+	SaveImage(ctx context.Context, blobID string, width, height int, thumbnailBlobID string) error
+	KeepBlob(ctx context.Context, blobID string) error
+	CanSeeBlob(ctx context.Context, userID, blobID string) (bool, error)
+	SweepUnusedBlobs(ctx context.Context, markedBefore time.Time, limit int) ([]string, error)
+
+	// upload related
+	CreateUpload(ctx context.Context, upload *schema.Upload) error
+	GetUpload(ctx context.Context, id string) (*schema.Upload, error)
+	AppendUploadChunk(ctx context.Context, id string, offset int64, data []byte) (int64, error)
+	GetUploadContent(ctx context.Context, id string) ([]byte, error)
+	FinalizeUpload(ctx context.Context, id string, attachment schema.Attachment) error
+	DeleteUpload(ctx context.Context, id string) error
+	DeleteExpiredUploads(ctx context.Context, now time.Time, limit int) (int, error)
+
+	// session related
+	CreateSession(ctx context.Context, session *schema.Session, refreshHash string) error
+	GetSession(ctx context.Context, id string, now time.Time) (*schema.Session, error)
+	RefreshSession(ctx context.Context, hash, newHash string, now time.Time, expiresAt string) (*schema.Session, error)
+	GetUserSessions(ctx context.Context, userID string, now time.Time) ([]schema.Session, error)
+	TouchSession(ctx context.Context, id, ip, userAgent string, now time.Time) error
+	DeleteSession(ctx context.Context, userID, id string) error
+	DeleteUserSessions(ctx context.Context, userID, keepID string) (int, error)
+	DeleteExpiredSessions(ctx context.Context, now time.Time, limit int) (int, error)
+
+	// credential related
+	GetPasswordHash(ctx context.Context, userID string) (string, error)
+	SetPasswordHash(ctx context.Context, userID, hash string) error
+	CreatePasskey(ctx context.Context, p *schema.Passkey) error
+	GetPasskey(ctx context.Context, id string) (*schema.Passkey, error)
+	GetUserPasskeys(ctx context.Context, userID string) ([]schema.Passkey, error)
+	UpdatePasskeyUse(ctx context.Context, id string, signCount uint32, now time.Time) error
+	DeletePasskey(ctx context.Context, userID, id string) error
+	CreateChallenge(ctx context.Context, challenge, kind, userID string, expiresAt time.Time) error
+	ConsumeChallenge(ctx context.Context, challenge, kind string, now time.Time) (string, error)
+	DeleteExpiredChallenges(ctx context.Context, now time.Time, limit int) (int, error)
+}
+
+// dbtx is implemented by both *sql.DB and *sql.Tx, so that queries run the same way inside and outside transactions.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 type appdbimpl struct {
-	c *sql.DB
+	// c runs the queries: the connection pool, or the transaction the instance is bound to
+	c dbtx
+
+	// conn is the connection pool, used to start transactions
+	conn *sql.DB
+
+	// tx is the transaction the instance is bound to, nil outside transactions
+	tx *sql.Tx
+
+	// fullText tells whether messages have a full-text index, which SQLite only supports when built with FTS5
+	fullText bool
 }
 
 // New returns a new instance of AppDatabase based on the SQLite connection `db`.
@@ -91,121 +210,53 @@ func New(db *sql.DB) (AppDatabase, error) {
 	if db == nil {
 		return nil, errors.New("database is required when building a AppDatabase")
 	}
-	_, err := db.Exec("PRAGMA foreign_keys = ON;")
+	var foreignKeys bool
+	if err := db.QueryRow(`PRAGMA foreign_keys;`).Scan(&foreignKeys); err != nil {
+		return nil, fmt.Errorf("error reading foreign keys setting: %w", err)
+	}
+	if !foreignKeys {
+		return nil, ErrForeignKeysDisabled
+	}
+
+	// Bring the schema up to date. Databases created before migrations were introduced are adopted by the first
+	// migration, as it only creates the missing tables.
+	if _, err := MigrateUp(db); err != nil {
+		return nil, err
+	}
+	fullText, err := ensureSearchIndex(db)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check if table exists. If not, the database is empty, and we need to create the structure
-	var tableName string
-	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='users';`).Scan(&tableName)
-	if errors.Is(err, sql.ErrNoRows) {
-		usersTable := `CREATE TABLE users (
-			id TEXT NOT NULL PRIMARY KEY,
-			username TEXT NOT NULL UNIQUE,
-			photo BLOB
-		);`
-
-		conversationsTable := `CREATE TABLE conversations (
-			id TEXT NOT NULL PRIMARY KEY,
-			name TEXT NOT NULL,
-			type TEXT NOT NULL CHECK (type IN ('group', 'direct')),
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			conversationPhoto BLOB
-		);`
-
-		conversationMembersTable := `CREATE TABLE conversation_members (
-			conversationId TEXT NOT NULL,
-			userId TEXT NOT NULL,
-			PRIMARY KEY (conversationId, userId),
-			FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
-			FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
-		);`
-
-		messagesTable := `CREATE TABLE messages (
-			id TEXT NOT NULL PRIMARY KEY,
-			conversationId TEXT NOT NULL,
-			senderId TEXT NOT NULL,
-			content TEXT NOT NULL,
-			timestamp TEXT NOT NULL,
-			attachment BLOB,
-			status TEXT NOT NULL,
-			forwardedFrom TEXT,
-			FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
-			FOREIGN KEY (senderId) REFERENCES users(id) ON DELETE CASCADE
-		);`
-
-		reactionsTable := `CREATE TABLE reactions (
-			messageId TEXT NOT NULL,
-			userId TEXT NOT NULL,
-			reaction TEXT NOT NULL,
-			PRIMARY KEY (messageId, userId),
-			FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
-			FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
-		);`
-
-		// NOTE:
-		// groups as separate tables (groups, group_members).
-		// at the end, unified groups and direct chats inside the `conversations` table
-		// using `type = 'group' | 'direct'`, with members in conversation_members.
-		// This simplifies the overall logic, as groups are just a type of conversation.
-		//
-		// groupsTable := `CREATE TABLE groups (
-		// 	id TEXT NOT NULL PRIMARY KEY,
-		// 	name TEXT NOT NULL,
-		// 	photo BLOB
-		// );`
-
-		// groupMembersTable := `CREATE TABLE group_members (
-		// 	groupId TEXT NOT NULL,
-		// 	userId TEXT NOT NULL,
-		// 	PRIMARY KEY (groupId, userId),
-		// 	FOREIGN KEY (groupId) REFERENCES groups(id) ON DELETE CASCADE,
-		// 	FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
-		// );`
-
-		messageStatusTable := `CREATE TABLE message_status (
-			messageId TEXT NOT NULL,
-			userId TEXT NOT NULL,
-			deliveredAt TEXT NOT NULL,
-			readAt TEXT,
-			PRIMARY KEY (messageId, userId),
-			FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
-			FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
-		);`
-
-		messageReceipts := `CREATE TABLE message_receipts (
-			message_id TEXT NOT NULL,
-			user_id TEXT NOT NULL,
-			status TEXT CHECK(status IN ('delivered', 'read')) NOT NULL,
-			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-			PRIMARY KEY (message_id, user_id),
-			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
-			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`
-
-		creationQueries := []string{
-			usersTable,
-			conversationsTable,
-			conversationMembersTable,
-			messagesTable,
-			reactionsTable,
-			// groupsTable,
-			// groupMembersTable,
-			messageStatusTable,
-			messageReceipts,
-		}
-		for _, stmt := range creationQueries {
-			_, err = db.Exec(stmt)
-			if err != nil {
-				return nil, fmt.Errorf("error creating table: %w", err)
-			}
-		}
-	}
+	return instrumented{&appdbimpl{c: db, conn: db, fullText: fullText}}, nil
+}
 
-	return &appdbimpl{c: db}, nil
+func (db *appdbimpl) Ping(ctx context.Context) error {
+	return db.conn.PingContext(ctx)
 }
 
-func (db *appdbimpl) Ping() error {
-	return db.c.Ping()
+func (db *appdbimpl) WithTx(ctx context.Context, fn func(AppDatabase) error) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error { return fn(tx) })
+}
+
+// withTx is WithTx for the methods of appdbimpl, which need the concrete type.
+func (db *appdbimpl) withTx(ctx context.Context, fn func(tx *appdbimpl) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	// no-op once committed, and makes sure a panic in fn does not leak the transaction
+	defer func() { _ = tx.Rollback() }()
+
+	if err := fn(&appdbimpl{c: tx, conn: db.conn, tx: tx, fullText: db.fullText}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// openTestDB opens a new, empty database in a temporary directory, closed at the end of the test.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open(DriverName, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// newTestAppDB returns an AppDatabase on a new, migrated database.
+func newTestAppDB(t *testing.T) (AppDatabase, *sql.DB) {
+	t.Helper()
+	conn := openTestDB(t)
+	db, err := New(conn)
+	if err != nil {
+		t.Fatalf("creating AppDatabase: %v", err)
+	}
+	return db, conn
+}
+
+// mustExec runs the statements, failing the test at the first error.
+func mustExec(t *testing.T, db *sql.DB, stmts ...string) {
+	t.Helper()
+	for _, stmt := range stmts {
+		if _, err := db.ExecContext(context.Background(), stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+}
+
+// TestForeignKeys checks that deletions cascade on every connection of the pool, not only on the first one.
+func TestForeignKeys(t *testing.T) {
+	_, db := newTestAppDB(t)
+	ctx := context.Background()
+	mustExec(t, db,
+		`INSERT INTO users (id, username) VALUES ('u1', 'alice');`,
+		`INSERT INTO conversations (id, name, type) VALUES ('c1', 'group', 'group');`,
+		`INSERT INTO messages (id, conversationId, senderId, content, timestamp, status, forwardedFrom)
+			VALUES ('m1', 'c1', 'u1', 'one', '2024-01-01T00:00:00Z', 'sent', '');`,
+		`INSERT INTO message_receipts (message_id, user_id, delivered_at)
+			VALUES ('m1', 'u1', '2024-01-01T00:00:00Z');`,
+		`INSERT INTO reactions (messageId, userId, reaction) VALUES ('m1', 'u1', '👍');`,
+	)
+
+	// both connections are held at once, so the second one cannot be the first one again
+	first, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	for i, conn := range []*sql.Conn{first, second} {
+		var enabled bool
+		if err := conn.QueryRowContext(ctx, `PRAGMA foreign_keys;`).Scan(&enabled); err != nil {
+			t.Fatal(err)
+		}
+		if !enabled {
+			t.Errorf("foreign keys are disabled on connection %d", i+1)
+		}
+	}
+
+	if _, err := second.ExecContext(ctx, `DELETE FROM messages WHERE id = 'm1';`); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"message_receipts", "reactions"} {
+		var n int
+		if err := second.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%d %s rows were left behind by the deleted message", n, table)
+		}
+	}
+}
+
+func TestNewRequiresForeignKeys(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := New(db); !errors.Is(err, ErrForeignKeysDisabled) {
+		t.Errorf("New returned %v, want %v", err, ErrForeignKeysDisabled)
+	}
+}
+
+// TestCreateConversationUnknownMember checks that an unknown member is reported as such, rather than as a failed
+// foreign key, and that the conversation is not created without them.
+func TestCreateConversationUnknownMember(t *testing.T) {
+	db, conn := newTestAppDB(t)
+	mustExec(t, conn, `INSERT INTO users (id, username) VALUES ('u1', 'alice');`)
+	conv := &schema.Conversation{ConversationID: "c1", DisplayName: "group", Type: "group", Members: []string{"u1", "nobody"}}
+	if err := db.CreateConversation(context.Background(), conv); !errors.Is(err, ErrUserDoesNotExist) {
+		t.Fatalf("CreateConversation returned %v, want %v", err, ErrUserDoesNotExist)
+	}
+	var n int
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM conversations`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("the conversation was created without its members")
+	}
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// messageExpiry is the SQL expression of the expiry time of a new message, from its timestamp and the ID of its
+// conversation (in this order). It is NULL when messages of the conversation do not expire.
+const messageExpiry = `(SELECT strftime('%Y-%m-%dT%H:%M:%SZ', ?, '+' || messageTtl || ' seconds')
+	FROM conversations WHERE id = ? AND messageTtl IS NOT NULL)`
+
+// ExpiredMessage is a message deleted because it expired.
+type ExpiredMessage struct {
+	ID             string
+	ConversationID string
+}
+
+// SetConversationMessageTTL sets the lifetime of the messages sent to the conversation from now on; zero means that
+// they never expire. Messages already sent keep their expiry time.
+func (db *appdbimpl) SetConversationMessageTTL(ctx context.Context, conversationID string, ttl time.Duration) error {
+	if conversationID == "" || ttl < 0 {
+		return fmt.Errorf("conversation ID cannot be empty and TTL cannot be negative")
+	}
+
+	var seconds interface{}
+	if ttl > 0 {
+		seconds = int64(ttl / time.Second)
+	}
+	res, err := db.c.ExecContext(ctx, `UPDATE conversations SET messageTtl = ? WHERE id = ?`, seconds, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to set message TTL: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to determine rows affected: %w", err)
+	} else if n == 0 {
+		return schema.ErrConversationDoesNotExist
+	}
+	return nil
+}
+
+// DeleteExpiredMessages deletes up to `limit` messages that expired at `now`, with their receipts, reactions and edit
+// history, and returns them. The blobs of their attachments are marked for deletion, see SweepUnusedBlobs.
+func (db *appdbimpl) DeleteExpiredMessages(ctx context.Context, now time.Time, limit int) ([]ExpiredMessage, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+
+	var expired []ExpiredMessage
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		// expiry times are stored in RFC 3339, which sorts chronologically as text
+		rows, err := tx.c.QueryContext(ctx, `SELECT id, conversationId FROM messages
+			WHERE expiresAt <= ? ORDER BY expiresAt LIMIT ?`, now.UTC().Format(time.RFC3339), limit)
+		if err != nil {
+			return fmt.Errorf("failed to query expired messages: %w", err)
+		}
+		defer rows.Close()
+
+		var placeholders []string
+		var args []interface{}
+		var ids []string
+		for rows.Next() {
+			var m ExpiredMessage
+			if err := rows.Scan(&m.ID, &m.ConversationID); err != nil {
+				return fmt.Errorf("failed to scan expired message: %w", err)
+			}
+			expired = append(expired, m)
+			placeholders = append(placeholders, "?")
+			args = append(args, m.ID)
+			ids = append(ids, m.ID)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error reading expired messages: %w", err)
+		}
+		if len(expired) == 0 {
+			return nil
+		}
+		blobs, err := tx.attachmentBlobs(ctx, messageAttachments, ids)
+		if err != nil {
+			return err
+		}
+
+		// attachments, receipts, reactions and revisions are deleted by the foreign keys
+		_, err = tx.c.ExecContext(ctx, `DELETE FROM messages WHERE id IN (`+strings.Join(placeholders, ",")+`)`, args...)
+		if err != nil {
+			return fmt.Errorf("failed to delete expired messages: %w", err)
+		}
+
+		return tx.markBlobsForDeletion(ctx, blobs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// blobReferences lists the columns holding blob IDs.
+var blobReferences = []struct {
+	table, ref string
+}{
+	{"users", "photoBlobId"},
+	{"conversations", "photoBlobId"},
+	{messageAttachments, "blob_id"},
+	{scheduledMessageAttachments, "blob_id"},
+	{"uploads", "blob_id"},
+}
+
+// blobInUse reports whether any user, conversation, message, scheduled message or upload references the blob, or
+// whether it is the thumbnail of another image.
+func (db *appdbimpl) blobInUse(ctx context.Context, blobID string) (bool, error) {
+	for _, col := range blobReferences {
+		var used bool
+		err := db.c.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM `+col.table+` WHERE `+col.ref+` = ?)`, blobID).Scan(&used)
+		if err != nil {
+			return false, fmt.Errorf("failed to check references to blob: %w", err)
+		}
+		if used {
+			return true, nil
+		}
+	}
+
+	// images small enough are their own thumbnail
+	var used bool
+	err := db.c.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM images WHERE thumbnail_blob_id = ? AND blob_id <> ?)`,
+		blobID, blobID).Scan(&used)
+	if err != nil {
+		return false, fmt.Errorf("failed to check references to blob: %w", err)
+	}
+	return used, nil
+}
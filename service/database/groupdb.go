@@ -1,30 +1,37 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/dilcetto/wasa/service/components/schema"
 )
 
-func (db *appdbimpl) GetGroupByID(groupID string) (*schema.Group, error) {
+// maxGroupNameLength is the longest name of a group, in characters
+const maxGroupNameLength = 50
+
+func (db *appdbimpl) GetGroupByID(ctx context.Context, groupID string) (*schema.Group, error) {
 	// fetch conversation as a group
 	var g schema.Group
-	err := db.c.QueryRow(`SELECT id, name, conversationPhoto, created_at FROM conversations WHERE id = ? AND type = 'group'`, groupID).
-		Scan(&g.ID, &g.GroupName, &g.GroupPhoto, &g.CreatedAt)
+	err := db.c.QueryRowContext(ctx, `SELECT id, name, COALESCE(photoBlobId, ''), created_at FROM conversations WHERE id = ? AND type = 'group'`, groupID).
+		Scan(&g.ID, &g.GroupName, &g.PhotoID, &g.CreatedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("group with ID %s not found", groupID)
+			return nil, schema.ErrGroupDoesNotExist
 		}
 		return nil, fmt.Errorf("error retrieving group: %w", err)
 	}
 	return &g, nil
 }
 
-func (db *appdbimpl) GetMyGroups(userID string) ([]*schema.Group, error) {
-	rows, err := db.c.Query(`
-        SELECT c.id, c.name, c.conversationPhoto, c.created_at
+func (db *appdbimpl) GetMyGroups(ctx context.Context, userID string) ([]*schema.Group, error) {
+	rows, err := db.c.QueryContext(ctx, `
+        SELECT c.id, c.name, COALESCE(c.photoBlobId, ''), c.created_at
         FROM conversations c
         JOIN conversation_members cm ON cm.conversationId = c.id
         WHERE cm.userId = ? AND c.type = 'group'`, userID)
@@ -36,7 +43,7 @@ func (db *appdbimpl) GetMyGroups(userID string) ([]*schema.Group, error) {
 	var groups []*schema.Group
 	for rows.Next() {
 		var g schema.Group
-		if err := rows.Scan(&g.ID, &g.GroupName, &g.GroupPhoto, &g.CreatedAt); err != nil {
+		if err := rows.Scan(&g.ID, &g.GroupName, &g.PhotoID, &g.CreatedAt); err != nil {
 			return nil, fmt.Errorf("error scanning group row: %w", err)
 		}
 		groups = append(groups, &g)
@@ -47,7 +54,7 @@ func (db *appdbimpl) GetMyGroups(userID string) ([]*schema.Group, error) {
 	return groups, nil
 }
 
-func (db *appdbimpl) CreateGroup(group *schema.Group) error {
+func (db *appdbimpl) CreateGroup(ctx context.Context, group *schema.Group) error {
 	// mapping schema.Group to schema.Conversation and reuse CreateConversation
 	conv := &schema.Conversation{
 		ConversationID: group.ID,
@@ -57,45 +64,175 @@ func (db *appdbimpl) CreateGroup(group *schema.Group) error {
 		Members:        group.Members,
 	}
 	// store photo if present
-	conv.ProfilePhoto = group.GroupPhoto
-	return db.CreateConversation(conv)
+	conv.PhotoID = group.PhotoID
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		if err := tx.CreateConversation(ctx, conv); err != nil {
+			return err
+		}
+		if group.OwnerID == "" {
+			return nil
+		}
+		return tx.SetMemberRole(ctx, group.ID, group.OwnerID, schema.RoleOwner)
+	})
 }
 
-func (db *appdbimpl) UpdateGroupName(groupID, newName string) error {
-	_, err := db.c.Exec(`UPDATE conversations SET name = ? WHERE id = ? AND type = 'group'`, newName, groupID)
+// UpdateGroupName renames a group. The name must have between 1 and maxGroupNameLength characters, or
+// schema.ErrInvalidGroupName is returned.
+func (db *appdbimpl) UpdateGroupName(ctx context.Context, groupID, newName string) error {
+	if n := utf8.RuneCountInString(strings.TrimSpace(newName)); n == 0 || n > maxGroupNameLength {
+		return schema.ErrInvalidGroupName
+	}
+	res, err := db.c.ExecContext(ctx, `UPDATE conversations SET name = ? WHERE id = ? AND type = 'group'`, strings.TrimSpace(newName), groupID)
 	if err != nil {
 		return fmt.Errorf("error updating group name: %w", err)
 	}
-	return nil
+	return groupRowAffected(res)
 }
 
-func (db *appdbimpl) UpdateGroupPhoto(groupID string, photo []byte) error {
-	_, err := db.c.Exec(`UPDATE conversations SET conversationPhoto = ? WHERE id = ? AND type = 'group'`, photo, groupID)
+func (db *appdbimpl) UpdateGroupPhoto(ctx context.Context, groupID, photoBlobID string) error {
+	res, err := db.c.ExecContext(ctx, `UPDATE conversations SET photoBlobId = ? WHERE id = ? AND type = 'group'`, photoBlobID, groupID)
 	if err != nil {
 		return fmt.Errorf("error updating group photo: %w", err)
 	}
-	return nil
+	return groupRowAffected(res)
+}
+
+// SetGroupSlowMode sets how long the members of a group wait between two messages; zero turns slow mode off.
+func (db *appdbimpl) SetGroupSlowMode(ctx context.Context, groupID string, interval time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("slow mode interval cannot be negative")
+	}
+	var seconds interface{}
+	if interval > 0 {
+		seconds = int64(interval / time.Second)
+	}
+	res, err := db.c.ExecContext(ctx, `UPDATE conversations SET slowMode = ? WHERE id = ? AND type = 'group'`, seconds, groupID)
+	if err != nil {
+		return fmt.Errorf("error updating group slow mode: %w", err)
+	}
+	return groupRowAffected(res)
 }
 
-func (db *appdbimpl) AddUserToGroup(groupID, userID string) error {
-	_, err := db.c.Exec(`INSERT INTO conversation_members (conversationId, userId) VALUES (?, ?)`, groupID, userID)
+// GetConversationSlowMode returns how long the members of a conversation wait between two messages, zero when slow
+// mode is off.
+func (db *appdbimpl) GetConversationSlowMode(ctx context.Context, conversationID string) (time.Duration, error) {
+	var seconds int64
+	err := db.c.QueryRowContext(ctx, `SELECT COALESCE(slowMode, 0) FROM conversations WHERE id = ?`, conversationID).Scan(&seconds)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, schema.ErrConversationDoesNotExist
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get slow mode: %w", err)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// groupRowAffected returns schema.ErrGroupDoesNotExist if the statement did not change any row.
+func groupRowAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("error adding user %s to group %s: %w", userID, groupID, err)
+		return fmt.Errorf("error checking rows affected: %w", err)
+	}
+	if n == 0 {
+		return schema.ErrGroupDoesNotExist
 	}
 	return nil
 }
 
-func (db *appdbimpl) LeaveGroup(groupID, userID string) error {
-	result, err := db.c.Exec(`DELETE FROM conversation_members WHERE conversationId = ? AND userId = ?`, groupID, userID)
+func (db *appdbimpl) AddUserToGroup(ctx context.Context, groupID, userID string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		var exists bool
+		err := tx.c.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM conversation_members WHERE conversationId = ? AND userId = ?)`, groupID, userID).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("error checking group membership: %w", err)
+		}
+		if exists {
+			return schema.ErrAlreadyGroupMember
+		}
+		_, err = tx.c.ExecContext(ctx, `INSERT INTO conversation_members (conversationId, userId, role) VALUES (?, ?, 'member')`, groupID, userID)
+		if err != nil {
+			return fmt.Errorf("error adding user %s to group %s: %w", userID, groupID, err)
+		}
+		return nil
+	})
+}
+
+// LeaveGroup removes the user from the group. When the last owner leaves, the ownership passes to the longest-standing
+// admin or, if there are no admins, to the longest-standing member. A group left without members is deleted.
+func (db *appdbimpl) LeaveGroup(ctx context.Context, groupID, userID string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		result, err := tx.c.ExecContext(ctx, `DELETE FROM conversation_members WHERE conversationId = ? AND userId = ?`, groupID, userID)
+		if err != nil {
+			return fmt.Errorf("error leaving group %s: %w", groupID, err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("error checking rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			return schema.ErrNotGroupMember
+		}
+
+		var remaining, owners int
+		err = tx.c.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(CASE WHEN role = 'owner' THEN 1 ELSE 0 END), 0)
+			FROM conversation_members WHERE conversationId = ?`, groupID).Scan(&remaining, &owners)
+		if err != nil {
+			return fmt.Errorf("error counting group members: %w", err)
+		}
+		switch {
+		case remaining == 0:
+			if _, err := tx.c.ExecContext(ctx, `DELETE FROM conversations WHERE id = ? AND type = 'group'`, groupID); err != nil {
+				return fmt.Errorf("error deleting empty group %s: %w", groupID, err)
+			}
+		case owners == 0:
+			_, err := tx.c.ExecContext(ctx, `
+				UPDATE conversation_members SET role = 'owner'
+				WHERE rowid = (
+					SELECT rowid FROM conversation_members
+					WHERE conversationId = ?
+					ORDER BY CASE role WHEN 'admin' THEN 0 ELSE 1 END, rowid
+					LIMIT 1
+				)`, groupID)
+			if err != nil {
+				return fmt.Errorf("error electing new owner of group %s: %w", groupID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetMemberRole returns the role of the user in the group, or schema.ErrNotGroupMember.
+func (db *appdbimpl) GetMemberRole(ctx context.Context, groupID, userID string) (string, error) {
+	var role string
+	err := db.c.QueryRowContext(ctx, `SELECT role FROM conversation_members WHERE conversationId = ? AND userId = ?`, groupID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", schema.ErrNotGroupMember
+	} else if err != nil {
+		return "", fmt.Errorf("error retrieving member role: %w", err)
+	}
+	return role, nil
+}
+
+func (db *appdbimpl) SetMemberRole(ctx context.Context, groupID, userID, role string) error {
+	result, err := db.c.ExecContext(ctx, `UPDATE conversation_members SET role = ? WHERE conversationId = ? AND userId = ?`, role, groupID, userID)
 	if err != nil {
-		return fmt.Errorf("error leaving group %s: %w", groupID, err)
+		return fmt.Errorf("error updating member role: %w", err)
 	}
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return fmt.Errorf("error checking rows affected: %w", err)
 	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("user %s is not a member of group %s", userID, groupID)
+		return schema.ErrNotGroupMember
 	}
 	return nil
 }
+
+// TransferGroupOwnership makes toUserID the owner of the group, and demotes fromUserID to admin.
+func (db *appdbimpl) TransferGroupOwnership(ctx context.Context, groupID, fromUserID, toUserID string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		if err := tx.SetMemberRole(ctx, groupID, toUserID, schema.RoleOwner); err != nil {
+			return err
+		}
+		return tx.SetMemberRole(ctx, groupID, fromUserID, schema.RoleAdmin)
+	})
+}
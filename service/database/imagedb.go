@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// SaveImage records the dimensions and the thumbnail of an image processed on upload. Images are content-addressed
+// like every blob, so saving an image again changes nothing.
+func (db *appdbimpl) SaveImage(ctx context.Context, blobID string, width, height int, thumbnailBlobID string) error {
+	if blobID == "" || thumbnailBlobID == "" {
+		return fmt.Errorf("image and thumbnail blob IDs cannot be empty")
+	}
+	_, err := db.c.ExecContext(ctx, `INSERT INTO images (blob_id, width, height, thumbnail_blob_id) VALUES (?, ?, ?, ?)
+		ON CONFLICT (blob_id) DO NOTHING`, blobID, width, height, thumbnailBlobID)
+	if err != nil {
+		return fmt.Errorf("failed to save image: %w", err)
+	}
+	return nil
+}
+
+// imagesOf returns the dimensions and thumbnails of the images with the given blob IDs, keyed by blob ID. Blobs that
+// are not processed images are missing from the map.
+func (db *appdbimpl) imagesOf(ctx context.Context, blobIDs []string) (map[string]schema.ImageInfo, error) {
+	found := make(map[string]schema.ImageInfo)
+	placeholders := make([]string, 0, len(blobIDs))
+	args := make([]interface{}, 0, len(blobIDs))
+	for _, id := range blobIDs {
+		if id != "" {
+			placeholders = append(placeholders, "?")
+			args = append(args, id)
+		}
+	}
+	if len(args) == 0 {
+		return found, nil
+	}
+
+	rows, err := db.c.QueryContext(ctx, `SELECT blob_id, width, height, thumbnail_blob_id FROM images
+		WHERE blob_id IN (`+strings.Join(placeholders, ",")+`)`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query images: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var blobID, thumbnailID string
+		var info schema.ImageInfo
+		if err := rows.Scan(&blobID, &info.Width, &info.Height, &thumbnailID); err != nil {
+			return nil, fmt.Errorf("failed to scan image: %w", err)
+		}
+		info.ThumbnailURL = schema.MediaURL(thumbnailID)
+		found[blobID] = info
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading images: %w", err)
+	}
+	return found, nil
+}
+
+// loadUserPhotos sets the thumbnail and the dimensions of the profile photo of the users.
+func (db *appdbimpl) loadUserPhotos(ctx context.Context, users []*schema.User) error {
+	ids := make([]string, 0, len(users))
+	for _, u := range users {
+		ids = append(ids, u.PhotoID)
+	}
+	images, err := db.imagesOf(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		info := images[u.PhotoID]
+		u.PhotoThumbnailURL, u.PhotoWidth, u.PhotoHeight = info.ThumbnailURL, info.Width, info.Height
+	}
+	return nil
+}
+
+// loadConversationPhotos sets the thumbnail and the dimensions of the photo of the conversations.
+func (db *appdbimpl) loadConversationPhotos(ctx context.Context, conversations []*schema.Conversation) error {
+	ids := make([]string, 0, len(conversations))
+	for _, c := range conversations {
+		ids = append(ids, c.PhotoID)
+	}
+	images, err := db.imagesOf(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, c := range conversations {
+		info := images[c.PhotoID]
+		c.PhotoThumbnailURL, c.PhotoWidth, c.PhotoHeight = info.ThumbnailURL, info.Width, info.Height
+	}
+	return nil
+}
+
+// forgetImage forgets the image of a blob that is no longer used, and returns the blob ID of its thumbnail, or the empty
+// string when the blob is not an image or is its own thumbnail.
+func (db *appdbimpl) forgetImage(ctx context.Context, blobID string) (string, error) {
+	var thumbnailID string
+	err := db.c.QueryRowContext(ctx, `DELETE FROM images WHERE blob_id = ? RETURNING thumbnail_blob_id`, blobID).Scan(&thumbnailID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to delete image: %w", err)
+	}
+	if thumbnailID == blobID {
+		return "", nil
+	}
+	return thumbnailID, nil
+}
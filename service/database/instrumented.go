@@ -0,0 +1,457 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/dilcetto/wasa/service/blobstore"
+	"github.com/dilcetto/wasa/service/components/schema"
+	"github.com/dilcetto/wasa/service/metrics"
+)
+
+// queryDuration is how long the methods of AppDatabase take, transactions included.
+var queryDuration = metrics.NewHistogramVec("wasa_db_query_duration_seconds",
+	"Duration of the calls to the database, by method of AppDatabase.", metrics.DefaultBuckets, "method")
+
+// instrumented is an AppDatabase that records how long the methods of the wrapped one take, by method name. Methods
+// called by other methods of appdbimpl are not recorded on their own.
+type instrumented struct {
+	AppDatabase
+}
+
+func observeQuery(method string, start time.Time) {
+	queryDuration.With(method).Observe(time.Since(start).Seconds())
+}
+
+// WithTx passes fn the transaction instrumented too. The duration of the whole transaction is recorded as WithTx.
+func (db instrumented) WithTx(ctx context.Context, fn func(AppDatabase) error) error {
+	defer observeQuery("WithTx", time.Now())
+	return db.AppDatabase.WithTx(ctx, func(tx AppDatabase) error {
+		return fn(instrumented{tx})
+	})
+}
+
+func (db instrumented) Ping(ctx context.Context) error {
+	defer observeQuery("Ping", time.Now())
+	return db.AppDatabase.Ping(ctx)
+}
+
+func (db instrumented) SearchUserByUsername(ctx context.Context, username string) ([]schema.User, error) {
+	defer observeQuery("SearchUserByUsername", time.Now())
+	return db.AppDatabase.SearchUserByUsername(ctx, username)
+}
+
+func (db instrumented) GetUserByName(ctx context.Context, username string) (*schema.User, error) {
+	defer observeQuery("GetUserByName", time.Now())
+	return db.AppDatabase.GetUserByName(ctx, username)
+}
+
+func (db instrumented) GetUserById(ctx context.Context, id string) (*schema.User, error) {
+	defer observeQuery("GetUserById", time.Now())
+	return db.AppDatabase.GetUserById(ctx, id)
+}
+
+func (db instrumented) CreateUser(ctx context.Context, user *schema.User) error {
+	defer observeQuery("CreateUser", time.Now())
+	return db.AppDatabase.CreateUser(ctx, user)
+}
+
+func (db instrumented) UpdateUsername(ctx context.Context, userID, newUsername string) error {
+	defer observeQuery("UpdateUsername", time.Now())
+	return db.AppDatabase.UpdateUsername(ctx, userID, newUsername)
+}
+
+func (db instrumented) UpdateUserPhoto(ctx context.Context, userID, photoBlobID string) error {
+	defer observeQuery("UpdateUserPhoto", time.Now())
+	return db.AppDatabase.UpdateUserPhoto(ctx, userID, photoBlobID)
+}
+
+func (db instrumented) GetMyConversations(ctx context.Context, userID string) ([]*schema.Conversation, error) {
+	defer observeQuery("GetMyConversations", time.Now())
+	return db.AppDatabase.GetMyConversations(ctx, userID)
+}
+
+func (db instrumented) GetConversationByID(ctx context.Context, userID, conversationID string) (*schema.Conversation, error) {
+	defer observeQuery("GetConversationByID", time.Now())
+	return db.AppDatabase.GetConversationByID(ctx, userID, conversationID)
+}
+
+func (db instrumented) SearchConversationByName(ctx context.Context, userID, name string) ([]schema.Conversation, error) {
+	defer observeQuery("SearchConversationByName", time.Now())
+	return db.AppDatabase.SearchConversationByName(ctx, userID, name)
+}
+
+func (db instrumented) CreateConversation(ctx context.Context, conversation *schema.Conversation) error {
+	defer observeQuery("CreateConversation", time.Now())
+	return db.AppDatabase.CreateConversation(ctx, conversation)
+}
+
+func (db instrumented) GetLastMessageByConversationID(ctx context.Context, conversationID string) (*schema.Message, error) {
+	defer observeQuery("GetLastMessageByConversationID", time.Now())
+	return db.AppDatabase.GetLastMessageByConversationID(ctx, conversationID)
+}
+
+func (db instrumented) EnsureDirectConversation(ctx context.Context, userID, peerUserID string) (*schema.Conversation, error) {
+	defer observeQuery("EnsureDirectConversation", time.Now())
+	return db.AppDatabase.EnsureDirectConversation(ctx, userID, peerUserID)
+}
+
+func (db instrumented) GetConversationMembers(ctx context.Context, conversationID string) ([]schema.Member, error) {
+	defer observeQuery("GetConversationMembers", time.Now())
+	return db.AppDatabase.GetConversationMembers(ctx, conversationID)
+}
+
+func (db instrumented) SetConversationMessageTTL(ctx context.Context, conversationID string, ttl time.Duration) error {
+	defer observeQuery("SetConversationMessageTTL", time.Now())
+	return db.AppDatabase.SetConversationMessageTTL(ctx, conversationID, ttl)
+}
+
+func (db instrumented) GetConversationType(ctx context.Context, conversationID string) (string, error) {
+	defer observeQuery("GetConversationType", time.Now())
+	return db.AppDatabase.GetConversationType(ctx, conversationID)
+}
+
+func (db instrumented) IsConversationMember(ctx context.Context, conversationID, userID string) (bool, error) {
+	defer observeQuery("IsConversationMember", time.Now())
+	return db.AppDatabase.IsConversationMember(ctx, conversationID, userID)
+}
+
+func (db instrumented) GetConversationMemberIDs(ctx context.Context, conversationID string) ([]string, error) {
+	defer observeQuery("GetConversationMemberIDs", time.Now())
+	return db.AppDatabase.GetConversationMemberIDs(ctx, conversationID)
+}
+
+func (db instrumented) GetMessageConversationID(ctx context.Context, messageID string) (string, error) {
+	defer observeQuery("GetMessageConversationID", time.Now())
+	return db.AppDatabase.GetMessageConversationID(ctx, messageID)
+}
+
+func (db instrumented) SendMessage(ctx context.Context, message *schema.Message) error {
+	defer observeQuery("SendMessage", time.Now())
+	return db.AppDatabase.SendMessage(ctx, message)
+}
+
+func (db instrumented) GetMessagesByConversationID(ctx context.Context, conversationID string) ([]*schema.Message, error) {
+	defer observeQuery("GetMessagesByConversationID", time.Now())
+	return db.AppDatabase.GetMessagesByConversationID(ctx, conversationID)
+}
+
+func (db instrumented) GetMessagesPage(ctx context.Context, conversationID, userID, before, after string, limit int) (*schema.MessagePage, error) {
+	defer observeQuery("GetMessagesPage", time.Now())
+	return db.AppDatabase.GetMessagesPage(ctx, conversationID, userID, before, after, limit)
+}
+
+func (db instrumented) GetMessageByID(ctx context.Context, messageID string) (*schema.Message, error) {
+	defer observeQuery("GetMessageByID", time.Now())
+	return db.AppDatabase.GetMessageByID(ctx, messageID)
+}
+
+func (db instrumented) ForwardMessage(ctx context.Context, message *schema.Message, userID string) error {
+	defer observeQuery("ForwardMessage", time.Now())
+	return db.AppDatabase.ForwardMessage(ctx, message, userID)
+}
+
+func (db instrumented) DeleteMessage(ctx context.Context, messageID, deletedAt string) error {
+	defer observeQuery("DeleteMessage", time.Now())
+	return db.AppDatabase.DeleteMessage(ctx, messageID, deletedAt)
+}
+
+func (db instrumented) HideMessage(ctx context.Context, messageID, userID, hiddenAt string) error {
+	defer observeQuery("HideMessage", time.Now())
+	return db.AppDatabase.HideMessage(ctx, messageID, userID, hiddenAt)
+}
+
+func (db instrumented) MarkMessageStatus(ctx context.Context, messageID, userID, status string) error {
+	defer observeQuery("MarkMessageStatus", time.Now())
+	return db.AppDatabase.MarkMessageStatus(ctx, messageID, userID, status)
+}
+
+func (db instrumented) MarkConversationRead(ctx context.Context, conversationID, userID, messageID string) ([]string, error) {
+	defer observeQuery("MarkConversationRead", time.Now())
+	return db.AppDatabase.MarkConversationRead(ctx, conversationID, userID, messageID)
+}
+
+func (db instrumented) GetMessageReceipts(ctx context.Context, messageID string) ([]schema.MessageReceipt, error) {
+	defer observeQuery("GetMessageReceipts", time.Now())
+	return db.AppDatabase.GetMessageReceipts(ctx, messageID)
+}
+
+func (db instrumented) EditMessage(ctx context.Context, messageID string, content []byte, editedAt string) error {
+	defer observeQuery("EditMessage", time.Now())
+	return db.AppDatabase.EditMessage(ctx, messageID, content, editedAt)
+}
+
+func (db instrumented) GetMessageRevisions(ctx context.Context, messageID string) ([]schema.MessageRevision, error) {
+	defer observeQuery("GetMessageRevisions", time.Now())
+	return db.AppDatabase.GetMessageRevisions(ctx, messageID)
+}
+
+func (db instrumented) GetMessageReplies(ctx context.Context, messageID, userID string) ([]*schema.Message, error) {
+	defer observeQuery("GetMessageReplies", time.Now())
+	return db.AppDatabase.GetMessageReplies(ctx, messageID, userID)
+}
+
+func (db instrumented) SearchMessages(ctx context.Context, search MessageSearch) ([]schema.MessageSearchResult, error) {
+	defer observeQuery("SearchMessages", time.Now())
+	return db.AppDatabase.SearchMessages(ctx, search)
+}
+
+func (db instrumented) DeleteExpiredMessages(ctx context.Context, now time.Time, limit int) ([]ExpiredMessage, error) {
+	defer observeQuery("DeleteExpiredMessages", time.Now())
+	return db.AppDatabase.DeleteExpiredMessages(ctx, now, limit)
+}
+
+func (db instrumented) CreateScheduledMessage(ctx context.Context, message *schema.ScheduledMessage) error {
+	defer observeQuery("CreateScheduledMessage", time.Now())
+	return db.AppDatabase.CreateScheduledMessage(ctx, message)
+}
+
+func (db instrumented) GetScheduledMessage(ctx context.Context, id string) (*schema.ScheduledMessage, error) {
+	defer observeQuery("GetScheduledMessage", time.Now())
+	return db.AppDatabase.GetScheduledMessage(ctx, id)
+}
+
+func (db instrumented) GetScheduledMessages(ctx context.Context, conversationID, senderID string) ([]*schema.ScheduledMessage, error) {
+	defer observeQuery("GetScheduledMessages", time.Now())
+	return db.AppDatabase.GetScheduledMessages(ctx, conversationID, senderID)
+}
+
+func (db instrumented) GetDueScheduledMessages(ctx context.Context, now time.Time, limit int) ([]*schema.ScheduledMessage, error) {
+	defer observeQuery("GetDueScheduledMessages", time.Now())
+	return db.AppDatabase.GetDueScheduledMessages(ctx, now, limit)
+}
+
+func (db instrumented) UpdateScheduledMessage(ctx context.Context, message *schema.ScheduledMessage) error {
+	defer observeQuery("UpdateScheduledMessage", time.Now())
+	return db.AppDatabase.UpdateScheduledMessage(ctx, message)
+}
+
+func (db instrumented) FailScheduledMessage(ctx context.Context, id, reason string) error {
+	defer observeQuery("FailScheduledMessage", time.Now())
+	return db.AppDatabase.FailScheduledMessage(ctx, id, reason)
+}
+
+func (db instrumented) DeleteScheduledMessage(ctx context.Context, id string) error {
+	defer observeQuery("DeleteScheduledMessage", time.Now())
+	return db.AppDatabase.DeleteScheduledMessage(ctx, id)
+}
+
+func (db instrumented) GetGroupByID(ctx context.Context, groupID string) (*schema.Group, error) {
+	defer observeQuery("GetGroupByID", time.Now())
+	return db.AppDatabase.GetGroupByID(ctx, groupID)
+}
+
+func (db instrumented) GetMyGroups(ctx context.Context, userID string) ([]*schema.Group, error) {
+	defer observeQuery("GetMyGroups", time.Now())
+	return db.AppDatabase.GetMyGroups(ctx, userID)
+}
+
+func (db instrumented) CreateGroup(ctx context.Context, group *schema.Group) error {
+	defer observeQuery("CreateGroup", time.Now())
+	return db.AppDatabase.CreateGroup(ctx, group)
+}
+
+func (db instrumented) UpdateGroupName(ctx context.Context, groupID, newName string) error {
+	defer observeQuery("UpdateGroupName", time.Now())
+	return db.AppDatabase.UpdateGroupName(ctx, groupID, newName)
+}
+
+func (db instrumented) SetGroupSlowMode(ctx context.Context, groupID string, interval time.Duration) error {
+	defer observeQuery("SetGroupSlowMode", time.Now())
+	return db.AppDatabase.SetGroupSlowMode(ctx, groupID, interval)
+}
+
+func (db instrumented) GetConversationSlowMode(ctx context.Context, conversationID string) (time.Duration, error) {
+	defer observeQuery("GetConversationSlowMode", time.Now())
+	return db.AppDatabase.GetConversationSlowMode(ctx, conversationID)
+}
+
+func (db instrumented) UpdateGroupPhoto(ctx context.Context, groupID, photoBlobID string) error {
+	defer observeQuery("UpdateGroupPhoto", time.Now())
+	return db.AppDatabase.UpdateGroupPhoto(ctx, groupID, photoBlobID)
+}
+
+func (db instrumented) AddUserToGroup(ctx context.Context, groupID, userID string) error {
+	defer observeQuery("AddUserToGroup", time.Now())
+	return db.AppDatabase.AddUserToGroup(ctx, groupID, userID)
+}
+
+func (db instrumented) LeaveGroup(ctx context.Context, groupID, userID string) error {
+	defer observeQuery("LeaveGroup", time.Now())
+	return db.AppDatabase.LeaveGroup(ctx, groupID, userID)
+}
+
+func (db instrumented) GetMemberRole(ctx context.Context, groupID, userID string) (string, error) {
+	defer observeQuery("GetMemberRole", time.Now())
+	return db.AppDatabase.GetMemberRole(ctx, groupID, userID)
+}
+
+func (db instrumented) SetMemberRole(ctx context.Context, groupID, userID, role string) error {
+	defer observeQuery("SetMemberRole", time.Now())
+	return db.AppDatabase.SetMemberRole(ctx, groupID, userID, role)
+}
+
+func (db instrumented) TransferGroupOwnership(ctx context.Context, groupID, fromUserID, toUserID string) error {
+	defer observeQuery("TransferGroupOwnership", time.Now())
+	return db.AppDatabase.TransferGroupOwnership(ctx, groupID, fromUserID, toUserID)
+}
+
+func (db instrumented) AddReactionToMessage(ctx context.Context, reaction *schema.Reaction) error {
+	defer observeQuery("AddReactionToMessage", time.Now())
+	return db.AppDatabase.AddReactionToMessage(ctx, reaction)
+}
+
+func (db instrumented) DeleteReactionFromMessage(ctx context.Context, messageId, userId string) error {
+	defer observeQuery("DeleteReactionFromMessage", time.Now())
+	return db.AppDatabase.DeleteReactionFromMessage(ctx, messageId, userId)
+}
+
+func (db instrumented) MoveInlineBlobs(ctx context.Context, store blobstore.BlobStore) (int, error) {
+	defer observeQuery("MoveInlineBlobs", time.Now())
+	return db.AppDatabase.MoveInlineBlobs(ctx, store)
+}
+
+func (db instrumented) SaveImage(ctx context.Context, blobID string, width, height int, thumbnailBlobID string) error {
+	defer observeQuery("SaveImage", time.Now())
+	return db.AppDatabase.SaveImage(ctx, blobID, width, height, thumbnailBlobID)
+}
+
+func (db instrumented) KeepBlob(ctx context.Context, blobID string) error {
+	defer observeQuery("KeepBlob", time.Now())
+	return db.AppDatabase.KeepBlob(ctx, blobID)
+}
+
+func (db instrumented) CanSeeBlob(ctx context.Context, userID, blobID string) (bool, error) {
+	defer observeQuery("CanSeeBlob", time.Now())
+	return db.AppDatabase.CanSeeBlob(ctx, userID, blobID)
+}
+
+func (db instrumented) SweepUnusedBlobs(ctx context.Context, markedBefore time.Time, limit int) ([]string, error) {
+	defer observeQuery("SweepUnusedBlobs", time.Now())
+	return db.AppDatabase.SweepUnusedBlobs(ctx, markedBefore, limit)
+}
+
+func (db instrumented) CreateUpload(ctx context.Context, upload *schema.Upload) error {
+	defer observeQuery("CreateUpload", time.Now())
+	return db.AppDatabase.CreateUpload(ctx, upload)
+}
+
+func (db instrumented) GetUpload(ctx context.Context, id string) (*schema.Upload, error) {
+	defer observeQuery("GetUpload", time.Now())
+	return db.AppDatabase.GetUpload(ctx, id)
+}
+
+func (db instrumented) AppendUploadChunk(ctx context.Context, id string, offset int64, data []byte) (int64, error) {
+	defer observeQuery("AppendUploadChunk", time.Now())
+	return db.AppDatabase.AppendUploadChunk(ctx, id, offset, data)
+}
+
+func (db instrumented) GetUploadContent(ctx context.Context, id string) ([]byte, error) {
+	defer observeQuery("GetUploadContent", time.Now())
+	return db.AppDatabase.GetUploadContent(ctx, id)
+}
+
+func (db instrumented) FinalizeUpload(ctx context.Context, id string, attachment schema.Attachment) error {
+	defer observeQuery("FinalizeUpload", time.Now())
+	return db.AppDatabase.FinalizeUpload(ctx, id, attachment)
+}
+
+func (db instrumented) DeleteUpload(ctx context.Context, id string) error {
+	defer observeQuery("DeleteUpload", time.Now())
+	return db.AppDatabase.DeleteUpload(ctx, id)
+}
+
+func (db instrumented) DeleteExpiredUploads(ctx context.Context, now time.Time, limit int) (int, error) {
+	defer observeQuery("DeleteExpiredUploads", time.Now())
+	return db.AppDatabase.DeleteExpiredUploads(ctx, now, limit)
+}
+
+func (db instrumented) CreateSession(ctx context.Context, session *schema.Session, refreshHash string) error {
+	defer observeQuery("CreateSession", time.Now())
+	return db.AppDatabase.CreateSession(ctx, session, refreshHash)
+}
+
+func (db instrumented) GetSession(ctx context.Context, id string, now time.Time) (*schema.Session, error) {
+	defer observeQuery("GetSession", time.Now())
+	return db.AppDatabase.GetSession(ctx, id, now)
+}
+
+func (db instrumented) RefreshSession(ctx context.Context, hash, newHash string, now time.Time, expiresAt string) (*schema.Session, error) {
+	defer observeQuery("RefreshSession", time.Now())
+	return db.AppDatabase.RefreshSession(ctx, hash, newHash, now, expiresAt)
+}
+
+func (db instrumented) GetUserSessions(ctx context.Context, userID string, now time.Time) ([]schema.Session, error) {
+	defer observeQuery("GetUserSessions", time.Now())
+	return db.AppDatabase.GetUserSessions(ctx, userID, now)
+}
+
+func (db instrumented) TouchSession(ctx context.Context, id, ip, userAgent string, now time.Time) error {
+	defer observeQuery("TouchSession", time.Now())
+	return db.AppDatabase.TouchSession(ctx, id, ip, userAgent, now)
+}
+
+func (db instrumented) DeleteSession(ctx context.Context, userID, id string) error {
+	defer observeQuery("DeleteSession", time.Now())
+	return db.AppDatabase.DeleteSession(ctx, userID, id)
+}
+
+func (db instrumented) DeleteUserSessions(ctx context.Context, userID, keepID string) (int, error) {
+	defer observeQuery("DeleteUserSessions", time.Now())
+	return db.AppDatabase.DeleteUserSessions(ctx, userID, keepID)
+}
+
+func (db instrumented) DeleteExpiredSessions(ctx context.Context, now time.Time, limit int) (int, error) {
+	defer observeQuery("DeleteExpiredSessions", time.Now())
+	return db.AppDatabase.DeleteExpiredSessions(ctx, now, limit)
+}
+
+func (db instrumented) GetPasswordHash(ctx context.Context, userID string) (string, error) {
+	defer observeQuery("GetPasswordHash", time.Now())
+	return db.AppDatabase.GetPasswordHash(ctx, userID)
+}
+
+func (db instrumented) SetPasswordHash(ctx context.Context, userID, hash string) error {
+	defer observeQuery("SetPasswordHash", time.Now())
+	return db.AppDatabase.SetPasswordHash(ctx, userID, hash)
+}
+
+func (db instrumented) CreatePasskey(ctx context.Context, p *schema.Passkey) error {
+	defer observeQuery("CreatePasskey", time.Now())
+	return db.AppDatabase.CreatePasskey(ctx, p)
+}
+
+func (db instrumented) GetPasskey(ctx context.Context, id string) (*schema.Passkey, error) {
+	defer observeQuery("GetPasskey", time.Now())
+	return db.AppDatabase.GetPasskey(ctx, id)
+}
+
+func (db instrumented) GetUserPasskeys(ctx context.Context, userID string) ([]schema.Passkey, error) {
+	defer observeQuery("GetUserPasskeys", time.Now())
+	return db.AppDatabase.GetUserPasskeys(ctx, userID)
+}
+
+func (db instrumented) UpdatePasskeyUse(ctx context.Context, id string, signCount uint32, now time.Time) error {
+	defer observeQuery("UpdatePasskeyUse", time.Now())
+	return db.AppDatabase.UpdatePasskeyUse(ctx, id, signCount, now)
+}
+
+func (db instrumented) DeletePasskey(ctx context.Context, userID, id string) error {
+	defer observeQuery("DeletePasskey", time.Now())
+	return db.AppDatabase.DeletePasskey(ctx, userID, id)
+}
+
+func (db instrumented) CreateChallenge(ctx context.Context, challenge, kind, userID string, expiresAt time.Time) error {
+	defer observeQuery("CreateChallenge", time.Now())
+	return db.AppDatabase.CreateChallenge(ctx, challenge, kind, userID, expiresAt)
+}
+
+func (db instrumented) ConsumeChallenge(ctx context.Context, challenge, kind string, now time.Time) (string, error) {
+	defer observeQuery("ConsumeChallenge", time.Now())
+	return db.AppDatabase.ConsumeChallenge(ctx, challenge, kind, now)
+}
+
+func (db instrumented) DeleteExpiredChallenges(ctx context.Context, now time.Time, limit int) (int, error) {
+	defer observeQuery("DeleteExpiredChallenges", time.Now())
+	return db.AppDatabase.DeleteExpiredChallenges(ctx, now, limit)
+}
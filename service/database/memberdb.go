@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// GetConversationType returns the type ('direct' or 'group') of the conversation, or
+// schema.ErrConversationDoesNotExist if there is no such conversation.
+func (db *appdbimpl) GetConversationType(ctx context.Context, conversationID string) (string, error) {
+	var convType string
+	err := db.c.QueryRowContext(ctx, `SELECT type FROM conversations WHERE id = ?`, conversationID).Scan(&convType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", schema.ErrConversationDoesNotExist
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get conversation type: %w", err)
+	}
+	return convType, nil
+}
+
+// IsConversationMember reports whether userID is a member of the conversation.
+func (db *appdbimpl) IsConversationMember(ctx context.Context, conversationID, userID string) (bool, error) {
+	var exists bool
+	err := db.c.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM conversation_members WHERE conversationId = ? AND userId = ?)`,
+		conversationID, userID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check conversation membership: %w", err)
+	}
+	return exists, nil
+}
+
+// GetMessageConversationID returns the ID of the conversation the message belongs to, or
+// schema.ErrMessageDoesNotExist if there is no such message.
+func (db *appdbimpl) GetMessageConversationID(ctx context.Context, messageID string) (string, error) {
+	var conversationID string
+	err := db.c.QueryRowContext(ctx, `SELECT conversationId FROM messages WHERE id = ?`, messageID).Scan(&conversationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", schema.ErrMessageDoesNotExist
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get message conversation: %w", err)
+	}
+	return conversationID, nil
+}
+
+// GetConversationMemberIDs returns the IDs of the members of the conversation.
+func (db *appdbimpl) GetConversationMemberIDs(ctx context.Context, conversationID string) ([]string, error) {
+	rows, err := db.c.QueryContext(ctx, `SELECT userId FROM conversation_members WHERE conversationId = ?`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query conversation members: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan conversation member: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over conversation members: %w", err)
+	}
+	return ids, nil
+}
@@ -1,192 +1,209 @@
 package database
 
 import (
-	"encoding/base64"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/dilcetto/wasa/service/components/schema"
 )
 
-func (db *appdbimpl) SendMessage(message *schema.Message) error {
+func (db *appdbimpl) SendMessage(ctx context.Context, message *schema.Message) error {
 	if message == nil {
 		return fmt.Errorf("message cannot be nil")
 	}
 
-	var attachment []byte
-	if len(message.Attachments) > 0 {
-		if dec, derr := base64.StdEncoding.DecodeString(message.Attachments[0]); derr == nil {
-			attachment = dec
-		} else {
-			attachment = []byte(message.Attachments[0])
+	// the message and its attachments are stored together, or not at all
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		query := `INSERT INTO messages (id, conversationId, senderId, content, timestamp, status, forwardedFrom, replyTo, expiresAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ` + messageExpiry + `)`
+		_, err := tx.c.ExecContext(ctx, query, message.ID, message.ConversationID, message.SenderID, string(message.Content.Value), message.Timestamp, message.MessageStatus, message.ForwardedFrom, nullIfEmpty(message.ReplyTo), message.Timestamp, message.ConversationID)
+		if err != nil {
+			return fmt.Errorf("failed to send message: %w", err)
 		}
-	}
-	query := `INSERT INTO messages (id, conversationId, senderId, content, timestamp, attachment, status, forwardedFrom) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
-	_, err := db.c.Exec(query, message.ID, message.ConversationID, message.SenderID, string(message.Content.Value), message.Timestamp, attachment, message.MessageStatus, message.ForwardedFrom)
-	if err != nil {
-		return fmt.Errorf("failed to send message: %w", err)
-	}
-	return nil
+		return tx.insertAttachments(ctx, messageAttachments, message.ID, message.Attachments)
+	})
 }
 
-func (db *appdbimpl) GetMessagesByConversationID(conversationID string) ([]*schema.Message, error) {
+// messageColumns are the columns read by scanMessages, `m` being the messages table and `u` the sender.
+const messageColumns = `m.id, m.conversationId, m.senderId, m.content, m.timestamp,
+      m.status, m.forwardedFrom,
+      COALESCE(m.editedAt, ''), m.revisions, COALESCE(m.replyTo, ''), COALESCE(m.expiresAt, ''),
+      COALESCE(m.deletedAt, ''), u.username, COALESCE(u.photoBlobId, '')`
+
+func (db *appdbimpl) GetMessagesByConversationID(ctx context.Context, conversationID string) ([]*schema.Message, error) {
 	if conversationID == "" {
 		return nil, fmt.Errorf("conversation ID cannot be empty")
 	}
 
 	query := `
-    SELECT 
-      m.id, m.conversationId, m.senderId, m.content, m.timestamp, 
-      m.attachment, m.status, m.forwardedFrom,
-      u.username, u.photo
+    SELECT ` + messageColumns + `
     FROM messages m
     JOIN users u ON m.senderId = u.id
     WHERE m.conversationId = ?
-    ORDER BY m.timestamp ASC`
-	rows, err := db.c.Query(query, conversationID)
+    ORDER BY m.timestamp ASC, m.seq ASC`
+	rows, err := db.c.QueryContext(ctx, query, conversationID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get messages: %w", err)
 	}
 	defer rows.Close()
 
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.decorateMessages(ctx, conversationID, messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// scanMessages reads the rows selected with messageColumns.
+func scanMessages(rows *sql.Rows) ([]*schema.Message, error) {
 	var messages []*schema.Message
 	var senderName string
-	var senderPhoto []byte
+	var senderPhoto string
 	for rows.Next() {
 		var msg schema.Message
 		var content string
-		var attachment []byte
 		// Scan row into vars and then populate msg
 		if err := rows.Scan(
 			&msg.ID, &msg.ConversationID, &msg.SenderID, &content, &msg.Timestamp,
-			&attachment, &msg.MessageStatus, &msg.ForwardedFrom,
-			&senderName, &senderPhoto,
+			&msg.MessageStatus, &msg.ForwardedFrom,
+			&msg.EditedAt, &msg.Revisions, &msg.ReplyTo, &msg.ExpiresAt,
+			&msg.DeletedAt, &senderName, &senderPhoto,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan message: %w", err)
 		}
 		// Content
-		// always keep text content
+		// always keep text content; messages with attachments get their type from them when decorated
 		msg.Content.Value = []byte(content)
-		if len(attachment) > 0 {
-			msg.Content.ContentType = schema.Image
-			msg.MessageType = string(schema.Image)
-			msg.Attachments = []string{base64.StdEncoding.EncodeToString(attachment)}
-		} else {
-			msg.Content.ContentType = schema.TextContent
-			msg.MessageType = string(schema.TextContent)
-		}
+		msg.Content.ContentType = schema.TextContent
+		msg.MessageType = string(schema.TextContent)
 		// Sender
 		msg.Sender.ID = msg.SenderID
 		msg.Sender.Username = senderName
-		msg.Sender.Photo = senderPhoto
+		msg.Sender.PhotoID = senderPhoto
 		messages = append(messages, &msg)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error reading messages: %w", err)
 	}
+	return messages, nil
+}
+
+// decorateMessages loads the attachments, the reactions and the quoted messages of the messages, and computes their
+// aggregate delivery status. Attachments are part of the content of the messages, so failing to load them fails the
+// call; the reactions, quotes and delivery status are left out instead.
+func (db *appdbimpl) decorateMessages(ctx context.Context, conversationID string, messages []*schema.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	if err := db.loadAttachments(ctx, messages); err != nil {
+		return err
+	}
+	db.loadQuotes(ctx, messages)
 
 	// load reactions in batch
-	if len(messages) > 0 {
-		idx := make(map[string]*schema.Message, len(messages))
-		placeholders := make([]string, 0, len(messages))
-		args := make([]interface{}, 0, len(messages))
-		for _, m := range messages {
-			idx[m.ID] = m
-			placeholders = append(placeholders, "?")
-			args = append(args, m.ID)
-		}
-		q := "SELECT r.messageId, r.userId, r.reaction, u.username FROM reactions r JOIN users u ON u.id = r.userId WHERE r.messageId IN (" + strings.Join(placeholders, ",") + ")"
-		rr, err := db.c.Query(q, args...)
-		if err == nil {
-			defer rr.Close()
-			for rr.Next() {
-				var mid, uid, emoji, uname string
-				if err := rr.Scan(&mid, &uid, &emoji, &uname); err == nil {
-					if m := idx[mid]; m != nil {
-						m.Reaction = append(m.Reaction, schema.Reaction{MessageId: mid, UserId: uid, Emoji: emoji, Username: uname})
-					}
+	idx := make(map[string]*schema.Message, len(messages))
+	placeholders := make([]string, 0, len(messages))
+	args := make([]interface{}, 0, len(messages))
+	for _, m := range messages {
+		idx[m.ID] = m
+		placeholders = append(placeholders, "?")
+		args = append(args, m.ID)
+	}
+	q := "SELECT r.messageId, r.userId, r.reaction, u.username FROM reactions r JOIN users u ON u.id = r.userId WHERE r.messageId IN (" + strings.Join(placeholders, ",") + ")"
+	rr, err := db.c.QueryContext(ctx, q, args...)
+	if err == nil {
+		defer rr.Close()
+		for rr.Next() {
+			var mid, uid, emoji, uname string
+			if err := rr.Scan(&mid, &uid, &emoji, &uname); err == nil {
+				if m := idx[mid]; m != nil {
+					m.Reaction = append(m.Reaction, schema.Reaction{MessageId: mid, UserId: uid, Emoji: emoji, Username: uname})
 				}
 			}
-			if err := rr.Err(); err != nil {
-				// ignore reaction load errors to not fail the whole call
-			}
 		}
-		// compute aggregate delivery/read based on all recipients in the conversation
-		// recipients are all members except the sender
-		recipients := 0
-		if row := db.c.QueryRow(`SELECT COUNT(*) FROM conversation_members WHERE conversationId = ?`, conversationID); row != nil {
-			_ = row.Scan(&recipients)
-			if recipients > 0 {
-				recipients -= 1
-			}
+		if err := rr.Err(); err != nil {
+			// ignore reaction load errors to not fail the whole call
 		}
-		if recipients < 0 {
-			recipients = 0
+	}
+	// compute aggregate delivery/read based on all recipients in the conversation
+	// recipients are all members except the sender
+	recipients := 0
+	if row := db.c.QueryRowContext(ctx, `SELECT COUNT(*) FROM conversation_members WHERE conversationId = ?`, conversationID); row != nil {
+		_ = row.Scan(&recipients)
+		if recipients > 0 {
+			recipients -= 1
 		}
+	}
+	if recipients < 0 {
+		recipients = 0
+	}
 
-		qs := "SELECT message_id, " +
-			"SUM(CASE WHEN status = 'read' THEN 1 ELSE 0 END) AS rc, " +
-			"SUM(CASE WHEN status IN ('read','delivered') THEN 1 ELSE 0 END) AS dc " +
-			"FROM message_receipts WHERE message_id IN (" + strings.Join(placeholders, ",") + ") GROUP BY message_id"
-		rs, err := db.c.Query(qs, args...)
-		if err == nil {
-			defer rs.Close()
-			for rs.Next() {
-				var mid string
-				var rc, dc int
-				if err := rs.Scan(&mid, &rc, &dc); err == nil {
-					if m := idx[mid]; m != nil && recipients > 0 {
-						if rc >= recipients {
-							m.MessageStatus = "read"
-						} else if dc >= recipients {
-							m.MessageStatus = "delivered"
-						}
+	qs := "SELECT r.message_id, COUNT(r.read_at) AS rc, COUNT(*) AS dc " +
+		"FROM message_receipts r JOIN messages m ON m.id = r.message_id AND r.user_id <> m.senderId " +
+		"WHERE r.message_id IN (" + strings.Join(placeholders, ",") + ") GROUP BY r.message_id"
+	rs, err := db.c.QueryContext(ctx, qs, args...)
+	if err == nil {
+		defer rs.Close()
+		for rs.Next() {
+			var mid string
+			var rc, dc int
+			if err := rs.Scan(&mid, &rc, &dc); err == nil {
+				if m := idx[mid]; m != nil && recipients > 0 {
+					if rc >= recipients {
+						m.MessageStatus = "read"
+					} else if dc >= recipients {
+						m.MessageStatus = "delivered"
 					}
 				}
 			}
-			_ = rs.Err()
 		}
+		_ = rs.Err()
 	}
-
-	return messages, nil
+	return nil
 }
 
-func (db *appdbimpl) GetMessageByID(messageID string) (*schema.Message, error) {
-	query := `SELECT m.id, m.conversationId, m.senderId, m.content, m.timestamp, m.attachment, m.status, m.forwardedFrom,
-					 u.username, u.photo
+func (db *appdbimpl) GetMessageByID(ctx context.Context, messageID string) (*schema.Message, error) {
+	query := `SELECT m.id, m.conversationId, m.senderId, m.content, m.timestamp, m.status, m.forwardedFrom,
+					 COALESCE(m.editedAt, ''), m.revisions, COALESCE(m.replyTo, ''), COALESCE(m.expiresAt, ''), COALESCE(m.deletedAt, ''),
+					 u.username, COALESCE(u.photoBlobId, '')
 			FROM messages m
 			JOIN users u ON u.id = m.senderId
 			WHERE m.id = ?`
 
-	row := db.c.QueryRow(query, messageID)
+	row := db.c.QueryRowContext(ctx, query, messageID)
 
 	var message schema.Message
-	var attachment []byte
 	var senderName string
-	var senderPhoto []byte
-	err := row.Scan(&message.ID, &message.ConversationID, &message.SenderID, &message.Content.Value, &message.Timestamp, &attachment, &message.MessageStatus, &message.ForwardedFrom, &senderName, &senderPhoto)
-	if err != nil {
-		return nil, err
+	var senderPhoto string
+	err := row.Scan(&message.ID, &message.ConversationID, &message.SenderID, &message.Content.Value, &message.Timestamp, &message.MessageStatus, &message.ForwardedFrom, &message.EditedAt, &message.Revisions, &message.ReplyTo, &message.ExpiresAt, &message.DeletedAt, &senderName, &senderPhoto)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, schema.ErrMessageDoesNotExist
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get message: %w", err)
 	}
 
-	if len(attachment) > 0 {
-		message.Attachments = []string{base64.StdEncoding.EncodeToString(attachment)}
-		message.Content.ContentType = schema.Image
-		message.MessageType = string(schema.Image)
-	} else {
-		message.Content.ContentType = schema.TextContent
-		message.MessageType = string(schema.TextContent)
+	message.Content.ContentType = schema.TextContent
+	message.MessageType = string(schema.TextContent)
+	if err := db.loadAttachments(ctx, []*schema.Message{&message}); err != nil {
+		return nil, err
 	}
 
 	message.Sender = schema.Sender{
 		ID:       message.SenderID,
 		Username: senderName,
-		Photo:    senderPhoto,
+		PhotoID:  senderPhoto,
 	}
 
+	db.loadQuotes(ctx, []*schema.Message{&message})
+
 	// load reactions for this message
-	rr, rerr := db.c.Query(`SELECT r.userId, r.reaction, u.username FROM reactions r JOIN users u ON u.id = r.userId WHERE r.messageId = ?`, messageID)
+	rr, rerr := db.c.QueryContext(ctx, `SELECT r.userId, r.reaction, u.username FROM reactions r JOIN users u ON u.id = r.userId WHERE r.messageId = ?`, messageID)
 	if rerr == nil {
 		defer rr.Close()
 		for rr.Next() {
@@ -204,7 +221,7 @@ func (db *appdbimpl) GetMessageByID(messageID string) (*schema.Message, error) {
 	return &message, nil
 }
 
-func (db *appdbimpl) ForwardMessage(message *schema.Message, userID string) error {
+func (db *appdbimpl) ForwardMessage(ctx context.Context, message *schema.Message, userID string) error {
 	if message == nil || userID == "" || message.ForwardedFrom == "" {
 		return fmt.Errorf("message, user ID, and forwardedFrom cannot be empty")
 	}
@@ -213,9 +230,11 @@ func (db *appdbimpl) ForwardMessage(message *schema.Message, userID string) erro
 	if len(message.Content.Value) == 0 && message.ForwardedFrom != "" {
 		var originalContent string
 		query := `SELECT content FROM messages WHERE id = ?`
-		err := db.c.QueryRow(query, message.ForwardedFrom).Scan(&originalContent)
-		if err != nil {
-			return fmt.Errorf("original message not found: %w", err)
+		err := db.c.QueryRowContext(ctx, query, message.ForwardedFrom).Scan(&originalContent)
+		if errors.Is(err, sql.ErrNoRows) {
+			return schema.ErrMessageDoesNotExist
+		} else if err != nil {
+			return fmt.Errorf("failed to get original message: %w", err)
 		}
 		message.Content = schema.MessageContent{
 			ContentType: schema.TextContent,
@@ -224,57 +243,35 @@ func (db *appdbimpl) ForwardMessage(message *schema.Message, userID string) erro
 
 	}
 
-	var attachment []byte
-	if len(message.Attachments) > 0 {
-		if dec, derr := base64.StdEncoding.DecodeString(message.Attachments[0]); derr == nil {
-			attachment = dec
-		} else {
-			attachment = []byte(message.Attachments[0])
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		query := `INSERT INTO messages (id, conversationId, senderId, content, timestamp, status, forwardedFrom, expiresAt) VALUES (?, ?, ?, ?, ?, ?, ?, ` + messageExpiry + `)`
+		_, err := tx.c.ExecContext(ctx, query, message.ID, message.ConversationID, userID, string(message.Content.Value), message.Timestamp, message.MessageStatus, message.ForwardedFrom, message.Timestamp, message.ConversationID)
+		if err != nil {
+			return fmt.Errorf("failed to forward message: %w", err)
 		}
-	}
-	query := `INSERT INTO messages (id, conversationId, senderId, content, timestamp, attachment, status, forwardedFrom) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
-	_, err := db.c.Exec(query, message.ID, message.ConversationID, userID, string(message.Content.Value), message.Timestamp, attachment, message.MessageStatus, message.ForwardedFrom)
-	if err != nil {
-		return fmt.Errorf("failed to forward message: %w", err)
-	}
-	return nil
-}
-
-func (db *appdbimpl) DeleteMessage(conversationID, messageID, userID string) error {
-	if conversationID == "" || messageID == "" || userID == "" {
-		return fmt.Errorf("conversation ID, message ID, and user ID cannot be empty")
-	}
-
-	query := `DELETE FROM messages WHERE id = ? AND conversationId = ? AND senderId = ?`
-	result, err := db.c.Exec(query, messageID, conversationID, userID)
-	if err != nil {
-		return fmt.Errorf("failed to delete message: %w", err)
-	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("failed to determine rows affected: %w", err)
-	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("no message deleted, possibly due to non-matching sender or invalid ID")
-	}
-
-	return nil
+		// the copy shares the blobs of the original attachments
+		return tx.insertAttachments(ctx, messageAttachments, message.ID, message.Attachments)
+	})
 }
 
-func (db *appdbimpl) MarkMessageStatus(messageID, userID, status string) error {
+func (db *appdbimpl) MarkMessageStatus(ctx context.Context, messageID, userID, status string) error {
 	if messageID == "" || userID == "" || (status != "delivered" && status != "read") {
 		return fmt.Errorf("invalid input")
 	}
 
+	// receipts only ever move forward: the delivery and read times are set once, and a message that has been read is
+	// never marked back as delivered, e.g. when the conversation is opened again
 	query := `
-	INSERT INTO message_receipts (message_id, user_id, status)
-	VALUES (?, ?, ?)
-	ON CONFLICT(message_id, user_id) DO UPDATE SET
-	status = excluded.status,
-	timestamp = CURRENT_TIMESTAMP`
+	INSERT INTO message_receipts (message_id, user_id, delivered_at) VALUES (?, ?, ` + receiptNow + `)
+	ON CONFLICT(message_id, user_id) DO NOTHING`
+	if status == "read" {
+		query = `
+		INSERT INTO message_receipts (message_id, user_id, delivered_at, read_at) VALUES (?, ?, ` + receiptNow + `, ` + receiptNow + `)
+		ON CONFLICT(message_id, user_id) DO UPDATE SET read_at = excluded.read_at
+		WHERE message_receipts.read_at IS NULL`
+	}
 
-	_, err := db.c.Exec(query, messageID, userID, status)
+	_, err := db.c.ExecContext(ctx, query, messageID, userID)
 	if err != nil {
 		return fmt.Errorf("failed to update message status: %w", err)
 	}
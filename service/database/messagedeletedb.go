@@ -0,0 +1,75 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// notHiddenFor is the SQL condition on `m`, the messages table, that keeps the messages a user has not deleted for
+// themselves. It takes the ID of the user as parameter.
+const notHiddenFor = `NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = ?)`
+
+// DeleteMessage deletes a message for everyone: its text, attachments, reactions and edit history are removed, while
+// the message itself stays in the timeline as a tombstone, so that the order of the conversation and the replies to
+// it are preserved. Deleting a tombstone again changes nothing. The blobs of the attachments are marked for deletion,
+// see SweepUnusedBlobs. It returns schema.ErrMessageDoesNotExist if the message does not exist.
+func (db *appdbimpl) DeleteMessage(ctx context.Context, messageID, deletedAt string) error {
+	if messageID == "" || deletedAt == "" {
+		return fmt.Errorf("message ID and deletion time cannot be empty")
+	}
+
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		var deleted bool
+		err := tx.c.QueryRowContext(ctx, `SELECT deletedAt IS NOT NULL FROM messages WHERE id = ?`, messageID).Scan(&deleted)
+		if errors.Is(err, sql.ErrNoRows) {
+			return schema.ErrMessageDoesNotExist
+		} else if err != nil {
+			return fmt.Errorf("failed to load message: %w", err)
+		}
+		if deleted {
+			return nil
+		}
+		blobs, err := tx.attachmentBlobs(ctx, messageAttachments, []string{messageID})
+		if err != nil {
+			return err
+		}
+
+		// the search index follows the content through its triggers
+		_, err = tx.c.ExecContext(ctx, `UPDATE messages SET content = '', editedAt = NULL, revisions = 0, deletedAt = ? WHERE id = ?`,
+			deletedAt, messageID)
+		if err != nil {
+			return fmt.Errorf("failed to delete message: %w", err)
+		}
+		if _, err := tx.c.ExecContext(ctx, `DELETE FROM message_attachments WHERE message_id = ?`, messageID); err != nil {
+			return fmt.Errorf("failed to delete attachments: %w", err)
+		}
+		if _, err := tx.c.ExecContext(ctx, `DELETE FROM reactions WHERE messageId = ?`, messageID); err != nil {
+			return fmt.Errorf("failed to delete reactions: %w", err)
+		}
+		if _, err := tx.c.ExecContext(ctx, `DELETE FROM message_revisions WHERE message_id = ?`, messageID); err != nil {
+			return fmt.Errorf("failed to delete message revisions: %w", err)
+		}
+
+		return tx.markBlobsForDeletion(ctx, blobs)
+	})
+}
+
+// HideMessage deletes a message for userID only: the message no longer appears in the timeline, replies, search
+// results and unread counters of the user, while the other members still see it. Hiding a message twice changes
+// nothing.
+func (db *appdbimpl) HideMessage(ctx context.Context, messageID, userID, hiddenAt string) error {
+	if messageID == "" || userID == "" || hiddenAt == "" {
+		return fmt.Errorf("message ID, user ID and hiding time cannot be empty")
+	}
+
+	_, err := db.c.ExecContext(ctx, `INSERT INTO hidden_messages (message_id, user_id, hidden_at) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, message_id) DO NOTHING`, messageID, userID, hiddenAt)
+	if err != nil {
+		return fmt.Errorf("failed to hide message: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// EditMessage replaces the text of a message, and saves the text it replaces as a new revision in the message history.
+// It returns schema.ErrMessageDoesNotExist if there is no such message.
+func (db *appdbimpl) EditMessage(ctx context.Context, messageID string, content []byte, editedAt string) error {
+	if messageID == "" || editedAt == "" {
+		return fmt.Errorf("message ID and edit time cannot be empty")
+	}
+
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		var oldContent, sentAt, lastEditedAt string
+		var revisions int
+		err := tx.c.QueryRowContext(ctx, `SELECT content, timestamp, COALESCE(editedAt, ''), revisions FROM messages WHERE id = ?`, messageID).
+			Scan(&oldContent, &sentAt, &lastEditedAt, &revisions)
+		if errors.Is(err, sql.ErrNoRows) {
+			return schema.ErrMessageDoesNotExist
+		} else if err != nil {
+			return fmt.Errorf("failed to load message: %w", err)
+		}
+
+		// the replaced text was written when the message was sent, or by the previous edit
+		writtenAt := sentAt
+		if lastEditedAt != "" {
+			writtenAt = lastEditedAt
+		}
+		_, err = tx.c.ExecContext(ctx, `INSERT INTO message_revisions (message_id, revision, content, written_at) VALUES (?, ?, ?, ?)`,
+			messageID, revisions, oldContent, writtenAt)
+		if err != nil {
+			return fmt.Errorf("failed to save message revision: %w", err)
+		}
+
+		_, err = tx.c.ExecContext(ctx, `UPDATE messages SET content = ?, editedAt = ?, revisions = revisions + 1 WHERE id = ?`,
+			string(content), editedAt, messageID)
+		if err != nil {
+			return fmt.Errorf("failed to edit message: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetMessageRevisions returns the previous versions of the text of a message, oldest first. The current text is not
+// included. A message that was never edited has no revisions.
+func (db *appdbimpl) GetMessageRevisions(ctx context.Context, messageID string) ([]schema.MessageRevision, error) {
+	rows, err := db.c.QueryContext(ctx, `SELECT revision, content, written_at FROM message_revisions WHERE message_id = ? ORDER BY revision ASC`, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query message revisions: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := []schema.MessageRevision{}
+	for rows.Next() {
+		var rev schema.MessageRevision
+		var content string
+		if err := rows.Scan(&rev.Revision, &content, &rev.Timestamp); err != nil {
+			return nil, fmt.Errorf("failed to scan message revision: %w", err)
+		}
+		rev.Content = schema.MessageContent{ContentType: schema.TextContent, Value: []byte(content)}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading message revisions: %w", err)
+	}
+	return revisions, nil
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// messageCursor is the position of a message in the conversation timeline. Messages are ordered by timestamp, and by
+// insertion order (their sequence number) for messages sent in the same second, so that a position is stable even when
+// new messages arrive.
+type messageCursor struct {
+	Timestamp string `json:"t"`
+	Seq       int64  `json:"r"`
+}
+
+// encode returns the opaque representation of the cursor sent to clients.
+func (c messageCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeMessageCursor(s string) (messageCursor, error) {
+	var c messageCursor
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(raw, &c); err != nil || c.Timestamp == "" || c.Seq <= 0 {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// GetMessagesPage returns up to `limit` messages of the conversation, in chronological order. With no cursor, the
+// newest messages are returned; `before` returns the messages older than the cursor, and `after` the messages newer
+// than the cursor. At most one of `before` and `after` can be set. Malformed cursors return ErrInvalidCursor. Messages
+// userID deleted for themselves are left out.
+func (db *appdbimpl) GetMessagesPage(ctx context.Context, conversationID, userID, before, after string, limit int) (*schema.MessagePage, error) {
+	if conversationID == "" {
+		return nil, fmt.Errorf("conversation ID cannot be empty")
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+	if before != "" && after != "" {
+		return nil, ErrInvalidCursor
+	}
+
+	// Fetch one extra row to know whether the page is the last one in the requested direction
+	query := `SELECT ` + messageColumns + `
+		FROM messages m
+		JOIN users u ON m.senderId = u.id
+		WHERE m.conversationId = ? AND ` + notHiddenFor
+	args := []interface{}{conversationID, userID}
+	forward := after != ""
+	switch {
+	case forward:
+		c, err := decodeMessageCursor(after)
+		if err != nil {
+			return nil, err
+		}
+		query += ` AND (m.timestamp > ? OR (m.timestamp = ? AND m.seq > ?)) ORDER BY m.timestamp ASC, m.seq ASC LIMIT ?`
+		args = append(args, c.Timestamp, c.Timestamp, c.Seq, limit+1)
+	case before != "":
+		c, err := decodeMessageCursor(before)
+		if err != nil {
+			return nil, err
+		}
+		query += ` AND (m.timestamp < ? OR (m.timestamp = ? AND m.seq < ?)) ORDER BY m.timestamp DESC, m.seq DESC LIMIT ?`
+		args = append(args, c.Timestamp, c.Timestamp, c.Seq, limit+1)
+	default:
+		query += ` ORDER BY m.timestamp DESC, m.seq DESC LIMIT ?`
+		args = append(args, limit+1)
+	}
+
+	rows, err := db.c.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages page: %w", err)
+	}
+	defer rows.Close()
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	if !forward {
+		// rows were read newest first
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	if err := db.decorateMessages(ctx, conversationID, messages); err != nil {
+		return nil, err
+	}
+
+	page := &schema.MessagePage{Messages: messages}
+	if page.Messages == nil {
+		page.Messages = []*schema.Message{}
+	}
+	if len(messages) == 0 {
+		// nothing new: keep polling from the same position
+		page.NewerCursor = after
+		return page, nil
+	}
+	newest, err := db.messageCursorOf(ctx, messages[len(messages)-1])
+	if err != nil {
+		return nil, err
+	}
+	page.NewerCursor = newest.encode()
+	// paging forward always starts after an existing message, while going backwards the extra row tells
+	if forward || hasMore {
+		oldest, err := db.messageCursorOf(ctx, messages[0])
+		if err != nil {
+			return nil, err
+		}
+		page.OlderCursor = oldest.encode()
+	}
+	return page, nil
+}
+
+func (db *appdbimpl) messageCursorOf(ctx context.Context, m *schema.Message) (messageCursor, error) {
+	c := messageCursor{Timestamp: m.Timestamp}
+	if err := db.c.QueryRowContext(ctx, `SELECT seq FROM messages WHERE id = ?`, m.ID).Scan(&c.Seq); err != nil {
+		return c, fmt.Errorf("failed to get message position: %w", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// pageIDs returns the IDs of the messages of a page, in order.
+func pageIDs(page *schema.MessagePage) []string {
+	ids := []string{}
+	for _, m := range page.Messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+// TestGetMessagesPage walks a conversation in both directions, with pages ending in the middle of messages sent in the
+// same second, checking that no message is skipped or returned twice.
+func TestGetMessagesPage(t *testing.T) {
+	db, conn := newTestAppDB(t)
+	ctx := context.Background()
+	mustExec(t, conn,
+		`INSERT INTO users (id, username) VALUES ('u1', 'alice'), ('u2', 'bob');`,
+		`INSERT INTO conversations (id, name, type) VALUES ('c1', 'group', 'group');`,
+		`INSERT INTO conversation_members (conversationId, userId) VALUES ('c1', 'u1'), ('c1', 'u2');`,
+		// m2, m3 and m4 are sent in the same second, so only their sequence numbers order them, against their IDs
+		`INSERT INTO messages (id, conversationId, senderId, content, timestamp, status, forwardedFrom) VALUES
+			('m1', 'c1', 'u1', 'one', '2024-01-01T00:00:00Z', 'sent', ''),
+			('m4', 'c1', 'u2', 'two', '2024-01-01T00:00:01Z', 'sent', ''),
+			('m3', 'c1', 'u1', 'three', '2024-01-01T00:00:01Z', 'sent', ''),
+			('m2', 'c1', 'u2', 'four', '2024-01-01T00:00:01Z', 'sent', ''),
+			('hidden', 'c1', 'u2', 'hidden', '2024-01-01T00:00:02Z', 'sent', ''),
+			('m5', 'c1', 'u1', 'five', '2024-01-01T00:00:03Z', 'sent', '');`,
+		`INSERT INTO hidden_messages (message_id, user_id, hidden_at) VALUES ('hidden', 'u1', '2024-01-01T00:00:04Z');`,
+	)
+	get := func(before, after string, want ...string) *schema.MessagePage {
+		t.Helper()
+		page, err := db.GetMessagesPage(ctx, "c1", "u1", before, after, 2)
+		if err != nil {
+			t.Fatalf("getting page: %v", err)
+		}
+		if got := pageIDs(page); !reflect.DeepEqual(got, append([]string{}, want...)) {
+			t.Fatalf("got page %v, want %v", got, want)
+		}
+		return page
+	}
+
+	newest := get("", "", "m2", "m5")
+	if newest.OlderCursor == "" || newest.NewerCursor == "" {
+		t.Fatalf("the newest page has cursors %q and %q, want both", newest.OlderCursor, newest.NewerCursor)
+	}
+
+	// backwards, from inside the messages sent in the same second
+	older := get(newest.OlderCursor, "", "m4", "m3")
+	oldest := get(older.OlderCursor, "", "m1")
+	if oldest.OlderCursor != "" {
+		t.Errorf("the oldest page has an older cursor")
+	}
+
+	// forwards, from the oldest message back to the newest one
+	page := get("", oldest.NewerCursor, "m4", "m3")
+	if page.OlderCursor == "" {
+		t.Errorf("a page read forwards has no older cursor")
+	}
+	page = get("", page.NewerCursor, "m2", "m5")
+	page = get("", page.NewerCursor)
+	if page.NewerCursor != newest.NewerCursor {
+		t.Errorf("an empty page moved the newer cursor from %q to %q", newest.NewerCursor, page.NewerCursor)
+	}
+
+	// a message arriving in the same second as the newest one is still returned
+	mustExec(t, conn, `INSERT INTO messages (id, conversationId, senderId, content, timestamp, status, forwardedFrom)
+		VALUES ('m6', 'c1', 'u2', 'six', '2024-01-01T00:00:03Z', 'sent', '');`)
+	get("", page.NewerCursor, "m6")
+
+	for name, cursors := range map[string][2]string{
+		"garbage":   {"not a cursor", ""},
+		"no seq":    {"", messageCursor{Timestamp: "2024-01-01T00:00:00Z"}.encode()},
+		"both ways": {newest.OlderCursor, newest.NewerCursor},
+	} {
+		if _, err := db.GetMessagesPage(ctx, "c1", "u1", cursors[0], cursors[1], 2); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrInvalidCursor)
+		}
+	}
+}
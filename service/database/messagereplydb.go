@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// quotePreviewLength is the maximum number of characters of the text of a message shown in quotes.
+const quotePreviewLength = 100
+
+// GetMessageReplies returns the messages that reply to messageID, in chronological order, leaving out those userID
+// deleted for themselves.
+func (db *appdbimpl) GetMessageReplies(ctx context.Context, messageID, userID string) ([]*schema.Message, error) {
+	if messageID == "" {
+		return nil, fmt.Errorf("message ID cannot be empty")
+	}
+
+	query := `SELECT ` + messageColumns + `
+		FROM messages m
+		JOIN users u ON m.senderId = u.id
+		WHERE m.replyTo = ? AND ` + notHiddenFor + `
+		ORDER BY m.timestamp ASC, m.seq ASC`
+	rows, err := db.c.QueryContext(ctx, query, messageID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get replies: %w", err)
+	}
+	defer rows.Close()
+
+	replies, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if replies == nil {
+		return []*schema.Message{}, nil
+	}
+	// replies live in the conversation of their parent
+	if err := db.decorateMessages(ctx, replies[0].ConversationID, replies); err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+// loadQuotes sets the quote of the messages that reply to another message. Parents that no longer exist, or that were
+// deleted for everyone, are quoted as deleted. As for reactions, load errors leave the quotes out rather than failing the whole call.
+func (db *appdbimpl) loadQuotes(ctx context.Context, messages []*schema.Message) {
+	quotes := make(map[string]*schema.MessageQuote)
+	placeholders := make([]string, 0, len(messages))
+	args := make([]interface{}, 0, len(messages))
+	for _, m := range messages {
+		if m.ReplyTo == "" || quotes[m.ReplyTo] != nil {
+			continue
+		}
+		quotes[m.ReplyTo] = &schema.MessageQuote{MessageID: m.ReplyTo, Deleted: true}
+		placeholders = append(placeholders, "?")
+		args = append(args, m.ReplyTo)
+	}
+	if len(args) == 0 {
+		return
+	}
+
+	q := "SELECT m.id, m.senderId, u.username, m.content, COALESCE(" + firstAttachmentKind + ", '') FROM messages m JOIN users u ON u.id = m.senderId WHERE m.deletedAt IS NULL AND m.id IN (" + strings.Join(placeholders, ",") + ")"
+	rows, err := db.c.QueryContext(ctx, q, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, content, kind string
+		quote := schema.MessageQuote{MessageType: string(schema.TextContent)}
+		if err := rows.Scan(&id, &quote.SenderID, &quote.Username, &content, &kind); err != nil {
+			return
+		}
+		quote.MessageID = id
+		quote.Preview = quotePreview(content)
+		if kind != "" {
+			quote.MessageType = string(schema.AttachmentContentType(kind))
+		}
+		*quotes[id] = quote
+	}
+	if err := rows.Err(); err != nil {
+		return
+	}
+
+	for _, m := range messages {
+		if m.ReplyTo != "" {
+			m.Quote = quotes[m.ReplyTo]
+		}
+	}
+}
+
+// quotePreview shortens the text of a message to fit in a quote.
+func quotePreview(content string) string {
+	runes := []rune(content)
+	if len(runes) <= quotePreviewLength {
+		return content
+	}
+	return string(runes[:quotePreviewLength-1]) + "…"
+}
@@ -0,0 +1,1024 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when the database has been migrated by a newer version of the executable.
+var ErrSchemaTooNew = errors.New("database schema is newer than this executable")
+
+// migration is a single, versioned change of the database schema. Migrations are applied in order, each one in its
+// own transaction. Once a migration has been released it must never be changed: append a new one instead.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+	down        func(tx *sql.Tx) error
+}
+
+// migrations is the ordered list of the schema changes. The version of each migration is its position in the list,
+// starting from 1.
+var migrations = []migration{
+	{1, "initial schema", migrateInitialSchema, dropInitialSchema},
+	{2, "group member roles", migrateMemberRoles, dropMemberRoles},
+	{3, "timeline indexes", migrateTimelineIndexes, dropTimelineIndexes},
+	{4, "blob store references", migrateBlobReferences, dropBlobReferences},
+	{5, "message edit history", migrateMessageRevisions, dropMessageRevisions},
+	{6, "message replies", migrateMessageReplies, dropMessageReplies},
+	{7, "message search index", migrateMessageSearch, dropMessageSearch},
+	{8, "read watermarks", migrateReadWatermarks, dropReadWatermarks},
+	{9, "receipt timestamps", migrateReceiptTimestamps, dropReceiptTimestamps},
+	{10, "disappearing messages", migrateMessageExpiry, dropMessageExpiry},
+	{11, "scheduled messages", migrateScheduledMessages, dropScheduledMessages},
+	{12, "message tombstones", migrateMessageTombstones, dropMessageTombstones},
+	{13, "message attachments", migrateMessageAttachments, dropMessageAttachments},
+	{14, "image thumbnails", migrateImageThumbnails, dropImageThumbnails},
+	{15, "resumable uploads", migrateUploads, dropUploads},
+	{16, "sessions and refresh tokens", migrateSessions, dropSessions},
+	{17, "session devices", migrateSessionDevices, dropSessionDevices},
+	{18, "passwords and passkeys", migrateCredentials, dropCredentials},
+	{19, "group slow mode", migrateSlowMode, dropSlowMode},
+}
+
+// MigrationStatus describes a migration known to this executable.
+type MigrationStatus struct {
+	Version     int
+	Description string
+
+	// AppliedAt is the time the migration was applied, or the empty string if it is pending
+	AppliedAt string
+}
+
+// LatestSchemaVersion returns the schema version this executable works with.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// SchemaVersion returns the version of the schema of the database, 0 for a database that was never migrated.
+func SchemaVersion(db *sql.DB) (int, error) {
+	if err := createSchemaVersionTable(db); err != nil {
+		return 0, err
+	}
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("error reading schema version: %w", err)
+	}
+	return version, nil
+}
+
+// GetMigrationStatus lists the migrations known to this executable, and when they were applied.
+func GetMigrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	if err := createSchemaVersionTable(db); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]string)
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_version`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema versions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("error scanning schema version: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading schema versions: %w", err)
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status = append(status, MigrationStatus{Version: m.version, Description: m.description, AppliedAt: applied[m.version]})
+	}
+	return status, nil
+}
+
+// MigrateUp applies every pending migration, and returns the versions that were applied. It returns ErrSchemaTooNew
+// if the database was migrated by a newer executable.
+func MigrateUp(db *sql.DB) ([]int, error) {
+	if err := checkSearchSupport(db); err != nil {
+		return nil, err
+	}
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestSchemaVersion() {
+		return nil, fmt.Errorf("%w: database is at version %d, executable supports up to %d", ErrSchemaTooNew, current, LatestSchemaVersion())
+	}
+
+	var applied []int
+	for _, m := range migrations[current:] {
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)`,
+				m.version, m.description, time.Now().UTC().Format(time.RFC3339))
+			return err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("error applying migration %d (%s): %w", m.version, m.description, err)
+		}
+		applied = append(applied, m.version)
+	}
+	return applied, nil
+}
+
+// MigrateDownTo reverts the applied migrations newer than `version`, newest first, and returns the versions that were
+// reverted. Reverting to version 0 drops every table.
+func MigrateDownTo(db *sql.DB, version int) ([]int, error) {
+	if version < 0 {
+		return nil, fmt.Errorf("invalid target version %d", version)
+	}
+	if err := checkSearchSupport(db); err != nil {
+		return nil, err
+	}
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestSchemaVersion() {
+		return nil, fmt.Errorf("%w: database is at version %d, executable supports up to %d", ErrSchemaTooNew, current, LatestSchemaVersion())
+	}
+
+	var reverted []int
+	for i := current - 1; i >= version; i-- {
+		m := migrations[i]
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if err := m.down(tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`DELETE FROM schema_version WHERE version = ?`, m.version)
+			return err
+		})
+		if err != nil {
+			return reverted, fmt.Errorf("error reverting migration %d (%s): %w", m.version, m.description, err)
+		}
+		reverted = append(reverted, m.version)
+	}
+	return reverted, nil
+}
+
+func createSchemaVersionTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER NOT NULL PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	);`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_version table: %w", err)
+	}
+	return nil
+}
+
+// inTransaction runs fn in a transaction, committing if fn succeeds and rolling back otherwise. Foreign keys are not
+// enforced while fn runs, as the SQLite documentation recommends for schema changes: dropping a table that other tables
+// reference would otherwise delete the rows referencing it, to rebuild it with a new layout.
+func inTransaction(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting a connection: %w", err)
+	}
+	defer conn.Close()
+
+	// the pragma is a no-op inside a transaction, so it is set on the connection first, and set back before the
+	// connection returns to the pool
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF;`); err != nil {
+		return fmt.Errorf("error disabling foreign keys: %w", err)
+	}
+	defer func() { _, _ = conn.ExecContext(ctx, `PRAGMA foreign_keys = ON;`) }()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// execAll executes the statements in order, stopping at the first error.
+func execAll(tx *sql.Tx, stmts ...string) error {
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateInitialSchema creates the tables of the first release. Tables are created only if missing, as databases
+// created before migrations were introduced already have them.
+func migrateInitialSchema(tx *sql.Tx) error {
+	usersTable := `CREATE TABLE IF NOT EXISTS users (
+		id TEXT NOT NULL PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE,
+		photo BLOB
+	);`
+
+	conversationsTable := `CREATE TABLE IF NOT EXISTS conversations (
+		id TEXT NOT NULL PRIMARY KEY,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL CHECK (type IN ('group', 'direct')),
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		conversationPhoto BLOB
+	);`
+
+	conversationMembersTable := `CREATE TABLE IF NOT EXISTS conversation_members (
+		conversationId TEXT NOT NULL,
+		userId TEXT NOT NULL,
+		PRIMARY KEY (conversationId, userId),
+		FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	messagesTable := `CREATE TABLE IF NOT EXISTS messages (
+		id TEXT NOT NULL PRIMARY KEY,
+		conversationId TEXT NOT NULL,
+		senderId TEXT NOT NULL,
+		content TEXT NOT NULL,
+		timestamp TEXT NOT NULL,
+		attachment BLOB,
+		status TEXT NOT NULL,
+		forwardedFrom TEXT,
+		FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
+		FOREIGN KEY (senderId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	reactionsTable := `CREATE TABLE IF NOT EXISTS reactions (
+		messageId TEXT NOT NULL,
+		userId TEXT NOT NULL,
+		reaction TEXT NOT NULL,
+		PRIMARY KEY (messageId, userId),
+		FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	// NOTE:
+	// groups as separate tables (groups, group_members).
+	// at the end, unified groups and direct chats inside the `conversations` table
+	// using `type = 'group' | 'direct'`, with members in conversation_members.
+	// This simplifies the overall logic, as groups are just a type of conversation.
+	//
+	// groupsTable := `CREATE TABLE groups (
+	// 	id TEXT NOT NULL PRIMARY KEY,
+	// 	name TEXT NOT NULL,
+	// 	photo BLOB
+	// );`
+
+	// groupMembersTable := `CREATE TABLE group_members (
+	// 	groupId TEXT NOT NULL,
+	// 	userId TEXT NOT NULL,
+	// 	PRIMARY KEY (groupId, userId),
+	// 	FOREIGN KEY (groupId) REFERENCES groups(id) ON DELETE CASCADE,
+	// 	FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	// );`
+
+	messageStatusTable := `CREATE TABLE IF NOT EXISTS message_status (
+		messageId TEXT NOT NULL,
+		userId TEXT NOT NULL,
+		deliveredAt TEXT NOT NULL,
+		readAt TEXT,
+		PRIMARY KEY (messageId, userId),
+		FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
+		FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	messageReceipts := `CREATE TABLE IF NOT EXISTS message_receipts (
+		message_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		status TEXT CHECK(status IN ('delivered', 'read')) NOT NULL,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (message_id, user_id),
+		FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	return execAll(tx,
+		usersTable,
+		conversationsTable,
+		conversationMembersTable,
+		messagesTable,
+		reactionsTable,
+		messageStatusTable,
+		messageReceipts,
+	)
+}
+
+func dropInitialSchema(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP TABLE IF EXISTS message_receipts;`,
+		`DROP TABLE IF EXISTS message_status;`,
+		`DROP TABLE IF EXISTS reactions;`,
+		`DROP TABLE IF EXISTS messages;`,
+		`DROP TABLE IF EXISTS conversation_members;`,
+		`DROP TABLE IF EXISTS conversations;`,
+		`DROP TABLE IF EXISTS users;`,
+	)
+}
+
+// migrateMemberRoles adds the role column to conversation_members, and makes the longest-standing member of every group
+// the owner, as the original creator was never recorded.
+func migrateMemberRoles(tx *sql.Tx) error {
+	var hasRole bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM pragma_table_info('conversation_members') WHERE name = 'role')`).Scan(&hasRole)
+	if err != nil || hasRole {
+		return err
+	}
+	return execAll(tx,
+		`ALTER TABLE conversation_members ADD COLUMN role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'admin', 'member'));`,
+		`UPDATE conversation_members SET role = 'owner'
+		WHERE rowid IN (
+			SELECT MIN(cm.rowid) FROM conversation_members cm
+			JOIN conversations c ON c.id = cm.conversationId
+			WHERE c.type = 'group'
+			GROUP BY cm.conversationId
+		);`,
+	)
+}
+
+func dropMemberRoles(tx *sql.Tx) error {
+	return execAll(tx, `ALTER TABLE conversation_members DROP COLUMN role;`)
+}
+
+// migrateTimelineIndexes creates the indexes used to page through conversations.
+func migrateTimelineIndexes(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE INDEX IF NOT EXISTS idx_messages_conversation_timeline ON messages (conversationId, timestamp);`,
+		`CREATE INDEX IF NOT EXISTS idx_reactions_message ON reactions (messageId);`,
+		`CREATE INDEX IF NOT EXISTS idx_message_receipts_message ON message_receipts (message_id);`,
+	)
+}
+
+func dropTimelineIndexes(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP INDEX IF EXISTS idx_messages_conversation_timeline;`,
+		`DROP INDEX IF EXISTS idx_reactions_message;`,
+		`DROP INDEX IF EXISTS idx_message_receipts_message;`,
+	)
+}
+
+// migrateBlobReferences adds the columns referencing the blob store. The content of the old BLOB columns is moved to
+// the store by MoveInlineBlobs, as migrations have no access to it.
+func migrateBlobReferences(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE users ADD COLUMN photoBlobId TEXT;`,
+		`ALTER TABLE conversations ADD COLUMN photoBlobId TEXT;`,
+		`ALTER TABLE messages ADD COLUMN attachmentBlobId TEXT;`,
+	)
+}
+
+// dropBlobReferences drops the blob references: blobs moved to the store are not copied back.
+func dropBlobReferences(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE messages DROP COLUMN attachmentBlobId;`,
+		`ALTER TABLE conversations DROP COLUMN photoBlobId;`,
+		`ALTER TABLE users DROP COLUMN photoBlobId;`,
+	)
+}
+
+// migrateMessageRevisions records when messages are edited, and keeps the text they had before each edit.
+func migrateMessageRevisions(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE messages ADD COLUMN editedAt TEXT;`,
+		`ALTER TABLE messages ADD COLUMN revisions INTEGER NOT NULL DEFAULT 0;`,
+		`CREATE TABLE message_revisions (
+			message_id TEXT NOT NULL,
+			revision INTEGER NOT NULL,
+			content TEXT NOT NULL,
+			written_at TEXT NOT NULL,
+			PRIMARY KEY (message_id, revision),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+		);`,
+	)
+}
+
+func dropMessageRevisions(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP TABLE IF EXISTS message_revisions;`,
+		`ALTER TABLE messages DROP COLUMN revisions;`,
+		`ALTER TABLE messages DROP COLUMN editedAt;`,
+	)
+}
+
+// migrateMessageReplies links replies to the message they answer. The link is not a foreign key: a reply keeps the ID
+// of its parent after the parent is deleted, so that it can be shown as a reply to a deleted message.
+func migrateMessageReplies(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE messages ADD COLUMN replyTo TEXT;`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages (replyTo);`,
+	)
+}
+
+func dropMessageReplies(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP INDEX IF EXISTS idx_messages_reply_to;`,
+		`ALTER TABLE messages DROP COLUMN replyTo;`,
+	)
+}
+
+// messageColumnsV7 are the columns of messages, but the key, when the sequence numbers were added.
+const messageColumnsV7 = `id, conversationId, senderId, content, timestamp, attachment, status, forwardedFrom,
+	attachmentBlobId, editedAt, revisions, replyTo`
+
+// migrateMessageSearch gives every message an explicit sequence number, in insertion order, and creates the full-text
+// index of their content keyed by it, like the timeline cursors. The implicit rowid of a table with a TEXT primary key
+// can be renumbered by VACUUM, which would silently break the index and the cursors that refer to it: existing messages
+// keep their rowid as sequence number, so the cursors already handed out stay valid. Without FTS5 in SQLite the index
+// is not created, and search falls back to matching the content with LIKE.
+func migrateMessageSearch(tx *sql.Tx) error {
+	err := execAll(tx,
+		`CREATE TABLE messages_new (
+			seq INTEGER PRIMARY KEY AUTOINCREMENT,
+			id TEXT NOT NULL UNIQUE,
+			conversationId TEXT NOT NULL,
+			senderId TEXT NOT NULL,
+			content TEXT NOT NULL,
+			timestamp TEXT NOT NULL,
+			attachment BLOB,
+			status TEXT NOT NULL,
+			forwardedFrom TEXT,
+			attachmentBlobId TEXT,
+			editedAt TEXT,
+			revisions INTEGER NOT NULL DEFAULT 0,
+			replyTo TEXT,
+			FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
+			FOREIGN KEY (senderId) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`INSERT INTO messages_new (seq, `+messageColumnsV7+`) SELECT rowid, `+messageColumnsV7+` FROM messages;`,
+		`DROP TABLE messages;`,
+		`ALTER TABLE messages_new RENAME TO messages;`,
+		`CREATE INDEX idx_messages_conversation_timeline ON messages (conversationId, timestamp);`,
+		`CREATE INDEX idx_messages_reply_to ON messages (replyTo);`,
+	)
+	if err != nil {
+		return err
+	}
+	return createMessageSearchIndex(tx, "seq")
+}
+
+// dropMessageSearch drops the full-text index, and makes the sequence numbers the implicit rowids again.
+func dropMessageSearch(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP TRIGGER IF EXISTS messages_fts_update;`,
+		`DROP TRIGGER IF EXISTS messages_fts_delete;`,
+		`DROP TRIGGER IF EXISTS messages_fts_insert;`,
+		`DROP TABLE IF EXISTS messages_fts;`,
+		`CREATE TABLE messages_old (
+			id TEXT NOT NULL PRIMARY KEY,
+			conversationId TEXT NOT NULL,
+			senderId TEXT NOT NULL,
+			content TEXT NOT NULL,
+			timestamp TEXT NOT NULL,
+			attachment BLOB,
+			status TEXT NOT NULL,
+			forwardedFrom TEXT,
+			attachmentBlobId TEXT,
+			editedAt TEXT,
+			revisions INTEGER NOT NULL DEFAULT 0,
+			replyTo TEXT,
+			FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
+			FOREIGN KEY (senderId) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`INSERT INTO messages_old (rowid, `+messageColumnsV7+`) SELECT seq, `+messageColumnsV7+` FROM messages;`,
+		`DROP TABLE messages;`,
+		`ALTER TABLE messages_old RENAME TO messages;`,
+		`CREATE INDEX idx_messages_conversation_timeline ON messages (conversationId, timestamp);`,
+		`CREATE INDEX idx_messages_reply_to ON messages (replyTo);`,
+	)
+}
+
+// createMessageSearchIndex creates the full-text index of the content of messages, an FTS5 external content table keyed
+// by the key column of messages, and the triggers that keep it in sync with every insert, edit and deletion, including
+// the ones cascading from deleted conversations. Nothing is created when SQLite was built without FTS5.
+func createMessageSearchIndex(tx *sql.Tx, key string) error {
+	fts5, err := hasFTS5(tx)
+	if err != nil || !fts5 {
+		return err
+	}
+	return execAll(tx,
+		`CREATE VIRTUAL TABLE messages_fts USING fts5(
+			content,
+			content = 'messages',
+			content_rowid = '`+key+`',
+			tokenize = 'unicode61 remove_diacritics 2'
+		);`,
+		`CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts (rowid, content) VALUES (new.`+key+`, new.content);
+		END;`,
+		`CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.`+key+`, old.content);
+		END;`,
+		`CREATE TRIGGER messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.`+key+`, old.content);
+			INSERT INTO messages_fts (rowid, content) VALUES (new.`+key+`, new.content);
+		END;`,
+		`INSERT INTO messages_fts (messages_fts) VALUES ('rebuild');`,
+	)
+}
+
+// ErrSearchNotSupported is returned when the database has a full-text search index that SQLite cannot use, as it was
+// built without FTS5.
+var ErrSearchNotSupported = errors.New("the database has a full-text search index, but SQLite was built without FTS5: build the executable with `-tags sqlite_fts5`")
+
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// hasFTS5 tells whether SQLite was built with FTS5, which the `sqlite_fts5` build tag enables.
+func hasFTS5(q rowQuerier) (bool, error) {
+	var fts5 bool
+	if err := q.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&fts5); err != nil {
+		return false, fmt.Errorf("error checking FTS5 support: %w", err)
+	}
+	return fts5, nil
+}
+
+// hasSearchIndex tells whether the database has the full-text index of the messages.
+func hasSearchIndex(q rowQuerier) (bool, error) {
+	var exists bool
+	err := q.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'messages_fts')`).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking the search index: %w", err)
+	}
+	return exists, nil
+}
+
+// checkSearchSupport returns ErrSearchNotSupported when the database has a full-text index but SQLite has no FTS5:
+// every change to the messages would fail, as the triggers keeping the index in sync cannot write to it.
+func checkSearchSupport(db *sql.DB) error {
+	indexed, err := hasSearchIndex(db)
+	if err != nil || !indexed {
+		return err
+	}
+	fts5, err := hasFTS5(db)
+	if err != nil {
+		return err
+	}
+	if !fts5 {
+		return ErrSearchNotSupported
+	}
+	return nil
+}
+
+// ensureSearchIndex creates the full-text index of a database migrated by an executable built without FTS5, when
+// SQLite has FTS5 now, and tells whether the index exists.
+func ensureSearchIndex(db *sql.DB) (bool, error) {
+	indexed, err := hasSearchIndex(db)
+	if err != nil || indexed {
+		return indexed, err
+	}
+	fts5, err := hasFTS5(db)
+	if err != nil || !fts5 {
+		return false, err
+	}
+	if err := inTransaction(db, func(tx *sql.Tx) error { return createMessageSearchIndex(tx, "seq") }); err != nil {
+		return false, fmt.Errorf("error creating the search index: %w", err)
+	}
+	return true, nil
+}
+
+// migrateReadWatermarks records, for every member, the position in the timeline up to which the conversation has been
+// read. Existing members start from the newest message they marked as read.
+func migrateReadWatermarks(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE conversation_members ADD COLUMN lastReadTimestamp TEXT;`,
+		`ALTER TABLE conversation_members ADD COLUMN lastReadSeq INTEGER;`,
+		`UPDATE conversation_members SET (lastReadTimestamp, lastReadSeq) = (
+			SELECT m.timestamp, m.seq FROM messages m
+			JOIN message_receipts r ON r.message_id = m.id
+			WHERE m.conversationId = conversation_members.conversationId
+			AND r.user_id = conversation_members.userId AND r.status = 'read'
+			ORDER BY m.timestamp DESC, m.seq DESC LIMIT 1
+		);`,
+	)
+}
+
+func dropReadWatermarks(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE conversation_members DROP COLUMN lastReadSeq;`,
+		`ALTER TABLE conversation_members DROP COLUMN lastReadTimestamp;`,
+	)
+}
+
+// migrateReceiptTimestamps merges message_status, which was never written, into message_receipts, and replaces the
+// status of every receipt with the time the message was delivered to and read by the recipient. A message that has
+// been read has been delivered too, so receipts always have a delivery time. Old receipts only know the time of their
+// last status change, which becomes the delivery time of read messages as well. Receipts of senders for their own
+// messages are dropped.
+func migrateReceiptTimestamps(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE message_receipts_new (
+			message_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			delivered_at TEXT NOT NULL,
+			read_at TEXT,
+			PRIMARY KEY (message_id, user_id),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`INSERT INTO message_receipts_new (message_id, user_id, delivered_at, read_at)
+			SELECT message_id, user_id, COALESCE(strftime('%Y-%m-%dT%H:%M:%SZ', timestamp), strftime('%Y-%m-%dT%H:%M:%SZ', 'now')),
+				CASE WHEN status = 'read' THEN COALESCE(strftime('%Y-%m-%dT%H:%M:%SZ', timestamp), strftime('%Y-%m-%dT%H:%M:%SZ', 'now')) END
+			FROM message_receipts r
+			WHERE NOT EXISTS (SELECT 1 FROM messages m WHERE m.id = r.message_id AND m.senderId = r.user_id);`,
+		`INSERT INTO message_receipts_new (message_id, user_id, delivered_at, read_at)
+			SELECT messageId, userId, deliveredAt, readAt FROM message_status WHERE true
+			ON CONFLICT (message_id, user_id) DO UPDATE SET read_at = COALESCE(read_at, excluded.read_at);`,
+		`DROP TABLE message_receipts;`,
+		`DROP TABLE message_status;`,
+		`ALTER TABLE message_receipts_new RENAME TO message_receipts;`,
+		`CREATE INDEX idx_message_receipts_message ON message_receipts (message_id);`,
+	)
+}
+
+func dropReceiptTimestamps(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE message_receipts_old (
+			message_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			status TEXT CHECK(status IN ('delivered', 'read')) NOT NULL,
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (message_id, user_id),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`INSERT INTO message_receipts_old (message_id, user_id, status, timestamp)
+			SELECT message_id, user_id, CASE WHEN read_at IS NULL THEN 'delivered' ELSE 'read' END,
+				datetime(COALESCE(read_at, delivered_at))
+			FROM message_receipts;`,
+		`DROP TABLE message_receipts;`,
+		`ALTER TABLE message_receipts_old RENAME TO message_receipts;`,
+		`CREATE INDEX idx_message_receipts_message ON message_receipts (message_id);`,
+		`CREATE TABLE message_status (
+			messageId TEXT NOT NULL,
+			userId TEXT NOT NULL,
+			deliveredAt TEXT NOT NULL,
+			readAt TEXT,
+			PRIMARY KEY (messageId, userId),
+			FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+	)
+}
+
+// migrateMessageExpiry adds the lifetime of the new messages of every conversation, in seconds, and the time each
+// message expires at. Existing messages never expire. The reaper relies on its deletions cascading, so the rows left
+// behind by the deletions made while the foreign keys were only enforced on some connections are deleted first.
+func migrateMessageExpiry(tx *sql.Tx) error {
+	if err := deleteOrphanRows(tx); err != nil {
+		return err
+	}
+	return execAll(tx,
+		`ALTER TABLE conversations ADD COLUMN messageTtl INTEGER;`,
+		`ALTER TABLE messages ADD COLUMN expiresAt TEXT;`,
+		`CREATE INDEX idx_messages_expires_at ON messages (expiresAt) WHERE expiresAt IS NOT NULL;`,
+	)
+}
+
+func dropMessageExpiry(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP INDEX IF EXISTS idx_messages_expires_at;`,
+		`ALTER TABLE messages DROP COLUMN expiresAt;`,
+		`ALTER TABLE conversations DROP COLUMN messageTtl;`,
+	)
+}
+
+// deleteOrphanRows deletes the rows referencing missing rows, as the cascades would have. Every foreign key cascades,
+// so the orphans are deleted until none are left. The rows cannot be restored, so migrating down keeps them deleted.
+func deleteOrphanRows(tx *sql.Tx) error {
+	for {
+		orphans, err := foreignKeyViolations(tx)
+		if err != nil {
+			return err
+		}
+		if len(orphans) == 0 {
+			return nil
+		}
+
+		for table, rowids := range orphans {
+			for _, rowid := range rowids {
+				if _, err := tx.Exec(`DELETE FROM `+table+` WHERE rowid = ?`, rowid); err != nil {
+					return fmt.Errorf("failed to delete an orphan %s row: %w", table, err)
+				}
+			}
+		}
+	}
+}
+
+// foreignKeyViolations returns the rowids of the rows referencing missing rows, by table.
+func foreignKeyViolations(tx *sql.Tx) (map[string][]int64, error) {
+	rows, err := tx.Query(`PRAGMA foreign_key_check;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check foreign keys: %w", err)
+	}
+	defer rows.Close()
+
+	orphans := make(map[string][]int64)
+	for rows.Next() {
+		var table, parent string
+		var rowid, fkid int64
+		if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			return nil, fmt.Errorf("failed to scan foreign key violation: %w", err)
+		}
+		orphans[table] = append(orphans[table], rowid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over foreign key violations: %w", err)
+	}
+	return orphans, nil
+}
+
+// migrateScheduledMessages adds the queue of the messages to be sent later. A scheduled message is deleted when it is
+// sent, in the same transaction that stores the message, and is marked as failed when it cannot be sent.
+func migrateScheduledMessages(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE scheduled_messages (
+			id TEXT NOT NULL PRIMARY KEY,
+			conversationId TEXT NOT NULL,
+			senderId TEXT NOT NULL,
+			content TEXT NOT NULL,
+			attachmentBlobId TEXT,
+			replyTo TEXT,
+			sendAt TEXT NOT NULL,
+			createdAt TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'failed')),
+			error TEXT,
+			FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
+			FOREIGN KEY (senderId) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX idx_scheduled_messages_due ON scheduled_messages (sendAt) WHERE status = 'pending';`,
+		`CREATE INDEX idx_scheduled_messages_sender ON scheduled_messages (conversationId, senderId, sendAt);`,
+	)
+}
+
+func dropScheduledMessages(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP TABLE IF EXISTS scheduled_messages;`,
+	)
+}
+
+// migrateMessageTombstones adds the time a message was deleted for everyone, which keeps it in the timeline as a
+// tombstone, and the messages each user deleted for themselves only. The blobs that deleted messages referenced are
+// marked for deletion, and deleted from the blob store after a grace period if nothing references them anymore.
+func migrateMessageTombstones(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE messages ADD COLUMN deletedAt TEXT;`,
+		`CREATE TABLE hidden_messages (
+			message_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			hidden_at TEXT NOT NULL,
+			PRIMARY KEY (user_id, message_id),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX idx_hidden_messages_message ON hidden_messages (message_id);`,
+		`CREATE TABLE blob_deletions (
+			blob_id TEXT PRIMARY KEY,
+			marked_at TEXT NOT NULL
+		);`,
+		`CREATE INDEX idx_blob_deletions_marked ON blob_deletions (marked_at);`,
+	)
+}
+
+func dropMessageTombstones(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP TABLE IF EXISTS blob_deletions;`,
+		`DROP TABLE IF EXISTS hidden_messages;`,
+		`ALTER TABLE messages DROP COLUMN deletedAt;`,
+	)
+}
+
+// migrateMessageAttachments moves the attachments of messages and scheduled messages to their own tables, which keep
+// an ordered list of attachments per message with their metadata. Attachments sent before only had a blob ID: they
+// were all photos, and their MIME type and size are unknown.
+func migrateMessageAttachments(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE message_attachments (
+			message_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			blob_id TEXT NOT NULL,
+			kind TEXT NOT NULL CHECK(kind IN ('image', 'video', 'audio', 'file')),
+			mime_type TEXT NOT NULL,
+			filename TEXT NOT NULL DEFAULT '',
+			size INTEGER NOT NULL,
+			caption TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (message_id, position),
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX idx_message_attachments_blob ON message_attachments (blob_id);`,
+		`INSERT INTO message_attachments (message_id, position, blob_id, kind, mime_type, size)
+			SELECT id, 0, attachmentBlobId, 'image', '', 0 FROM messages WHERE attachmentBlobId IS NOT NULL;`,
+		`ALTER TABLE messages DROP COLUMN attachmentBlobId;`,
+
+		`CREATE TABLE scheduled_message_attachments (
+			message_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			blob_id TEXT NOT NULL,
+			kind TEXT NOT NULL CHECK(kind IN ('image', 'video', 'audio', 'file')),
+			mime_type TEXT NOT NULL,
+			filename TEXT NOT NULL DEFAULT '',
+			size INTEGER NOT NULL,
+			caption TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (message_id, position),
+			FOREIGN KEY (message_id) REFERENCES scheduled_messages(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX idx_scheduled_message_attachments_blob ON scheduled_message_attachments (blob_id);`,
+		`INSERT INTO scheduled_message_attachments (message_id, position, blob_id, kind, mime_type, size)
+			SELECT id, 0, attachmentBlobId, 'image', '', 0 FROM scheduled_messages WHERE attachmentBlobId IS NOT NULL;`,
+		`ALTER TABLE scheduled_messages DROP COLUMN attachmentBlobId;`,
+	)
+}
+
+// dropMessageAttachments keeps the first attachment of every message, the only one the previous schema can hold.
+func dropMessageAttachments(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE scheduled_messages ADD COLUMN attachmentBlobId TEXT;`,
+		`UPDATE scheduled_messages SET attachmentBlobId = (SELECT blob_id FROM scheduled_message_attachments a
+			WHERE a.message_id = scheduled_messages.id ORDER BY position LIMIT 1);`,
+		`DROP TABLE IF EXISTS scheduled_message_attachments;`,
+
+		`ALTER TABLE messages ADD COLUMN attachmentBlobId TEXT;`,
+		`UPDATE messages SET attachmentBlobId = (SELECT blob_id FROM message_attachments a
+			WHERE a.message_id = messages.id ORDER BY position LIMIT 1);`,
+		`DROP TABLE IF EXISTS message_attachments;`,
+	)
+}
+
+// migrateImageThumbnails adds the dimensions and the thumbnail of the images processed on upload, keyed by the blob ID
+// of the image. Images uploaded before have no row, and are shown at full size.
+func migrateImageThumbnails(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE images (
+			blob_id TEXT PRIMARY KEY,
+			width INTEGER NOT NULL,
+			height INTEGER NOT NULL,
+			thumbnail_blob_id TEXT NOT NULL
+		);`,
+		`CREATE INDEX idx_images_thumbnail ON images (thumbnail_blob_id);`,
+	)
+}
+
+// dropImageThumbnails forgets the images; their thumbnails stay in the blob store.
+func dropImageThumbnails(tx *sql.Tx) error {
+	return execAll(tx, `DROP TABLE IF EXISTS images;`)
+}
+
+// migrateUploads adds the resumable uploads of attachments, with the chunks of content received so far. Chunks are
+// deleted once the upload is finalized into a blob.
+func migrateUploads(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE uploads (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			length INTEGER NOT NULL,
+			received INTEGER NOT NULL DEFAULT 0,
+			filename TEXT NOT NULL DEFAULT '',
+			kind TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			blob_id TEXT,
+			mime_type TEXT NOT NULL DEFAULT '',
+			size INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX idx_uploads_expires ON uploads (expires_at);`,
+		`CREATE INDEX idx_uploads_blob ON uploads (blob_id);`,
+		`CREATE TABLE upload_chunks (
+			upload_id TEXT NOT NULL,
+			start INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			PRIMARY KEY (upload_id, start),
+			FOREIGN KEY (upload_id) REFERENCES uploads(id) ON DELETE CASCADE
+		);`,
+	)
+}
+
+// dropUploads forgets the uploads; the blobs of finalized uploads stay in the blob store.
+func dropUploads(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP TABLE IF EXISTS upload_chunks;`,
+		`DROP TABLE IF EXISTS uploads;`,
+	)
+}
+
+// migrateSessions adds the sessions opened by logging in, and the refresh tokens issued for them. The refresh tokens
+// of a session form a family: each one can be exchanged once for the next one, and the used ones are kept to detect
+// their reuse.
+func migrateSessions(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			refreshed_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX idx_sessions_user ON sessions (user_id);`,
+		`CREATE INDEX idx_sessions_expires ON sessions (expires_at);`,
+		`CREATE TABLE refresh_tokens (
+			hash TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL,
+			issued_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			used_at TEXT,
+			FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX idx_refresh_tokens_session ON refresh_tokens (session_id);`,
+		`CREATE INDEX idx_refresh_tokens_expires ON refresh_tokens (expires_at);`,
+	)
+}
+
+// dropSessions forgets the sessions: every user has to log in again.
+func dropSessions(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP TABLE IF EXISTS refresh_tokens;`,
+		`DROP TABLE IF EXISTS sessions;`,
+	)
+}
+
+// migrateSessionDevices records the device of each session, and when it was last seen, so users can list their
+// devices. Sessions opened before are shown as seen when they were last refreshed.
+func migrateSessionDevices(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE sessions ADD COLUMN device_label TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE sessions ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE sessions ADD COLUMN ip TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE sessions ADD COLUMN last_seen_at TEXT NOT NULL DEFAULT '';`,
+		`UPDATE sessions SET last_seen_at = refreshed_at;`,
+	)
+}
+
+func dropSessionDevices(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE sessions DROP COLUMN last_seen_at;`,
+		`ALTER TABLE sessions DROP COLUMN ip;`,
+		`ALTER TABLE sessions DROP COLUMN user_agent;`,
+		`ALTER TABLE sessions DROP COLUMN device_label;`,
+	)
+}
+
+// migrateCredentials adds the credentials users can log in with: a password hash, or passkeys. Passkeys are registered
+// and used by signing a challenge, kept until the ceremony completes. Existing users have no credentials, and log in
+// with their username until they add some. Sessions record whether they were opened by creating the account or with a
+// credential; the existing sessions cannot tell, so they are not verified.
+func migrateCredentials(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE users ADD COLUMN passwordHash TEXT;`,
+		`CREATE TABLE passkeys (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			public_key BLOB NOT NULL,
+			sign_count INTEGER NOT NULL DEFAULT 0,
+			created_at TEXT NOT NULL,
+			last_used_at TEXT,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX idx_passkeys_user ON passkeys (user_id);`,
+		`CREATE TABLE webauthn_challenges (
+			challenge TEXT PRIMARY KEY,
+			kind TEXT NOT NULL CHECK (kind IN ('register', 'login')),
+			user_id TEXT,
+			expires_at TEXT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX idx_webauthn_challenges_expires ON webauthn_challenges (expires_at);`,
+		`ALTER TABLE sessions ADD COLUMN verified INTEGER NOT NULL DEFAULT 0;`,
+	)
+}
+
+func dropCredentials(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP TABLE IF EXISTS webauthn_challenges;`,
+		`DROP TABLE IF EXISTS passkeys;`,
+		`ALTER TABLE sessions DROP COLUMN verified;`,
+		`ALTER TABLE users DROP COLUMN passwordHash;`,
+	)
+}
+
+// migrateSlowMode adds the slow mode of groups: how long, in seconds, each member waits between two messages. NULL means
+// that slow mode is off.
+func migrateSlowMode(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE conversations ADD COLUMN slowMode INTEGER;`,
+	)
+}
+
+func dropSlowMode(tx *sql.Tx) error {
+	return execAll(tx,
+		`ALTER TABLE conversations DROP COLUMN slowMode;`,
+	)
+}
@@ -0,0 +1,182 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMigrateDownAndUp(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := MigrateUp(db); err != nil {
+		t.Fatalf("migrating up: %v", err)
+	}
+	if _, err := MigrateDownTo(db, 0); err != nil {
+		t.Fatalf("migrating down: %v", err)
+	}
+	if _, err := MigrateUp(db); err != nil {
+		t.Fatalf("migrating up again: %v", err)
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Errorf("schema version is %d, want %d", version, LatestSchemaVersion())
+	}
+}
+
+// TestMessageSequence checks that the messages keep their rowid as sequence number, with the rows referencing them,
+// and that VACUUM does not renumber them.
+func TestMessageSequence(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := MigrateUp(db); err != nil {
+		t.Fatalf("migrating up: %v", err)
+	}
+	if _, err := MigrateDownTo(db, 6); err != nil {
+		t.Fatalf("migrating down to 6: %v", err)
+	}
+	mustExec(t, db,
+		`INSERT INTO users (id, username) VALUES ('u1', 'alice'), ('u2', 'bob');`,
+		`INSERT INTO conversations (id, name, type) VALUES ('c1', 'group', 'group');`,
+		`INSERT INTO conversation_members (conversationId, userId) VALUES ('c1', 'u1'), ('c1', 'u2');`,
+		`INSERT INTO messages (id, conversationId, senderId, content, timestamp, status) VALUES
+			('m1', 'c1', 'u1', 'one', '2024-01-01T00:00:00Z', 'sent'),
+			('m2', 'c1', 'u1', 'two', '2024-01-01T00:00:00Z', 'sent'),
+			('m3', 'c1', 'u1', 'three', '2024-01-01T00:00:00Z', 'sent');`,
+		`DELETE FROM messages WHERE id = 'm1';`,
+		`INSERT INTO reactions (messageId, userId, reaction) VALUES ('m3', 'u2', '👍');`,
+	)
+
+	if _, err := MigrateUp(db); err != nil {
+		t.Fatalf("migrating up: %v", err)
+	}
+	mustExec(t, db, `VACUUM;`)
+
+	want := map[string]int64{"m2": 2, "m3": 3}
+	for id, seq := range want {
+		var got int64
+		if err := db.QueryRow(`SELECT seq FROM messages WHERE id = ?`, id).Scan(&got); err != nil {
+			t.Fatalf("reading the sequence number of %s: %v", id, err)
+		}
+		if got != seq {
+			t.Errorf("sequence number of %s is %d, want %d", id, got, seq)
+		}
+	}
+	var reactions int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM reactions WHERE messageId = 'm3'`).Scan(&reactions); err != nil {
+		t.Fatal(err)
+	}
+	if reactions != 1 {
+		t.Errorf("the reactions to the messages were lost: found %d, want 1", reactions)
+	}
+
+	// new messages never reuse the sequence number of a deleted one
+	mustExec(t, db,
+		`DELETE FROM messages WHERE id = 'm3';`,
+		`INSERT INTO messages (id, conversationId, senderId, content, timestamp, status)
+			VALUES ('m4', 'c1', 'u1', 'four', '2024-01-01T00:00:00Z', 'sent');`,
+	)
+	var seq int64
+	if err := db.QueryRow(`SELECT seq FROM messages WHERE id = 'm4'`).Scan(&seq); err != nil {
+		t.Fatal(err)
+	}
+	if seq != 4 {
+		t.Errorf("sequence number of a new message is %d, want 4", seq)
+	}
+}
+
+// TestSearchMessages runs with and without the full-text index, depending on the `sqlite_fts5` build tag.
+func TestSearchMessages(t *testing.T) {
+	db, conn := newTestAppDB(t)
+	mustExec(t, conn,
+		`INSERT INTO users (id, username) VALUES ('u1', 'alice'), ('u2', 'bob'), ('u3', 'carol');`,
+		`INSERT INTO conversations (id, name, type) VALUES ('c1', 'group', 'group'), ('c2', 'other', 'group');`,
+		`INSERT INTO conversation_members (conversationId, userId) VALUES ('c1', 'u1'), ('c1', 'u2'), ('c2', 'u3');`,
+		`INSERT INTO messages (id, conversationId, senderId, content, timestamp, status, forwardedFrom) VALUES
+			('m1', 'c1', 'u1', 'lunch at noon?', '2024-01-01T10:00:00Z', 'sent', ''),
+			('m2', 'c1', 'u2', 'no lunch today', '2024-01-01T11:00:00Z', 'sent', ''),
+			('m3', 'c1', 'u2', 'see you tomorrow', '2024-01-01T12:00:00Z', 'sent', ''),
+			('m4', 'c2', 'u3', 'lunch with carol', '2024-01-01T13:00:00Z', 'sent', '');`,
+	)
+
+	tests := []struct {
+		name   string
+		search MessageSearch
+		want   []string
+	}{
+		{"term", MessageSearch{Terms: []SearchTerm{{Text: "lunch"}}}, []string{"m1", "m2"}},
+		{"sender", MessageSearch{Terms: []SearchTerm{{Text: "lunch"}}, From: "bob"}, []string{"m2"}},
+		{"filters only", MessageSearch{In: "group"}, []string{"m3", "m2", "m1"}},
+		{"no match", MessageSearch{Terms: []SearchTerm{{Text: "dinner"}}}, nil},
+		{"wildcards are literal", MessageSearch{Terms: []SearchTerm{{Text: "%"}}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.search.UserID = "u2"
+			tt.search.Limit = 10
+			results, err := db.SearchMessages(context.Background(), tt.search)
+			if err != nil {
+				t.Fatalf("searching: %v", err)
+			}
+			got := make(map[string]bool)
+			for _, r := range results {
+				got[r.Message.ID] = true
+			}
+			if len(results) != len(tt.want) {
+				t.Fatalf("found %d messages, want %v", len(results), tt.want)
+			}
+			for _, id := range tt.want {
+				if !got[id] {
+					t.Errorf("message %s not found, want %v", id, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestDeleteOrphanRows checks that the rows left behind by deletions that did not cascade are deleted.
+func TestDeleteOrphanRows(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := MigrateUp(db); err != nil {
+		t.Fatalf("migrating up: %v", err)
+	}
+	if _, err := MigrateDownTo(db, 9); err != nil {
+		t.Fatalf("migrating down to 9: %v", err)
+	}
+	mustExec(t, db,
+		`INSERT INTO users (id, username) VALUES ('u1', 'alice');`,
+		`INSERT INTO conversations (id, name, type) VALUES ('c1', 'group', 'group');`,
+		`INSERT INTO messages (id, conversationId, senderId, content, timestamp, status, forwardedFrom) VALUES
+			('m1', 'c1', 'u1', 'one', '2024-01-01T00:00:00Z', 'sent', ''),
+			('m2', 'c1', 'u1', 'two', '2024-01-01T00:00:00Z', 'sent', '');`,
+		`INSERT INTO reactions (messageId, userId, reaction) VALUES ('m1', 'u1', '👍'), ('m2', 'u1', '👍');`,
+	)
+	// the message is deleted as by a connection without foreign keys
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{`PRAGMA foreign_keys = OFF;`, `DELETE FROM messages WHERE id = 'm1';`, `PRAGMA foreign_keys = ON;`} {
+		if _, err := conn.ExecContext(context.Background(), stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	_ = conn.Close()
+
+	if _, err := MigrateUp(db); err != nil {
+		t.Fatalf("migrating up: %v", err)
+	}
+	var violations, reactions int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_foreign_key_check`).Scan(&violations); err != nil {
+		t.Fatal(err)
+	}
+	if violations != 0 {
+		t.Errorf("%d orphan rows are left", violations)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM reactions WHERE messageId = 'm2'`).Scan(&reactions); err != nil {
+		t.Fatal(err)
+	}
+	if reactions != 1 {
+		t.Errorf("the reaction to an existing message was deleted")
+	}
+}
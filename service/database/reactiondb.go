@@ -1,12 +1,13 @@
 package database
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/dilcetto/wasa/service/components/schema"
 )
 
-func (db *appdbimpl) AddReactionToMessage(reaction *schema.Reaction) error {
+func (db *appdbimpl) AddReactionToMessage(ctx context.Context, reaction *schema.Reaction) error {
 	if reaction == nil {
 		return fmt.Errorf("reaction is nil")
 	}
@@ -15,27 +16,38 @@ func (db *appdbimpl) AddReactionToMessage(reaction *schema.Reaction) error {
 	}
 
 	// Upsert: one reaction per (messageId, userId). If it exists, update the emoji.
+	// Messages deleted for everyone cannot receive reactions.
 	query := `
     INSERT INTO reactions (messageId, userId, reaction)
-    VALUES (?, ?, ?)
+    SELECT ?, ?, ? WHERE EXISTS (SELECT 1 FROM messages WHERE id = ? AND deletedAt IS NULL)
     ON CONFLICT(messageId, userId) DO UPDATE SET
       reaction = excluded.reaction`
-	_, err := db.c.Exec(query, reaction.MessageId, reaction.UserId, reaction.Emoji)
+	res, err := db.c.ExecContext(ctx, query, reaction.MessageId, reaction.UserId, reaction.Emoji, reaction.MessageId)
 	if err != nil {
 		return fmt.Errorf("failed to add reaction: %w", err)
 	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to determine rows affected: %w", err)
+	} else if n == 0 {
+		return schema.ErrMessageDeleted
+	}
 	return nil
 }
 
-func (db *appdbimpl) DeleteReactionFromMessage(messageId, userId string) error {
+func (db *appdbimpl) DeleteReactionFromMessage(ctx context.Context, messageId, userId string) error {
 	if messageId == "" || userId == "" {
 		return fmt.Errorf("messageID and userID cannot be empty")
 	}
 
 	query := `DELETE FROM reactions WHERE messageId = ? AND userId = ?`
-	_, err := db.c.Exec(query, messageId, userId)
+	res, err := db.c.ExecContext(ctx, query, messageId, userId)
 	if err != nil {
 		return fmt.Errorf("failed to remove reaction: %w", err)
 	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to determine rows affected: %w", err)
+	} else if n == 0 {
+		return schema.ErrReactionDoesNotExist
+	}
 	return nil
 }
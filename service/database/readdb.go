@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// unreadCount is the number of unread messages of a conversation, and how many of them mention the user.
+type unreadCount struct {
+	messages int
+	mentions int
+}
+
+// unreadCounts returns the unread counters of the conversations of userID, keyed by conversation ID, limited to
+// conversationID if not empty. Conversations without unread messages are missing from the map.
+//
+// A message is unread when it was sent by another member after the read watermark of the user, and was deleted neither
+// for everyone nor for the user. It mentions the user when it contains @username followed by a character that cannot
+// be part of a username; usernames only contain letters, digits and underscores, so they are safe to use in GLOB
+// patterns.
+func (db *appdbimpl) unreadCounts(ctx context.Context, userID, conversationID string) (map[string]unreadCount, error) {
+	query := `
+		SELECT cm.conversationId, COUNT(*),
+			SUM(CASE WHEN m.content GLOB '*@' || me.username || '[^A-Za-z0-9_]*'
+				OR m.content GLOB '*@' || me.username THEN 1 ELSE 0 END)
+		FROM conversation_members cm
+		JOIN users me ON me.id = cm.userId
+		JOIN messages m ON m.conversationId = cm.conversationId AND m.senderId <> cm.userId
+		WHERE cm.userId = ? AND m.deletedAt IS NULL
+		AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = cm.userId)
+		AND (cm.lastReadTimestamp IS NULL OR (m.timestamp, m.seq) > (cm.lastReadTimestamp, cm.lastReadSeq))`
+	args := []interface{}{userID}
+	if conversationID != "" {
+		query += ` AND cm.conversationId = ?`
+		args = append(args, conversationID)
+	}
+	query += ` GROUP BY cm.conversationId`
+
+	rows, err := db.c.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count unread messages: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]unreadCount)
+	for rows.Next() {
+		var id string
+		var c unreadCount
+		if err := rows.Scan(&id, &c.messages, &c.mentions); err != nil {
+			return nil, fmt.Errorf("failed to scan unread messages: %w", err)
+		}
+		counts[id] = c
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading unread messages: %w", err)
+	}
+	return counts, nil
+}
+
+// MarkConversationRead moves the read watermark of userID in the conversation up to messageID, and marks as read every
+// message of the other members up to it. The watermark never moves back: marking an older message changes nothing.
+// It returns the senders of the messages it marked as read, or schema.ErrMessageDoesNotExist if the message does not
+// exist.
+func (db *appdbimpl) MarkConversationRead(ctx context.Context, conversationID, userID, messageID string) ([]string, error) {
+	if conversationID == "" || userID == "" || messageID == "" {
+		return nil, fmt.Errorf("conversation ID, user ID and message ID cannot be empty")
+	}
+
+	var senders []string
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		var pos messageCursor
+		err := tx.c.QueryRowContext(ctx, `SELECT timestamp, seq FROM messages WHERE id = ? AND conversationId = ?`, messageID, conversationID).
+			Scan(&pos.Timestamp, &pos.Seq)
+		if errors.Is(err, sql.ErrNoRows) {
+			return schema.ErrMessageDoesNotExist
+		} else if err != nil {
+			return fmt.Errorf("failed to get message position: %w", err)
+		}
+
+		res, err := tx.c.ExecContext(ctx, `UPDATE conversation_members SET lastReadTimestamp = ?, lastReadSeq = ?
+			WHERE conversationId = ? AND userId = ?
+			AND (lastReadTimestamp IS NULL OR (?, ?) > (lastReadTimestamp, lastReadSeq))`,
+			pos.Timestamp, pos.Seq, conversationID, userID, pos.Timestamp, pos.Seq)
+		if err != nil {
+			return fmt.Errorf("failed to move read watermark: %w", err)
+		}
+		if moved, err := res.RowsAffected(); err != nil || moved == 0 {
+			return err
+		}
+
+		rows, err := tx.c.QueryContext(ctx, `SELECT DISTINCT m.senderId FROM messages m
+			LEFT JOIN message_receipts r ON r.message_id = m.id AND r.user_id = ?
+			WHERE m.conversationId = ? AND m.senderId <> ? AND (m.timestamp, m.seq) <= (?, ?) AND r.read_at IS NULL`,
+			userID, conversationID, userID, pos.Timestamp, pos.Seq)
+		if err != nil {
+			return fmt.Errorf("failed to get unread senders: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var sender string
+			if err := rows.Scan(&sender); err != nil {
+				return fmt.Errorf("failed to scan sender: %w", err)
+			}
+			senders = append(senders, sender)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to read senders: %w", err)
+		}
+
+		_, err = tx.c.ExecContext(ctx, `INSERT INTO message_receipts (message_id, user_id, delivered_at, read_at)
+			SELECT m.id, ?, `+receiptNow+`, `+receiptNow+` FROM messages m
+			WHERE m.conversationId = ? AND m.senderId <> ? AND (m.timestamp, m.seq) <= (?, ?)
+			ON CONFLICT (message_id, user_id) DO UPDATE SET read_at = excluded.read_at
+			WHERE read_at IS NULL`,
+			userID, conversationID, userID, pos.Timestamp, pos.Seq)
+		if err != nil {
+			return fmt.Errorf("failed to mark messages as read: %w", err)
+		}
+		return nil
+	})
+	return senders, err
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// TestMarkConversationRead checks the unread counters of a member as their read watermark moves through the
+// conversation, and the senders whose messages each move marks as read.
+func TestMarkConversationRead(t *testing.T) {
+	db, conn := newTestAppDB(t)
+	ctx := context.Background()
+	mustExec(t, conn,
+		`INSERT INTO users (id, username) VALUES ('u1', 'alice'), ('u2', 'bob'), ('u3', 'carol');`,
+		`INSERT INTO conversations (id, name, type) VALUES ('c1', 'group', 'group'), ('c2', 'other', 'group');`,
+		`INSERT INTO conversation_members (conversationId, userId) VALUES ('c1', 'u1'), ('c1', 'u2'), ('c1', 'u3'), ('c2', 'u1'), ('c2', 'u2');`,
+		// m2 and m3 are sent in the same second
+		`INSERT INTO messages (id, conversationId, senderId, content, timestamp, status, forwardedFrom) VALUES
+			('m1', 'c1', 'u2', 'hi @alice', '2024-01-01T00:00:00Z', 'sent', ''),
+			('m2', 'c1', 'u3', 'hello', '2024-01-01T00:00:01Z', 'sent', ''),
+			('m3', 'c1', 'u2', 'not @alicebob', '2024-01-01T00:00:01Z', 'sent', ''),
+			('m4', 'c1', 'u1', 'mine', '2024-01-01T00:00:02Z', 'sent', ''),
+			('m5', 'c1', 'u2', '', '2024-01-01T00:00:03Z', 'sent', ''),
+			('m6', 'c1', 'u3', 'hidden @alice', '2024-01-01T00:00:04Z', 'sent', ''),
+			('m7', 'c1', 'u3', 'bye @alice.', '2024-01-01T00:00:05Z', 'sent', ''),
+			('other', 'c2', 'u2', 'other', '2024-01-01T00:00:00Z', 'sent', '');`,
+		`UPDATE messages SET deletedAt = '2024-01-01T00:00:06Z' WHERE id = 'm5';`,
+		`INSERT INTO hidden_messages (message_id, user_id, hidden_at) VALUES ('m6', 'u1', '2024-01-01T00:00:06Z');`,
+	)
+	expectUnread := func(step string, messages, mentions int) {
+		t.Helper()
+		conv, err := db.GetConversationByID(ctx, "u1", "c1")
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if conv.UnreadCount != messages || conv.UnreadMentions != mentions {
+			t.Errorf("%s: %d unread messages and %d mentions, want %d and %d", step, conv.UnreadCount, conv.UnreadMentions, messages, mentions)
+		}
+	}
+	markRead := func(step, messageID string, want ...string) {
+		t.Helper()
+		senders, err := db.MarkConversationRead(ctx, "c1", "u1", messageID)
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		sort.Strings(senders)
+		if !reflect.DeepEqual(append([]string{}, senders...), append([]string{}, want...)) {
+			t.Errorf("%s: marked the messages of %v as read, want %v", step, senders, want)
+		}
+	}
+
+	expectUnread("before reading", 4, 2)
+
+	// the watermark stops between the two messages sent in the same second
+	markRead("reading up to m2", "m2", "u2", "u3")
+	expectUnread("after reading up to m2", 2, 1)
+
+	markRead("reading an older message", "m1")
+	expectUnread("after reading an older message", 2, 1)
+
+	markRead("reading up to m7", "m7", "u2", "u3")
+	expectUnread("after reading everything", 0, 0)
+
+	var receipts int
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM message_receipts WHERE user_id = 'u1' AND read_at IS NOT NULL`).Scan(&receipts); err != nil {
+		t.Fatal(err)
+	}
+	if receipts != 6 {
+		t.Errorf("%d messages are read, want the 6 of the other members", receipts)
+	}
+
+	for _, id := range []string{"missing", "other"} {
+		if _, err := db.MarkConversationRead(ctx, "c1", "u1", id); !errors.Is(err, schema.ErrMessageDoesNotExist) {
+			t.Errorf("reading up to %s: got %v, want %v", id, err, schema.ErrMessageDoesNotExist)
+		}
+	}
+}
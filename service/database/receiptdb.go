@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// receiptNow is the SQL expression of the current time in receipts, in the RFC 3339 format used by messages.
+const receiptNow = `strftime('%Y-%m-%dT%H:%M:%SZ', 'now')`
+
+// GetMessageReceipts returns the delivery status of the message for every current member of its conversation but the
+// sender, the members who read it first, followed by the ones it was delivered to and then by the others.
+func (db *appdbimpl) GetMessageReceipts(ctx context.Context, messageID string) ([]schema.MessageReceipt, error) {
+	if messageID == "" {
+		return nil, fmt.Errorf("message ID cannot be empty")
+	}
+
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT u.id, u.username, COALESCE(u.photoBlobId, ''), COALESCE(r.delivered_at, ''), COALESCE(r.read_at, '')
+		FROM messages m
+		JOIN conversation_members cm ON cm.conversationId = m.conversationId AND cm.userId <> m.senderId
+		JOIN users u ON u.id = cm.userId
+		LEFT JOIN message_receipts r ON r.message_id = m.id AND r.user_id = cm.userId
+		WHERE m.id = ?
+		ORDER BY r.read_at IS NULL, r.read_at, r.delivered_at IS NULL, r.delivered_at, u.username`, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get receipts: %w", err)
+	}
+	defer rows.Close()
+
+	receipts := []schema.MessageReceipt{}
+	for rows.Next() {
+		var r schema.MessageReceipt
+		if err := rows.Scan(&r.User.ID, &r.User.Username, &r.User.PhotoID, &r.DeliveredAt, &r.ReadAt); err != nil {
+			return nil, fmt.Errorf("failed to scan receipt: %w", err)
+		}
+		receipts = append(receipts, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading receipts: %w", err)
+	}
+
+	users := make([]*schema.User, len(receipts))
+	for i := range receipts {
+		users[i] = &receipts[i].User
+	}
+	if err := db.loadUserPhotos(ctx, users); err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// scheduledColumns are the columns read by scanScheduledMessage.
+const scheduledColumns = `id, conversationId, senderId, content, COALESCE(replyTo, ''),
+	sendAt, createdAt, status, COALESCE(error, '')`
+
+// scanScheduledMessage reads a row selected with scheduledColumns.
+func scanScheduledMessage(row interface{ Scan(...interface{}) error }) (*schema.ScheduledMessage, error) {
+	var m schema.ScheduledMessage
+	var content string
+	if err := row.Scan(&m.ID, &m.ConversationID, &m.SenderID, &content, &m.ReplyTo,
+		&m.SendAt, &m.CreatedAt, &m.Status, &m.Error); err != nil {
+		return nil, err
+	}
+	m.Content = schema.MessageContent{ContentType: schema.TextContent, Value: []byte(content)}
+	return &m, nil
+}
+
+// loadScheduledAttachments sets the attachments of the scheduled messages, and their content type from the kind of the
+// first one.
+func (db *appdbimpl) loadScheduledAttachments(ctx context.Context, messages []*schema.ScheduledMessage) error {
+	ids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	attachments, err := db.attachmentsOf(ctx, scheduledMessageAttachments, ids)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		m.Attachments = attachments[m.ID]
+		m.AttachmentIDs = nil
+		for _, a := range m.Attachments {
+			m.AttachmentIDs = append(m.AttachmentIDs, a.BlobID)
+		}
+		if len(m.Attachments) > 0 {
+			m.Content.ContentType = schema.AttachmentContentType(m.Attachments[0].Kind)
+		}
+	}
+	return nil
+}
+
+// CreateScheduledMessage queues a message to be sent at message.SendAt, with its attachments.
+func (db *appdbimpl) CreateScheduledMessage(ctx context.Context, message *schema.ScheduledMessage) error {
+	if message == nil || message.ID == "" || message.SendAt == "" {
+		return fmt.Errorf("scheduled message, ID and send time cannot be empty")
+	}
+
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		_, err := tx.c.ExecContext(ctx, `INSERT INTO scheduled_messages
+			(id, conversationId, senderId, content, replyTo, sendAt, createdAt, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?, 'pending')`,
+			message.ID, message.ConversationID, message.SenderID, string(message.Content.Value),
+			nullIfEmpty(message.ReplyTo), message.SendAt, message.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to schedule message: %w", err)
+		}
+		return tx.insertAttachments(ctx, scheduledMessageAttachments, message.ID, message.Attachments)
+	})
+}
+
+// GetScheduledMessage returns the scheduled message with the given ID, or schema.ErrScheduledMessageNotFound.
+func (db *appdbimpl) GetScheduledMessage(ctx context.Context, id string) (*schema.ScheduledMessage, error) {
+	row := db.c.QueryRowContext(ctx, `SELECT `+scheduledColumns+` FROM scheduled_messages WHERE id = ?`, id)
+	m, err := scanScheduledMessage(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, schema.ErrScheduledMessageNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get scheduled message: %w", err)
+	}
+	if err := db.loadScheduledAttachments(ctx, []*schema.ScheduledMessage{m}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetScheduledMessages returns the messages senderID scheduled in the conversation, in the order they will be sent.
+func (db *appdbimpl) GetScheduledMessages(ctx context.Context, conversationID, senderID string) ([]*schema.ScheduledMessage, error) {
+	rows, err := db.c.QueryContext(ctx, `SELECT `+scheduledColumns+` FROM scheduled_messages
+		WHERE conversationId = ? AND senderId = ? ORDER BY sendAt, createdAt`, conversationID, senderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scheduled messages: %w", err)
+	}
+	defer rows.Close()
+	messages, err := scanScheduledMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.loadScheduledAttachments(ctx, messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// GetDueScheduledMessages returns up to `limit` pending scheduled messages whose send time is not after `now`, the
+// oldest first.
+func (db *appdbimpl) GetDueScheduledMessages(ctx context.Context, now time.Time, limit int) ([]*schema.ScheduledMessage, error) {
+	// send times are stored in RFC 3339 UTC, which sorts chronologically as text
+	rows, err := db.c.QueryContext(ctx, `SELECT `+scheduledColumns+` FROM scheduled_messages
+		WHERE status = 'pending' AND sendAt <= ? ORDER BY sendAt, createdAt LIMIT ?`, now.UTC().Format(time.RFC3339), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due scheduled messages: %w", err)
+	}
+	defer rows.Close()
+	messages, err := scanScheduledMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.loadScheduledAttachments(ctx, messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func scanScheduledMessages(rows *sql.Rows) ([]*schema.ScheduledMessage, error) {
+	messages := []*schema.ScheduledMessage{}
+	for rows.Next() {
+		m, err := scanScheduledMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan scheduled message: %w", err)
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading scheduled messages: %w", err)
+	}
+	return messages, nil
+}
+
+// UpdateScheduledMessage replaces the content, attachments, reply and send time of a scheduled message, which becomes
+// pending again if it had failed.
+func (db *appdbimpl) UpdateScheduledMessage(ctx context.Context, message *schema.ScheduledMessage) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		// the attachments that are removed are marked for deletion, SweepUnusedBlobs keeps those referenced elsewhere
+		previous, err := tx.attachmentBlobs(ctx, scheduledMessageAttachments, []string{message.ID})
+		if err != nil {
+			return err
+		}
+		kept := make(map[string]bool, len(message.Attachments))
+		for _, a := range message.Attachments {
+			kept[a.BlobID] = true
+		}
+		var removed []string
+		for _, blobID := range previous {
+			if !kept[blobID] {
+				removed = append(removed, blobID)
+			}
+		}
+		res, err := tx.c.ExecContext(ctx, `UPDATE scheduled_messages
+			SET content = ?, replyTo = ?, sendAt = ?, status = 'pending', error = NULL
+			WHERE id = ?`,
+			string(message.Content.Value), nullIfEmpty(message.ReplyTo), message.SendAt, message.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update scheduled message: %w", err)
+		}
+		if err := scheduledRowAffected(res); err != nil {
+			return err
+		}
+		if err := tx.insertAttachments(ctx, scheduledMessageAttachments, message.ID, message.Attachments); err != nil {
+			return err
+		}
+		return tx.markBlobsForDeletion(ctx, removed)
+	})
+}
+
+// FailScheduledMessage marks a scheduled message as failed, so that it is not sent until it is updated.
+func (db *appdbimpl) FailScheduledMessage(ctx context.Context, id, reason string) error {
+	res, err := db.c.ExecContext(ctx, `UPDATE scheduled_messages SET status = 'failed', error = ? WHERE id = ?`, reason, id)
+	if err != nil {
+		return fmt.Errorf("failed to update scheduled message: %w", err)
+	}
+	return scheduledRowAffected(res)
+}
+
+// DeleteScheduledMessage removes a message from the queue, either because it was cancelled or because it was sent. Its
+// attachments are marked for deletion, and kept by SweepUnusedBlobs when the message was sent with them.
+func (db *appdbimpl) DeleteScheduledMessage(ctx context.Context, id string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		blobs, err := tx.attachmentBlobs(ctx, scheduledMessageAttachments, []string{id})
+		if err != nil {
+			return err
+		}
+		res, err := tx.c.ExecContext(ctx, `DELETE FROM scheduled_messages WHERE id = ?`, id)
+		if err != nil {
+			return fmt.Errorf("failed to delete scheduled message: %w", err)
+		}
+		if err := scheduledRowAffected(res); err != nil {
+			return err
+		}
+		return tx.markBlobsForDeletion(ctx, blobs)
+	})
+}
+
+// scheduledRowAffected returns schema.ErrScheduledMessageNotFound if the statement did not change any row.
+func scheduledRowAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to determine rows affected: %w", err)
+	}
+	if n == 0 {
+		return schema.ErrScheduledMessageNotFound
+	}
+	return nil
+}
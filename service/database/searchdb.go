@@ -0,0 +1,204 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// Markers wrapped around the matching words in the snippets of search results.
+const (
+	SnippetMatchStart = "<mark>"
+	SnippetMatchEnd   = "</mark>"
+)
+
+// MessageSearch describes a search of messages. Terms are matched against the content of the messages, while the
+// other fields filter the results. Empty fields are ignored.
+type MessageSearch struct {
+	// UserID is the user searching: only messages of conversations the user is a member of are returned
+	UserID string
+
+	Terms []SearchTerm
+
+	// From is the username of the sender
+	From string
+
+	// In is a conversation ID, a group name, or the username of the other member of a direct conversation
+	In string
+
+	HasPhoto bool
+	Before   time.Time
+	After    time.Time
+	Limit    int
+}
+
+// SearchTerm is a word or a phrase to look for. Prefix terms also match the words starting with Text.
+type SearchTerm struct {
+	Text   string
+	Prefix bool
+}
+
+// matchExpression returns the FTS5 query matching all the terms. Every term is quoted, so that the text typed by
+// users is never interpreted as FTS5 syntax.
+func (s MessageSearch) matchExpression() string {
+	parts := make([]string, 0, len(s.Terms))
+	for _, t := range s.Terms {
+		part := `"` + strings.ReplaceAll(t.Text, `"`, `""`) + `"`
+		if t.Prefix {
+			part += "*"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns, with the ESCAPE '\' clause.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchMessages returns the messages matching the search. Messages are ranked by relevance when there are terms to
+// match in the full-text index, and newest first otherwise. Without the index, terms match anywhere in the content,
+// ignoring case for ASCII letters only, and snippets are not highlighted.
+func (db *appdbimpl) SearchMessages(ctx context.Context, s MessageSearch) ([]schema.MessageSearchResult, error) {
+	if s.UserID == "" || s.Limit <= 0 {
+		return nil, fmt.Errorf("user ID and a positive limit are required")
+	}
+
+	fullText := db.fullText && len(s.Terms) > 0
+	var query string
+	var args []interface{}
+	if fullText {
+		query = `SELECT m.id, snippet(messages_fts, 0, ?, ?, '…', 16)
+		FROM messages_fts
+		JOIN messages m ON m.seq = messages_fts.rowid`
+		args = append(args, SnippetMatchStart, SnippetMatchEnd)
+	} else {
+		query = `SELECT m.id, m.content
+		FROM messages m`
+	}
+	query += `
+		JOIN users u ON u.id = m.senderId
+		JOIN conversations c ON c.id = m.conversationId
+		JOIN conversation_members cm ON cm.conversationId = m.conversationId AND cm.userId = ?
+		WHERE m.deletedAt IS NULL AND ` + notHiddenFor
+	args = append(args, s.UserID, s.UserID)
+
+	if fullText {
+		query += ` AND messages_fts MATCH ?`
+		args = append(args, s.matchExpression())
+	} else {
+		for _, t := range s.Terms {
+			query += ` AND m.content LIKE ? ESCAPE '\'`
+			args = append(args, "%"+likeEscaper.Replace(t.Text)+"%")
+		}
+	}
+	if s.From != "" {
+		query += ` AND u.username = ? COLLATE NOCASE`
+		args = append(args, s.From)
+	}
+	if s.In != "" {
+		query += ` AND (c.id = ?
+			OR (c.type = 'group' AND c.name = ? COLLATE NOCASE)
+			OR (c.type = 'direct' AND EXISTS (
+				SELECT 1 FROM conversation_members pm JOIN users pu ON pu.id = pm.userId
+				WHERE pm.conversationId = c.id AND pm.userId <> ? AND pu.username = ? COLLATE NOCASE)))`
+		args = append(args, s.In, s.In, s.UserID, s.In)
+	}
+	if s.HasPhoto {
+		query += ` AND EXISTS (SELECT 1 FROM message_attachments a WHERE a.message_id = m.id AND a.kind = 'image')`
+	}
+	// timestamps are stored in RFC 3339, which sorts chronologically as text
+	if !s.Before.IsZero() {
+		query += ` AND m.timestamp < ?`
+		args = append(args, s.Before.UTC().Format(time.RFC3339))
+	}
+	if !s.After.IsZero() {
+		query += ` AND m.timestamp >= ?`
+		args = append(args, s.After.UTC().Format(time.RFC3339))
+	}
+
+	if fullText {
+		query += ` ORDER BY bm25(messages_fts), m.timestamp DESC LIMIT ?`
+	} else {
+		query += ` ORDER BY m.timestamp DESC, m.seq DESC LIMIT ?`
+	}
+	args = append(args, s.Limit)
+
+	rows, err := db.c.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	snippets := make(map[string]string)
+	for rows.Next() {
+		var id, snippet string
+		if err := rows.Scan(&id, &snippet); err != nil {
+			return nil, fmt.Errorf("failed to scan search result: %w", err)
+		}
+		if !fullText {
+			snippet = quotePreview(snippet)
+		}
+		ids = append(ids, id)
+		snippets[id] = snippet
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading search results: %w", err)
+	}
+
+	messages, err := db.getMessagesByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]schema.MessageSearchResult, 0, len(ids))
+	for _, id := range ids {
+		if m := messages[id]; m != nil {
+			results = append(results, schema.MessageSearchResult{Message: m, Snippet: snippets[id]})
+		}
+	}
+	return results, nil
+}
+
+// getMessagesByIDs loads and decorates the messages with the given IDs, which can belong to different conversations.
+func (db *appdbimpl) getMessagesByIDs(ctx context.Context, ids []string) (map[string]*schema.Message, error) {
+	found := make(map[string]*schema.Message, len(ids))
+	if len(ids) == 0 {
+		return found, nil
+	}
+
+	placeholders := make([]string, 0, len(ids))
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		placeholders = append(placeholders, "?")
+		args = append(args, id)
+	}
+	query := `SELECT ` + messageColumns + `
+		FROM messages m
+		JOIN users u ON m.senderId = u.id
+		WHERE m.id IN (` + strings.Join(placeholders, ",") + `)`
+	rows, err := db.c.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages: %w", err)
+	}
+	defer rows.Close()
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// the delivery status depends on the members of each conversation
+	byConversation := make(map[string][]*schema.Message)
+	for _, m := range messages {
+		found[m.ID] = m
+		byConversation[m.ConversationID] = append(byConversation[m.ConversationID], m)
+	}
+	for conversationID, conversationMessages := range byConversation {
+		if err := db.decorateMessages(ctx, conversationID, conversationMessages); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,216 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// sessionColumns are the columns scanned by scanSession, for the sessions table aliased as s.
+const sessionColumns = `s.id, s.user_id, s.device_label, s.user_agent, s.ip, s.created_at, s.refreshed_at,
+	s.last_seen_at, s.expires_at, s.verified`
+
+func scanSession(row interface{ Scan(...interface{}) error }) (schema.Session, error) {
+	var s schema.Session
+	err := row.Scan(&s.ID, &s.UserID, &s.DeviceLabel, &s.UserAgent, &s.IP, &s.CreatedAt, &s.RefreshedAt, &s.LastSeenAt,
+		&s.ExpiresAt, &s.Verified)
+	return s, err
+}
+
+// CreateSession opens a session, with its first refresh token given by hash, valid until the session expires. The
+// session ID, user and times must be set; the device is optional.
+func (db *appdbimpl) CreateSession(ctx context.Context, session *schema.Session, refreshHash string) error {
+	if session.ID == "" || session.UserID == "" || session.CreatedAt == "" || session.ExpiresAt == "" || refreshHash == "" {
+		return fmt.Errorf("session ID, user ID, times and refresh token cannot be empty")
+	}
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		_, err := tx.c.ExecContext(ctx, `INSERT INTO sessions (id, user_id, device_label, user_agent, ip, created_at,
+				refreshed_at, last_seen_at, expires_at, verified)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, session.ID, session.UserID, session.DeviceLabel, session.UserAgent,
+			session.IP, session.CreatedAt, session.CreatedAt, session.CreatedAt, session.ExpiresAt, session.Verified)
+		if err != nil {
+			return fmt.Errorf("failed to create session: %w", err)
+		}
+		session.RefreshedAt = session.CreatedAt
+		session.LastSeenAt = session.CreatedAt
+		_, err = tx.c.ExecContext(ctx, `INSERT INTO refresh_tokens (hash, session_id, issued_at, expires_at)
+			VALUES (?, ?, ?, ?)`, refreshHash, session.ID, session.CreatedAt, session.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to store refresh token: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetSession returns a session that is open at `now`, or schema.ErrSessionNotFound. The sessions of deleted users
+// are not found.
+func (db *appdbimpl) GetSession(ctx context.Context, id string, now time.Time) (*schema.Session, error) {
+	s, err := scanSession(db.c.QueryRowContext(ctx, `SELECT `+sessionColumns+` FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.id = ? AND s.expires_at > ?`, id, now.UTC().Format(time.RFC3339)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, schema.ErrSessionNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load session: %w", err)
+	}
+	return &s, nil
+}
+
+// RefreshSession exchanges the refresh token given by hash for the one given by newHash, and extends the session
+// until expiresAt. Each refresh token can be exchanged once: presenting a used one means that it leaked, so the
+// session is closed, for whoever holds its tokens, and schema.ErrRefreshTokenReused is returned together with the
+// closed session. Unknown and expired refresh tokens are reported with schema.ErrSessionNotFound.
+func (db *appdbimpl) RefreshSession(ctx context.Context, hash, newHash string, now time.Time, expiresAt string) (*schema.Session, error) {
+	nowText := now.UTC().Format(time.RFC3339)
+	var session *schema.Session
+	var reused bool
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		var sessionID string
+		var usedAt sql.NullString
+		err := tx.c.QueryRowContext(ctx, `SELECT t.session_id, t.used_at FROM refresh_tokens t
+			JOIN sessions s ON s.id = t.session_id
+			WHERE t.hash = ? AND t.expires_at > ? AND s.expires_at > ?`, hash, nowText, nowText).Scan(&sessionID, &usedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return schema.ErrSessionNotFound
+		} else if err != nil {
+			return fmt.Errorf("failed to load refresh token: %w", err)
+		}
+
+		if !usedAt.Valid {
+			res, err := tx.c.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = ? WHERE hash = ? AND used_at IS NULL`, nowText, hash)
+			if err != nil {
+				return fmt.Errorf("failed to use refresh token: %w", err)
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("failed to use refresh token: %w", err)
+			}
+			reused = n == 0
+		} else {
+			reused = true
+		}
+		if reused {
+			// the session is closed when the transaction commits, and the error returned afterwards
+			if session, err = tx.GetSession(ctx, sessionID, now); err != nil {
+				return err
+			}
+			if _, err := tx.c.ExecContext(ctx, `DELETE FROM sessions WHERE id = ?`, sessionID); err != nil {
+				return fmt.Errorf("failed to close session: %w", err)
+			}
+			return nil
+		}
+
+		if _, err := tx.c.ExecContext(ctx, `INSERT INTO refresh_tokens (hash, session_id, issued_at, expires_at)
+			VALUES (?, ?, ?, ?)`, newHash, sessionID, nowText, expiresAt); err != nil {
+			return fmt.Errorf("failed to store refresh token: %w", err)
+		}
+		if _, err := tx.c.ExecContext(ctx, `UPDATE sessions SET refreshed_at = ?, last_seen_at = ?, expires_at = ?
+			WHERE id = ?`, nowText, nowText, expiresAt, sessionID); err != nil {
+			return fmt.Errorf("failed to extend session: %w", err)
+		}
+		session, err = tx.GetSession(ctx, sessionID, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return session, schema.ErrRefreshTokenReused
+	}
+	return session, nil
+}
+
+// GetUserSessions returns the sessions of a user that are open at `now`, the most recently seen first.
+func (db *appdbimpl) GetUserSessions(ctx context.Context, userID string, now time.Time) ([]schema.Session, error) {
+	rows, err := db.c.QueryContext(ctx, `SELECT `+sessionColumns+` FROM sessions s
+		WHERE s.user_id = ? AND s.expires_at > ?
+		ORDER BY s.last_seen_at DESC, s.created_at DESC`, userID, now.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []schema.Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read session: %w", err)
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// TouchSession records that a session was seen at `now`, from the given address and user agent.
+func (db *appdbimpl) TouchSession(ctx context.Context, id, ip, userAgent string, now time.Time) error {
+	_, err := db.c.ExecContext(ctx, `UPDATE sessions SET last_seen_at = ?, ip = ?, user_agent = ? WHERE id = ?`,
+		now.UTC().Format(time.RFC3339), ip, userAgent, id)
+	if err != nil {
+		return fmt.Errorf("failed to update session: %w", err)
+	}
+	return nil
+}
+
+// DeleteSession closes a session of a user, or returns schema.ErrSessionNotFound.
+func (db *appdbimpl) DeleteSession(ctx context.Context, userID, id string) error {
+	res, err := db.c.ExecContext(ctx, `DELETE FROM sessions WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to close session: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to close session: %w", err)
+	} else if n == 0 {
+		return schema.ErrSessionNotFound
+	}
+	return nil
+}
+
+// DeleteUserSessions closes every session of a user but `keepID`, which can be empty, and returns their number.
+func (db *appdbimpl) DeleteUserSessions(ctx context.Context, userID, keepID string) (int, error) {
+	res, err := db.c.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ? AND id != ?`, userID, keepID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to close sessions: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to close sessions: %w", err)
+	}
+	return int(n), nil
+}
+
+// DeleteExpiredSessions deletes up to limit sessions that expired at `now`, and the refresh tokens that expired, which
+// are no longer needed to detect their reuse. It returns the number of sessions deleted.
+func (db *appdbimpl) DeleteExpiredSessions(ctx context.Context, now time.Time, limit int) (int, error) {
+	if limit <= 0 {
+		return 0, fmt.Errorf("limit must be positive")
+	}
+
+	nowText := now.UTC().Format(time.RFC3339)
+	var deleted int64
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		res, err := tx.c.ExecContext(ctx, `DELETE FROM sessions WHERE id IN (
+				SELECT id FROM sessions WHERE expires_at <= ? ORDER BY expires_at LIMIT ?
+			)`, nowText, limit)
+		if err != nil {
+			return fmt.Errorf("failed to delete expired sessions: %w", err)
+		}
+		if deleted, err = res.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to delete expired sessions: %w", err)
+		}
+		if _, err := tx.c.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE expires_at <= ?`, nowText); err != nil {
+			return fmt.Errorf("failed to delete expired refresh tokens: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
@@ -0,0 +1,222 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dilcetto/wasa/service/components/schema"
+)
+
+// CreateUpload starts a resumable upload. The upload ID, user, length and times must be set.
+func (db *appdbimpl) CreateUpload(ctx context.Context, upload *schema.Upload) error {
+	if upload.ID == "" || upload.UserID == "" || upload.CreatedAt == "" || upload.ExpiresAt == "" {
+		return fmt.Errorf("upload ID, user ID and times cannot be empty")
+	}
+	_, err := db.c.ExecContext(ctx, `INSERT INTO uploads (id, user_id, length, filename, kind, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		upload.ID, upload.UserID, upload.Length, upload.Filename, upload.Kind, upload.CreatedAt, upload.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create upload: %w", err)
+	}
+	return nil
+}
+
+// GetUpload returns an upload, with its attachment once finalized, or schema.ErrUploadNotFound.
+func (db *appdbimpl) GetUpload(ctx context.Context, id string) (*schema.Upload, error) {
+	var u schema.Upload
+	var blobID sql.NullString
+	var mimeType string
+	var size int64
+	err := db.c.QueryRowContext(ctx, `SELECT id, user_id, length, received, filename, kind, created_at, expires_at,
+		       blob_id, mime_type, size
+		FROM uploads WHERE id = ?`, id).Scan(&u.ID, &u.UserID, &u.Length, &u.Offset, &u.Filename, &u.Kind,
+		&u.CreatedAt, &u.ExpiresAt, &blobID, &mimeType, &size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, schema.ErrUploadNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load upload: %w", err)
+	}
+	if !blobID.Valid {
+		return &u, nil
+	}
+
+	u.Attachment = &schema.Attachment{
+		BlobID:   blobID.String,
+		Kind:     u.Kind,
+		MimeType: mimeType,
+		Filename: u.Filename,
+		Size:     size,
+	}
+	images, err := db.imagesOf(ctx, []string{blobID.String})
+	if err != nil {
+		return nil, err
+	}
+	u.Attachment.ImageInfo = images[blobID.String]
+	return &u, nil
+}
+
+// AppendUploadChunk appends a chunk of content to an upload at offset, which must be the length of the content
+// received so far, and returns the new offset. A chunk that does not match the offset (schema.ErrUploadOffsetMismatch),
+// that goes past the length of the upload (schema.ErrUploadTooLarge), or sent after finalizing it
+// (schema.ErrUploadFinalized) is refused.
+func (db *appdbimpl) AppendUploadChunk(ctx context.Context, id string, offset int64, data []byte) (int64, error) {
+	var newOffset int64
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		var length, received int64
+		var finalized bool
+		err := tx.c.QueryRowContext(ctx, `SELECT length, received, blob_id IS NOT NULL FROM uploads WHERE id = ?`, id).
+			Scan(&length, &received, &finalized)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return schema.ErrUploadNotFound
+		case err != nil:
+			return fmt.Errorf("failed to load upload: %w", err)
+		case finalized:
+			return schema.ErrUploadFinalized
+		case offset != received:
+			return schema.ErrUploadOffsetMismatch
+		case offset+int64(len(data)) > length:
+			return schema.ErrUploadTooLarge
+		}
+
+		newOffset = offset + int64(len(data))
+		if len(data) == 0 {
+			return nil
+		}
+		if _, err := tx.c.ExecContext(ctx, `INSERT INTO upload_chunks (upload_id, start, data) VALUES (?, ?, ?)`, id, offset, data); err != nil {
+			return fmt.Errorf("failed to store upload chunk: %w", err)
+		}
+		if _, err := tx.c.ExecContext(ctx, `UPDATE uploads SET received = ? WHERE id = ?`, newOffset, id); err != nil {
+			return fmt.Errorf("failed to update upload: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newOffset, nil
+}
+
+// GetUploadContent returns the content received by an upload, which must be complete (schema.ErrUploadIncomplete)
+// and not finalized yet (schema.ErrUploadFinalized).
+func (db *appdbimpl) GetUploadContent(ctx context.Context, id string) ([]byte, error) {
+	upload, err := db.GetUpload(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Attachment != nil {
+		return nil, schema.ErrUploadFinalized
+	}
+	if upload.Offset != upload.Length {
+		return nil, schema.ErrUploadIncomplete
+	}
+
+	rows, err := db.c.QueryContext(ctx, `SELECT data FROM upload_chunks WHERE upload_id = ? ORDER BY start`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upload chunks: %w", err)
+	}
+	defer rows.Close()
+	content := bytes.NewBuffer(make([]byte, 0, upload.Length))
+	for rows.Next() {
+		var chunk []byte
+		if err := rows.Scan(&chunk); err != nil {
+			return nil, fmt.Errorf("failed to scan upload chunk: %w", err)
+		}
+		content.Write(chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading upload chunks: %w", err)
+	}
+	return content.Bytes(), nil
+}
+
+// FinalizeUpload records the attachment an upload was turned into, and deletes the chunks of content it received. An
+// upload is finalized once: it returns schema.ErrUploadFinalized when finalized already.
+func (db *appdbimpl) FinalizeUpload(ctx context.Context, id string, attachment schema.Attachment) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		res, err := tx.c.ExecContext(ctx, `UPDATE uploads SET blob_id = ?, kind = ?, mime_type = ?, size = ?
+			WHERE id = ? AND blob_id IS NULL`, attachment.BlobID, attachment.Kind, attachment.MimeType, attachment.Size, id)
+		if err != nil {
+			return fmt.Errorf("failed to finalize upload: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to finalize upload: %w", err)
+		} else if n == 0 {
+			if _, err := tx.GetUpload(ctx, id); err != nil {
+				return err
+			}
+			return schema.ErrUploadFinalized
+		}
+		if _, err := tx.c.ExecContext(ctx, `DELETE FROM upload_chunks WHERE upload_id = ?`, id); err != nil {
+			return fmt.Errorf("failed to delete upload chunks: %w", err)
+		}
+		return nil
+	})
+}
+
+// DeleteUpload cancels an upload. The blob of a finalized upload is marked for deletion, see SweepUnusedBlobs.
+func (db *appdbimpl) DeleteUpload(ctx context.Context, id string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		var blobID sql.NullString
+		err := tx.c.QueryRowContext(ctx, `DELETE FROM uploads WHERE id = ? RETURNING blob_id`, id).Scan(&blobID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return schema.ErrUploadNotFound
+		} else if err != nil {
+			return fmt.Errorf("failed to delete upload: %w", err)
+		}
+		if blobID.Valid {
+			return tx.markBlobsForDeletion(ctx, []string{blobID.String})
+		}
+		return nil
+	})
+}
+
+// DeleteExpiredUploads deletes up to limit uploads that expired at `now`, whether finalized or not, and returns their
+// number. The blobs of finalized uploads are marked for deletion, see SweepUnusedBlobs: messages sent with them keep
+// their attachment.
+func (db *appdbimpl) DeleteExpiredUploads(ctx context.Context, now time.Time, limit int) (int, error) {
+	if limit <= 0 {
+		return 0, fmt.Errorf("limit must be positive")
+	}
+
+	var deleted int
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		rows, err := tx.c.QueryContext(ctx, `DELETE FROM uploads WHERE id IN (
+				SELECT id FROM uploads WHERE expires_at <= ? ORDER BY expires_at LIMIT ?
+			) RETURNING blob_id`, now.UTC().Format(time.RFC3339), limit)
+		if err != nil {
+			return fmt.Errorf("failed to delete expired uploads: %w", err)
+		}
+		defer rows.Close()
+
+		var blobs []string
+		seen := make(map[string]bool)
+		for rows.Next() {
+			var blobID sql.NullString
+			if err := rows.Scan(&blobID); err != nil {
+				return fmt.Errorf("failed to scan expired upload: %w", err)
+			}
+			deleted++
+			if blobID.Valid && !seen[blobID.String] {
+				seen[blobID.String] = true
+				blobs = append(blobs, blobID.String)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error reading expired uploads: %w", err)
+		}
+		if err := rows.Close(); err != nil {
+			return fmt.Errorf("failed to close expired uploads: %w", err)
+		}
+
+		return tx.markBlobsForDeletion(ctx, blobs)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -8,52 +9,62 @@ import (
 	"github.com/dilcetto/wasa/service/components/schema"
 )
 
-var ErrUserDoesNotExist = errors.New("user does not exist")
-var ErrUsernameTaken = errors.New("username already exists")
+// ErrUserDoesNotExist and ErrUsernameTaken are the schema errors, kept here for the callers of the user methods.
+var (
+	ErrUserDoesNotExist = schema.ErrUserDoesNotExist
+	ErrUsernameTaken    = schema.ErrUsernameTaken
+)
 
-func (db *appdbimpl) CreateUser(u *schema.User) error {
+func (db *appdbimpl) CreateUser(ctx context.Context, u *schema.User) error {
 	// Check if user with the same name already exists
 	var exists bool
-	err := db.c.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", u.Username).Scan(&exists)
+	err := db.c.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", u.Username).Scan(&exists)
 	if err != nil {
 		return fmt.Errorf("failed to check if username exists: %w", err)
 	}
 	if exists {
-		return fmt.Errorf("username %s already exists", u.Username)
+		return ErrUsernameTaken
 	}
 
 	// Attempt to insert the new user
-	_, err = db.c.Exec("INSERT INTO users(id, username, photo) VALUES (?, ?, ?)", u.ID, u.Username, u.Photo)
+	_, err = db.c.ExecContext(ctx, "INSERT INTO users(id, username, photoBlobId) VALUES (?, ?, ?)", u.ID, u.Username, nullIfEmpty(u.PhotoID))
 	if err != nil {
 		return fmt.Errorf("failed to create user %s: %w", u.Username, err)
 	}
 	return nil
 }
 
-func (db *appdbimpl) GetUserByName(username string) (*schema.User, error) {
+func (db *appdbimpl) GetUserByName(ctx context.Context, username string) (*schema.User, error) {
 	var u schema.User
-	err := db.c.QueryRow("SELECT id, username, photo FROM users WHERE username = ?", username).Scan(&u.ID, &u.Username, &u.Photo)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, ErrUserDoesNotExist
-		}
+	err := db.c.QueryRowContext(ctx, "SELECT id, username, COALESCE(photoBlobId, '') FROM users WHERE username = ?", username).Scan(&u.ID, &u.Username, &u.PhotoID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserDoesNotExist
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if err := db.loadUserPhotos(ctx, []*schema.User{&u}); err != nil {
 		return nil, err
 	}
 	return &u, nil
 }
 
-func (db *appdbimpl) GetUserById(userID string) (*schema.User, error) {
+func (db *appdbimpl) GetUserById(ctx context.Context, userID string) (*schema.User, error) {
 	var user schema.User
-	err := db.c.QueryRow("SELECT id, username, photo FROM users WHERE id = ?", userID).Scan(&user.ID, &user.Username, &user.Photo)
-	if err != nil {
+	err := db.c.QueryRowContext(ctx, "SELECT id, username, COALESCE(photoBlobId, '') FROM users WHERE id = ?", userID).Scan(&user.ID, &user.Username, &user.PhotoID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserDoesNotExist
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if err := db.loadUserPhotos(ctx, []*schema.User{&user}); err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
-func (db *appdbimpl) SearchUserByUsername(username string) ([]schema.User, error) {
+func (db *appdbimpl) SearchUserByUsername(ctx context.Context, username string) ([]schema.User, error) {
 	var users []schema.User
-	rows, err := db.c.Query("SELECT id, username, photo FROM users WHERE username LIKE ?", "%"+username+"%")
+	rows, err := db.c.QueryContext(ctx, "SELECT id, username, COALESCE(photoBlobId, '') FROM users WHERE username LIKE ?", "%"+username+"%")
 	if err != nil {
 		return nil, fmt.Errorf("failed to search users by username: %w", err)
 	}
@@ -61,7 +72,7 @@ func (db *appdbimpl) SearchUserByUsername(username string) ([]schema.User, error
 
 	for rows.Next() {
 		var u schema.User
-		if err := rows.Scan(&u.ID, &u.Username, &u.Photo); err != nil {
+		if err := rows.Scan(&u.ID, &u.Username, &u.PhotoID); err != nil {
 			return nil, fmt.Errorf("failed to scan user: %w", err)
 		}
 		users = append(users, u)
@@ -69,20 +80,28 @@ func (db *appdbimpl) SearchUserByUsername(username string) ([]schema.User, error
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating over users: %w", err)
 	}
+
+	ptrs := make([]*schema.User, len(users))
+	for i := range users {
+		ptrs[i] = &users[i]
+	}
+	if err := db.loadUserPhotos(ctx, ptrs); err != nil {
+		return nil, err
+	}
 	return users, nil
 }
 
-func (db *appdbimpl) UpdateUsername(userId, newName string) error {
+func (db *appdbimpl) UpdateUsername(ctx context.Context, userId, newName string) error {
 	// check for username collision before updating
 	var exists bool
-	if err := db.c.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = ? AND id <> ?)`, newName, userId).Scan(&exists); err != nil {
+	if err := db.c.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE username = ? AND id <> ?)`, newName, userId).Scan(&exists); err != nil {
 		return err
 	}
 	if exists {
 		return ErrUsernameTaken
 	}
 
-	res, err := db.c.Exec(`UPDATE users SET username=? WHERE id=?`, newName, userId)
+	res, err := db.c.ExecContext(ctx, `UPDATE users SET username=? WHERE id=?`, newName, userId)
 	if err != nil {
 		return err
 	}
@@ -95,15 +114,15 @@ func (db *appdbimpl) UpdateUsername(userId, newName string) error {
 	return nil
 }
 
-func (db *appdbimpl) UpdateUserPhoto(userID string, photo []byte) error {
+func (db *appdbimpl) UpdateUserPhoto(ctx context.Context, userID, photoBlobID string) error {
 	var exists bool
-	err := db.c.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id=?)`, userID).Scan(&exists)
+	err := db.c.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE id=?)`, userID).Scan(&exists)
 	if err != nil {
 		return err
 	}
 	if !exists {
 		return ErrUserDoesNotExist
 	}
-	_, err = db.c.Exec(`UPDATE users SET photo=? WHERE id=?`, photo, userID)
+	_, err = db.c.ExecContext(ctx, `UPDATE users SET photoBlobId=? WHERE id=?`, photoBlobID, userID)
 	return err
 }
@@ -0,0 +1,80 @@
+package events
+
+// Types of the events published to clients.
+const (
+	ConversationCreated = "conversation.created"
+	MessageCreated      = "message.created"
+	MessageEdited       = "message.edited"
+	MessageDeleted      = "message.deleted"
+	MessageHidden       = "message.hidden"
+	ReactionChanged     = "reaction.changed"
+	ReceiptUpdated      = "receipt.updated"
+	ConversationRead    = "conversation.read"
+	ConversationUpdated = "conversation.updated"
+	GroupUpdated        = "group.updated"
+	MemberJoined        = "member.joined"
+	MemberLeft          = "member.left"
+	MemberUpdated       = "member.updated"
+)
+
+// Event is a change in a conversation, as sent to clients. Data depends on Type: it is a schema.Message for
+// MessageCreated and MessageEdited, a schema.Conversation for ConversationCreated, and one of the structures below for
+// the other types.
+type Event struct {
+	Type           string      `json:"type"`
+	ConversationID string      `json:"conversationId"`
+	Timestamp      string      `json:"timestamp"`
+	Data           interface{} `json:"data,omitempty"`
+}
+
+// MessageData identifies a message, for MessageDeleted and MessageHidden events. Tombstone is set when the message was
+// deleted for everyone and stays in the timeline as deleted; otherwise it is gone, e.g. because it expired.
+// MessageHidden events are only sent to the user who deleted the message for themselves.
+type MessageData struct {
+	MessageID string `json:"messageId"`
+	Tombstone bool   `json:"tombstone,omitempty"`
+}
+
+// ReactionData is the reaction of a user to a message, for ReactionChanged events. An empty Emoji means that the
+// reaction was removed.
+type ReactionData struct {
+	MessageID string `json:"messageId"`
+	UserID    string `json:"userId"`
+	Emoji     string `json:"emoji,omitempty"`
+}
+
+// ReceiptData is the new delivery status of a message for a user, for ReceiptUpdated events.
+type ReceiptData struct {
+	MessageID string `json:"messageId"`
+	UserID    string `json:"userId"`
+	Status    string `json:"status"`
+}
+
+// ReadData is the message up to which a user has read the conversation, for ConversationRead events.
+type ReadData struct {
+	UserID    string `json:"userId"`
+	MessageID string `json:"messageId"`
+}
+
+// SettingsData is the new settings of a conversation and the member who changed them, for ConversationUpdated events.
+type SettingsData struct {
+	UserID     string `json:"userId"`
+	MessageTTL int    `json:"messageTtl"`
+}
+
+// GroupData lists the group fields that changed, for GroupUpdated events. The photo itself is not sent: clients load
+// it from the media endpoint.
+type GroupData struct {
+	GroupName string `json:"groupName,omitempty"`
+	PhotoID   string `json:"photoId,omitempty"`
+
+	// SlowMode is the new slow mode of the group in seconds, 0 when it was turned off
+	SlowMode *int `json:"slowMode,omitempty"`
+}
+
+// MemberData is a member of a group, for MemberJoined, MemberLeft and MemberUpdated events.
+type MemberData struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username,omitempty"`
+	Role     string `json:"role,omitempty"`
+}
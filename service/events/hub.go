@@ -0,0 +1,185 @@
+/*
+Package events contains the in-process hub that delivers real-time events to connected clients.
+
+Each connected client opens a Session for its user; the API publishes an Event to a list of users (usually the members
+of a conversation) and the Hub fans it out to every open session of those users. The Hub does not know anything about
+the transport: the api package streams the session events over a WebSocket. Sessions remember the authentication
+session (the device) they were opened with, so that signing a device out disconnects it at once.
+
+Example:
+
+	hub := events.NewHub()
+	defer hub.Close()
+
+	session := hub.Subscribe(userID, authSessionID)
+	defer hub.Unsubscribe(session)
+
+	for ev := range session.Events() {
+		// send ev to the client
+	}
+*/
+package events
+
+import (
+	"sync"
+)
+
+// sessionBuffer is the number of events queued for a session. A session that falls this much behind is dropped, and
+// the client is expected to reconnect and reload its state.
+const sessionBuffer = 64
+
+// Hub keeps the open sessions of every user and fans out events to them. It is safe for concurrent use.
+type Hub struct {
+	mu       sync.RWMutex
+	sessions map[string]map[*Session]struct{}
+	closed   bool
+}
+
+// Session is a single connection of a user to the Hub.
+type Session struct {
+	UserID        string
+	AuthSessionID string
+
+	events    chan Event
+	once      sync.Once
+	signedOut bool
+}
+
+// NewHub returns a new, empty Hub.
+func NewHub() *Hub {
+	return &Hub{sessions: make(map[string]map[*Session]struct{})}
+}
+
+// Events returns the channel where the session receives its events. The channel is closed when the session is
+// unsubscribed, dropped for being too slow, or when the Hub is closed.
+func (s *Session) Events() <-chan Event {
+	return s.events
+}
+
+// SignedOut reports whether the session was closed by Disconnect or DisconnectAll. It is only meaningful once the
+// events channel is closed.
+func (s *Session) SignedOut() bool {
+	return s.signedOut
+}
+
+func (s *Session) close() {
+	s.once.Do(func() { close(s.events) })
+}
+
+// Subscribe opens a new session for the user, connected with the authentication session authSessionID. If the Hub is
+// already closed, the returned session is closed too.
+func (h *Hub) Subscribe(userID, authSessionID string) *Session {
+	s := &Session{UserID: userID, AuthSessionID: authSessionID, events: make(chan Event, sessionBuffer)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		s.close()
+		return s
+	}
+	if h.sessions[userID] == nil {
+		h.sessions[userID] = make(map[*Session]struct{})
+	}
+	h.sessions[userID][s] = struct{}{}
+	return s
+}
+
+// Unsubscribe closes the session and removes it from the Hub.
+func (h *Hub) Unsubscribe(s *Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+// remove must be called with the write lock held.
+func (h *Hub) remove(s *Session) {
+	if userSessions, ok := h.sessions[s.UserID]; ok {
+		delete(userSessions, s)
+		if len(userSessions) == 0 {
+			delete(h.sessions, s.UserID)
+		}
+	}
+	s.close()
+}
+
+// Disconnect closes the sessions of the user connected with one of the authentication sessions, which were signed out.
+func (h *Hub) Disconnect(userID string, authSessionIDs ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.sessions[userID] {
+		for _, id := range authSessionIDs {
+			if s.AuthSessionID == id {
+				s.signedOut = true
+				h.remove(s)
+				break
+			}
+		}
+	}
+}
+
+// DisconnectAll closes every session of the user, except those connected with keepAuthSessionID if not empty, as the
+// user was signed out of every other device.
+func (h *Hub) DisconnectAll(userID, keepAuthSessionID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.sessions[userID] {
+		if keepAuthSessionID == "" || s.AuthSessionID != keepAuthSessionID {
+			s.signedOut = true
+			h.remove(s)
+		}
+	}
+}
+
+// Publish sends the event to every open session of the given users. Sessions whose buffer is full are dropped.
+func (h *Hub) Publish(userIDs []string, ev Event) {
+	var slow []*Session
+
+	h.mu.RLock()
+	seen := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		for s := range h.sessions[userID] {
+			select {
+			case s.events <- ev:
+			default:
+				slow = append(slow, s)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	if len(slow) > 0 {
+		h.mu.Lock()
+		for _, s := range slow {
+			h.remove(s)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// SessionCount returns the number of open sessions.
+func (h *Hub) SessionCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for _, userSessions := range h.sessions {
+		n += len(userSessions)
+	}
+	return n
+}
+
+// Close closes every open session. Sessions opened after Close are closed immediately.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for _, userSessions := range h.sessions {
+		for s := range userSessions {
+			s.close()
+		}
+	}
+	h.sessions = make(map[string]map[*Session]struct{})
+}
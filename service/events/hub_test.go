@@ -0,0 +1,32 @@
+package events
+
+import "testing"
+
+func TestDisconnect(t *testing.T) {
+	hub := NewHub()
+	defer hub.Close()
+
+	phone := hub.Subscribe("u1", "phone")
+	laptop := hub.Subscribe("u1", "laptop")
+	other := hub.Subscribe("u2", "phone")
+
+	hub.Disconnect("u1", "phone")
+	if _, ok := <-phone.Events(); ok || !phone.SignedOut() {
+		t.Error("the session of the signed out device is still open")
+	}
+	hub.Publish([]string{"u1", "u2"}, Event{Type: MessageCreated})
+	if _, ok := <-laptop.Events(); !ok {
+		t.Error("the session of another device was closed")
+	}
+	if _, ok := <-other.Events(); !ok {
+		t.Error("the session of another user was closed")
+	}
+
+	hub.DisconnectAll("u1", "")
+	if _, ok := <-laptop.Events(); ok || !laptop.SignedOut() {
+		t.Error("a session is still open after signing out of every device")
+	}
+	if n := hub.SessionCount(); n != 1 {
+		t.Errorf("%d sessions are open, want 1", n)
+	}
+}
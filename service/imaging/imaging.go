@@ -0,0 +1,187 @@
+/*
+Package imaging validates and normalizes the images uploaded by users: profile photos, group photos and images sent in
+messages.
+
+Process decodes an image (JPEG, PNG, GIF or WebP), applies its EXIF orientation and encodes it again, which drops EXIF,
+GPS and any other metadata of the upload. PNG images stay PNG, while JPEG and WebP images are encoded as JPEG, or as PNG
+when they have transparent pixels. Images larger than the limit of their Profile are scaled down, and a
+thumbnail that fits in ThumbnailSize×ThumbnailSize pixels is generated for each of them.
+
+Example:
+
+	img, err := imaging.Process(data, imaging.Avatar)
+	if errors.Is(err, imaging.ErrUnsupportedImage) {
+		...
+	}
+	id, err := store.Put(ctx, img.Data)
+	thumbnailID, err := store.Put(ctx, img.Thumbnail)
+*/
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // registers the WebP decoder
+)
+
+const (
+	// ThumbnailSize is the largest width and height of a thumbnail, in pixels
+	ThumbnailSize = 320
+
+	// maxPixels is the largest number of pixels of an image accepted, checked before decoding it
+	maxPixels = 40_000_000
+
+	// jpegQuality is the quality of the JPEG images encoded by Process
+	jpegQuality = 85
+)
+
+// ErrUnsupportedImage is returned by Process when the content is not an image in one of the supported formats.
+var ErrUnsupportedImage = errors.New("unsupported image format: use JPEG, PNG, GIF or WebP")
+
+// ErrImageTooLarge is returned by Process when the image has too many pixels to be decoded safely.
+var ErrImageTooLarge = errors.New("image dimensions are too large")
+
+// Profile is how an image is processed, depending on where it is used.
+type Profile struct {
+	// MaxSize is the largest width and height of the processed image, in pixels; larger images are scaled down
+	MaxSize int
+}
+
+var (
+	// Avatar is the profile of profile photos and group photos
+	Avatar = Profile{MaxSize: 1024}
+
+	// MessageImage is the profile of images sent in messages
+	MessageImage = Profile{MaxSize: 2560}
+)
+
+// Image is a processed image.
+type Image struct {
+	Data     []byte
+	MimeType string
+	Width    int
+	Height   int
+
+	// Thumbnail is the content of the thumbnail, a JPEG image, or a PNG image for images with transparency. It is
+	// Data itself when the image already fits in the size of thumbnails.
+	Thumbnail []byte
+}
+
+// Process validates an image and returns it without metadata, oriented and scaled down according to the profile,
+// together with its thumbnail. GIF images are kept as they are, as they carry no EXIF data and encoding them again
+// would lose their animation; their thumbnail shows the first frame.
+func Process(data []byte, profile Profile) (*Image, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrUnsupportedImage
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, ErrImageTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedImage, err)
+	}
+
+	if format == "gif" {
+		b := src.Bounds()
+		result := &Image{Data: data, MimeType: "image/gif", Width: b.Dx(), Height: b.Dy()}
+		if result.Thumbnail, err = thumbnail(src, data); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	if format == "jpeg" {
+		src = orient(src, jpegOrientation(data))
+	}
+	src = fit(src, profile.MaxSize)
+
+	result := &Image{Width: src.Bounds().Dx(), Height: src.Bounds().Dy()}
+	if result.Data, result.MimeType, err = encode(src, format == "png"); err != nil {
+		return nil, err
+	}
+	if result.Thumbnail, err = thumbnail(src, result.Data); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// thumbnail returns the thumbnail of an image, or its encoded content when it already fits in the size of thumbnails.
+func thumbnail(src image.Image, encoded []byte) ([]byte, error) {
+	b := src.Bounds()
+	if b.Dx() <= ThumbnailSize && b.Dy() <= ThumbnailSize {
+		return encoded, nil
+	}
+	data, _, err := encode(fit(src, ThumbnailSize), false)
+	return data, err
+}
+
+// fit scales an image down, keeping its aspect ratio, so that it fits in size×size pixels. Smaller images are returned
+// as they are.
+func fit(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	if w >= h {
+		h = max(1, h*size/w)
+		w = size
+	} else {
+		w = max(1, w*size/h)
+		h = size
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
+
+// encode encodes an image as PNG when asked to or when it has transparent pixels, and as JPEG otherwise.
+func encode(img image.Image, lossless bool) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if lossless || !opaque(img) {
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, "", fmt.Errorf("failed to encode image: %w", err)
+		}
+		return buf.Bytes(), "image/png", nil
+	}
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, "", fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), "image/jpeg", nil
+}
+
+// opaque reports whether all the pixels of an image are opaque.
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
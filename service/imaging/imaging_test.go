@@ -0,0 +1,234 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+var (
+	red   = color.NRGBA{R: 0xff, A: 0xff}
+	green = color.NRGBA{G: 0xff, A: 0xff}
+	blue  = color.NRGBA{B: 0xff, A: 0xff}
+	white = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+)
+
+// halves returns an opaque image of w×h pixels, red on its left half and blue on its right half.
+func halves(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.SetNRGBA(x, y, red)
+			} else {
+				img.SetNRGBA(x, y, blue)
+			}
+		}
+	}
+	return img
+}
+
+// quadrants returns an opaque image of w×h pixels, red, blue, green and white from its top left quadrant clockwise.
+func quadrants(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			switch {
+			case x < w/2 && y < h/2:
+				img.SetNRGBA(x, y, red)
+			case y < h/2:
+				img.SetNRGBA(x, y, blue)
+			case x < w/2:
+				img.SetNRGBA(x, y, white)
+			default:
+				img.SetNRGBA(x, y, green)
+			}
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withExif returns a JPEG image with an EXIF segment holding the orientation, in the byte order, followed by extra.
+func withExif(data []byte, order binary.ByteOrder, orientation uint16, extra string) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112) // orientation
+	order.PutUint16(tiff[12:], 3)      // SHORT
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+	segment := append(append([]byte("Exif\x00\x00"), tiff...), extra...)
+
+	out := []byte{0xff, 0xd8, 0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(out[4:], uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+// expectColor checks that the pixel of an image is close to the color, as JPEG encoding is lossy.
+func expectColor(t *testing.T, img image.Image, x, y int, want color.NRGBA) {
+	t.Helper()
+	got := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+	near := func(a, b uint8) bool { return int(a)-int(b) < 0x30 && int(b)-int(a) < 0x30 }
+	if !near(got.R, want.R) || !near(got.G, want.G) || !near(got.B, want.B) {
+		t.Errorf("pixel (%d, %d) is %v, want %v", x, y, got, want)
+	}
+}
+
+func decode(t *testing.T, data []byte) (image.Image, string) {
+	t.Helper()
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decoding processed image: %v", err)
+	}
+	return img, format
+}
+
+func TestProcessScalesDown(t *testing.T) {
+	for _, tc := range []struct {
+		name                    string
+		data                    []byte
+		profile                 Profile
+		mimeType                string
+		width, height           int
+		thumbWidth, thumbHeight int
+	}{
+		{"landscape PNG", encodePNG(t, halves(2000, 1000)), Avatar, "image/png", 1024, 512, 320, 160},
+		{"portrait JPEG", encodeJPEG(t, halves(400, 3000)), Avatar, "image/jpeg", 136, 1024, 42, 320},
+		{"fits", encodeJPEG(t, halves(2000, 1000)), MessageImage, "image/jpeg", 2000, 1000, 320, 160},
+		{"smaller than a thumbnail", encodePNG(t, halves(100, 50)), Avatar, "image/png", 100, 50, 100, 50},
+	} {
+		img, err := Process(tc.data, tc.profile)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if img.MimeType != tc.mimeType || img.Width != tc.width || img.Height != tc.height {
+			t.Errorf("%s: got a %s of %d×%d, want a %s of %d×%d", tc.name, img.MimeType, img.Width, img.Height,
+				tc.mimeType, tc.width, tc.height)
+		}
+		decoded, format := decode(t, img.Data)
+		if b := decoded.Bounds(); b.Dx() != tc.width || b.Dy() != tc.height || "image/"+format != tc.mimeType {
+			t.Errorf("%s: the data is a %s of %d×%d", tc.name, format, b.Dx(), b.Dy())
+		}
+		expectColor(t, decoded, 0, 0, red)
+		expectColor(t, decoded, tc.width-1, tc.height-1, blue)
+
+		thumb, _ := decode(t, img.Thumbnail)
+		if b := thumb.Bounds(); b.Dx() != tc.thumbWidth || b.Dy() != tc.thumbHeight {
+			t.Errorf("%s: the thumbnail is %d×%d, want %d×%d", tc.name, b.Dx(), b.Dy(), tc.thumbWidth, tc.thumbHeight)
+		}
+		if fits := tc.width <= ThumbnailSize && tc.height <= ThumbnailSize; fits != bytes.Equal(img.Thumbnail, img.Data) {
+			t.Errorf("%s: the thumbnail is the image itself: %v, want %v", tc.name, !fits, fits)
+		}
+	}
+}
+
+// TestProcessStripsExif checks that the EXIF orientation is applied to the pixels, and that the metadata is dropped.
+func TestProcessStripsExif(t *testing.T) {
+	// orientation 6 is displayed rotated 90° clockwise: the red top left quadrant ends up top right
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := withExif(encodeJPEG(t, quadrants(40, 20)), order, 6, "GPS 45.4642N 9.1900E")
+		if got := jpegOrientation(data); got != 6 {
+			t.Fatalf("%v: read orientation %d, want 6", order, got)
+		}
+		img, err := Process(data, Avatar)
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		if img.Width != 20 || img.Height != 40 {
+			t.Errorf("%v: got %d×%d, want 20×40", order, img.Width, img.Height)
+		}
+		if bytes.Contains(img.Data, []byte("Exif")) || bytes.Contains(img.Data, []byte("GPS")) {
+			t.Errorf("%v: the processed image still has its metadata", order)
+		}
+		decoded, _ := decode(t, img.Data)
+		expectColor(t, decoded, 5, 5, white)
+		expectColor(t, decoded, 15, 5, red)
+		expectColor(t, decoded, 5, 35, green)
+		expectColor(t, decoded, 15, 35, blue)
+	}
+
+	for orientation, size := range map[uint16][2]int{1: {40, 20}, 3: {40, 20}, 5: {20, 40}, 8: {20, 40}, 9: {40, 20}} {
+		img, err := Process(withExif(encodeJPEG(t, halves(40, 20)), binary.BigEndian, orientation, ""), Avatar)
+		if err != nil {
+			t.Fatalf("orientation %d: %v", orientation, err)
+		}
+		if img.Width != size[0] || img.Height != size[1] {
+			t.Errorf("orientation %d: got %d×%d, want %d×%d", orientation, img.Width, img.Height, size[0], size[1])
+		}
+	}
+}
+
+// TestProcessGIF checks that GIF images are kept as they are, with a thumbnail of their first frame.
+func TestProcessGIF(t *testing.T) {
+	palette := color.Palette{red, blue}
+	frame := image.NewPaletted(image.Rect(0, 0, 640, 480), palette)
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Process(buf.Bytes(), Avatar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.MimeType != "image/gif" || !bytes.Equal(img.Data, buf.Bytes()) {
+		t.Errorf("the GIF image was encoded again as %s", img.MimeType)
+	}
+	thumb, format := decode(t, img.Thumbnail)
+	if b := thumb.Bounds(); format != "jpeg" || b.Dx() != 320 || b.Dy() != 240 {
+		t.Errorf("the thumbnail is a %s of %d×%d, want a jpeg of 320×240", format, b.Dx(), b.Dy())
+	}
+}
+
+func TestProcessErrors(t *testing.T) {
+	// a valid PNG header announcing more pixels than accepted, with no image data after it
+	huge := encodePNG(t, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	binary.BigEndian.PutUint32(huge[16:], 10000)
+	binary.BigEndian.PutUint32(huge[20:], 10000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+
+	for name, tc := range map[string]struct {
+		data []byte
+		want error
+	}{
+		"text":      {[]byte("not an image"), ErrUnsupportedImage},
+		"truncated": {encodePNG(t, halves(10, 10))[:60], ErrUnsupportedImage},
+		"too large": {huge, ErrImageTooLarge},
+	} {
+		if _, err := Process(tc.data, Avatar); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", name, err, tc.want)
+		}
+	}
+}
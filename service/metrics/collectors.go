@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets suited to request and query latencies, in seconds.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// CounterVec is a counter with labels, for totals that only go up (requests served, messages sent, ...).
+type CounterVec struct {
+	name   string
+	labels *labelSet
+}
+
+// Counter is the series of a CounterVec for some label values.
+type Counter struct {
+	v value
+}
+
+// NewCounterVec registers a counter with the given label names.
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{name: name, labels: newLabelSet(labelNames)}
+	register(name, help, "counter", c)
+	return c
+}
+
+// With returns the counter of the label values, given in the order of the label names.
+func (c *CounterVec) With(labelValues ...string) *Counter {
+	return c.labels.get(labelValues, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add adds delta, which must not be negative, to the counter.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.v.add(delta)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.labels.each(func(labels []string, series interface{}) {
+		writeSample(w, c.name, labels, series.(*Counter).v.get())
+	})
+}
+
+// GaugeVec is a gauge with labels, for values that go up and down (open connections, queue lengths, ...).
+type GaugeVec struct {
+	name   string
+	labels *labelSet
+}
+
+// Gauge is the series of a GaugeVec for some label values.
+type Gauge struct {
+	v value
+}
+
+// NewGaugeVec registers a gauge with the given label names.
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{name: name, labels: newLabelSet(labelNames)}
+	register(name, help, "gauge", g)
+	return g
+}
+
+// With returns the gauge of the label values, given in the order of the label names.
+func (g *GaugeVec) With(labelValues ...string) *Gauge {
+	return g.labels.get(labelValues, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+// Set sets the gauge to f.
+func (g *Gauge) Set(f float64) {
+	g.v.set(f)
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.labels.each(func(labels []string, series interface{}) {
+		writeSample(w, g.name, labels, series.(*Gauge).v.get())
+	})
+}
+
+// HistogramVec is a histogram with labels, counting observations (usually durations, in seconds) in buckets.
+type HistogramVec struct {
+	name    string
+	buckets []float64
+	labels  *labelSet
+}
+
+// Histogram is the series of a HistogramVec for some label values.
+type Histogram struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a histogram with the given upper bounds of the buckets, which DefaultBuckets suits for
+// latencies, and label names.
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{name: name, buckets: buckets, labels: newLabelSet(labelNames)}
+	register(name, help, "histogram", h)
+	return h
+}
+
+// With returns the histogram of the label values, given in the order of the label names.
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	return h.labels.get(labelValues, func() interface{} {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	}).(*Histogram)
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(f float64) {
+	// the first bucket whose upper bound is at least f
+	i := sort.SearchFloat64s(h.buckets, f)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += f
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.labels.each(func(labels []string, series interface{}) {
+		s := series.(*Histogram)
+		s.mu.Lock()
+		counts := append([]uint64(nil), s.counts...)
+		count, sum := s.count, s.sum
+		s.mu.Unlock()
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += counts[i]
+			writeSample(w, h.name+"_bucket", append(labels, `le="`+formatFloat(upper)+`"`), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", append(labels, `le="+Inf"`), float64(count))
+		writeSample(w, h.name+"_sum", labels, sum)
+		writeSample(w, h.name+"_count", labels, float64(count))
+	})
+}
@@ -0,0 +1,173 @@
+/*
+Package metrics collects counters, gauges and histograms and exposes them in the Prometheus text format.
+
+Like expvar, metrics are created once, usually in package-level variables, and registered in a process-wide registry
+that Handler serves. Every metric has a fixed list of label names; the series of each combination of label values is
+created the first time it is used.
+
+Example:
+
+	var requests = metrics.NewCounterVec("app_requests_total", "Requests served.", "route")
+
+	requests.With("/login").Inc()
+
+	mux.Handle("/metrics", metrics.Handler())
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// contentType is the content type of the Prometheus text exposition format
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// family is a metric with all its series.
+type family interface {
+	// write writes the series of the metric, in the text format, after the HELP and TYPE lines
+	write(w *bufio.Writer)
+}
+
+// registered is a metric of the registry, with the header of its family.
+type registered struct {
+	name string
+	help string
+	kind string
+	f    family
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]registered)
+)
+
+// register adds a metric to the registry. It panics when the name is already taken, like expvar.Publish, as metrics
+// are created at initialization.
+func register(name, help, kind string, f family) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("metrics: reuse of metric name " + name)
+	}
+	registry[name] = registered{name: name, help: help, kind: kind, f: f}
+}
+
+// Handler returns an http.Handler that writes every registered metric, sorted by name, in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMu.Lock()
+		metrics := make([]registered, 0, len(registry))
+		for _, m := range registry {
+			metrics = append(metrics, m)
+		}
+		registryMu.Unlock()
+		sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+		w.Header().Set("Content-Type", contentType)
+		bw := bufio.NewWriter(w)
+		for _, m := range metrics {
+			_, _ = fmt.Fprintf(bw, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+			_, _ = fmt.Fprintf(bw, "# TYPE %s %s\n", m.name, m.kind)
+			m.f.write(bw)
+		}
+		_ = bw.Flush()
+	})
+}
+
+// labelSet holds the series of a metric by label values. It is safe for concurrent use.
+type labelSet struct {
+	names []string
+
+	mu     sync.RWMutex
+	series map[string]interface{}
+	values map[string][]string
+}
+
+func newLabelSet(names []string) *labelSet {
+	return &labelSet{
+		names:  names,
+		series: make(map[string]interface{}),
+		values: make(map[string][]string),
+	}
+}
+
+// get returns the series of the label values, created with newSeries when missing. It panics when the number of
+// values does not match the label names, which is a programming error.
+func (s *labelSet) get(values []string, newSeries func() interface{}) interface{} {
+	if len(values) != len(s.names) {
+		panic(fmt.Sprintf("metrics: %d label values given for %d labels", len(values), len(s.names)))
+	}
+	key := strings.Join(values, "\xff")
+
+	s.mu.RLock()
+	series, ok := s.series[key]
+	s.mu.RUnlock()
+	if ok {
+		return series
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if series, ok := s.series[key]; ok {
+		return series
+	}
+	series = newSeries()
+	s.series[key] = series
+	s.values[key] = append([]string(nil), values...)
+	return series
+}
+
+// each calls fn for every series, sorted by label values, with its labels formatted for the text format.
+func (s *labelSet) each(fn func(labels []string, series interface{})) {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.series))
+	for key := range s.series {
+		keys = append(keys, key)
+	}
+	s.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s.mu.RLock()
+		series, values := s.series[key], s.values[key]
+		s.mu.RUnlock()
+
+		labels := make([]string, len(values))
+		for i, v := range values {
+			labels[i] = s.names[i] + `="` + escapeLabel(v) + `"`
+		}
+		fn(labels, series)
+	}
+}
+
+// writeSample writes a line of the text format.
+func writeSample(w *bufio.Writer, name string, labels []string, value float64) {
+	_, _ = w.WriteString(name)
+	if len(labels) > 0 {
+		_, _ = w.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+	_, _ = w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
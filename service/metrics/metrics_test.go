@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrape returns the lines of the metric family `name` served by Handler, from its HELP line on.
+func scrape(t *testing.T, name string) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); got != contentType {
+		t.Errorf("got content type %q, want %q", got, contentType)
+	}
+	var lines []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "# HELP "+name+" ") || strings.HasPrefix(line, "# TYPE "+name+" ") ||
+			strings.HasPrefix(line, name+"{") || strings.HasPrefix(line, name+"_") || strings.HasPrefix(line, name+" ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// unregister removes the metrics of a test from the registry at its end, so that it can run again.
+func unregister(t *testing.T, names ...string) {
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		for _, name := range names {
+			delete(registry, name)
+		}
+	})
+}
+
+func expectLines(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Requests served.", "route", "status")
+	unregister(t, "test_requests_total")
+	c.With("/b", "200").Inc()
+	c.With("/a", "500").Add(2.5)
+	c.With("/b", "200").Inc()
+
+	expectLines(t, scrape(t, "test_requests_total"),
+		"# HELP test_requests_total Requests served.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{route="/a",status="500"} 2.5`,
+		`test_requests_total{route="/b",status="200"} 2`,
+	)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("a counter decreased")
+		}
+	}()
+	c.With("/a", "500").Add(-1)
+}
+
+func TestGaugeWithoutLabels(t *testing.T) {
+	g := NewGaugeVec("test_sessions", "Open sessions.")
+	unregister(t, "test_sessions")
+	g.With().Set(3)
+	g.With().Dec()
+	g.With().Inc()
+	g.With().Dec()
+
+	expectLines(t, scrape(t, "test_sessions"),
+		"# HELP test_sessions Open sessions.",
+		"# TYPE test_sessions gauge",
+		"test_sessions 2",
+	)
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogramVec("test_duration_seconds", "Durations.", []float64{1, 0.5}, "method")
+	unregister(t, "test_duration_seconds")
+	for _, v := range []float64{0.25, 0.5, 0.75, 2} {
+		h.With("get").Observe(v)
+	}
+
+	expectLines(t, scrape(t, "test_duration_seconds"),
+		"# HELP test_duration_seconds Durations.",
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{method="get",le="0.5"} 2`,
+		`test_duration_seconds_bucket{method="get",le="1"} 3`,
+		`test_duration_seconds_bucket{method="get",le="+Inf"} 4`,
+		`test_duration_seconds_sum{method="get"} 3.5`,
+		`test_duration_seconds_count{method="get"} 4`,
+	)
+}
+
+func TestEscaping(t *testing.T) {
+	c := NewCounterVec("test_escaped_total", "Help with a \\ and a\nnew line.", "value")
+	unregister(t, "test_escaped_total")
+	c.With("a \"quoted\" \\ value\non two lines").Inc()
+
+	expectLines(t, scrape(t, "test_escaped_total"),
+		`# HELP test_escaped_total Help with a \\ and a\nnew line.`,
+		"# TYPE test_escaped_total counter",
+		`test_escaped_total{value="a \"quoted\" \\ value\non two lines"} 1`,
+	)
+}
+
+func TestRegistrationErrors(t *testing.T) {
+	NewCounterVec("test_registered_total", "Registered.")
+	unregister(t, "test_registered_total", "test_labels_total", "test_more_labels")
+	for name, register := range map[string]func(){
+		"reused name":     func() { NewGaugeVec("test_registered_total", "Again.") },
+		"missing label":   func() { NewCounterVec("test_labels_total", "Labels.", "a", "b").With("a") },
+		"too many labels": func() { NewGaugeVec("test_more_labels", "Labels.").With("a") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: no panic", name)
+				}
+			}()
+			register()
+		}()
+	}
+}
@@ -0,0 +1,114 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestDecodeCBOR decodes the examples of RFC 8949, Appendix A, that use definite lengths.
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"3903e7", int64(-1000)},
+		{"f93c00", 1.0},
+		{"f93e00", 1.5},
+		{"f9c400", -4.0},
+		{"f90001", 5.960464477539063e-8},
+		{"f97c00", math.Inf(1)},
+		{"fa47c35000", 100000.0},
+		{"fb3ff199999999999a", 1.1},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"f7", nil},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"62c3bc", "ü"},
+		{"80", []interface{}{}},
+		{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"a0", map[interface{}]interface{}{}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+	}
+	for _, tt := range tests {
+		got, rest, err := decodeCBOR(mustHex(t, tt.hex))
+		if err != nil {
+			t.Errorf("decoding %s: %v", tt.hex, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decoding %s: got %#v, want %#v", tt.hex, got, tt.want)
+		}
+		if len(rest) != 0 {
+			t.Errorf("decoding %s: %d bytes left", tt.hex, len(rest))
+		}
+	}
+}
+
+func TestDecodeCBORTrailingBytes(t *testing.T) {
+	got, rest, err := decodeCBOR(mustHex(t, "0102"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != int64(1) || !bytes.Equal(rest, []byte{2}) {
+		t.Errorf("got %v with %x left, want 1 with 02 left", got, rest)
+	}
+}
+
+func TestDecodeCBORInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+	}{
+		{"empty", ""},
+		{"truncated argument", "1903"},
+		{"truncated byte string", "440102"},
+		{"truncated array", "8201"},
+		{"truncated map", "a101"},
+		{"byte string longer than the data", "5bffffffffffffffff"},
+		{"array longer than the data", "9bffffffffffffffff"},
+		{"map longer than the data", "bbffffffffffffffff"},
+		{"integer overflow", "1bffffffffffffffff"},
+		{"indefinite length", "9f01ff"},
+		{"reserved additional information", "1c"},
+		{"byte string map key", "a14001"},
+		{"unsupported simple value", "f820"},
+		{"nesting too deep", strings.Repeat("81", maxCBORDepth+1) + "00"},
+		{"nesting far too deep", strings.Repeat("81", 100000) + "00"},
+	}
+	for _, tt := range tests {
+		if v, _, err := decodeCBOR(mustHex(t, tt.hex)); err == nil {
+			t.Errorf("%s: decoded %#v, want an error", tt.name, v)
+		}
+	}
+
+	if _, _, err := decodeCBOR(mustHex(t, strings.Repeat("81", maxCBORDepth)+"00")); err != nil {
+		t.Errorf("nesting at the limit: %v", err)
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", s, err)
+	}
+	return b
+}
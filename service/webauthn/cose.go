@@ -0,0 +1,119 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers of the public keys accepted, in the order of preference offered to authenticators.
+const (
+	AlgES256 = -7   // ECDSA with P-256 and SHA-256
+	AlgEdDSA = -8   // Ed25519
+	AlgRS256 = -257 // RSASSA-PKCS1-v1_5 with SHA-256
+)
+
+// minRSAKeyBits is the size of the smallest RSA key accepted
+const minRSAKeyBits = 2048
+
+// COSE key parameters (RFC 9052 and RFC 9053)
+const (
+	coseKty = 1
+	coseAlg = 3
+
+	coseCrv = -1 // curve, or RSA modulus
+	coseX   = -2 // x coordinate, or RSA exponent
+	coseY   = -3
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// publicKey is a credential public key that verifies signatures over data.
+type publicKey interface {
+	verify(data, sig []byte) bool
+}
+
+type ecdsaKey struct{ *ecdsa.PublicKey }
+
+func (k ecdsaKey) verify(data, sig []byte) bool {
+	digest := sha256.Sum256(data)
+	return ecdsa.VerifyASN1(k.PublicKey, digest[:], sig)
+}
+
+type ed25519Key struct{ ed25519.PublicKey }
+
+func (k ed25519Key) verify(data, sig []byte) bool {
+	return ed25519.Verify(k.PublicKey, data, sig)
+}
+
+type rsaKey struct{ *rsa.PublicKey }
+
+func (k rsaKey) verify(data, sig []byte) bool {
+	digest := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(k.PublicKey, crypto.SHA256, digest[:], sig) == nil
+}
+
+// parsePublicKey parses a COSE key of one of the supported algorithms.
+func parsePublicKey(cose []byte) (publicKey, error) {
+	v, rest, err := decodeCBOR(cose)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data after the public key")
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("public key is not a map")
+	}
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 public key")
+		}
+		curve := elliptic.P256()
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("public key is not on the P-256 curve")
+		}
+		return ecdsaKey{pub}, nil
+
+	case kty == coseKtyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		return ed25519Key{ed25519.PublicKey(x)}, nil
+
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseCrv)].([]byte)
+		e, _ := m[int64(coseX)].([]byte)
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA public key")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < minRSAKeyBits || pub.E < 3 {
+			return nil, errors.New("RSA public key too weak")
+		}
+		return rsaKey{pub}, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %d with algorithm %d", kty, alg)
+}
@@ -0,0 +1,112 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+)
+
+// TestParsePublicKeyVectors verifies the signatures of RFC 8032 (Ed25519, test 1) and RFC 6979 (P-256 with SHA-256,
+// message "sample") with the public keys encoded in COSE.
+func TestParsePublicKeyVectors(t *testing.T) {
+	ed25519Key := coseMap{
+		{coseKty, coseKtyOKP}, {coseAlg, AlgEdDSA}, {coseCrv, coseCrvEd25519},
+		{coseX, mustHex(t, "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a")},
+	}
+	ed25519Sig := mustHex(t, "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e06522490155"+
+		"5fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b")
+
+	p256Key := coseMap{
+		{coseKty, coseKtyEC2}, {coseAlg, AlgES256}, {coseCrv, coseCrvP256},
+		{coseX, mustHex(t, "60fed4ba255a9d31c961eb74c6356d68c049b8923b61fa6ce669622e60f29fb6")},
+		{coseY, mustHex(t, "7903fe1008b8bc99a41ae9e95628bc64f2f1b20c2d7e9f5177a3c294d4462299")},
+	}
+	p256Sig, err := asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(mustHex(t, "efd48b2aacb6a8fd1140dd9cd45e81d69d2c877b56aaf991c34d0ea84eaf3716")),
+		new(big.Int).SetBytes(mustHex(t, "f7cb1c942d657c41d436c7a1b6e29f65f3e900dbb9aff4064dc4ab2f843acda8")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      coseMap
+		message  []byte
+		sig      []byte
+		tampered []byte
+	}{
+		{"EdDSA", ed25519Key, []byte{}, ed25519Sig, []byte{0}},
+		{"ES256", p256Key, []byte("sample"), p256Sig, []byte("test")},
+	}
+	for _, tt := range tests {
+		key, err := parsePublicKey(encodeCBOR(tt.key))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !key.verify(tt.message, tt.sig) {
+			t.Errorf("%s: the signature of the test vector does not verify", tt.name)
+		}
+		if key.verify(tt.tampered, tt.sig) {
+			t.Errorf("%s: the signature verifies another message", tt.name)
+		}
+	}
+}
+
+func TestParsePublicKeyRS256(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := rs256Signer(priv)
+	key, err := parsePublicKey(rs256Key(&priv.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.verify([]byte("sample"), sign([]byte("sample"))) {
+		t.Error("the signature does not verify")
+	}
+	if key.verify([]byte("test"), sign([]byte("sample"))) {
+		t.Error("the signature verifies another message")
+	}
+}
+
+func TestParsePublicKeyInvalid(t *testing.T) {
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := es256Key(&p256.PublicKey)
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	x[31], y[31] = 1, 1
+
+	tests := []struct {
+		name string
+		cose []byte
+	}{
+		{"point off the curve", encodeCBOR(coseMap{{coseKty, coseKtyEC2}, {coseAlg, AlgES256}, {coseCrv, coseCrvP256}, {coseX, x}, {coseY, y}})},
+		{"other curve", encodeCBOR(coseMap{{coseKty, coseKtyEC2}, {coseAlg, AlgES256}, {coseCrv, 2}, {coseX, x}, {coseY, y}})},
+		{"short coordinates", encodeCBOR(coseMap{{coseKty, coseKtyEC2}, {coseAlg, AlgES256}, {coseCrv, coseCrvP256}, {coseX, x[:31]}, {coseY, y}})},
+		{"short Ed25519 key", encodeCBOR(coseMap{{coseKty, coseKtyOKP}, {coseAlg, AlgEdDSA}, {coseCrv, coseCrvEd25519}, {coseX, x[:31]}})},
+		{"weak RSA key", rs256Key(&weak.PublicKey)},
+		{"unsupported algorithm", encodeCBOR(coseMap{{coseKty, coseKtyEC2}, {coseAlg, -35}, {coseCrv, coseCrvP256}, {coseX, x}, {coseY, y}})},
+		{"not a map", encodeCBOR([]interface{}{1, 2})},
+		{"trailing bytes", append(append([]byte(nil), valid...), 0)},
+		{"truncated", valid[:len(valid)-1]},
+	}
+	for _, tt := range tests {
+		if _, err := parsePublicKey(tt.cose); err == nil {
+			t.Errorf("%s: parsed, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Package webauthn verifies the passkeys (WebAuthn public key credentials) that users register and log in with.
+
+The browser creates a credential with navigator.credentials.create() from CreationOptions, and the server keeps its ID
+and public key, as returned by RelyingParty.VerifyRegistration. To log in, the browser signs a new challenge with
+navigator.credentials.get() from RequestOptions, and RelyingParty.VerifyAssertion checks the signature with the public
+key of the credential. Challenges are random, used once, and must be kept by the caller between the two steps.
+
+Attestation is not requested: authenticators are trusted on first use, which suits passkeys synced between devices.
+ES256, EdDSA and RS256 keys are supported.
+*/
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidCredential is returned, wrapped with the reason, when a registration or an assertion does not verify.
+var ErrInvalidCredential = errors.New("invalid passkey")
+
+// Flags of the authenticator data
+const (
+	flagUserPresent      = 0x01
+	flagAttestedCredData = 0x40
+	flagExtensionData    = 0x80
+)
+
+// RelyingParty is the site passkeys are bound to.
+type RelyingParty struct {
+	// ID is the domain of the site, e.g. "example.com", which credentials are scoped to
+	ID string
+
+	// Name is shown by the browser when creating a passkey
+	Name string
+
+	// Origins are the origins the web UI is served from, e.g. "https://chat.example.com"
+	Origins []string
+}
+
+// Credential is a passkey as registered: what the server keeps to verify its assertions.
+type Credential struct {
+	// ID is the credential ID chosen by the authenticator
+	ID []byte
+
+	// PublicKey is the COSE encoding of the public key
+	PublicKey []byte
+
+	// SignCount is the signature counter, zero for authenticators that do not keep one
+	SignCount uint32
+}
+
+// NewChallenge returns a random challenge, encoded in base64url like every binary value of the options.
+func NewChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// clientData is the part of the client data JSON the server checks.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData is the parsed authenticator data of a registration or an assertion.
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// credentialID and publicKey are only set by registrations
+	credentialID []byte
+	publicKey    []byte
+}
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidCredential, fmt.Sprintf(format, args...))
+}
+
+// ChallengeOf returns the challenge that client data was created for, to find what the ceremony is about before
+// verifying it.
+func ChallengeOf(clientDataJSON []byte) (string, error) {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil || cd.Challenge == "" {
+		return "", invalid("malformed client data")
+	}
+	return cd.Challenge, nil
+}
+
+// checkClientData verifies that the client data was created for the ceremony, the challenge and an origin of the
+// relying party.
+func (rp RelyingParty) checkClientData(clientDataJSON []byte, ceremony, challenge string) error {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return invalid("malformed client data")
+	}
+	if cd.Type != ceremony {
+		return invalid("client data is for %q", cd.Type)
+	}
+	if cd.Challenge != challenge {
+		return invalid("challenge does not match")
+	}
+	for _, origin := range rp.Origins {
+		if cd.Origin == origin {
+			return nil
+		}
+	}
+	return invalid("origin %q is not allowed", cd.Origin)
+}
+
+// parseAuthenticatorData parses authenticator data, and checks that it was created for the relying party with the
+// user present. Extensions are skipped, and nothing may follow them.
+func (rp RelyingParty) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, invalid("authenticator data too short")
+	}
+	ad := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return nil, invalid("credential is for another relying party")
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, invalid("user was not present")
+	}
+
+	rest := data[37:]
+	if ad.flags&flagAttestedCredData != 0 {
+		// AAGUID, then the length of the credential ID
+		if len(rest) < 18 {
+			return nil, invalid("attested credential data too short")
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+			return nil, invalid("invalid credential ID")
+		}
+		ad.credentialID = rest[:idLen]
+		rest = rest[idLen:]
+
+		// the public key is the CBOR item that follows
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, invalid("malformed public key: %v", err)
+		}
+		ad.publicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+	if ad.flags&flagExtensionData != 0 {
+		ext, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, invalid("malformed extensions: %v", err)
+		}
+		if _, ok := ext.(map[interface{}]interface{}); !ok {
+			return nil, invalid("malformed extensions")
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, invalid("trailing data after the authenticator data")
+	}
+	return ad, nil
+}
+
+// VerifyRegistration verifies a new credential, from the clientDataJSON and attestationObject of the response of
+// navigator.credentials.create(), created for the challenge.
+func (rp RelyingParty) VerifyRegistration(clientDataJSON, attestationObject []byte, challenge string) (*Credential, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	v, rest, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, invalid("malformed attestation object: %v", err)
+	}
+	if len(rest) != 0 {
+		return nil, invalid("trailing data after the attestation object")
+	}
+	attestation, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, invalid("malformed attestation object")
+	}
+	// the attestation statement is not verified, as it is not requested
+	authData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, invalid("attestation object without authenticator data")
+	}
+
+	ad, err := rp.parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, invalid("registration without a credential")
+	}
+	if _, err := parsePublicKey(ad.publicKey); err != nil {
+		return nil, invalid("%v", err)
+	}
+	return &Credential{
+		ID:        append([]byte(nil), ad.credentialID...),
+		PublicKey: append([]byte(nil), ad.publicKey...),
+		SignCount: ad.signCount,
+	}, nil
+}
+
+// VerifyAssertion verifies that a credential signed the challenge, from the clientDataJSON, authenticatorData and
+// signature of the response of navigator.credentials.get(), with cred as stored. The new signature counter is returned,
+// to be stored. A counter that does not increase means that the credential may have been cloned, and fails the
+// assertion.
+func (rp RelyingParty) VerifyAssertion(clientDataJSON, authData, signature []byte, challenge string, cred Credential) (uint32, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+	ad, err := rp.parseAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, invalid("%v", err)
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	if !key.verify(signed, signature) {
+		return 0, invalid("signature does not verify")
+	}
+
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return 0, invalid("signature counter did not increase, the passkey may have been cloned")
+	}
+	return ad.signCount, nil
+}
@@ -0,0 +1,277 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+var testRP = RelyingParty{ID: "chat.example.com", Name: "Chat", Origins: []string{"https://chat.example.com"}}
+
+// coseMap is a CBOR map with its keys in order, as encoded by encodeCBOR.
+type coseMap []struct {
+	key, value interface{}
+}
+
+// encodeCBOR encodes the integers, byte and text strings, arrays and coseMaps of the tests.
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		default:
+			b := []byte{major<<5 | 26, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(b[1:], uint32(n))
+			return b
+		}
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []interface{}:
+		b := head(4, uint64(len(v)))
+		for _, item := range v {
+			b = append(b, encodeCBOR(item)...)
+		}
+		return b
+	case coseMap:
+		b := head(5, uint64(len(v)))
+		for _, kv := range v {
+			b = append(b, encodeCBOR(kv.key)...)
+			b = append(b, encodeCBOR(kv.value)...)
+		}
+		return b
+	}
+	panic("unsupported CBOR value")
+}
+
+func es256Key(pub *ecdsa.PublicKey) []byte {
+	return encodeCBOR(coseMap{
+		{coseKty, coseKtyEC2}, {coseAlg, AlgES256}, {coseCrv, coseCrvP256},
+		{coseX, pub.X.FillBytes(make([]byte, 32))}, {coseY, pub.Y.FillBytes(make([]byte, 32))},
+	})
+}
+
+func rs256Key(pub *rsa.PublicKey) []byte {
+	return encodeCBOR(coseMap{
+		{coseKty, coseKtyRSA}, {coseAlg, AlgRS256},
+		{coseCrv, pub.N.Bytes()}, {coseX, big.NewInt(int64(pub.E)).Bytes()},
+	})
+}
+
+func rs256Signer(priv *rsa.PrivateKey) func([]byte) []byte {
+	return func(data []byte) []byte {
+		digest := sha256.Sum256(data)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+		if err != nil {
+			panic(err)
+		}
+		return sig
+	}
+}
+
+// authenticator creates and uses a credential like a browser and its authenticator would.
+type authenticator struct {
+	credentialID []byte
+	publicKey    []byte
+	sign         func(data []byte) []byte
+	signCount    uint32
+}
+
+func newAuthenticator(t *testing.T, alg int) *authenticator {
+	t.Helper()
+	a := &authenticator{credentialID: []byte("credential-" + big.NewInt(int64(-alg)).String()), signCount: 1}
+	switch alg {
+	case AlgES256:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.publicKey = es256Key(&priv.PublicKey)
+		a.sign = func(data []byte) []byte {
+			digest := sha256.Sum256(data)
+			sig, err := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+			if err != nil {
+				panic(err)
+			}
+			return sig
+		}
+	case AlgEdDSA:
+		priv := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+		a.publicKey = encodeCBOR(coseMap{
+			{coseKty, coseKtyOKP}, {coseAlg, AlgEdDSA}, {coseCrv, coseCrvEd25519},
+			{coseX, []byte(priv.Public().(ed25519.PublicKey))},
+		})
+		a.sign = func(data []byte) []byte { return ed25519.Sign(priv, data) }
+	case AlgRS256:
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.publicKey = rs256Key(&priv.PublicKey)
+		a.sign = rs256Signer(priv)
+	}
+	return a
+}
+
+func clientDataJSON(ceremony, challenge, origin string) []byte {
+	b, _ := json.Marshal(map[string]interface{}{"type": ceremony, "challenge": challenge, "origin": origin, "crossOrigin": false})
+	return b
+}
+
+// authData returns the authenticator data for the relying party, with the credential when attested.
+func (a *authenticator) authData(rpID string, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	if flags&flagAttestedCredData != 0 {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = append(data, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.publicKey...)
+	}
+	return data
+}
+
+func attestationObject(authData []byte) []byte {
+	return encodeCBOR(coseMap{{"fmt", "none"}, {"attStmt", coseMap{}}, {"authData", authData}})
+}
+
+// assert signs the challenge, and returns the client data, the authenticator data and the signature.
+func (a *authenticator) assert(challenge, origin string, flags byte) ([]byte, []byte, []byte) {
+	cd := clientDataJSON("webauthn.get", challenge, origin)
+	ad := a.authData(testRP.ID, flags)
+	cdHash := sha256.Sum256(cd)
+	return cd, ad, a.sign(append(append([]byte(nil), ad...), cdHash[:]...))
+}
+
+func TestVerifyRegistrationAndAssertion(t *testing.T) {
+	for _, alg := range []struct {
+		name string
+		id   int
+	}{{"ES256", AlgES256}, {"EdDSA", AlgEdDSA}, {"RS256", AlgRS256}} {
+		t.Run(alg.name, func(t *testing.T) {
+			a := newAuthenticator(t, alg.id)
+			challenge, err := NewChallenge()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cd := clientDataJSON("webauthn.create", challenge, testRP.Origins[0])
+			att := attestationObject(a.authData(testRP.ID, flagUserPresent|flagAttestedCredData))
+			cred, err := testRP.VerifyRegistration(cd, att, challenge)
+			if err != nil {
+				t.Fatalf("registration: %v", err)
+			}
+			if string(cred.ID) != string(a.credentialID) || cred.SignCount != 1 {
+				t.Errorf("registered credential %q with counter %d, want %q with 1", cred.ID, cred.SignCount, a.credentialID)
+			}
+
+			a.signCount = 2
+			cd, ad, sig := a.assert(challenge, testRP.Origins[0], flagUserPresent)
+			count, err := testRP.VerifyAssertion(cd, ad, sig, challenge, *cred)
+			if err != nil {
+				t.Fatalf("assertion: %v", err)
+			}
+			if count != 2 {
+				t.Errorf("signature counter is %d, want 2", count)
+			}
+		})
+	}
+}
+
+func TestVerifyRegistrationInvalid(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	const challenge = "challenge"
+	origin := testRP.Origins[0]
+	attested := byte(flagUserPresent | flagAttestedCredData)
+	valid := attestationObject(a.authData(testRP.ID, attested))
+
+	tests := []struct {
+		name        string
+		clientData  []byte
+		attestation []byte
+	}{
+		{"wrong origin", clientDataJSON("webauthn.create", challenge, "https://evil.example.com"), valid},
+		{"wrong challenge", clientDataJSON("webauthn.create", "other", origin), valid},
+		{"wrong ceremony", clientDataJSON("webauthn.get", challenge, origin), valid},
+		{"other relying party", clientDataJSON("webauthn.create", challenge, origin), attestationObject(a.authData("evil.example.com", attested))},
+		{"user not present", clientDataJSON("webauthn.create", challenge, origin), attestationObject(a.authData(testRP.ID, flagAttestedCredData))},
+		{"no credential", clientDataJSON("webauthn.create", challenge, origin), attestationObject(a.authData(testRP.ID, flagUserPresent))},
+		{"truncated attestation", clientDataJSON("webauthn.create", challenge, origin), valid[:len(valid)-10]},
+		{"trailing bytes after the attestation", clientDataJSON("webauthn.create", challenge, origin), append(append([]byte(nil), valid...), 0)},
+		{"trailing bytes after the authenticator data", clientDataJSON("webauthn.create", challenge, origin), attestationObject(append(a.authData(testRP.ID, attested), 0))},
+	}
+	for _, tt := range tests {
+		if _, err := testRP.VerifyRegistration(tt.clientData, tt.attestation, challenge); !errors.Is(err, ErrInvalidCredential) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, ErrInvalidCredential)
+		}
+	}
+}
+
+func TestVerifyAssertionInvalid(t *testing.T) {
+	a := newAuthenticator(t, AlgEdDSA)
+	cred := Credential{ID: a.credentialID, PublicKey: a.publicKey, SignCount: 5}
+	const challenge = "challenge"
+	origin := testRP.Origins[0]
+
+	assert := func(signCount uint32, challenge, origin string, flags byte) func() ([]byte, []byte, []byte) {
+		return func() ([]byte, []byte, []byte) {
+			a.signCount = signCount
+			return a.assert(challenge, origin, flags)
+		}
+	}
+	tests := []struct {
+		name   string
+		assert func() ([]byte, []byte, []byte)
+	}{
+		{"wrong origin", assert(6, challenge, "https://evil.example.com", flagUserPresent)},
+		{"wrong challenge", assert(6, "other", origin, flagUserPresent)},
+		{"user not present", assert(6, challenge, origin, 0)},
+		{"counter replayed", assert(5, challenge, origin, flagUserPresent)},
+		{"counter going back", assert(4, challenge, origin, flagUserPresent)},
+		{"signature of other data", func() ([]byte, []byte, []byte) {
+			cd, ad, sig := assert(6, challenge, origin, flagUserPresent)()
+			ad[36]++
+			return cd, ad, sig
+		}},
+		{"trailing bytes", func() ([]byte, []byte, []byte) {
+			a.signCount = 6
+			cd := clientDataJSON("webauthn.get", challenge, origin)
+			ad := append(a.authData(testRP.ID, flagUserPresent), 0)
+			cdHash := sha256.Sum256(cd)
+			return cd, ad, a.sign(append(append([]byte(nil), ad...), cdHash[:]...))
+		}},
+	}
+	for _, tt := range tests {
+		cd, ad, sig := tt.assert()
+		if _, err := testRP.VerifyAssertion(cd, ad, sig, challenge, cred); !errors.Is(err, ErrInvalidCredential) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, ErrInvalidCredential)
+		}
+	}
+
+	cd, ad, sig := assert(6, challenge, origin, flagUserPresent)()
+	if _, err := testRP.VerifyAssertion(cd, ad, sig, challenge, cred); err != nil {
+		t.Errorf("valid assertion: %v", err)
+	}
+}
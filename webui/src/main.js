@@ -1,7 +1,7 @@
 import {createApp, reactive} from 'vue'
 import App from './App.vue'
 import router from './router'
-import axios from './services/axios.js';
+import axios, { mediaUrl } from './services/axios.js';
 import ErrorMsg from './components/ErrorMsg.vue'
 import LoadingSpinner from './components/LoadingSpinner.vue'
 
@@ -11,6 +11,7 @@ import '@/assets/theme.css'
 
 const app = createApp(App)
 app.config.globalProperties.$axios = axios;
+app.config.globalProperties.$mediaUrl = mediaUrl;
 app.component("ErrorMsg", ErrorMsg);
 app.component("LoadingSpinner", LoadingSpinner);
 app.use(router)
@@ -11,4 +11,55 @@ try {
   if (t) instance.defaults.headers.common["Authorization"] = `Bearer ${t}`;
 } catch {}
 
+// Access tokens are short-lived: when one is refused, the refresh token is
+// exchanged once for new tokens and the request is retried. Concurrent requests
+// share the same refresh, as each refresh token can only be used once.
+let refreshing = null;
+
+function refreshTokens() {
+  if (!refreshing) {
+    let refreshToken = null;
+    try { refreshToken = localStorage.getItem("refreshToken"); } catch {}
+    if (!refreshToken) return Promise.reject(new Error("no refresh token"));
+    refreshing = axios.post(`${__API_URL__}/token/refresh`, { refreshToken }, { timeout: instance.defaults.timeout })
+      .then(({ data }) => {
+        localStorage.setItem("token", data.token);
+        localStorage.setItem("refreshToken", data.refreshToken);
+        instance.defaults.headers.common["Authorization"] = `Bearer ${data.token}`;
+        return data.token;
+      })
+      .finally(() => { refreshing = null; });
+  }
+  return refreshing;
+}
+
+instance.interceptors.response.use(undefined, async (error) => {
+  const config = error.config;
+  const url = (config && config.url) || '';
+  if (!error.response || error.response.status !== 401 || !config || config._retried
+      || url.endsWith('/login') || url.endsWith('/token/refresh')) {
+    throw error;
+  }
+  let token;
+  try {
+    token = await refreshTokens();
+  } catch {
+    throw error;
+  }
+  config._retried = true;
+  config.headers = { ...config.headers, Authorization: `Bearer ${token}` };
+  return instance(config);
+});
+
 export default instance;
+
+// URL of a photo or attachment stored in the blob store, from its blob ID or from
+// a path such as the thumbnailUrl of images. Images cannot send the
+// Authorization header, so the token goes in the query string.
+export function mediaUrl(blobIdOrPath) {
+  if (!blobIdOrPath) return '';
+  let t = '';
+  try { t = localStorage.getItem("token") || ''; } catch {}
+  const path = blobIdOrPath.startsWith('/') ? blobIdOrPath : `/media/${blobIdOrPath}`;
+  return `${__API_URL__}${path}?token=${encodeURIComponent(t)}`;
+}
@@ -0,0 +1,71 @@
+// The API encodes the binary values of WebAuthn options and credentials in
+// base64url, while the browser API works with ArrayBuffers: these helpers
+// convert between the two.
+
+export function passkeysSupported() {
+  return typeof window !== 'undefined' && !!window.PublicKeyCredential && !!navigator.credentials;
+}
+
+function decode(value) {
+  const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+  const padded = base64 + '='.repeat((4 - base64.length % 4) % 4);
+  const binary = atob(padded);
+  const bytes = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i++) bytes[i] = binary.charCodeAt(i);
+  return bytes.buffer;
+}
+
+function encode(buffer) {
+  if (!buffer) return '';
+  const bytes = new Uint8Array(buffer);
+  let binary = '';
+  for (let i = 0; i < bytes.length; i++) binary += String.fromCharCode(bytes[i]);
+  return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function descriptors(list) {
+  return (list || []).map(c => ({ type: c.type, id: decode(c.id) }));
+}
+
+// createPasskey runs navigator.credentials.create() with the options of
+// POST /user/passkeys/options, and returns the credential to send to POST /user/passkeys.
+export async function createPasskey(options) {
+  const credential = await navigator.credentials.create({
+    publicKey: {
+      ...options,
+      challenge: decode(options.challenge),
+      user: { ...options.user, id: decode(options.user.id) },
+      excludeCredentials: descriptors(options.excludeCredentials),
+    },
+  });
+  return {
+    id: credential.id,
+    type: credential.type,
+    response: {
+      clientDataJSON: encode(credential.response.clientDataJSON),
+      attestationObject: encode(credential.response.attestationObject),
+    },
+  };
+}
+
+// getPasskey runs navigator.credentials.get() with the options of
+// POST /login/passkey/options, and returns the credential to send to POST /login/passkey.
+export async function getPasskey(options) {
+  const credential = await navigator.credentials.get({
+    publicKey: {
+      ...options,
+      challenge: decode(options.challenge),
+      allowCredentials: descriptors(options.allowCredentials),
+    },
+  });
+  return {
+    id: credential.id,
+    type: credential.type,
+    response: {
+      clientDataJSON: encode(credential.response.clientDataJSON),
+      authenticatorData: encode(credential.response.authenticatorData),
+      signature: encode(credential.response.signature),
+      userHandle: encode(credential.response.userHandle),
+    },
+  };
+}